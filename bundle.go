@@ -36,6 +36,7 @@ func Bundle(path string) ([]byte, error) {
 	}
 
 	b := bundlepkg.Bundle{
+		File:     path,
 		Bytecode: bc.Encode(),
 		Modules:  map[string]bundlepkg.ModuleCode{},
 		Plugins:  map[string][]byte{},
@@ -226,15 +227,19 @@ func compileModule(st *bundleState, files []string) (bundlepkg.ModuleCode, error
 
 	bc := c.Bytecode()
 	exports := map[string]int{}
+	consts := map[string]bool{}
 	for name, sym := range c.Store {
 		if sym.Scope == compiler.GlobalScope && vm.IsExported(name) {
 			exports[name] = sym.Index
+			if sym.Const {
+				consts[name] = true
+			}
 		}
 	}
 
 	st.ndefs = int(bc.NDefs())
 	st.nconsts += int(bc.NConsts())
-	return bundlepkg.ModuleCode{Bytecode: bc.Encode(), Exports: exports}, nil
+	return bundlepkg.ModuleCode{Bytecode: bc.Encode(), Exports: exports, Consts: consts}, nil
 }
 
 // addPlugin stores the shared object a module opens, looked up the same way
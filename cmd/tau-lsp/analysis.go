@@ -174,13 +174,38 @@ func params(toks []item.Item) string {
 	if len(toks) < 2 || !toks[1].Is(item.LParen) {
 		return "fn()"
 	}
-	var names []string
+
+	var (
+		names []string
+		cur   strings.Builder
+		depth int
+	)
 	for _, t := range toks[2:] {
-		if t.Is(item.RParen) {
-			break
-		}
-		if t.Is(item.Ident) {
-			names = append(names, t.Val)
+		switch {
+		case depth == 0 && (t.Is(item.RParen) || t.Is(item.Comma)):
+			if cur.Len() > 0 {
+				names = append(names, cur.String())
+				cur.Reset()
+			}
+			if t.Is(item.RParen) {
+				return "fn(" + strings.Join(names, ", ") + ")"
+			}
+		case t.Is(item.Assign) && depth == 0:
+			cur.WriteString(" = ")
+		default:
+			// The default of a parameter can hold brackets of its own.
+			if t.Is(item.LParen) || t.Is(item.LBracket) || t.Is(item.LBrace) {
+				depth++
+			} else if t.Is(item.RParen) || t.Is(item.RBracket) || t.Is(item.RBrace) {
+				depth--
+			}
+			if t.Is(item.String) {
+				cur.WriteString(strconv.Quote(t.Val))
+			} else if t.Is(item.Comma) {
+				cur.WriteString(", ")
+			} else {
+				cur.WriteString(t.Val)
+			}
 		}
 	}
 	return "fn(" + strings.Join(names, ", ") + ")"
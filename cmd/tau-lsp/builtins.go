@@ -16,7 +16,7 @@ var builtinDocs = map[string]builtinDoc{
 	"print":   {"print(...)", "Writes its arguments separated by spaces, without a newline."},
 	"input":   {"input(prompt...)", "Reads one line from standard input and returns it without the newline."},
 	"string":  {"string(x)", "The string representation of any value."},
-	"error":   {"error(msg)", "Builds an error value carrying msg."},
+	"error":   {"error(msg, cause)", "Builds an error value carrying msg, wrapping the error cause if given."},
 	"type":    {"type(x)", "The name of the type of x, as a string."},
 	"int":     {"int(x)", "Converts a number or string to an integer."},
 	"float":   {"float(x)", "Converts a number or string to a float."},
@@ -24,6 +24,8 @@ var builtinDocs = map[string]builtinDoc{
 	"append":  {"append(list, ...)", "Returns the list with the given elements added at the end."},
 	"new":     {"new()", "A new empty object, the value a module builds itself from."},
 	"failed":  {"failed(x)", "Reports whether x is an error value."},
+	"try":     {"try(fn, args...)", "Calls fn with args; a runtime error that stops it comes back as an error value."},
+	"sprintf": {"sprintf(format, args...)", "The format string with each %-verb replaced by its argument, the way printf does."},
 	"dlopen":  {"dlopen(path)", "Opens a shared object and returns a handle whose fields are its symbols."},
 	"cfunc":   {"cfunc(sym, ret, args)", "A C function with its types as codes. See the ffi module, which writes them for you."},
 	"pipe":    {"pipe(capacity...)", "A channel that goroutines send to and receive from."},
@@ -51,8 +53,8 @@ var builtins = func() []string {
 
 // keywords are the words the lexer reserves.
 var keywords = []string{
-	"fn", "if", "else", "for", "return", "break", "continue",
-	"true", "false", "null", "import", "tau",
+	"fn", "if", "else", "for", "return", "break", "continue", "defer", "nonlocal", "const",
+	"true", "false", "null", "import", "tau", "select", "switch", "case", "default",
 }
 
 var keywordSet = func() map[string]bool {
@@ -294,10 +294,10 @@ func TestDiagnosticsFollowChanges(t *testing.T) {
 func TestCompletionOffersBuiltinsKeywordsAndLocalNames(t *testing.T) {
 	c := newClient(t)
 	initialize(c)
-	c.open(testURI, "answer = 42\ndouble = fn(x) { x * 2 }\n\n")
+	c.open(testURI, "answer = 42\ndouble = fn(x) { x * 2 }\nscale = fn(x, by = max(1, 2), ...rest) { x * by }\n\n")
 	id := c.request("textDocument/completion", map[string]any{
 		"textDocument": doc(testURI),
-		"position":     at(2, 0),
+		"position":     at(3, 0),
 	})
 	msgs := c.run()
 
@@ -318,6 +318,9 @@ func TestCompletionOffersBuiltinsKeywordsAndLocalNames(t *testing.T) {
 	if got := labels["double"]["detail"]; got != "fn(x)" {
 		t.Errorf("detail of double = %v, want fn(x)", got)
 	}
+	if got := labels["scale"]["detail"]; got != "fn(x, by = max(1, 2), ...rest)" {
+		t.Errorf("detail of scale = %v, want fn(x, by = max(1, 2), ...rest)", got)
+	}
 	if labels["println"]["documentation"] == "" {
 		t.Error("builtin completion carries no documentation")
 	}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 
@@ -17,10 +18,72 @@ func run() error {
 		return errUsage
 	}
 
+	if opt.cpuprofile != "" {
+		stop, err := startProfile("cpuprofile", opt.cpuprofile, tau.StartCPUProfile, tau.StopCPUProfile)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	if opt.memprofile != "" {
+		start := func(w io.Writer) error { return tau.StartHeapProfile(w, opt.memprofilerate) }
+		stop, err := startProfile("memprofile", opt.memprofile, start, tau.StopHeapProfile)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+	if opt.trace != "" {
+		stop, err := startProfile("trace", opt.trace, tau.StartTrace, tau.StopTrace)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	if opt.noOptimize {
+		tau.DisableOptimizer()
+	}
 	tau.SetArgs(append([]string{opt.path}, opt.args...))
 	return tau.ExecFileVM(opt.path)
 }
 
+// startProfile profiles or traces the program into the named file. What goes wrong
+// writing it is said and nothing else: the program has run by then, and its
+// own outcome is the one that counts.
+func startProfile(name, path string, start func(io.Writer) error, stop func() error) (func(), error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := start(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		if err := stop(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		}
+		f.Close()
+	}, nil
+}
+
+// debug runs a tau file under the debugger.
+func debug() error {
+	opt := parseDebugOpts()
+	if opt.dap {
+		return tau.DebugDAP()
+	}
+	if opt.path == "" {
+		usageDebug()
+		return errUsage
+	}
+
+	tau.SetArgs(append([]string{opt.path}, opt.args...))
+	return tau.Debug(opt.path)
+}
+
 // build compiles tau files down to .tauc bytecode.
 func build() error {
 	opt := parseBuildOpts()
@@ -28,6 +91,9 @@ func build() error {
 		usageBuild()
 		return errUsage
 	}
+	if opt.noOptimize {
+		tau.DisableOptimizer()
+	}
 	return tau.CompileFiles(opt.files, opt.output)
 }
 
@@ -39,12 +105,31 @@ func bundle() error {
 		usageBundle()
 		return errUsage
 	}
+	if opt.noOptimize {
+		tau.DisableOptimizer()
+	}
 	return tau.BuildExecutable(opt.file, opt.output)
 }
 
 // test runs the *_test.tau files, like `go test` does.
 func test() error {
-	return tau.TestFiles(parseTestOpts().paths)
+	opt := parseTestOpts()
+	return tau.TestFiles(opt.paths, tau.TestFlags{
+		CPUProfile:     opt.cpuprofile,
+		MemProfile:     opt.memprofile,
+		MemProfileRate: opt.memprofilerate,
+		NoOptimize:     opt.noOptimize,
+	})
+}
+
+// traceCmd tells what is in a trace written by `tau run -trace`.
+func traceCmd() error {
+	opt := parseTraceOpts()
+	if opt.path == "" {
+		usageTrace()
+		return errUsage
+	}
+	return tau.TraceFile(opt.path, opt.chrome)
 }
 
 // format rewrites tau files in the canonical style, like `go fmt` does.
@@ -80,12 +165,16 @@ func help() error {
 	switch cmd := os.Args[2]; cmd {
 	case "run":
 		usageRun()
+	case "debug":
+		usageDebug()
 	case "build":
 		usageBuild()
 	case "bundle":
 		usageBundle()
 	case "test":
 		usageTest()
+	case "trace":
+		usageTrace()
 	case "fmt":
 		usageFmt()
 	case "doc":
@@ -144,12 +233,16 @@ func main() {
 	switch cmd := os.Args[1]; cmd {
 	case "run":
 		check(run())
+	case "debug":
+		check(debug())
 	case "build":
 		check(build())
 	case "bundle":
 		check(bundle())
 	case "test":
 		check(test())
+	case "trace":
+		check(traceCmd())
 	case "fmt":
 		check(format())
 	case "doc":
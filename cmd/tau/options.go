@@ -12,22 +12,44 @@ import (
 var errUsage = errors.New("usage")
 
 type runOpt struct {
+	path           string
+	args           []string
+	cpuprofile     string
+	memprofile     string
+	memprofilerate int64
+	trace          string
+	noOptimize     bool
+}
+
+type debugOpt struct {
 	path string
 	args []string
+	dap  bool
 }
 
 type buildOpt struct {
-	files  []string
-	output string
+	files      []string
+	output     string
+	noOptimize bool
 }
 
 type bundleOpt struct {
-	file   string
-	output string
+	file       string
+	output     string
+	noOptimize bool
 }
 
 type testOpt struct {
-	paths []string
+	paths          []string
+	cpuprofile     string
+	memprofile     string
+	memprofilerate int64
+	noOptimize     bool
+}
+
+type traceOpt struct {
+	path   string
+	chrome string
 }
 
 type fmtOpt struct {
@@ -47,6 +69,11 @@ type replOpt struct {
 
 func parseRunOpts() (opt runOpt) {
 	cmd := flag.NewFlagSet("run", flag.ExitOnError)
+	cmd.StringVar(&opt.cpuprofile, "cpuprofile", "", "Write a CPU profile of the program to the given file")
+	cmd.StringVar(&opt.memprofile, "memprofile", "", "Write a heap profile of the program to the given file")
+	cmd.Int64Var(&opt.memprofilerate, "memprofilerate", 0, "Sample one object allocated in this many for -memprofile")
+	cmd.StringVar(&opt.trace, "trace", "", "Write a trace of the routines and the pipes to the given file")
+	cmd.BoolVar(&opt.noOptimize, "O0", false, "Run the code as written, without optimizing it")
 	cmd.Usage = usageRun
 	cmd.Parse(os.Args[2:])
 
@@ -57,10 +84,24 @@ func parseRunOpts() (opt runOpt) {
 	return
 }
 
+func parseDebugOpts() (opt debugOpt) {
+	cmd := flag.NewFlagSet("debug", flag.ExitOnError)
+	cmd.BoolVar(&opt.dap, "dap", false, "Speak the Debug Adapter Protocol on stdin and stdout")
+	cmd.Usage = usageDebug
+	cmd.Parse(os.Args[2:])
+
+	opt.path = cmd.Arg(0)
+	if cmd.NArg() > 1 {
+		opt.args = cmd.Args()[1:]
+	}
+	return
+}
+
 func parseBundleOpts() (opt bundleOpt) {
 	cmd := flag.NewFlagSet("bundle", flag.ExitOnError)
 	cmd.StringVar(&opt.output, "o", "", "Write the executable to the given file")
 	cmd.StringVar(&opt.output, "out", "", "Write the executable to the given file (same as -o)")
+	cmd.BoolVar(&opt.noOptimize, "O0", false, "Bundle the code as written, without optimizing it")
 	cmd.Usage = usageBundle
 	cmd.Parse(os.Args[2:])
 
@@ -72,6 +113,7 @@ func parseBuildOpts() (opt buildOpt) {
 	cmd := flag.NewFlagSet("build", flag.ExitOnError)
 	cmd.StringVar(&opt.output, "o", "", "Write the bytecode to the given file")
 	cmd.StringVar(&opt.output, "out", "", "Write the bytecode to the given file (same as -o)")
+	cmd.BoolVar(&opt.noOptimize, "O0", false, "Compile the code as written, without optimizing it")
 	cmd.Usage = usageBuild
 	cmd.Parse(os.Args[2:])
 
@@ -81,6 +123,10 @@ func parseBuildOpts() (opt buildOpt) {
 
 func parseTestOpts() (opt testOpt) {
 	cmd := flag.NewFlagSet("test", flag.ExitOnError)
+	cmd.StringVar(&opt.cpuprofile, "cpuprofile", "", "Write a CPU profile of the test file to the given file")
+	cmd.StringVar(&opt.memprofile, "memprofile", "", "Write a heap profile of the test file to the given file")
+	cmd.Int64Var(&opt.memprofilerate, "memprofilerate", 0, "Sample one object allocated in this many for -memprofile")
+	cmd.BoolVar(&opt.noOptimize, "O0", false, "Run the tests on the code as written, without optimizing it")
 	cmd.Usage = usageTest
 	cmd.Parse(os.Args[2:])
 
@@ -88,6 +134,16 @@ func parseTestOpts() (opt testOpt) {
 	return
 }
 
+func parseTraceOpts() (opt traceOpt) {
+	cmd := flag.NewFlagSet("trace", flag.ExitOnError)
+	cmd.StringVar(&opt.chrome, "chrome", "", "Write the trace as Chrome trace-event JSON to the given file")
+	cmd.Usage = usageTrace
+	cmd.Parse(os.Args[2:])
+
+	opt.path = cmd.Arg(0)
+	return
+}
+
 func parseFmtOpts() (opt fmtOpt) {
 	cmd := flag.NewFlagSet("fmt", flag.ExitOnError)
 	cmd.BoolVar(&opt.write, "w", false, "Write the result back to the source file")
@@ -125,9 +181,11 @@ Tau is a dynamically typed, interpreted programming language.
 
 Commands:
   run       Run a tau file
+  debug     Run a tau file under the debugger
   build     Compile tau files into '.tauc' bytecode
   bundle    Compile a tau file into a standalone executable
   test      Run the tests of the given files or directories
+  trace     Tell what is in a trace written by 'run -trace'
   fmt       Format tau source files
   doc       Show what a module exports
   repl      Start the interactive prompt
@@ -144,11 +202,35 @@ Use '%s help COMMAND' for more information on a command.
 }
 
 func usageRun() {
-	fmt.Fprintf(os.Stderr, `Usage: %s run FILE [ARGS]
+	fmt.Fprintf(os.Stderr, `Usage: %s run [OPTIONS] FILE [ARGS]
 
 Run a tau file, either source or compiled bytecode. Anything after FILE is
 passed to the program itself and read with os.Args.
 
+With -cpuprofile the program is sampled a hundred times a second and the
+profile, by tau function and line, is written in the format of pprof: read
+it with 'go tool pprof' or any tool that reads that.
+
+With -trace every routine started, every value through a pipe and every wait
+on one is recorded, along with the collections: 'tau trace' tells where the
+time went, which is what to look at when a pipeline stalls.
+
+With -memprofile one object in 512 allocated is sampled, or one in the
+-memprofilerate given, and the heap profile says where the program allocated
+and how much of it is still in use when it ends, again in the format of pprof.
+
+With -O0 the code runs as it is written: the compiler leaves out the pass
+that folds constants, drops unreachable code and fuses the instructions it
+can into fewer, which is what to reach for when the optimizer is suspected.
+
+Options:
+  -O0                   Run the code as written, without optimizing it
+  -cpuprofile FILE      Write a CPU profile of the program to FILE
+  -memprofile FILE      Write a heap profile of the program to FILE
+  -memprofilerate N     Sample one object in N for -memprofile (default 512)
+  -trace FILE           Write a trace of the routines and the pipes to FILE,
+                        for 'tau trace' to read
+
 Arguments:
   FILE      Path to a '.tau' source file or a '.tauc' bytecode file
   ARGS      Arguments for the program
@@ -156,8 +238,42 @@ Arguments:
 Examples:
   %s run hello.tau
   %s run server.tau -port 8080
+  %s run -cpuprofile cpu.prof hello.tau
+  %s run -memprofile mem.prof hello.tau
+  %s run -trace out.trace pipeline.tau
   %s hello.tau
-`, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+}
+
+func usageDebug() {
+	fmt.Fprintf(os.Stderr, `Usage: %s debug [OPTIONS] FILE [ARGS]
+       %s debug --dap
+
+Run a tau source file under the debugger. The program starts paused at its
+first line and a prompt takes the commands: breakpoints by file and line,
+stepping into and over calls, the calls of every routine, and what their
+locals and globals hold. Type "help" at the prompt for the list.
+
+A breakpoint names the file by its trailing path elements, so "main.tau:12"
+stops in any main.tau and "lib/main.tau:12" only in the one under lib.
+
+With --dap there is no prompt: the debugger speaks the Debug Adapter Protocol
+on the standard input and output, for an editor to drive, and the editor says
+which file to run when it launches it. What the program prints is sent to the
+editor along with the rest.
+
+Options:
+  --dap     Speak the Debug Adapter Protocol on stdin and stdout
+
+Arguments:
+  FILE      Path to the '.tau' source file
+  ARGS      Arguments for the program
+
+Examples:
+  %s debug hello.tau
+  %s debug server.tau -port 8080
+  %s debug --dap
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 }
 
 func usageBundle() {
@@ -171,6 +287,7 @@ Without -o the executable takes the name of the source file without its
 extension.
 
 Options:
+  -O0               Bundle the code as written, without optimizing it
   -o, --out FILE    Write the executable to FILE
 
 Arguments:
@@ -189,6 +306,7 @@ Compile tau source files into '.tauc' bytecode. Without -o each file is
 written next to its source with the extension replaced.
 
 Options:
+  -O0               Compile the code as written, without optimizing it
   -o, --out FILE    Write the bytecode to FILE (only with a single input)
 
 Arguments:
@@ -202,12 +320,21 @@ Examples:
 }
 
 func usageTest() {
-	fmt.Fprintf(os.Stderr, `Usage: %s test [PATH...]
+	fmt.Fprintf(os.Stderr, `Usage: %s test [OPTIONS] [PATH...]
 
 Run the '*_test.tau' files found in the given paths, a directory standing for
 the test files it holds. With no path the current directory is used. Each file
 runs in its own process, so a crashing test takes down only itself.
 
+Options:
+  -O0                   Run the tests on the code as written, without
+                        optimizing it
+  -cpuprofile FILE      Write a CPU profile of the test to FILE; there has
+                        to be a single test file, a profile is of one process
+  -memprofile FILE      Write a heap profile of the test to FILE, again of a
+                        single test file
+  -memprofilerate N     Sample one object in N for -memprofile (default 512)
+
 Arguments:
   PATH...   Files or directories to test (default: the current directory)
 
@@ -215,6 +342,35 @@ Examples:
   %s test
   %s test stdlib
   %s test stdlib/strings_test.tau
+  %s test -cpuprofile cpu.prof stdlib/strings_test.tau
+  %s test -memprofile mem.prof stdlib/strings_test.tau
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+}
+
+func usageTrace() {
+	fmt.Fprintf(os.Stderr, `Usage: %s trace [OPTIONS] FILE
+
+Tell what is in a trace written by 'tau run -trace': every routine with the
+time it spent blocked sending, receiving and in a select, every pipe with the
+values that went through it and the time routines spent waiting on it, the
+collections and their pauses, and which routines were still blocked when the
+trace ended, and on what. A program that deadlocked ends with all of them
+there.
+
+With -chrome the whole trace is written instead, in the trace-event JSON that
+chrome://tracing and https://ui.perfetto.dev show as a timeline, a routine to
+a row. A file of "-" is the standard output.
+
+Options:
+  -chrome FILE  Write the trace as Chrome trace-event JSON to FILE
+
+Arguments:
+  FILE      Path to the trace
+
+Examples:
+  %s run -trace out.trace pipeline.tau
+  %s trace out.trace
+  %s trace -chrome out.json out.trace
 `, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 }
 
@@ -0,0 +1,55 @@
+package tau
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCPUProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prog.tau")
+	err := os.WriteFile(path, []byte(`fib = fn(n) {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}
+fib(29)
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prof bytes.Buffer
+	if err := StartCPUProfile(&prof); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartCPUProfile(io.Discard); err == nil {
+		t.Error("a second profile started while the first one runs")
+	}
+	if err := ExecFileVM(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := StopCPUProfile(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := gzip.NewReader(&prof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The encoding itself is tested in internal/pprof: here it is enough that
+	// the samples are of the tau function, in the tau file.
+	for _, want := range []string{"fib", path, "cpu", "nanoseconds"} {
+		if !bytes.Contains(raw, []byte(want)) {
+			t.Errorf("no %q in the profile", want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package tau
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A deadlock ends the process, so the program runs in another one: this test
+// binary again, told by the environment to be the interpreter.
+func init() {
+	if path := os.Getenv("TAU_TEST_RUN"); path != "" {
+		if err := ExecFileVM(path); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+}
+
+func runTau(t *testing.T, src string) *exec.Cmd {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "prog.tau")
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "TAU_TEST_RUN="+path)
+	return cmd
+}
+
+func exitCode(t *testing.T, err error) int {
+	t.Helper()
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		t.Fatalf("not an exit: %v", err)
+	}
+	return ee.ExitCode()
+}
+
+func TestDeadlock(t *testing.T) {
+	cmd := runTau(t, `worker = fn(in, out) {
+	send(out, recv(in) * 2)
+}
+a = pipe()
+b = pipe()
+tau worker(a, b)
+println("waiting")
+recv(b)
+`)
+	out, err := cmd.CombinedOutput()
+	if code := exitCode(t, err); code != 2 {
+		t.Fatalf("exit %d:\n%s", code, out)
+	}
+	// The pipes are named after where they were made, which is the path of
+	// the file in the temporary directory.
+	for _, want := range []string{
+		"waiting\nfatal error: all routines are asleep - deadlock!",
+		"routine 1 [recv on pipe made at ",
+		"prog.tau:5]:\n    <top level> at ",
+		"routine 2 [recv on pipe made at ",
+		"prog.tau:4]:\n    worker at ",
+		"routine started at ",
+	} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("no %q in:\n%s", want, out)
+		}
+	}
+}
+
+// Routines that all wait, but not forever, or on a pipe somebody will close:
+// none of these is a deadlock.
+func TestNoDeadlock(t *testing.T) {
+	cmd := runTau(t, `p = pipe()
+tau fn() {
+	for i = 0; i < 3; ++i {
+		select {
+			case recv(p) {}
+			case after(20) {}
+		}
+	}
+	close(p)
+}()
+recv(p)
+println("done")
+`)
+	out, err := cmd.CombinedOutput()
+	if err != nil || string(out) != "done\n" {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+}
+
+// A routine waiting on a timer of the runtime is not stuck while the timer is
+// still going to go off, and it is once the timer is stopped.
+func TestTimerDeadlock(t *testing.T) {
+	cmd := runTau(t, `p = pipe(1)
+timer(p, 30, 0)
+recv(p)
+println("fired")
+stoptimer(timer(p, 30, 0))
+recv(p)
+`)
+	out, err := cmd.CombinedOutput()
+	if code := exitCode(t, err); code != 2 {
+		t.Fatalf("exit %d:\n%s", code, out)
+	}
+	if want := "fired\nfatal error: all routines are asleep - deadlock!"; !strings.Contains(string(out), want) {
+		t.Errorf("no %q in:\n%s", want, out)
+	}
+}
+
+// TestSelectSend has selects send on unbuffered pipes that other selects wait
+// to receive from, while those have another case ready. A send only goes to a
+// receiver that took it: a select never waits for one that went with another
+// case. Before that, the first program deadlocked on the send it meant to give
+// up with the default, and the two routines of the second sat waiting for each
+// other to receive forever, which is why the program is killed if it hangs.
+func TestSelectSend(t *testing.T) {
+	for _, src := range []string{`c = pipe()
+d = pipe(1)
+ready = pipe(1)
+tau fn() {
+	send(ready, true)
+	select {
+		case recv(d) {}
+		case recv(c) {}
+	}
+}()
+recv(ready)
+send(d, 1)
+println(select {
+	case send(c, 1) { "done" }
+	default { "done" }
+})
+`, `a = pipe()
+b = pipe()
+done = pipe(2)
+loop = fn(n, x, y) {
+	for i = 0; i < n; i++ {
+		select {
+			case send(x, i) {}
+			case recv(y) {}
+		}
+	}
+	send(done, true)
+}
+tau loop(50000, a, b)
+tau loop(50000, b, a)
+recv(done)
+recv(done)
+println("done")
+`} {
+		cmd := runTau(t, src)
+		cmd.Env = append(cmd.Env, "TAUMAXPROCS=4")
+		var out strings.Builder
+		cmd.Stdout, cmd.Stderr = &out, &out
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		hung := time.AfterFunc(20*time.Second, func() { cmd.Process.Kill() })
+		err := cmd.Wait()
+		hung.Stop()
+		if err != nil || out.String() != "done\n" {
+			t.Errorf("%v:\n%s\n%s", err, out.String(), src)
+		}
+	}
+}
+
+func TestSIGQUIT(t *testing.T) {
+	cmd := runTau(t, `spin = fn() { for true {} }
+tau spin()
+println("started")
+recv(pipe())
+`)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Once the program runs, and the signal goes to it and not to Go.
+	buf := make([]byte, len("started\n"))
+	if _, err := stdout.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cmd.Process.Signal(syscall.SIGQUIT)
+
+	if code := exitCode(t, cmd.Wait()); code != 2 {
+		t.Fatalf("exit %d:\n%s", code, stderr.String())
+	}
+	for _, want := range []string{"SIGQUIT: quit", "routine 1 [recv on pipe made at ", "routine 2 [running]:\n    spin at "} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("no %q in:\n%s", want, stderr.String())
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package tau
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/NicoNex/tau/internal/compiler"
+	"github.com/NicoNex/tau/internal/dap"
+	"github.com/NicoNex/tau/internal/vm"
+)
+
+const debugPrompt = "(tau-debug) "
+
+const debugHelp = `Commands:
+  break, b [FILE:]LINE   Stop when a line is reached, in this file by default
+  delete, d [N]          Remove breakpoint N, or all of them
+  breakpoints            List the breakpoints
+  continue, c            Run until the next breakpoint
+  step, s                Go to the next line, into the calls
+  next, n                Go to the next line, over the calls
+  finish                 Run until the function returns
+  backtrace, bt          List the calls of the routine being looked at
+  frame, f N             Look at call N of the backtrace
+  locals                 List the locals of the call being looked at
+  globals                List the globals of the file being looked at
+  print, p NAME          Print what a name holds
+  list, l                Show the source around the line being looked at
+  routines               List the running tau routines
+  routine N              Look at routine N
+  help, h                Show this help
+  quit, q                Stop the program and leave
+`
+
+// debugger is the prompt of `tau debug`: it gets the program whenever it
+// stops and holds it until told how to go on. Between two stops it keeps the
+// breakpoints, which outlive them, and nothing else.
+type debugger struct {
+	in    *bufio.Reader
+	out   io.Writer
+	path  string
+	bps   []vm.Breakpoint
+	files map[string][]string
+	eof   bool
+
+	// What is being looked at, valid only during a stop.
+	stop    *vm.Stop
+	routine int
+	frames  []vm.Frame
+	frame   int
+}
+
+// Debug runs a tau file under the debugger, taking commands from the
+// terminal. The program starts paused at its first line.
+func Debug(path string) error {
+	return DebugWith(path, os.Stdin, os.Stdout)
+}
+
+// DebugWith is Debug reading the commands from in and writing what it has to
+// say to out. The program's own output goes where it always goes.
+func DebugWith(path string, in io.Reader, out io.Writer) error {
+	d := &debugger{
+		in:    bufio.NewReader(in),
+		out:   out,
+		path:  filepath.Clean(path),
+		files: make(map[string][]string),
+	}
+
+	err := RunDebugged(d.path, d.stopped)
+	fmt.Fprintln(d.out, "program exited")
+	return err
+}
+
+// DebugDAP runs the debug adapter on the standard input and output, for an
+// editor to drive. The program's output, which would get in the way of the
+// protocol, is sent to the editor as part of it.
+func DebugDAP() error {
+	proto, output, end, err := splitStdout()
+	if err != nil {
+		return err
+	}
+
+	run := func(path string, stopped func(*vm.Stop) vm.Resume) error {
+		defer end()
+		return RunDebugged(path, stopped)
+	}
+	return dap.Serve(os.Stdin, proto, map[string]io.Reader{"stdout": output}, run)
+}
+
+// RunDebugged compiles and runs a tau file under a debugger, which stopped
+// stands for: it is called every time the program stops, the first time
+// before the first line, and returns how the program goes on.
+func RunDebugged(path string, stopped func(*vm.Stop) vm.Resume) error {
+	if err := CheckImports(path); err != nil {
+		return err
+	}
+
+	// Before compiling: the names of the locals are kept only by a compiler
+	// that knows it has to, and modules are compiled while the program runs.
+	vm.Debug(stopped)
+	// The debugger steps through the program line by line and shows its
+	// locals, which is what the code as written does and not what the
+	// optimizer made of it.
+	compiler.DisableOptimizer()
+
+	bytecode, err := compile(path)
+	if err != nil {
+		return err
+	}
+	return runBytecode(path, bytecode)
+}
+
+// stopped is called every time the program stops, and returns how it goes
+// on. Input that runs out lets the program run to its end.
+func (d *debugger) stopped(s *vm.Stop) vm.Resume {
+	d.stop = s
+	d.look(s.Routine)
+	defer func() { d.stop, d.frames = nil, nil }()
+
+	if d.eof {
+		return vm.Continue
+	}
+	d.where(s.Reason)
+
+	for {
+		fmt.Fprint(d.out, debugPrompt)
+		line, err := d.in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(d.out)
+			d.eof = true
+			d.bps = nil
+			vm.SetBreakpoints(nil)
+			return vm.Continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		cmd, args := fields[0], fields[1:]
+
+		switch cmd {
+		case "continue", "c":
+			return vm.Continue
+		case "step", "s":
+			return vm.Step
+		case "next", "n":
+			return vm.Next
+		case "finish":
+			return vm.Finish
+		case "quit", "q":
+			os.Exit(0)
+		default:
+			d.command(cmd, args)
+		}
+	}
+}
+
+// command runs the commands that look without moving.
+func (d *debugger) command(cmd string, args []string) {
+	switch cmd {
+	case "break", "b":
+		d.addBreakpoint(args)
+	case "delete", "d":
+		d.deleteBreakpoint(args)
+	case "breakpoints":
+		for i, b := range d.bps {
+			fmt.Fprintf(d.out, "%d: %s:%d\n", i+1, b.File, b.Line)
+		}
+	case "backtrace", "bt":
+		d.backtrace()
+	case "frame", "f":
+		n, ok := d.number(args, len(d.frames))
+		if ok {
+			d.frame = n
+			d.printFrame(n)
+		}
+	case "locals":
+		if f, ok := d.current(); ok {
+			d.printVars(f.Locals(), "no locals here")
+		}
+	case "globals":
+		if f, ok := d.current(); ok {
+			d.printVars(f.Globals(), "no globals here")
+		}
+	case "print", "p":
+		d.print(args)
+	case "list", "l":
+		if f, ok := d.current(); ok {
+			d.list(f.File, f.Line)
+		}
+	case "routines":
+		d.routines()
+	case "routine":
+		d.switchRoutine(args)
+	case "help", "h":
+		fmt.Fprint(d.out, debugHelp)
+	default:
+		fmt.Fprintf(d.out, "unknown command %q, \"help\" lists them\n", cmd)
+	}
+}
+
+// look makes a routine the one being looked at, from its innermost call.
+func (d *debugger) look(routine int) {
+	d.routine = routine
+	d.frames = d.stop.Frames(routine)
+	d.frame = 0
+}
+
+func (d *debugger) current() (vm.Frame, bool) {
+	if d.frame >= len(d.frames) {
+		fmt.Fprintln(d.out, "no call to look at")
+		return vm.Frame{}, false
+	}
+	return d.frames[d.frame], true
+}
+
+// where says where the program stopped and shows the line.
+func (d *debugger) where(reason vm.StopReason) {
+	f, ok := d.current()
+	if !ok {
+		return
+	}
+
+	switch reason {
+	case vm.StopBreakpoint:
+		fmt.Fprintf(d.out, "breakpoint hit in routine %d, %s at %s:%d\n", d.routine, f.Name, f.File, f.Line)
+	default:
+		fmt.Fprintf(d.out, "stopped in routine %d, %s at %s:%d\n", d.routine, f.Name, f.File, f.Line)
+	}
+	d.showLine(f.File, f.Line)
+}
+
+func (d *debugger) addBreakpoint(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(d.out, "usage: break [FILE:]LINE")
+		return
+	}
+
+	file, line := d.path, args[0]
+	if d.frame < len(d.frames) {
+		file = d.frames[d.frame].File
+	}
+	if i := strings.LastIndexByte(args[0], ':'); i >= 0 {
+		file, line = args[0][:i], args[0][i+1:]
+	}
+
+	n, err := strconv.Atoi(line)
+	if err != nil || n < 1 {
+		fmt.Fprintf(d.out, "%q is not a line\n", line)
+		return
+	}
+
+	d.bps = append(d.bps, vm.Breakpoint{File: file, Line: n})
+	vm.SetBreakpoints(d.bps)
+	fmt.Fprintf(d.out, "breakpoint %d at %s:%d\n", len(d.bps), file, n)
+}
+
+func (d *debugger) deleteBreakpoint(args []string) {
+	if len(args) == 0 {
+		d.bps = nil
+		vm.SetBreakpoints(nil)
+		fmt.Fprintln(d.out, "all breakpoints deleted")
+		return
+	}
+
+	n, ok := d.number(args, len(d.bps)+1)
+	if !ok || n == 0 {
+		if ok {
+			fmt.Fprintln(d.out, "breakpoints are numbered from 1")
+		}
+		return
+	}
+	d.bps = append(d.bps[:n-1], d.bps[n:]...)
+	vm.SetBreakpoints(d.bps)
+	fmt.Fprintf(d.out, "breakpoint %d deleted\n", n)
+}
+
+// number reads the only argument as a number below max.
+func (d *debugger) number(args []string, max int) (int, bool) {
+	if len(args) != 1 {
+		fmt.Fprintln(d.out, "expected a number")
+		return 0, false
+	}
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 || n >= max {
+		fmt.Fprintf(d.out, "no %s here\n", args[0])
+		return 0, false
+	}
+	return n, true
+}
+
+func (d *debugger) backtrace() {
+	for i := range d.frames {
+		mark := " "
+		if i == d.frame {
+			mark = "*"
+		}
+		fmt.Fprint(d.out, mark)
+		d.printFrame(i)
+		if n := d.frames[i].Elided; n > 0 {
+			noun := "frames"
+			if n == 1 {
+				noun = "frame"
+			}
+			fmt.Fprintf(d.out, "    ... %d %s elided by tail calls\n", n, noun)
+		}
+	}
+}
+
+func (d *debugger) printFrame(i int) {
+	f := d.frames[i]
+	fmt.Fprintf(d.out, "#%d %s at %s:%d\n", i, f.Name, f.File, f.Line)
+}
+
+func (d *debugger) printVars(vars []vm.Var, none string) {
+	if len(vars) == 0 {
+		fmt.Fprintln(d.out, none)
+		return
+	}
+	for _, v := range vars {
+		fmt.Fprintf(d.out, "%s = %s\n", v.Name, v.Value)
+	}
+}
+
+func (d *debugger) print(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(d.out, "usage: print NAME")
+		return
+	}
+
+	f, ok := d.current()
+	if !ok {
+		return
+	}
+	if v, ok := f.Lookup(args[0]); ok {
+		fmt.Fprintln(d.out, v)
+	} else {
+		fmt.Fprintf(d.out, "no %s here\n", args[0])
+	}
+}
+
+func (d *debugger) routines() {
+	for _, r := range d.stop.Routines() {
+		mark := " "
+		if r.ID == d.routine {
+			mark = "*"
+		}
+		if len(r.Frames) == 0 {
+			fmt.Fprintf(d.out, "%s%d not started\n", mark, r.ID)
+			continue
+		}
+		f := r.Frames[0]
+		fmt.Fprintf(d.out, "%s%d %s at %s:%d\n", mark, r.ID, f.Name, f.File, f.Line)
+	}
+}
+
+func (d *debugger) switchRoutine(args []string) {
+	if len(args) != 1 {
+		fmt.Fprintln(d.out, "usage: routine N")
+		return
+	}
+
+	for _, r := range d.stop.Routines() {
+		if strconv.Itoa(r.ID) == args[0] {
+			d.look(r.ID)
+			d.backtrace()
+			return
+		}
+	}
+	fmt.Fprintf(d.out, "no routine %s\n", args[0])
+}
+
+// list shows the lines around the one being looked at.
+func (d *debugger) list(file string, line int) {
+	src := d.source(file)
+	for i := max(line-5, 1); i <= min(line+5, len(src)); i++ {
+		mark := " "
+		if i == line {
+			mark = ">"
+		}
+		fmt.Fprintf(d.out, "%s%4d  %s\n", mark, i, src[i-1])
+	}
+}
+
+func (d *debugger) showLine(file string, line int) {
+	if src := d.source(file); line > 0 && line <= len(src) {
+		fmt.Fprintf(d.out, "%5d  %s\n", line, src[line-1])
+	}
+}
+
+// source returns the lines of a file, read once.
+func (d *debugger) source(file string) []string {
+	if lines, ok := d.files[file]; ok {
+		return lines
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		d.files[file] = nil
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	d.files[file] = lines
+	return lines
+}
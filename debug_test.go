@@ -0,0 +1,89 @@
+package tau
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The debugger hooks into every VM of the process for good, so everything it
+// is tested on runs in this one test, a session after the other.
+func TestDebug(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, src string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	write("lib.tau", `secret = 7
+Double = fn(x) {
+	y = x * 2
+	return y + secret
+}
+`)
+	main := write("main.tau", `lib = import("lib")
+sq = fn(n) {
+	r = n * n
+	return r
+}
+
+total = 0
+for i = 0; i < 3; i++ {
+	total += sq(i)
+}
+v = lib.Double(total)
+
+p = pipe()
+w = fn(out) {
+	send(out, v)
+}
+tau w(p)
+recv(p)
+`)
+
+	cmds := []string{
+		"b 3", "c", // into sq, from the top level
+		"bt", "locals", "p total",
+		"finish", "next",
+		"d", "b lib.tau:3", "c", // into a module
+		"locals", "p secret",
+		"step", "step",
+		"d", "b 15", "c", // into a routine
+		"routines", "locals",
+		"c",
+	}
+
+	var out strings.Builder
+	err := DebugWith(main, strings.NewReader(strings.Join(cmds, "\n")+"\n"), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"stopped in routine 1, <top level> at " + main + ":1\n",
+		"breakpoint hit in routine 1, sq at " + main + ":3\n",
+		"*#0 sq at " + main + ":3\n #1 <top level> at " + main + ":9\n",
+		"n = 0\nr = null\n",
+		"(tau-debug) 0\n",
+		"stopped in routine 1, <top level> at " + main + ":9\n",
+		"stopped in routine 1, <top level> at " + main + ":8\n",
+		"breakpoint hit in routine 1, Double at " + filepath.Join(dir, "lib.tau") + ":3\n",
+		"x = 5\ny = null\n",
+		"(tau-debug) 7\n",
+		"stopped in routine 1, Double at " + filepath.Join(dir, "lib.tau") + ":4\n",
+		"stopped in routine 1, <top level> at " + main + ":13\n",
+		// The import ran in a VM of its own, number 2.
+		"breakpoint hit in routine 3, w at " + main + ":15\n",
+		" 1 <top level> at " + main + ":18\n*3 w at " + main + ":15\n",
+		"out = <pipe>\n",
+		"program exited\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package tau
+
+import (
+	"strings"
+	"testing"
+)
+
+// A runtime error ends the program, and the calls deferred by every function
+// it went through are made on the way out, the innermost first.
+func TestDeferOnError(t *testing.T) {
+	cmd := runTau(t, `outer = fn() {
+	defer println("outer")
+	inner()
+}
+inner = fn() {
+	defer println("inner 1")
+	defer println("inner 2")
+	null.x
+}
+outer()
+println("not reached")
+`)
+	stdout, err := cmd.Output()
+	if code := exitCode(t, err); code != 1 {
+		t.Fatalf("exit %d:\n%s", code, stdout)
+	}
+	if want := "inner 2\ninner 1\nouter\n"; string(stdout) != want {
+		t.Errorf("got %q, want %q", stdout, want)
+	}
+}
+
+// A deferred call that fails fails the function that deferred it, after its
+// other deferred calls are made.
+func TestDeferFails(t *testing.T) {
+	cmd := runTau(t, `f = fn() {
+	defer println("first")
+	defer fn() { null.x }()
+	defer println("last")
+	1
+}
+f()
+println("not reached")
+`)
+	out, err := cmd.CombinedOutput()
+	if code := exitCode(t, err); code != 1 {
+		t.Fatalf("exit %d:\n%s", code, out)
+	}
+	for _, want := range []string{"last\n", "null object has no attribute x", "first\n"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("no %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(string(out), "not reached") {
+		t.Errorf("the program went on:\n%s", out)
+	}
+}
+
+// A routine that fails makes its deferred calls too, and the rest of the
+// program goes on.
+func TestDeferRoutine(t *testing.T) {
+	cmd := runTau(t, `done = pipe()
+worker = fn() {
+	defer close(done)
+	null.x
+}
+tau worker()
+recv(done)
+println("done")
+`)
+	stdout, err := cmd.Output()
+	if err != nil || string(stdout) != "done\n" {
+		t.Fatalf("%v:\n%s", err, stdout)
+	}
+}
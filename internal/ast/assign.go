@@ -58,17 +58,12 @@ func (a Assign) Compile(c *compiler.Compiler) (position int, err error) {
 			return
 		}
 
-		symbol := c.Define(name)
-
-		if symbol.Scope == compiler.GlobalScope {
-			position = c.Emit(code.OpSetGlobal, symbol.Index)
-			c.Bookmark(a.pos)
-			return
-		} else {
-			position = c.Emit(code.OpSetLocal, symbol.Index)
-			c.Bookmark(a.pos)
-			return
+		if err = c.Assignable(name); err != nil {
+			return 0, c.NewError(a.pos, "%v", err)
 		}
+		position = c.StoreSymbol(c.Define(name))
+		c.Bookmark(a.pos)
+		return
 
 	case Definable:
 		if position, err = left.CompileDefine(c); err != nil {
@@ -81,11 +76,79 @@ func (a Assign) Compile(c *compiler.Compiler) (position int, err error) {
 		c.Bookmark(a.pos)
 		return
 
+	case List:
+		// a, b = f() and [a, b] = l: OpUnpack checks there are as many
+		// values as names and leaves them on the stack for the names to
+		// take one by one.
+		names, err := unpackNames(c, left, a.pos)
+		if err != nil {
+			return 0, err
+		}
+		if position, err = a.r.Compile(c); err != nil {
+			return 0, err
+		}
+		position = c.Emit(code.OpUnpack, len(names))
+		c.Bookmark(a.pos)
+		for _, n := range names {
+			if err := set(c, n, a.pos); err != nil {
+				return 0, err
+			}
+		}
+		return position, nil
+
+	case Fields:
+		if len(left.names) > 255 {
+			return 0, c.NewError(a.pos, "cannot assign to %d names, it takes 1 to 255", len(left.names))
+		}
+		if position, err = a.r.Compile(c); err != nil {
+			return
+		}
+		for _, n := range left.names {
+			c.Emit(code.OpConstant, c.AddConstant(obj.NewString(n)))
+		}
+		position = c.Emit(code.OpUnpackFields, len(left.names))
+		c.Bookmark(a.pos)
+		for _, n := range left.names {
+			if err := set(c, n, a.pos); err != nil {
+				return 0, err
+			}
+		}
+		return position, nil
+
 	default:
 		return 0, fmt.Errorf("cannot assign to literal")
 	}
 }
 
+// unpackNames returns the names a list on the left of an assignment is made
+// of, which is all it may be made of.
+func unpackNames(c *compiler.Compiler, l List, pos int) ([]string, error) {
+	if len(l) == 0 || len(l) > 255 {
+		return nil, c.NewError(pos, "cannot assign to %d names, it takes 1 to 255", len(l))
+	}
+
+	names := make([]string, len(l))
+	for i, n := range l {
+		id, ok := n.(Identifier)
+		if !ok {
+			return nil, c.NewError(pos, "cannot assign to %v, only to names when there are more than one", n)
+		}
+		names[i] = id.String()
+	}
+	return names, nil
+}
+
+// set assigns the value on top of the stack to name, the way an assignment
+// does, and drops it.
+func set(c *compiler.Compiler, name string, pos int) error {
+	if err := c.Assignable(name); err != nil {
+		return c.NewError(pos, "%v", err)
+	}
+	c.StoreSymbol(c.Define(name))
+	c.Emit(code.OpPop)
+	return nil
+}
+
 func (a Assign) IsConstExpression() bool {
 	return false
 }
@@ -42,6 +42,10 @@ func (c Call) Compile(comp *compiler.Compiler) (position int, err error) {
 		return
 	}
 
+	if spreads(c.Args) {
+		return c.compileSpread(comp)
+	}
+
 	for _, a := range c.Args {
 		if position, err = a.Compile(comp); err != nil {
 			return
@@ -53,6 +57,45 @@ func (c Call) Compile(comp *compiler.Compiler) (position int, err error) {
 	return
 }
 
+// compileSpread compiles a call with some of its arguments spread. They are
+// given to OpCallSpread as lists, the ones spread as they are and each run of
+// the others made into one, which the VM lays out on the stack before making
+// the call.
+func (c Call) compileSpread(comp *compiler.Compiler) (position int, err error) {
+	var segments, run int
+
+	flush := func() {
+		if run > 0 {
+			comp.Emit(code.OpList, run)
+			segments++
+			run = 0
+		}
+	}
+
+	for _, a := range c.Args {
+		if s, ok := a.(Spread); ok {
+			flush()
+			if position, err = s.list.Compile(comp); err != nil {
+				return
+			}
+			segments++
+		} else {
+			if position, err = a.Compile(comp); err != nil {
+				return
+			}
+			run++
+		}
+	}
+	flush()
+
+	if segments > 255 {
+		return 0, comp.NewError(c.pos, "too many arguments spread in a call, it takes up to 255")
+	}
+	position = comp.Emit(code.OpCallSpread, segments)
+	comp.Bookmark(c.pos)
+	return
+}
+
 func (c Call) IsConstExpression() bool {
 	return false
 }
@@ -13,10 +13,11 @@ import (
 type ConcurrentCall struct {
 	fn   Node
 	args []Node
+	pos  int
 }
 
-func NewConcurrentCall(fn Node, args []Node) Node {
-	return ConcurrentCall{fn, args}
+func NewConcurrentCall(fn Node, args []Node, pos int) Node {
+	return ConcurrentCall{fn, args, pos}
 }
 
 func (c ConcurrentCall) Eval() (obj.Object, error) {
@@ -33,6 +34,10 @@ func (c ConcurrentCall) String() string {
 }
 
 func (c ConcurrentCall) Compile(comp *compiler.Compiler) (position int, err error) {
+	if spreads(c.args) {
+		return 0, comp.NewError(c.pos, "the arguments of a tau call can't be spread")
+	}
+
 	if position, err = c.fn.Compile(comp); err != nil {
 		return
 	}
@@ -43,7 +48,10 @@ func (c ConcurrentCall) Compile(comp *compiler.Compiler) (position int, err erro
 		}
 	}
 
-	return comp.Emit(code.OpConcurrentCall, len(c.args)), nil
+	// Where the routine was started from, for the trace of its errors.
+	position = comp.Emit(code.OpConcurrentCall, len(c.args))
+	comp.Bookmark(c.pos)
+	return position, nil
 }
 
 func (ConcurrentCall) IsConstExpression() bool {
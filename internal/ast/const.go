@@ -0,0 +1,55 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/NicoNex/tau/internal/compiler"
+	"github.com/NicoNex/tau/internal/obj"
+)
+
+// Const gives a name the only value it will ever have. The value can be
+// anything an assignment takes; the compiler refuses any later assignment to
+// the name, and what it gives to an import can't be written either.
+type Const struct {
+	name string
+	val  Node
+	pos  int
+}
+
+func NewConst(name string, val Node, pos int) Node {
+	return Const{name, val, pos}
+}
+
+func (k Const) Eval() (obj.Object, error) {
+	return obj.NullObj, errors.New("ast.Const: not a constant expression")
+}
+
+func (k Const) String() string {
+	return fmt.Sprintf("const %s = %v", k.name, k.val)
+}
+
+func (k Const) Compile(c *compiler.Compiler) (position int, err error) {
+	// A function takes the name of its constant, the way it does the name
+	// of a variable, so that it can call itself.
+	if fn, ok := k.val.(Function); ok && fn.Name == "" {
+		fn.Name = k.name
+		k.val = fn
+	}
+
+	if position, err = k.val.Compile(c); err != nil {
+		return
+	}
+
+	symbol, err := c.DefineConst(k.name)
+	if err != nil {
+		return 0, c.NewError(k.pos, "%v", err)
+	}
+	position = c.StoreSymbol(symbol)
+	c.Bookmark(k.pos)
+	return position, nil
+}
+
+func (Const) IsConstExpression() bool {
+	return false
+}
@@ -0,0 +1,65 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/NicoNex/tau/internal/code"
+	"github.com/NicoNex/tau/internal/compiler"
+	"github.com/NicoNex/tau/internal/obj"
+)
+
+// Defer is a call put off until the function it is in returns, whichever way
+// it does. The function and the arguments are worked out where the defer is.
+type Defer struct {
+	fn   Node
+	args []Node
+	pos  int
+}
+
+func NewDefer(fn Node, args []Node, pos int) Node {
+	return Defer{fn, args, pos}
+}
+
+func (d Defer) Eval() (obj.Object, error) {
+	return obj.NullObj, errors.New("ast.Defer: not a constant expression")
+}
+
+func (d Defer) String() string {
+	var args = make([]string, len(d.args))
+
+	for i, a := range d.args {
+		args[i] = a.String()
+	}
+	return fmt.Sprintf("defer %v(%s)", d.fn, strings.Join(args, ", "))
+}
+
+func (d Defer) Compile(c *compiler.Compiler) (position int, err error) {
+	// The program has no function to return from, only an end, and the
+	// files of an import end before anyone gets to use what they opened.
+	if !c.InFunction() {
+		return 0, c.NewError(d.pos, "defer outside of a function")
+	}
+	if spreads(d.args) {
+		return 0, c.NewError(d.pos, "the arguments of a deferred call can't be spread")
+	}
+
+	if position, err = d.fn.Compile(c); err != nil {
+		return
+	}
+
+	for _, a := range d.args {
+		if position, err = a.Compile(c); err != nil {
+			return
+		}
+	}
+
+	position = c.Emit(code.OpDefer, len(d.args))
+	c.Bookmark(d.pos)
+	return position, nil
+}
+
+func (Defer) IsConstExpression() bool {
+	return false
+}
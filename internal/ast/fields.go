@@ -0,0 +1,40 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/NicoNex/tau/internal/compiler"
+	"github.com/NicoNex/tau/internal/obj"
+)
+
+// Fields is the left side of {a, b} = o, which takes the fields a and b of
+// the object o into names of the same name. It means nothing anywhere else.
+type Fields struct {
+	names []string
+	pos   int
+}
+
+func NewFields(names []string, pos int) Node {
+	return Fields{
+		names: names,
+		pos:   pos,
+	}
+}
+
+func (f Fields) Eval() (obj.Object, error) {
+	return obj.NullObj, errors.New("ast.Fields: not a constant expression")
+}
+
+func (f Fields) String() string {
+	return fmt.Sprintf("{%s}", strings.Join(f.names, ", "))
+}
+
+func (f Fields) Compile(c *compiler.Compiler) (position int, err error) {
+	return 0, c.NewError(f.pos, "%v is not a map, it is only good on the left of =", f)
+}
+
+func (f Fields) IsConstExpression() bool {
+	return false
+}
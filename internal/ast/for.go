@@ -40,6 +40,9 @@ func (f For) Compile(c *compiler.Compiler) (position int, err error) {
 		if position, err = f.before.Compile(c); err != nil {
 			return
 		}
+		// Like after, an expression whose value nobody wants: left on the
+		// stack it would pile up, one for every time a nested loop starts.
+		c.Emit(code.OpPop)
 	}
 
 	startPos := c.Pos()
@@ -0,0 +1,96 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/NicoNex/tau/internal/code"
+	"github.com/NicoNex/tau/internal/compiler"
+	"github.com/NicoNex/tau/internal/obj"
+)
+
+// ForIn is a loop over the elements of a collection: a list, a map, a string,
+// bytes or a pipe. The key is empty when the loop names the values alone.
+type ForIn struct {
+	key  string
+	val  string
+	expr Node
+	body Node
+	pos  int
+}
+
+func NewForIn(key, val string, expr, body Node, pos int) Node {
+	return ForIn{
+		key:  key,
+		val:  val,
+		expr: expr,
+		body: body,
+		pos:  pos,
+	}
+}
+
+func (f ForIn) Eval() (obj.Object, error) {
+	return obj.NullObj, errors.New("ast.ForIn: not a constant expression")
+}
+
+func (f ForIn) String() string {
+	if f.key == "" {
+		return fmt.Sprintf("for %s in %v { %v }", f.val, f.expr, f.body)
+	}
+	return fmt.Sprintf("for %s, %s in %v { %v }", f.key, f.val, f.expr, f.body)
+}
+
+// Compile leaves the collection and the cursor of OpIter on the stack for the
+// whole loop. OpIterNext pushes the key and the value, or the one the loop
+// asks for, which go to the names, and jumps out once there is nothing left,
+// to where break goes too: the two pops of the state.
+func (f ForIn) Compile(c *compiler.Compiler) (position int, err error) {
+	if position, err = f.expr.Compile(c); err != nil {
+		return
+	}
+	c.Emit(code.OpIter)
+	c.Bookmark(f.pos)
+
+	nvars := 1
+	if f.key != "" {
+		nvars = 2
+	}
+	nextPos := c.Emit(code.OpIterNext, compiler.GenericPlaceholder, nvars)
+
+	if err = set(c, f.val, f.pos); err != nil {
+		return
+	}
+	if f.key != "" {
+		if err = set(c, f.key, f.pos); err != nil {
+			return
+		}
+	}
+
+	startBody := c.Pos()
+	if position, err = f.body.Compile(c); err != nil {
+		return
+	}
+	endBody := c.Pos()
+
+	c.Emit(code.OpJump, nextPos)
+	exitPos := c.Emit(code.OpPop)
+	c.Emit(code.OpPop)
+	endPos := c.Emit(code.OpNull)
+	c.ReplaceOperands(nextPos, exitPos, nvars)
+
+	err = c.ReplaceContinueOperands(startBody, endBody, endBody)
+	if err != nil {
+		return
+	}
+	err = c.ReplaceBreakOperands(startBody, endBody, exitPos)
+	if err != nil {
+		return
+	}
+
+	c.Bookmark(f.pos)
+	return endPos, nil
+}
+
+func (f ForIn) IsConstExpression() bool {
+	return false
+}
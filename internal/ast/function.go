@@ -11,17 +11,21 @@ import (
 )
 
 type Function struct {
-	body   Node
-	Name   string
-	pos    int
-	params []Identifier
+	body     Node
+	Name     string
+	pos      int
+	params   []Identifier
+	defaults []Node
+	rest     *Identifier
 }
 
-func NewFunction(params []Identifier, body Node, pos int) Node {
+func NewFunction(params []Identifier, defaults []Node, rest *Identifier, body Node, pos int) Node {
 	return Function{
-		params: params,
-		body:   body,
-		pos:    pos,
+		params:   params,
+		defaults: defaults,
+		rest:     rest,
+		body:     body,
+		pos:      pos,
 	}
 }
 
@@ -32,8 +36,15 @@ func (f Function) Eval() (obj.Object, error) {
 func (f Function) String() string {
 	var params []string
 
-	for _, p := range f.params {
-		params = append(params, p.String())
+	for i, p := range f.params {
+		if f.defaults[i] != nil {
+			params = append(params, fmt.Sprintf("%v = %v", p, f.defaults[i]))
+		} else {
+			params = append(params, p.String())
+		}
+	}
+	if f.rest != nil {
+		params = append(params, "..."+f.rest.String())
 	}
 	return fmt.Sprintf("fn(%s) { %v }", strings.Join(params, ", "), f.body)
 }
@@ -45,15 +56,38 @@ func (f Function) Compile(c *compiler.Compiler) (position int, err error) {
 		c.DefineFunctionName(f.Name)
 	}
 
-	for _, p := range f.params {
-		c.Define(p.String())
+	// The parameters that can't be left out are the ones up to the last
+	// with no default.
+	var (
+		required int
+		slots    = make([]int, len(f.params))
+	)
+	for i, p := range f.params {
+		slots[i] = c.Define(p.String()).Index
+		if f.defaults[i] == nil {
+			required = i + 1
+		}
+	}
+	// The rest of the arguments come in the slot after the parameters.
+	if f.rest != nil {
+		c.Define(f.rest.String())
+	}
+
+	for i, d := range f.defaults {
+		if d != nil {
+			if err = compileDefault(c, slots[i], d); err != nil {
+				return
+			}
+		}
 	}
+	prologue := c.Pos()
 
 	if position, err = f.body.Compile(c); err != nil {
 		return
 	}
 
-	if c.LastIs(code.OpPop) {
+	// The pop of the last default is not the value of an empty body.
+	if c.Pos() > prologue && c.LastIs(code.OpPop) {
 		c.ReplaceLastPopWithReturn()
 	}
 	if !c.LastIs(code.OpReturnValue) {
@@ -62,18 +96,39 @@ func (f Function) Compile(c *compiler.Compiler) (position int, err error) {
 
 	freeSymbols := c.FreeSymbols
 	nLocals := c.NumDefs
+	info := c.ScopeInfo()
 	ins, bookmarks := c.LeaveScope()
 
 	for _, s := range freeSymbols {
-		position = c.LoadSymbol(s)
+		position = c.CaptureSymbol(s)
 	}
 
-	fn := obj.NewFunctionCompiled(ins, nLocals, len(f.params), bookmarks)
+	fn := obj.NewFunctionCompiled(ins, nLocals, len(f.params), required, f.rest != nil, bookmarks, f.Name, c.File())
+	c.RecordFunction(fn, info)
 	position = c.Emit(code.OpClosure, c.AddConstant(fn), len(freeSymbols))
 	c.Bookmark(f.pos)
 	return
 }
 
+// compileDefault gives the parameter in the slot idx its default when the call
+// left it out, which makes it null, or passed null, the way the standard
+// library has always said "the default" for arguments it can't go without.
+// The default is worked out at each call, after the ones before it, so that
+// it can use them.
+func compileDefault(c *compiler.Compiler, idx int, def Node) error {
+	c.Emit(code.OpGetLocal, idx)
+	c.Emit(code.OpNull)
+	c.Emit(code.OpEqual)
+	jump := c.Emit(code.OpJumpNotTruthy, compiler.GenericPlaceholder)
+	if _, err := def.Compile(c); err != nil {
+		return err
+	}
+	c.Emit(code.OpSetLocal, idx)
+	c.Emit(code.OpPop)
+	c.ReplaceOperand(jump, c.Pos())
+	return nil
+}
+
 func (f Function) IsConstExpression() bool {
 	return false
 }
@@ -3,6 +3,7 @@ package ast
 import (
 	"errors"
 
+	"github.com/NicoNex/tau/internal/code"
 	"github.com/NicoNex/tau/internal/compiler"
 	"github.com/NicoNex/tau/internal/obj"
 )
@@ -10,6 +11,11 @@ import (
 type Identifier struct {
 	name string
 	pos  int
+	// The value of the constant the name stands for, when the parser already
+	// knew it. The name is then a constant expression like a literal is, and
+	// what it is part of is worked out once, by the compiler.
+	val   obj.Object
+	konst bool
 }
 
 func NewIdentifier(name string, pos int) Identifier {
@@ -19,7 +25,20 @@ func NewIdentifier(name string, pos int) Identifier {
 	}
 }
 
+// NewConstIdentifier is a name that stands for a constant, whose value is val.
+func NewConstIdentifier(name string, val obj.Object, pos int) Identifier {
+	return Identifier{
+		name:  name,
+		pos:   pos,
+		val:   val,
+		konst: true,
+	}
+}
+
 func (i Identifier) Eval() (obj.Object, error) {
+	if i.konst {
+		return i.val, nil
+	}
 	return obj.NullObj, errors.New("ast.Identifier: not a constant expression")
 }
 
@@ -28,6 +47,12 @@ func (i Identifier) String() string {
 }
 
 func (i Identifier) Compile(c *compiler.Compiler) (position int, err error) {
+	if i.konst {
+		position = c.Emit(code.OpConstant, c.AddConstant(i.val))
+		c.Bookmark(i.pos)
+		return position, nil
+	}
+
 	if symbol, ok := c.Resolve(i.name); ok {
 		return c.LoadSymbol(symbol), nil
 	}
@@ -38,5 +63,5 @@ func (i Identifier) Compile(c *compiler.Compiler) (position int, err error) {
 }
 
 func (i Identifier) IsConstExpression() bool {
-	return false
+	return i.konst
 }
@@ -0,0 +1,47 @@
+package ast
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/NicoNex/tau/internal/code"
+	"github.com/NicoNex/tau/internal/compiler"
+	"github.com/NicoNex/tau/internal/obj"
+)
+
+// Nonlocal declares names of the function it is in to be the variables of the
+// same name outside it: assigning one of them changes that variable instead of
+// making a local that hides it.
+type Nonlocal struct {
+	names []string
+	pos   int
+}
+
+func NewNonlocal(names []string, pos int) Node {
+	return Nonlocal{names, pos}
+}
+
+func (n Nonlocal) Eval() (obj.Object, error) {
+	return obj.NullObj, errors.New("ast.Nonlocal: not a constant expression")
+}
+
+func (n Nonlocal) String() string {
+	return "nonlocal " + strings.Join(n.names, ", ")
+}
+
+func (n Nonlocal) Compile(c *compiler.Compiler) (position int, err error) {
+	for _, name := range n.names {
+		if _, err := c.Nonlocal(name); err != nil {
+			return 0, c.NewError(n.pos, "%v", err)
+		}
+	}
+
+	// It is a statement, but everything in a block leaves a value.
+	position = c.Emit(code.OpNull)
+	c.Bookmark(n.pos)
+	return
+}
+
+func (Nonlocal) IsConstExpression() bool {
+	return false
+}
@@ -0,0 +1,177 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/NicoNex/tau/internal/code"
+	"github.com/NicoNex/tau/internal/compiler"
+	"github.com/NicoNex/tau/internal/obj"
+)
+
+// SelectCase is a case of a select: a receive from a pipe or a send to it,
+// with the name that takes what recv or send would have returned, if any.
+type SelectCase struct {
+	target string
+	pipe   Node
+	val    Node
+	body   Node
+}
+
+type Select struct {
+	cases   []SelectCase
+	timeout Node
+	// The body run when no case is ready, either right away if there's a
+	// default or once the timeout has passed.
+	alt Node
+	pos int
+}
+
+func NewRecvCase(target string, pipe, body Node) SelectCase {
+	return SelectCase{target: target, pipe: pipe, body: body}
+}
+
+func NewSendCase(target string, pipe, val, body Node) SelectCase {
+	return SelectCase{target: target, pipe: pipe, val: val, body: body}
+}
+
+func NewSelect(cases []SelectCase, timeout, alt Node, pos int) Node {
+	return Select{
+		cases:   cases,
+		timeout: timeout,
+		alt:     alt,
+		pos:     pos,
+	}
+}
+
+func (s Select) Eval() (obj.Object, error) {
+	return obj.NullObj, errors.New("ast.Select: not a constant expression")
+}
+
+func (s Select) String() string {
+	var b strings.Builder
+
+	b.WriteString("select { ")
+	for _, cs := range s.cases {
+		b.WriteString("case ")
+		if cs.target != "" {
+			fmt.Fprintf(&b, "%s = ", cs.target)
+		}
+		if cs.val != nil {
+			fmt.Fprintf(&b, "send(%v, %v) { %v } ", cs.pipe, cs.val, cs.body)
+		} else {
+			fmt.Fprintf(&b, "recv(%v) { %v } ", cs.pipe, cs.body)
+		}
+	}
+
+	switch {
+	case s.timeout != nil:
+		fmt.Fprintf(&b, "case after(%v) { %v } ", s.timeout, s.alt)
+	case s.alt != nil:
+		fmt.Fprintf(&b, "default { %v } ", s.alt)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// Compile lays the cases on the stack for OpSelect, a kind, a pipe and a value
+// each, and follows it with a table of jumps, one per case and one for when
+// none of them went. The VM takes the jump of the case it picked, which finds
+// what recv or send returned on top of the stack.
+func (s Select) Compile(c *compiler.Compiler) (position int, err error) {
+	if len(s.cases) > 255 {
+		return 0, c.NewError(s.pos, "too many cases in select, at most 255 are allowed")
+	}
+
+	for _, cs := range s.cases {
+		kind := code.SelectRecv
+		if cs.val != nil {
+			kind = code.SelectSend
+		}
+		c.Emit(code.OpConstant, c.AddConstant(obj.NewInteger(int64(kind))))
+
+		if position, err = cs.pipe.Compile(c); err != nil {
+			return
+		}
+		if cs.val == nil {
+			c.Emit(code.OpNull)
+		} else if position, err = cs.val.Compile(c); err != nil {
+			return
+		}
+	}
+
+	var flags int
+	switch {
+	case s.timeout != nil:
+		if position, err = s.timeout.Compile(c); err != nil {
+			return
+		}
+		flags |= code.SelectTimeout
+	case s.alt != nil:
+		flags |= code.SelectDefault
+	}
+	position = c.Emit(code.OpSelect, len(s.cases), flags)
+	c.Bookmark(s.pos)
+
+	table := make([]int, len(s.cases)+1)
+	for i := range table {
+		table[i] = c.Emit(code.OpJump, compiler.GenericPlaceholder)
+	}
+
+	var ends []int
+	for i, cs := range s.cases {
+		c.ReplaceOperand(table[i], c.Pos())
+
+		if cs.target != "" {
+			if err := c.Assignable(cs.target); err != nil {
+				return 0, c.NewError(s.pos, "%v", err)
+			}
+			c.StoreSymbol(c.Define(cs.target))
+		}
+		c.Emit(code.OpPop)
+
+		if err = compileBody(c, cs.body); err != nil {
+			return
+		}
+		ends = append(ends, c.Emit(code.OpJump, compiler.GenericPlaceholder))
+	}
+
+	// Without a default or a timeout the select waits until a case goes, and
+	// the last jump is never taken: the null is the value of a select without
+	// cases, which would be waiting forever anyway.
+	c.ReplaceOperand(table[len(s.cases)], c.Pos())
+	if s.alt != nil {
+		c.Emit(code.OpPop)
+		if err = compileBody(c, s.alt); err != nil {
+			return
+		}
+	}
+
+	for _, e := range ends {
+		c.ReplaceOperand(e, c.Pos())
+	}
+	return c.Pos(), nil
+}
+
+// compileBody compiles the body of a case of a select or a switch so that it
+// leaves its value on the stack, like the branches of an if do. An empty one
+// is null.
+func compileBody(c *compiler.Compiler, body Node) error {
+	start := c.Pos()
+
+	if _, err := body.Compile(c); err != nil {
+		return err
+	}
+
+	if c.Pos() == start {
+		c.Emit(code.OpNull)
+	} else if c.LastIs(code.OpPop) {
+		c.RemoveLast()
+	}
+	return nil
+}
+
+func (s Select) IsConstExpression() bool {
+	return false
+}
@@ -0,0 +1,47 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/NicoNex/tau/internal/compiler"
+	"github.com/NicoNex/tau/internal/obj"
+)
+
+// Spread is ...list among the arguments of a call: the elements of the list
+// given one by one. A call compiles the list itself, so a Spread that gets
+// compiled is one written anywhere else.
+type Spread struct {
+	list Node
+	pos  int
+}
+
+func NewSpread(list Node, pos int) Node {
+	return Spread{list, pos}
+}
+
+func (s Spread) Eval() (obj.Object, error) {
+	return obj.NullObj, errors.New("ast.Spread: not a constant expression")
+}
+
+func (s Spread) String() string {
+	return fmt.Sprintf("...%v", s.list)
+}
+
+func (s Spread) Compile(c *compiler.Compiler) (position int, err error) {
+	return 0, c.NewError(s.pos, "... outside of the arguments of a call")
+}
+
+func (Spread) IsConstExpression() bool {
+	return false
+}
+
+// spreads reports whether any of the arguments is spread.
+func spreads(args []Node) bool {
+	for _, a := range args {
+		if _, ok := a.(Spread); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -3,6 +3,7 @@ package ast
 import (
 	"errors"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -257,13 +258,25 @@ func (i *interpolator) nodes() ([]Node, string, error) {
 				continue
 			}
 
+			s, spec := splitSpec(s)
+			if spec != "" && !specRe.MatchString(spec) {
+				return []Node{}, "", fmt.Errorf("bad format %q in interpolation", spec)
+			}
+
 			// Parse the code
 			tree, errs := i.parse(i.file, s)
 			if len(errs) > 0 {
 				return []Node{}, "", i.parserError(errs)
 			}
 
+			// A plain value is a 0xff in the string the VM fills in, one with
+			// a format has it between a 0xfe and the 0xff. Neither byte is
+			// ever part of UTF-8 text.
 			nodes = append(nodes, tree)
+			if spec != "" {
+				i.WriteByte(0xfe)
+				i.WriteString(spec)
+			}
 			i.WriteByte(0xff)
 			continue
 		} else if r == '}' {
@@ -280,6 +293,50 @@ func (i *interpolator) nodes() ([]Node, string, error) {
 	return nodes, i.String(), nil
 }
 
+// specRe is what a format after the colon looks like: the flags, the width,
+// the precision and the verb of sprintf.
+var specRe = regexp.MustCompile(`^[-+ #0]*[0-9]*(\.[0-9]*)?[dxXobfeEgGsqvT]$`)
+
+// splitSpec splits the format off the code of an interpolation, "x:08.3f"
+// into "x" and "08.3f". A colon outside brackets and strings is never part of
+// an expression: in tau it is only found between the key and the value of a
+// map, which are inside braces.
+func splitSpec(s string) (expr, spec string) {
+	var (
+		depth   int
+		quote   byte
+		colon   = -1
+		escaped bool
+	)
+
+	for j := 0; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case quote != 0:
+			if escaped {
+				escaped = false
+			} else if c == '\\' && quote == '"' {
+				escaped = true
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '`':
+			quote = c
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+		case c == ':' && depth == 0:
+			colon = j
+		}
+	}
+
+	if colon < 0 {
+		return s, ""
+	}
+	return s[:colon], s[colon+1:]
+}
+
 func (i *interpolator) parserError(errs []error) error {
 	var buf strings.Builder
 
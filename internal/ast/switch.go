@@ -0,0 +1,394 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/NicoNex/tau/internal/code"
+	"github.com/NicoNex/tau/internal/compiler"
+	"github.com/NicoNex/tau/internal/obj"
+)
+
+// SwitchCase is a case of a switch: the values or the patterns it matches,
+// any of them, and the guard that has to hold as well, if there is one.
+type SwitchCase struct {
+	values []Node
+	guard  Node
+	body   Node
+}
+
+// Switch is a switch on the value of subject, or on conditions when subject is
+// nil. Its value is the one of the body that ran, null if none did.
+type Switch struct {
+	subject Node
+	cases   []SwitchCase
+	alt     Node
+	pos     int
+}
+
+// A switch on integer constants goes through a table, a jump for each number
+// from the lowest to the highest, when it has at least this many of them and
+// no more than half of the table is holes.
+const minTableCases = 4
+
+func NewSwitchCase(values []Node, guard, body Node) SwitchCase {
+	return SwitchCase{values: values, guard: guard, body: body}
+}
+
+func NewSwitch(subject Node, cases []SwitchCase, alt Node, pos int) Node {
+	return Switch{
+		subject: subject,
+		cases:   cases,
+		alt:     alt,
+		pos:     pos,
+	}
+}
+
+func (s Switch) Eval() (obj.Object, error) {
+	return obj.NullObj, errors.New("ast.Switch: not a constant expression")
+}
+
+func (s Switch) String() string {
+	var b strings.Builder
+
+	b.WriteString("switch ")
+	if s.subject != nil {
+		fmt.Fprintf(&b, "%v ", s.subject)
+	}
+	b.WriteString("{ ")
+	for _, cs := range s.cases {
+		var vals []string
+		for _, v := range cs.values {
+			vals = append(vals, v.String())
+		}
+		fmt.Fprintf(&b, "case %s ", strings.Join(vals, ", "))
+		if cs.guard != nil {
+			fmt.Fprintf(&b, "if %v ", cs.guard)
+		}
+		fmt.Fprintf(&b, "{ %v } ", cs.body)
+	}
+	if s.alt != nil {
+		fmt.Fprintf(&b, "default { %v } ", s.alt)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func (s Switch) Compile(c *compiler.Compiler) (position int, err error) {
+	switch lo, n, ok := s.table(); {
+	case s.subject == nil:
+		position, err = s.compileConds(c)
+	case ok:
+		position, err = s.compileTable(c, lo, n)
+	default:
+		position, err = s.compileMatch(c)
+	}
+	if err != nil {
+		return
+	}
+	c.Bookmark(s.pos)
+	return
+}
+
+// compileConds compiles a switch with no subject, where every case is a list
+// of conditions and runs when any of them holds: an if/else if chain.
+func (s Switch) compileConds(c *compiler.Compiler) (position int, err error) {
+	var ends []int
+
+	for _, cs := range s.cases {
+		var toBody []int
+
+		for _, v := range cs.values {
+			if _, err = v.Compile(c); err != nil {
+				return
+			}
+			next := c.Emit(code.OpJumpNotTruthy, compiler.GenericPlaceholder)
+			toBody = append(toBody, c.Emit(code.OpJump, compiler.GenericPlaceholder))
+			c.ReplaceOperand(next, c.Pos())
+		}
+		nextCase := []int{c.Emit(code.OpJump, compiler.GenericPlaceholder)}
+
+		for _, j := range toBody {
+			c.ReplaceOperand(j, c.Pos())
+		}
+		end, err := s.compileCaseBody(c, cs, &nextCase, false)
+		if err != nil {
+			return 0, err
+		}
+		ends = append(ends, end)
+
+		for _, j := range nextCase {
+			c.ReplaceOperand(j, c.Pos())
+		}
+	}
+	return s.compileDefault(c, ends, false)
+}
+
+// compileMatch compiles a switch on a value that is kept on the stack while
+// the cases are tried in turn, and dropped once one of them matched or none
+// did. Every alternative of a case is tried on a copy of it.
+func (s Switch) compileMatch(c *compiler.Compiler) (position int, err error) {
+	var ends []int
+
+	if _, err = s.subject.Compile(c); err != nil {
+		return
+	}
+
+	for _, cs := range s.cases {
+		var toBody []int
+
+		for _, v := range cs.values {
+			var fails []failJump
+
+			c.Emit(code.OpDup)
+			if err = matchPattern(c, v, 2, false, &fails); err != nil {
+				return
+			}
+			toBody = append(toBody, c.Emit(code.OpJump, compiler.GenericPlaceholder))
+			landFails(c, fails)
+		}
+		nextCase := []int{c.Emit(code.OpJump, compiler.GenericPlaceholder)}
+
+		for _, j := range toBody {
+			c.ReplaceOperand(j, c.Pos())
+		}
+		end, err := s.compileCaseBody(c, cs, &nextCase, true)
+		if err != nil {
+			return 0, err
+		}
+		ends = append(ends, end)
+
+		for _, j := range nextCase {
+			c.ReplaceOperand(j, c.Pos())
+		}
+	}
+	return s.compileDefault(c, ends, true)
+}
+
+// compileCaseBody compiles the guard of a case, which jumps to the next case
+// when it doesn't hold, and its body, with the subject dropped first if there
+// is one on the stack. It returns the jump out of the switch at its end.
+func (s Switch) compileCaseBody(c *compiler.Compiler, cs SwitchCase, nextCase *[]int, drop bool) (int, error) {
+	if cs.guard != nil {
+		if _, err := cs.guard.Compile(c); err != nil {
+			return 0, err
+		}
+		*nextCase = append(*nextCase, c.Emit(code.OpJumpNotTruthy, compiler.GenericPlaceholder))
+	}
+	if drop {
+		c.Emit(code.OpPop)
+	}
+	if err := compileBody(c, cs.body); err != nil {
+		return 0, err
+	}
+	return c.Emit(code.OpJump, compiler.GenericPlaceholder), nil
+}
+
+// compileDefault compiles what runs when no case did, the default or null,
+// and points the jumps at the end of the cases past it.
+func (s Switch) compileDefault(c *compiler.Compiler, ends []int, drop bool) (int, error) {
+	if drop {
+		c.Emit(code.OpPop)
+	}
+	if s.alt != nil {
+		if err := compileBody(c, s.alt); err != nil {
+			return 0, err
+		}
+	} else {
+		c.Emit(code.OpNull)
+	}
+
+	for _, e := range ends {
+		c.ReplaceOperand(e, c.Pos())
+	}
+	return c.Pos(), nil
+}
+
+// table reports whether the switch can go through a jump table, and the
+// lowest number and how many there are from it to the highest if it can.
+func (s Switch) table() (lo int64, n int, ok bool) {
+	var vals []int64
+
+	if s.subject == nil {
+		return 0, 0, false
+	}
+	for _, cs := range s.cases {
+		if cs.guard != nil {
+			return 0, 0, false
+		}
+		for _, v := range cs.values {
+			i, isInt := intConst(v)
+			if !isInt {
+				return 0, 0, false
+			}
+			vals = append(vals, i)
+		}
+	}
+	if len(vals) < minTableCases {
+		return 0, 0, false
+	}
+
+	sort.Slice(vals, func(i, j int) bool { return vals[i] < vals[j] })
+	lo, hi := vals[0], vals[len(vals)-1]
+	if hi-lo < 0 || hi-lo >= int64(2*len(vals)) || hi-lo >= 1<<16-1 {
+		return 0, 0, false
+	}
+	return lo, int(hi-lo) + 1, true
+}
+
+// intConst returns the value of n if it is an integer the compiler can work
+// out, which -1 is as well as 1.
+func intConst(n Node) (int64, bool) {
+	if !n.IsConstExpression() {
+		return 0, false
+	}
+	o, err := n.Eval()
+	if err != nil || o.Type() != obj.IntType {
+		return 0, false
+	}
+	return o.Int(), true
+}
+
+// compileTable compiles a switch on integer constants to OpSwitchTable, which
+// takes the subject off the stack and one of the jumps after it: one for
+// every number from lo on, and the last one for the default. A number that
+// two cases have goes to the first, as it would with ==.
+func (s Switch) compileTable(c *compiler.Compiler, lo int64, n int) (position int, err error) {
+	var ends []int
+
+	if _, err = s.subject.Compile(c); err != nil {
+		return
+	}
+	c.Emit(code.OpSwitchTable, c.AddConstant(obj.NewInteger(lo)), n)
+
+	table := make([]int, n+1)
+	for i := range table {
+		table[i] = c.Emit(code.OpJump, compiler.GenericPlaceholder)
+	}
+
+	target := make([]int, n+1)
+	for i := range target {
+		target[i] = -1
+	}
+	for _, cs := range s.cases {
+		start := c.Pos()
+		for _, v := range cs.values {
+			i, _ := intConst(v)
+			if target[i-lo] < 0 {
+				target[i-lo] = start
+			}
+		}
+		if err = compileBody(c, cs.body); err != nil {
+			return
+		}
+		ends = append(ends, c.Emit(code.OpJump, compiler.GenericPlaceholder))
+	}
+
+	alt := c.Pos()
+	for i, j := range table {
+		if target[i] < 0 {
+			target[i] = alt
+		}
+		c.ReplaceOperand(j, target[i])
+	}
+	return s.compileDefault(c, ends, false)
+}
+
+func (s Switch) IsConstExpression() bool {
+	return false
+}
+
+// A jump taken when a pattern doesn't match, and how many values are on the
+// stack at that point, the subject of the switch included.
+type failJump struct {
+	pos    int
+	height int
+}
+
+// matchPattern matches p against the value on top of the stack, which is
+// height values high, and takes the value off. A list or a map is a pattern
+// for a value of that shape, made of more patterns; inside one of them a name
+// takes the value it stands for, and _ takes none. Anything else is a value
+// the one on the stack has to be equal to, names at the top of a case too.
+// The jumps taken when the value doesn't match go to fails.
+func matchPattern(c *compiler.Compiler, p Node, height int, nested bool, fails *[]failJump) error {
+	switch p := p.(type) {
+	case Identifier:
+		if !nested {
+			break
+		}
+		if p.String() == "_" {
+			c.Emit(code.OpPop)
+			return nil
+		}
+		return set(c, p.String(), p.pos)
+
+	case List:
+		if len(p) > 255 {
+			return fmt.Errorf("too many elements in a list pattern, at most 255 are allowed")
+		}
+		c.Emit(code.OpMatchList, len(p))
+		*fails = append(*fails, failJump{c.Emit(code.OpJumpNotTruthy, compiler.GenericPlaceholder), height})
+
+		height += len(p) - 1
+		for _, e := range p {
+			if err := matchPattern(c, e, height, true, fails); err != nil {
+				return err
+			}
+			height--
+		}
+		return nil
+
+	case Map:
+		if len(p.m) > 255 {
+			return fmt.Errorf("too many keys in a map pattern, at most 255 are allowed")
+		}
+		for _, kv := range p.m {
+			if _, err := kv[0].Compile(c); err != nil {
+				return err
+			}
+		}
+		c.Emit(code.OpMatchMap, len(p.m))
+		*fails = append(*fails, failJump{c.Emit(code.OpJumpNotTruthy, compiler.GenericPlaceholder), height})
+
+		height += len(p.m) - 1
+		for _, kv := range p.m {
+			if err := matchPattern(c, kv[1], height, true, fails); err != nil {
+				return err
+			}
+			height--
+		}
+		return nil
+	}
+
+	if _, err := p.Compile(c); err != nil {
+		return err
+	}
+	c.Emit(code.OpEqual)
+	*fails = append(*fails, failJump{c.Emit(code.OpJumpNotTruthy, compiler.GenericPlaceholder), height - 1})
+	return nil
+}
+
+// landFails lays out where the jumps of a pattern that didn't match land: a
+// run of pops that leaves the subject of the switch alone on the stack, which
+// each jump enters at the height it left from, so that what follows tries the
+// next alternative as the first was tried.
+func landFails(c *compiler.Compiler, fails []failJump) {
+	var top int
+	for _, f := range fails {
+		top = max(top, f.height)
+	}
+
+	for h := top; h >= 1; h-- {
+		for _, f := range fails {
+			if f.height == h {
+				c.ReplaceOperand(f.pos, c.Pos())
+			}
+		}
+		if h > 1 {
+			c.Emit(code.OpPop)
+		}
+	}
+}
@@ -16,13 +16,16 @@ import (
 
 // Magic marks a bundle. Plain bytecode does not have it, so both kinds can be
 // told apart and keep working.
-var Magic = []byte("TAUB\x03")
+var Magic = []byte("TAUB\x04")
 
 // A Bundle is a compiled program together with everything it needs at run
 // time: every module it imports, already compiled, and the shared objects
 // those modules load. Running one touches nothing else on the filesystem and
 // asks nothing of the parser or the compiler.
 type Bundle struct {
+	// The source file of the program, which its runtime errors and its
+	// traces point at wherever the bundle runs from.
+	File     string
 	Bytecode []byte
 	// The modules in the order they have to be loaded, dependencies first. A
 	// module is compiled knowing how many globals and constants come before
@@ -39,6 +42,9 @@ type Bundle struct {
 type ModuleCode struct {
 	Bytecode []byte
 	Exports  map[string]int
+	// The exported names that are constants, which the program importing the
+	// module can't assign.
+	Consts map[string]bool
 }
 
 // bundledModules hands the runtime what it needs of each module: the bundle
@@ -47,7 +53,7 @@ func bundledModules(mods map[string]ModuleCode) map[string]vm.BundledModule {
 	out := make(map[string]vm.BundledModule, len(mods))
 
 	for name, m := range mods {
-		out[name] = vm.BundledModule{Bytecode: m.Bytecode, Exports: m.Exports}
+		out[name] = vm.BundledModule{Bytecode: m.Bytecode, Exports: m.Exports, Consts: m.Consts}
 	}
 	return out
 }
@@ -72,14 +78,15 @@ func Is(b []byte) bool {
 	return bytes.HasPrefix(b, Magic)
 }
 
-// openBundle unpacks a bundle: its modules go to the importer, its plugins to
-// a directory the loader is pointed at, and the bytecode comes back ready to
-// run. The returned function removes what was written.
-func Open(raw []byte) (compiler.Bytecode, func(), error) {
+// Open unpacks a bundle: its modules go to the importer, its plugins to a
+// directory the loader is pointed at, and the bytecode comes back ready to
+// run, with the name of the file it was compiled from. The returned function
+// removes what was written.
+func Open(raw []byte) (compiler.Bytecode, string, func(), error) {
 	var b Bundle
 
 	if err := b.decode(raw[len(Magic):]); err != nil {
-		return compiler.Bytecode{}, nil, err
+		return compiler.Bytecode{}, "", nil, err
 	}
 	vm.SetBundledModules(b.Order, bundledModules(b.Modules))
 
@@ -87,7 +94,7 @@ func Open(raw []byte) (compiler.Bytecode, func(), error) {
 	if len(b.Plugins) > 0 {
 		dir, err := os.MkdirTemp("", "tau-plugins")
 		if err != nil {
-			return compiler.Bytecode{}, nil, err
+			return compiler.Bytecode{}, "", nil, err
 		}
 		clean = func() { os.RemoveAll(dir) }
 
@@ -95,12 +102,12 @@ func Open(raw []byte) (compiler.Bytecode, func(), error) {
 			dst := filepath.Join(dir, name)
 			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
 				clean()
-				return compiler.Bytecode{}, nil, err
+				return compiler.Bytecode{}, "", nil, err
 			}
 			// Executable: it is about to be dlopen'd.
 			if err := os.WriteFile(dst, so, 0755); err != nil {
 				clean()
-				return compiler.Bytecode{}, nil, err
+				return compiler.Bytecode{}, "", nil, err
 			}
 		}
 
@@ -111,5 +118,5 @@ func Open(raw []byte) (compiler.Bytecode, func(), error) {
 		os.Setenv("TAUPATH", taupath)
 	}
 
-	return compiler.DecodeBytecode(b.Bytecode), clean, nil
+	return compiler.DecodeBytecode(b.Bytecode), b.File, clean, nil
 }
@@ -13,6 +13,7 @@ import (
 // modules come in the order they have to be loaded, which is the order they
 // were compiled for:
 //
+//	the name of the source file of the program
 //	uint32 nmodules
 //	  for each: name, bytecode, uint32 nexports, for each: name, uint32 index
 //	uint32 nplugins
@@ -27,6 +28,7 @@ import (
 func (b Bundle) Encode() []byte {
 	var buf []byte
 
+	buf = appendBlob(buf, []byte(b.File))
 	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b.Order)))
 	for _, name := range b.Order {
 		m := b.Modules[name]
@@ -39,6 +41,11 @@ func (b Bundle) Encode() []byte {
 		for _, exp := range sortedKeys(m.Exports) {
 			buf = appendBlob(buf, []byte(exp))
 			buf = binary.BigEndian.AppendUint32(buf, uint32(m.Exports[exp]))
+			if m.Consts[exp] {
+				buf = append(buf, 1)
+			} else {
+				buf = append(buf, 0)
+			}
 		}
 	}
 
@@ -55,17 +62,21 @@ func (b Bundle) Encode() []byte {
 func (b *Bundle) decode(raw []byte) error {
 	r := &reader{buf: raw}
 
+	b.File = string(r.blob())
 	nmods := r.uint32()
 	b.Order = make([]string, 0, nmods)
 	b.Modules = make(map[string]ModuleCode, nmods)
 
 	for i := uint32(0); i < nmods; i++ {
 		name := string(r.blob())
-		m := ModuleCode{Bytecode: r.blob(), Exports: map[string]int{}}
+		m := ModuleCode{Bytecode: r.blob(), Exports: map[string]int{}, Consts: map[string]bool{}}
 
 		for n := r.uint32(); n > 0; n-- {
 			exp := string(r.blob())
 			m.Exports[exp] = int(r.uint32())
+			if r.byte() == 1 {
+				m.Consts[exp] = true
+			}
 		}
 
 		b.Order = append(b.Order, name)
@@ -133,6 +144,14 @@ func (r *reader) uint32() uint32 {
 	return binary.BigEndian.Uint32(b)
 }
 
+func (r *reader) byte() byte {
+	b := r.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
 func (r *reader) blob() []byte { return r.take(int(r.uint32())) }
 
 func (r *reader) rest() []byte {
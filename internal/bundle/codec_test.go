@@ -0,0 +1,38 @@
+package bundle
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	b := Bundle{
+		File:     "prog.tau",
+		Bytecode: []byte("the program"),
+		Order:    []string{"strings"},
+		Modules: map[string]ModuleCode{
+			"strings": {Bytecode: []byte("the module"), Exports: map[string]int{"Join": 3}, Consts: map[string]bool{}},
+		},
+		Plugins: map[string][]byte{"lib.so": []byte("the plugin")},
+	}
+
+	var got Bundle
+	if err := got.decode(b.Encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file is what the errors of the program point at once it runs out
+	// of the bundle, wherever that is.
+	if got.File != b.File {
+		t.Errorf("file %q, want %q", got.File, b.File)
+	}
+	if !bytes.Equal(got.Bytecode, b.Bytecode) {
+		t.Errorf("bytecode %q, want %q", got.Bytecode, b.Bytecode)
+	}
+	if m := got.Modules["strings"]; !bytes.Equal(m.Bytecode, []byte("the module")) || m.Exports["Join"] != 3 {
+		t.Errorf("module %+v", m)
+	}
+	if !bytes.Equal(got.Plugins["lib.so"], []byte("the plugin")) {
+		t.Errorf("plugin %q", got.Plugins["lib.so"])
+	}
+}
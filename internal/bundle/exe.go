@@ -108,17 +108,13 @@ func RunEmbedded() error {
 		return err
 	}
 
-	bytecode, clean, err := Open(raw)
+	bytecode, file, clean, err := Open(raw)
 	if err != nil {
 		return err
 	}
 	defer clean()
 
-	self, err := os.Executable()
-	if err != nil {
-		self = os.Args[0]
-	}
-	return Run(self, bytecode)
+	return Run(file, bytecode)
 }
 
 
@@ -72,6 +72,43 @@ const (
 	OpGetFree
 	OpLoadModule
 	OpInterpolate
+	OpSelect
+	OpIter
+	OpIterNext
+	OpUnpack
+	OpUnpackFields
+	OpDup
+	OpMatchList
+	OpMatchMap
+	OpSwitchTable
+	OpDefer
+	OpCallSpread
+	OpSetFree
+	OpCaptureLocal
+	OpCaptureFree
+
+	// Made by the optimizer only, each out of a few instructions the
+	// compiler writes one after the other, see compiler/optimize.go.
+	OpLocalConst
+	OpUpdateLocal
+	OpCompareJump
+
+	// A call whose value is returned right away, which reuses the frame of
+	// the function making it.
+	OpTailCall
+)
+
+// The flags of OpSelect: whether it has a default case or a timeout, which is
+// then on the stack above the cases.
+const (
+	SelectDefault = 1 << iota
+	SelectTimeout
+)
+
+// The kinds of the cases of a select, as the VM finds them on the stack.
+const (
+	SelectRecv = iota
+	SelectSend
 )
 
 var definitions = map[Opcode]*Definition{
@@ -119,16 +156,36 @@ var definitions = map[Opcode]*Definition{
 	OpJump:          {"OpJump", []int{2}},
 	OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
 
-	OpDot:         {"OpDot", []int{}},
-	OpDefine:      {"OpDefine", []int{}},
-	OpGetGlobal:   {"OpGetGlobal", []int{2}},
-	OpSetGlobal:   {"OpSetGlobal", []int{2}},
-	OpGetLocal:    {"OpGetLocal", []int{1}},
-	OpSetLocal:    {"OpSetLocal", []int{1}},
-	OpGetBuiltin:  {"OpGetBuiltin", []int{1}},
-	OpGetFree:     {"OpGetFree", []int{1}},
-	OpLoadModule:  {"OpLoadModule", []int{}},
-	OpInterpolate: {"OpInterpolate", []int{2, 2}},
+	OpDot:          {"OpDot", []int{}},
+	OpDefine:       {"OpDefine", []int{}},
+	OpGetGlobal:    {"OpGetGlobal", []int{2}},
+	OpSetGlobal:    {"OpSetGlobal", []int{2}},
+	OpGetLocal:     {"OpGetLocal", []int{1}},
+	OpSetLocal:     {"OpSetLocal", []int{1}},
+	OpGetBuiltin:   {"OpGetBuiltin", []int{1}},
+	OpGetFree:      {"OpGetFree", []int{1}},
+	OpLoadModule:   {"OpLoadModule", []int{}},
+	OpInterpolate:  {"OpInterpolate", []int{2, 2}},
+	OpSelect:       {"OpSelect", []int{1, 1}},
+	OpIter:         {"OpIter", []int{}},
+	OpIterNext:     {"OpIterNext", []int{2, 1}},
+	OpUnpack:       {"OpUnpack", []int{1}},
+	OpUnpackFields: {"OpUnpackFields", []int{1}},
+	OpDup:          {"OpDup", []int{}},
+	OpMatchList:    {"OpMatchList", []int{1}},
+	OpMatchMap:     {"OpMatchMap", []int{1}},
+	OpSwitchTable:  {"OpSwitchTable", []int{2, 2}},
+	OpDefer:        {"OpDefer", []int{1}},
+	OpCallSpread:   {"OpCallSpread", []int{1}},
+	OpSetFree:      {"OpSetFree", []int{1}},
+	OpCaptureLocal: {"OpCaptureLocal", []int{1, 1}},
+	OpCaptureFree:  {"OpCaptureFree", []int{1, 1}},
+
+	OpLocalConst:  {"OpLocalConst", []int{1, 2, 1}},
+	OpUpdateLocal: {"OpUpdateLocal", []int{1, 2, 1}},
+	OpCompareJump: {"OpCompareJump", []int{1, 2}},
+
+	OpTailCall: {"OpTailCall", []int{1}},
 }
 
 func (ins Instructions) String() string {
@@ -166,6 +223,9 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 	case 2:
 		return fmt.Sprintf("%s %d %d", def.Name, operands[0], operands[1])
 
+	case 3:
+		return fmt.Sprintf("%s %d %d %d", def.Name, operands[0], operands[1], operands[2])
+
 	default:
 		return fmt.Sprintf("error: unhandled operand count for %s\n", def.Name)
 	}
@@ -54,11 +54,29 @@ func _() {
 	_ = x[OpGetFree-43]
 	_ = x[OpLoadModule-44]
 	_ = x[OpInterpolate-45]
+	_ = x[OpSelect-46]
+	_ = x[OpIter-47]
+	_ = x[OpIterNext-48]
+	_ = x[OpUnpack-49]
+	_ = x[OpUnpackFields-50]
+	_ = x[OpDup-51]
+	_ = x[OpMatchList-52]
+	_ = x[OpMatchMap-53]
+	_ = x[OpSwitchTable-54]
+	_ = x[OpDefer-55]
+	_ = x[OpCallSpread-56]
+	_ = x[OpSetFree-57]
+	_ = x[OpCaptureLocal-58]
+	_ = x[OpCaptureFree-59]
+	_ = x[OpLocalConst-60]
+	_ = x[OpUpdateLocal-61]
+	_ = x[OpCompareJump-62]
+	_ = x[OpTailCall-63]
 }
 
-const _Opcode_name = "OpHaltOpPopOpConstantOpTrueOpFalseOpNullOpListOpMapOpClosureOpCurrentClosureOpAddOpSubOpMulOpDivOpModOpBwAndOpBwOrOpBwXorOpBwNotOpBwLShiftOpBwRShiftOpAndOpOrOpEqualOpNotEqualOpGreaterThanOpGreaterThanEqualOpMinusOpBangOpIndexOpCallOpConcurrentCallOpReturnOpReturnValueOpJumpOpJumpNotTruthyOpDotOpDefineOpGetGlobalOpSetGlobalOpGetLocalOpSetLocalOpGetBuiltinOpGetFreeOpLoadModuleOpInterpolate"
+const _Opcode_name = "OpHaltOpPopOpConstantOpTrueOpFalseOpNullOpListOpMapOpClosureOpCurrentClosureOpAddOpSubOpMulOpDivOpModOpBwAndOpBwOrOpBwXorOpBwNotOpBwLShiftOpBwRShiftOpAndOpOrOpEqualOpNotEqualOpGreaterThanOpGreaterThanEqualOpMinusOpBangOpIndexOpCallOpConcurrentCallOpReturnOpReturnValueOpJumpOpJumpNotTruthyOpDotOpDefineOpGetGlobalOpSetGlobalOpGetLocalOpSetLocalOpGetBuiltinOpGetFreeOpLoadModuleOpInterpolateOpSelectOpIterOpIterNextOpUnpackOpUnpackFieldsOpDupOpMatchListOpMatchMapOpSwitchTableOpDeferOpCallSpreadOpSetFreeOpCaptureLocalOpCaptureFreeOpLocalConstOpUpdateLocalOpCompareJumpOpTailCall"
 
-var _Opcode_index = [...]uint16{0, 6, 11, 21, 27, 34, 40, 46, 51, 60, 76, 81, 86, 91, 96, 101, 108, 114, 121, 128, 138, 148, 153, 157, 164, 174, 187, 205, 212, 218, 225, 231, 247, 255, 268, 274, 289, 294, 302, 313, 324, 334, 344, 356, 365, 377, 390}
+var _Opcode_index = [...]uint16{0, 6, 11, 21, 27, 34, 40, 46, 51, 60, 76, 81, 86, 91, 96, 101, 108, 114, 121, 128, 138, 148, 153, 157, 164, 174, 187, 205, 212, 218, 225, 231, 247, 255, 268, 274, 289, 294, 302, 313, 324, 334, 344, 356, 365, 377, 390, 398, 404, 414, 422, 436, 441, 452, 462, 475, 482, 494, 503, 517, 530, 542, 555, 568, 578}
 
 func (i Opcode) String() string {
 	if i >= Opcode(len(_Opcode_index)-1) {
@@ -53,6 +53,17 @@ static inline void write_uint64(struct buffer *buf, uint64_t n) {
 	write_uint32(buf, n);
 }
 
+// A string that may be missing, written as its length and 0 for NULL, the
+// way the file of a bookmark is.
+static inline void encode_cstring(struct buffer *buf, const char *str) {
+	uint32_t len = str != NULL ? strlen(str) : 0;
+
+	write_uint32(buf, len);
+	if (len > 0) {
+		write_string(buf, str, len);
+	}
+}
+
 static inline void encode_bookmarks(struct buffer *buf, struct bookmark *bookmarks, size_t len) {
 	for (int i = 0; i < len; i++) {
 		struct bookmark b = bookmarks[i];
@@ -93,11 +104,15 @@ static inline void encode_objects(struct buffer *buf, struct object *objs, size_
 		case obj_function: {
 			struct function *fn = o.data.fn;
 			write_uint32(buf, fn->num_params);
+			write_uint32(buf, fn->num_required);
+			write_byte(buf, fn->variadic);
 			write_uint32(buf, fn->num_locals);
 			write_uint32(buf, fn->len);
 			write_bytes(buf, fn->instructions, fn->len);
 			write_uint32(buf, fn->bklen);
 			encode_bookmarks(buf, fn->bookmarks, fn->bklen);
+			encode_cstring(buf, fn->name);
+			encode_cstring(buf, fn->file);
 			break;
 		}
 		default:
@@ -163,6 +178,11 @@ static inline char *read_string(struct reader *r, size_t len) {
 	return str;
 }
 
+static inline char *decode_cstring(struct reader *r) {
+	uint32_t len = read_uint32(r);
+	return len > 0 ? read_string(r, len) : NULL;
+}
+
 static inline struct bookmark *decode_bookmarks(struct reader *r, size_t len) {
 	struct bookmark *bms = malloc(sizeof(struct bookmark) * len);
 
@@ -214,12 +234,21 @@ static inline struct object *decode_objects(struct reader *r, size_t len) {
 		}
 		case obj_function: {
 			uint32_t nparams = read_uint32(r);
+			uint32_t nrequired = read_uint32(r);
+			uint8_t variadic = read_byte(r);
 			uint32_t nlocals = read_uint32(r);
 			uint32_t len = read_uint32(r);
 			uint8_t *insts = read_bytes(r, len);
 			uint32_t bklen = read_uint32(r);
 			struct bookmark *bmarks = decode_bookmarks(r, bklen);
-			objs[i] = new_function_obj(insts, len, nlocals, nparams, bmarks, bklen);
+			char *name = decode_cstring(r);
+			char *file = decode_cstring(r);
+			objs[i] = new_function_obj(insts, len, nlocals, nparams, bmarks, bklen, name, file);
+			objs[i].data.fn->num_required = nrequired;
+			objs[i].data.fn->variadic = variadic;
+			// new_function_obj keeps copies of its own.
+			free(name);
+			free(file);
 			break;
 		}
 		default:
@@ -41,7 +41,11 @@ type Compiler struct {
 	constBase int
 	// The file being compiled when a module is made of more than one, empty
 	// for the usual case of a program or a module that is a single file.
-	partFile    string
+	partFile string
+	// Every file compiled into this unit, for the debugger.
+	parts []string
+	// Whether this is a module, compiled to run on top of a program.
+	module      bool
 	scopes      []CompilationScope
 	scopeIndex  int
 	fileName    string
@@ -90,6 +94,7 @@ func NewImport(numDefs, numConsts int) *Compiler {
 		SymbolTable: st,
 		scopes:      []CompilationScope{{}},
 		constBase:   numConsts,
+		module:      true,
 	}
 }
 
@@ -151,6 +156,13 @@ func (c *Compiler) ReplaceOperand(opPos, operand int) {
 	c.replaceInstruction(opPos, newInst)
 }
 
+// ReplaceOperands is ReplaceOperand for an instruction with more than one
+// operand, which are all written again.
+func (c *Compiler) ReplaceOperands(opPos int, operands ...int) {
+	op := code.Opcode(c.scopes[c.scopeIndex].instructions[opPos])
+	c.replaceInstruction(opPos, code.Make(op, operands...))
+}
+
 func (c *Compiler) ReplaceContinueOperands(startBody, endBody, operand int) error {
 	ins := c.scopes[c.scopeIndex].instructions
 	l := len(ins)
@@ -216,8 +228,8 @@ func (c *Compiler) EnterScope() {
 }
 
 func (c *Compiler) LeaveScope() (code.Instructions, []tauerr.Bookmark) {
-	ins := c.scopes[c.scopeIndex].instructions
-	bookmarks := c.scopes[c.scopeIndex].bookmarks
+	tailCalls(c.scopes[c.scopeIndex].instructions)
+	ins, bookmarks := c.optimize(c.scopes[c.scopeIndex].instructions, c.scopes[c.scopeIndex].bookmarks)
 	c.scopes = c.scopes[:len(c.scopes)-1]
 	c.scopeIndex--
 	c.SymbolTable = c.SymbolTable.outer
@@ -225,6 +237,12 @@ func (c *Compiler) LeaveScope() (code.Instructions, []tauerr.Bookmark) {
 	return ins, bookmarks
 }
 
+// InFunction reports whether what is being compiled is the body of a function
+// rather than the top level of a file.
+func (c *Compiler) InFunction() bool {
+	return c.scopeIndex > 0
+}
+
 // Returns the position to the last instruction.
 func (c *Compiler) Pos() int {
 	return len(c.scopes[c.scopeIndex].instructions)
@@ -292,6 +310,10 @@ func (c *Compiler) Finish() error {
 	if name, pos, ok := c.Pending(); ok {
 		return c.UnresolvedError(name, pos)
 	}
+	c.recordGlobals()
+
+	s := &c.scopes[c.scopeIndex]
+	s.instructions, s.bookmarks = c.optimize(s.instructions, s.bookmarks)
 	return nil
 }
 
@@ -306,6 +328,21 @@ func (c *Compiler) SetFileInfo(name, content string) {
 func (c *Compiler) SetPartInfo(name, content string) {
 	c.SetFileInfo(name, content)
 	c.partFile = name
+	c.parts = append(c.parts, name)
+}
+
+// File is the file the functions compiled now say they come from. A module's
+// functions run on the VM of their caller and have to name theirs, while the
+// program's own are in the file the VM runs and name none.
+func (c *Compiler) File() string {
+	switch {
+	case !c.module:
+		return ""
+	case c.partFile != "":
+		return c.partFile
+	default:
+		return c.fileName
+	}
 }
 
 func (c *Compiler) LoadSymbol(s Symbol) int {
@@ -325,6 +362,40 @@ func (c *Compiler) LoadSymbol(s Symbol) int {
 	}
 }
 
+// StoreSymbol assigns the value on top of the stack to s, leaving it there.
+// A free symbol is only ever assigned when it was declared nonlocal, and so
+// taken as a cell.
+func (c *Compiler) StoreSymbol(s Symbol) int {
+	switch s.Scope {
+	case GlobalScope:
+		return c.Emit(code.OpSetGlobal, s.Index)
+	case FreeScope:
+		return c.Emit(code.OpSetFree, s.Index)
+	default:
+		return c.Emit(code.OpSetLocal, s.Index)
+	}
+}
+
+// CaptureSymbol pushes what a closure being made takes of s, one of its free
+// symbols as it is in the function around it: the variable itself when it is
+// a cell, or has to become one because the closure, or one inside it, assigns
+// it, and its value otherwise.
+func (c *Compiler) CaptureSymbol(s Symbol) int {
+	var cell int
+	if s.Cell {
+		cell = 1
+	}
+
+	switch s.Scope {
+	case LocalScope:
+		return c.Emit(code.OpCaptureLocal, s.Index, cell)
+	case FreeScope:
+		return c.Emit(code.OpCaptureFree, s.Index, cell)
+	default:
+		return c.LoadSymbol(s)
+	}
+}
+
 func (c *Compiler) Bytecode() Bytecode {
 	b := Bytecode{
 		len:     C.uint32_t(len(c.scopes[c.scopeIndex].instructions)),
@@ -378,6 +449,10 @@ func (b Bytecode) NConsts() uint {
 	return uint(b.nconsts)
 }
 
+func (b Bytecode) Consts() []obj.Object {
+	return unsafe.Slice((*obj.Object)(unsafe.Pointer(b.consts)), b.nconsts)
+}
+
 func (b Bytecode) BKLen() uint {
 	return uint(b.bklen)
 }
@@ -389,3 +464,37 @@ func (b Bytecode) Bookmarks() *C.struct_bookmark {
 func (b Bytecode) NDefs() uint {
 	return uint(b.ndefs)
 }
+
+// tailCalls makes a tail call of every call in ins whose value the function
+// returns as it is: the one right before a return, and the one in the tail of
+// a branch, which jumps to the return after the if. The function making it
+// needs its frame no longer and the VM hands it over to the function called,
+// so that recursion in tail position runs in as many frames as a loop does.
+// It is done whether the optimizer runs or not: how deep a program can go is
+// not something -O0 should change.
+func tailCalls(ins code.Instructions) {
+	// Where each instruction goes on to, past the jumps.
+	lands := func(i int) code.Opcode {
+		for n := 0; i < len(ins) && code.Opcode(ins[i]) == code.OpJump && n < len(ins); n++ {
+			i = int(code.ReadUint16(ins[i+1:]))
+		}
+		if i >= len(ins) {
+			return code.OpHalt
+		}
+		return code.Opcode(ins[i])
+	}
+
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			return
+		}
+		_, read := code.ReadOperands(def, ins[i+1:])
+		next := i + 1 + read
+
+		if code.Opcode(ins[i]) == code.OpCall && lands(next) == code.OpReturnValue {
+			ins[i] = byte(code.OpTailCall)
+		}
+		i = next
+	}
+}
@@ -0,0 +1,126 @@
+package compiler
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/NicoNex/tau/internal/obj"
+)
+
+// FuncInfo is what a debugger needs to know about a function that its
+// bytecode doesn't say: the names of its locals and of what it captured, in
+// the order of their slots.
+type FuncInfo struct {
+	Locals []string
+	Free   []string
+}
+
+// The names are thrown away once a function is compiled, the VM only knows
+// slots. A debugger asks to keep them before anything is compiled, modules
+// included, and finds them here by the function they belong to. Nothing is
+// kept when nobody asked, a program that isn't being debugged pays nothing.
+var debugInfo struct {
+	sync.Mutex
+	on    bool
+	funcs map[uintptr]FuncInfo
+	units []unit
+}
+
+// unit is the program or a module: the files it was compiled from and the
+// globals it defined, each by its slot.
+type unit struct {
+	files   []string
+	globals map[string]int
+}
+
+// KeepDebugInfo makes every compiler from now on record the names of the
+// slots of what it compiles.
+func KeepDebugInfo() {
+	debugInfo.Lock()
+	defer debugInfo.Unlock()
+
+	debugInfo.on = true
+	debugInfo.funcs = make(map[uintptr]FuncInfo)
+	debugInfo.units = nil
+}
+
+// FuncDebugInfo returns the names of the slots of the function, given the
+// address of its C struct function.
+func FuncDebugInfo(fn uintptr) (FuncInfo, bool) {
+	debugInfo.Lock()
+	defer debugInfo.Unlock()
+
+	info, ok := debugInfo.funcs[fn]
+	return info, ok
+}
+
+// DebugGlobals returns the globals of the program or of the module the file
+// belongs to, by name. Two modules may well use the same name for different
+// globals, which is why the file is needed to tell which one a name means.
+func DebugGlobals(file string) map[string]int {
+	debugInfo.Lock()
+	defer debugInfo.Unlock()
+
+	for _, u := range debugInfo.units {
+		for _, f := range u.files {
+			if f == file {
+				return u.globals
+			}
+		}
+	}
+	return nil
+}
+
+// ScopeInfo returns the names of the slots of the function being compiled.
+// It has to be asked before leaving its scope, which takes the table away.
+func (c *Compiler) ScopeInfo() FuncInfo {
+	debugInfo.Lock()
+	on := debugInfo.on
+	debugInfo.Unlock()
+	if !on {
+		return FuncInfo{}
+	}
+
+	var info FuncInfo
+	info.Locals = make([]string, c.NumDefs)
+	for name, sym := range c.Store {
+		if sym.Scope == LocalScope && sym.Index < len(info.Locals) {
+			info.Locals[sym.Index] = name
+		}
+	}
+	for _, sym := range c.FreeSymbols {
+		info.Free = append(info.Free, sym.Name)
+	}
+	return info
+}
+
+// RecordFunction keeps the names of the slots of a compiled function.
+func (c *Compiler) RecordFunction(fn obj.Object, info FuncInfo) {
+	debugInfo.Lock()
+	defer debugInfo.Unlock()
+
+	if debugInfo.on {
+		debugInfo.funcs[uintptr(unsafe.Pointer(fn.CompiledFunction()))] = info
+	}
+}
+
+// recordGlobals keeps the names of the globals defined by this unit.
+func (c *Compiler) recordGlobals() {
+	debugInfo.Lock()
+	defer debugInfo.Unlock()
+
+	if !debugInfo.on {
+		return
+	}
+
+	u := unit{files: c.parts, globals: make(map[string]int)}
+	if len(u.files) == 0 {
+		u.files = []string{c.fileName}
+	}
+	for name, sym := range c.global().Store {
+		if sym.Scope == GlobalScope {
+			u.globals[name] = sym.Index
+		}
+	}
+	debugInfo.units = append(debugInfo.units, u)
+}
@@ -0,0 +1,609 @@
+package compiler
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+
+	"github.com/NicoNex/tau/internal/code"
+	"github.com/NicoNex/tau/internal/obj"
+	"github.com/NicoNex/tau/internal/tauerr"
+)
+
+// The optimizer rewrites the instructions of a function, or of the top level,
+// once they are all there: each node of the AST compiles to its instructions
+// without knowing what comes before or after, and what comes out of that is
+// correct but has jumps to jumps, code after a return and a dispatch for each
+// of the pushes x = x + 1 is made of. It works on the instructions decoded
+// into a list, where a jump points at an instruction and not at an offset, so
+// that instructions can go away or become shorter and be written out again
+// with the jumps and the bookmarks where they belong.
+//
+// What it does, until there is nothing left to do:
+//
+//   - folds the constants that meet on the stack, and the conditions that are
+//     constants: `if true` has no jump and `for false` no body;
+//   - threads the jumps, a jump to a jump goes where the second one goes, and
+//     a jump to a return returns;
+//   - removes what can't be reached, the code after a return or a break;
+//   - makes one instruction of the few that are always written together: a
+//     local and a constant with an operator, OpLocalConst, the same assigned
+//     back to the local, OpUpdateLocal, which is what ++i and i += 2 are, and
+//     a comparison with the jump that tests it, OpCompareJump.
+//
+// Nothing it does can be seen from the program, only how fast it goes. An
+// instruction made of others fails, when it does, at the bookmark of the one
+// that could fail, the operator, so that errors point where they always have.
+// `tau run -O0` and the debugger turn it off, to step through the code the way
+// it was written.
+
+var noOptimize atomic.Bool
+
+// DisableOptimizer makes every compiler from now on write the instructions the
+// way the AST compiles to them.
+func DisableOptimizer() {
+	noOptimize.Store(true)
+}
+
+// inst is an instruction of the list the optimizer works on. The target of a
+// jump is the index of the instruction it goes to, len(list) for the end.
+type inst struct {
+	op        code.Opcode
+	operands  []int
+	target    int
+	table     bool
+	dead      bool
+	bookmarks []tauerr.Bookmark
+}
+
+type optimizer struct {
+	c     *Compiler
+	insts []inst
+	// Whether these are the instructions of a function. The last value the
+	// top level pops is what the REPL shows, so none of its pops can go.
+	function bool
+}
+
+// targetOperand is which operand of op is the offset it jumps to, or -1.
+func targetOperand(op code.Opcode) int {
+	switch op {
+	case code.OpJump, code.OpJumpNotTruthy, code.OpIterNext:
+		return 0
+	case code.OpCompareJump:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// optimize returns ins and its bookmarks optimized. What it doesn't understand,
+// an offset that is not where an instruction starts, it leaves as it is.
+func (c *Compiler) optimize(ins code.Instructions, bookmarks []tauerr.Bookmark) (code.Instructions, []tauerr.Bookmark) {
+	if noOptimize.Load() || len(ins) == 0 {
+		return ins, bookmarks
+	}
+
+	o := optimizer{c: c, function: c.InFunction()}
+	if !o.decode(ins, bookmarks) {
+		return ins, bookmarks
+	}
+
+	for i := 0; i < 16; i++ {
+		changed := o.fold()
+		changed = o.fuse() || changed
+		changed = o.thread() || changed
+		changed = o.prune() || changed
+		if !changed {
+			break
+		}
+	}
+	return o.encode()
+}
+
+func (o *optimizer) decode(ins code.Instructions, bookmarks []tauerr.Bookmark) bool {
+	var (
+		index = make(map[int]int)
+		ends  []int
+	)
+
+	for pos := 0; pos < len(ins); {
+		def, err := code.Lookup(ins[pos])
+		if err != nil {
+			return false
+		}
+		operands, read := code.ReadOperands(def, ins[pos+1:])
+		index[pos] = len(o.insts)
+		o.insts = append(o.insts, inst{op: code.Opcode(ins[pos]), operands: operands, target: -1})
+		pos += read + 1
+		ends = append(ends, pos)
+	}
+	index[len(ins)] = len(o.insts)
+
+	for i := range o.insts {
+		in := &o.insts[i]
+		if t := targetOperand(in.op); t >= 0 {
+			idx, ok := index[in.operands[t]]
+			if !ok {
+				return false
+			}
+			in.target = idx
+		}
+
+		// The jumps after a select and a switch on integers are a table the
+		// VM indexes, they have to stay one after the other.
+		var n int
+		switch in.op {
+		case code.OpSelect:
+			n = in.operands[0] + 1
+		case code.OpSwitchTable:
+			n = in.operands[1] + 1
+		}
+		for j := i + 1; j <= i+n; j++ {
+			if j >= len(o.insts) || o.insts[j].op != code.OpJump {
+				return false
+			}
+			o.insts[j].table = true
+		}
+	}
+
+	// The bookmark of an instruction is the first one at or past its end.
+	for _, b := range bookmarks {
+		i := sort.SearchInts(ends, b.Offset())
+		if i == len(ends) {
+			i = len(ends) - 1
+		}
+		o.insts[i].bookmarks = append(o.insts[i].bookmarks, b)
+	}
+	return true
+}
+
+// targets tells the instructions some jump goes to. Nothing that comes before
+// one of them can be merged with it, the code that jumps there expects it.
+func (o *optimizer) targets() []bool {
+	t := make([]bool, len(o.insts)+1)
+	for _, in := range o.insts {
+		if in.target >= 0 {
+			t[in.target] = true
+		}
+	}
+	return t
+}
+
+// kill removes the instructions from i to j included, all but the first when
+// keep is set. Their bookmarks go to i if it stays, and to the instruction
+// before otherwise, whose errors they covered already.
+func (o *optimizer) kill(i, j int, keep bool) {
+	for k := i; k <= j; k++ {
+		if keep && k == i {
+			continue
+		}
+		o.insts[k].dead = true
+	}
+	if keep {
+		for k := i + 1; k <= j; k++ {
+			o.insts[i].bookmarks = append(o.insts[i].bookmarks, o.insts[k].bookmarks...)
+			o.insts[k].bookmarks = nil
+		}
+	}
+	o.compact()
+}
+
+// merge makes of the instructions from i to j the instruction in, with the
+// bookmarks of the one at fails, the one that can fail, if it has any.
+func (o *optimizer) merge(i, j, fails int, in inst) {
+	in.bookmarks = o.insts[fails].bookmarks
+	if len(in.bookmarks) == 0 {
+		for k := i; k <= j; k++ {
+			in.bookmarks = append(in.bookmarks, o.insts[k].bookmarks...)
+		}
+	}
+	for k := i; k <= j; k++ {
+		o.insts[k].bookmarks = nil
+	}
+	o.insts[i] = in
+	o.kill(i, j, true)
+}
+
+// compact drops the dead instructions, and moves the jumps to one of them to
+// the next one alive.
+func (o *optimizer) compact() {
+	var (
+		next  = make([]int, len(o.insts)+1)
+		alive []inst
+	)
+
+	for i, in := range o.insts {
+		next[i] = len(alive)
+		if !in.dead {
+			alive = append(alive, in)
+		} else if len(in.bookmarks) > 0 && len(alive) > 0 {
+			prev := &alive[len(alive)-1]
+			prev.bookmarks = append(prev.bookmarks, in.bookmarks...)
+		}
+	}
+	next[len(o.insts)] = len(alive)
+
+	for i := range alive {
+		if alive[i].target >= 0 {
+			alive[i].target = next[alive[i].target]
+		}
+	}
+	o.insts = alive
+}
+
+// value is the value the instruction in pushes, if it is a constant this
+// compiler knows. The ones of a program this compiler continues are in its
+// pool and not here.
+func (o *optimizer) value(in inst) (obj.Object, bool) {
+	switch in.op {
+	case code.OpTrue:
+		return obj.TrueObj, true
+	case code.OpFalse:
+		return obj.FalseObj, true
+	case code.OpNull:
+		return obj.NullObj, true
+	case code.OpConstant:
+		idx := in.operands[0] - o.c.constBase
+		if idx >= 0 && idx < len(o.c.constants) {
+			return o.c.constants[idx], true
+		}
+	}
+	return obj.NullObj, false
+}
+
+// push is the instruction that pushes v.
+func (o *optimizer) push(v obj.Object) inst {
+	switch {
+	case v.Type() == obj.BoolType && v.IsTruthy():
+		return inst{op: code.OpTrue, target: -1}
+	case v.Type() == obj.BoolType:
+		return inst{op: code.OpFalse, target: -1}
+	default:
+		return inst{op: code.OpConstant, operands: []int{o.c.AddConstant(v)}, target: -1}
+	}
+}
+
+func (o *optimizer) fold() (changed bool) {
+	t := o.targets()
+
+	for i := 0; i < len(o.insts); i++ {
+		l, ok := o.value(o.insts[i])
+		if !ok {
+			continue
+		}
+
+		if i+2 < len(o.insts) && !t[i+1] && !t[i+2] {
+			if r, ok := o.value(o.insts[i+1]); ok {
+				if v, ok := foldBinary(o.insts[i+2].op, l, r); ok {
+					o.merge(i, i+2, i+2, o.push(v))
+					t, changed = o.targets(), true
+					continue
+				}
+			}
+		}
+
+		if i+1 >= len(o.insts) || t[i+1] {
+			continue
+		}
+		switch next := o.insts[i+1]; next.op {
+		case code.OpMinus:
+			if v, ok := foldMinus(l); ok {
+				o.merge(i, i+1, i+1, o.push(v))
+				t, changed = o.targets(), true
+			}
+
+		case code.OpBang:
+			if foldable(l) {
+				o.merge(i, i+1, i+1, o.push(obj.ParseBool(!l.IsTruthy())))
+				t, changed = o.targets(), true
+			}
+
+		// A condition known beforehand either never jumps, or always does.
+		case code.OpJumpNotTruthy:
+			if !foldable(l) {
+				continue
+			}
+			if l.IsTruthy() {
+				o.kill(i, i+1, false)
+			} else {
+				o.merge(i, i+1, i+1, inst{op: code.OpJump, operands: []int{0}, target: next.target})
+			}
+			t, changed = o.targets(), true
+		}
+	}
+	return
+}
+
+// foldable reports whether the truth of v is known without running anything.
+func foldable(v obj.Object) bool {
+	switch v.Type() {
+	case obj.BoolType, obj.NullType, obj.IntType, obj.FloatType, obj.StringType:
+		return true
+	default:
+		return false
+	}
+}
+
+func foldMinus(v obj.Object) (obj.Object, bool) {
+	switch v.Type() {
+	case obj.IntType:
+		return obj.NewInteger(-v.Int()), true
+	case obj.FloatType:
+		return obj.NewFloat(-v.Float()), true
+	default:
+		return obj.NullObj, false
+	}
+}
+
+// foldBinary is what the VM makes of l op r, for the numbers and the operators
+// that can't fail. A division by zero stays for the VM to report, and so does
+// anything on a type that isn't a number.
+func foldBinary(op code.Opcode, l, r obj.Object) (obj.Object, bool) {
+	if l.Type() == obj.IntType && r.Type() == obj.IntType {
+		a, b := l.Int(), r.Int()
+		// The one quotient that doesn't fit, which C traps on.
+		div := b != 0 && !(a == math.MinInt64 && b == -1)
+
+		switch op {
+		case code.OpAdd:
+			return obj.NewInteger(a + b), true
+		case code.OpSub:
+			return obj.NewInteger(a - b), true
+		case code.OpMul:
+			return obj.NewInteger(a * b), true
+		case code.OpDiv:
+			return obj.NewInteger(a / b), div
+		case code.OpMod:
+			return obj.NewInteger(a % b), div
+		case code.OpBwAnd:
+			return obj.NewInteger(a & b), true
+		case code.OpBwOr:
+			return obj.NewInteger(a | b), true
+		case code.OpBwXor:
+			return obj.NewInteger(a ^ b), true
+		case code.OpEqual:
+			return obj.ParseBool(a == b), true
+		case code.OpNotEqual:
+			return obj.ParseBool(a != b), true
+		case code.OpGreaterThan:
+			return obj.ParseBool(a > b), true
+		case code.OpGreaterThanEqual:
+			return obj.ParseBool(a >= b), true
+		}
+		return obj.NullObj, false
+	}
+
+	if !obj.AssertTypes(l, obj.IntType, obj.FloatType) || !obj.AssertTypes(r, obj.IntType, obj.FloatType) {
+		return obj.NullObj, false
+	}
+	a, b := obj.ToFloat(l, r)
+
+	switch op {
+	case code.OpAdd:
+		return obj.NewFloat(a + b), true
+	case code.OpSub:
+		return obj.NewFloat(a - b), true
+	case code.OpMul:
+		return obj.NewFloat(a * b), true
+	case code.OpDiv:
+		return obj.NewFloat(a / b), b != 0
+	case code.OpEqual:
+		return obj.ParseBool(a == b), true
+	case code.OpNotEqual:
+		return obj.ParseBool(a != b), true
+	case code.OpGreaterThan:
+		return obj.ParseBool(a > b), true
+	case code.OpGreaterThanEqual:
+		return obj.ParseBool(a >= b), true
+	}
+	return obj.NullObj, false
+}
+
+// isBinary reports whether op takes two values and pushes one, which the VM
+// can run on a local and a constant without pushing them first.
+func isBinary(op code.Opcode) bool {
+	switch op {
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+		code.OpBwAnd, code.OpBwOr, code.OpBwXor, code.OpBwLShift, code.OpBwRShift:
+		return true
+	default:
+		return isComparison(op)
+	}
+}
+
+func isComparison(op code.Opcode) bool {
+	switch op {
+	case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpGreaterThanEqual:
+		return true
+	default:
+		return false
+	}
+}
+
+// isPure reports whether op only pushes a value, which a pop right after it
+// can take away with it.
+func isPure(op code.Opcode) bool {
+	switch op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull, code.OpCurrentClosure,
+		code.OpGetLocal, code.OpGetGlobal, code.OpGetFree, code.OpGetBuiltin, code.OpDup:
+		return true
+	default:
+		return false
+	}
+}
+
+// match reports whether the instructions from i on have the opcodes ops, and
+// none of them but the first is the target of a jump.
+func (o *optimizer) match(t []bool, i int, ops ...code.Opcode) bool {
+	if i+len(ops) > len(o.insts) {
+		return false
+	}
+	for k, op := range ops {
+		if o.insts[i+k].op != op || (k > 0 && t[i+k]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (o *optimizer) fuse() (changed bool) {
+	t := o.targets()
+
+	for i := 0; i < len(o.insts); i++ {
+		in := o.insts[i]
+		var next code.Opcode
+		if i+1 < len(o.insts) {
+			next = o.insts[i+1].op
+		}
+
+		switch {
+		// x = x + 1 as a statement, the local changed where it is.
+		case i+4 < len(o.insts) && isBinary(o.insts[i+2].op) &&
+			o.match(t, i, code.OpGetLocal, code.OpConstant, o.insts[i+2].op, code.OpSetLocal, code.OpPop) &&
+			in.operands[0] == o.insts[i+3].operands[0]:
+			local, k, op := in.operands[0], o.insts[i+1].operands[0], int(o.insts[i+2].op)
+			o.merge(i, i+4, i+2, inst{op: code.OpUpdateLocal, operands: []int{local, k, op}, target: -1})
+
+		case i+2 < len(o.insts) && isBinary(o.insts[i+2].op) &&
+			o.match(t, i, code.OpGetLocal, code.OpConstant, o.insts[i+2].op):
+			local, k, op := in.operands[0], o.insts[i+1].operands[0], int(o.insts[i+2].op)
+			o.merge(i, i+2, i+2, inst{op: code.OpLocalConst, operands: []int{local, k, op}, target: -1})
+
+		case isComparison(in.op) && next == code.OpJumpNotTruthy && !t[i+1]:
+			target := o.insts[i+1].target
+			o.merge(i, i+1, i, inst{op: code.OpCompareJump, operands: []int{int(in.op), 0}, target: target})
+
+		// A value nobody uses, which the old value of i++ is once the
+		// increment is an OpUpdateLocal.
+		case o.function && isPure(in.op) && next == code.OpPop && !t[i+1]:
+			o.kill(i, i+1, false)
+
+		case o.function && isPure(in.op) && o.match(t, i, in.op, code.OpUpdateLocal, code.OpPop):
+			o.kill(i+2, i+2, false)
+			o.kill(i, i, false)
+
+		// x = f(); g(x): the value assigned is the one on the stack already.
+		case o.match(t, i, code.OpSetLocal, code.OpPop, code.OpGetLocal) && in.operands[0] == o.insts[i+2].operands[0],
+			o.match(t, i, code.OpSetGlobal, code.OpPop, code.OpGetGlobal) && in.operands[0] == o.insts[i+2].operands[0]:
+			o.kill(i, i+2, true)
+
+		default:
+			continue
+		}
+		t, changed = o.targets(), true
+	}
+	return
+}
+
+// thread makes every jump go where it ends up going.
+func (o *optimizer) thread() (changed bool) {
+	for i := range o.insts {
+		in := &o.insts[i]
+		if in.target < 0 {
+			continue
+		}
+
+		seen := map[int]bool{i: true}
+		for t := in.target; t < len(o.insts) && o.insts[t].op == code.OpJump && !seen[t]; t = o.insts[t].target {
+			seen[t] = true
+			if o.insts[t].target != in.target {
+				in.target = o.insts[t].target
+				changed = true
+			}
+		}
+
+		// A jump to a return returns, that is all the return would do.
+		if in.op == code.OpJump && !in.table && in.target < len(o.insts) {
+			switch to := o.insts[in.target]; to.op {
+			case code.OpReturn, code.OpReturnValue, code.OpHalt:
+				in.op, in.operands, in.target = to.op, nil, -1
+				changed = true
+			}
+		}
+	}
+
+	// A jump to the instruction right after it goes nowhere.
+	for i := 0; i < len(o.insts); i++ {
+		switch in := o.insts[i]; {
+		case in.table || in.target != i+1:
+			continue
+		case in.op == code.OpJump:
+			o.kill(i, i, false)
+		case in.op == code.OpJumpNotTruthy:
+			o.insts[i] = inst{op: code.OpPop, target: -1, bookmarks: in.bookmarks}
+		default:
+			continue
+		}
+		changed = true
+	}
+	return
+}
+
+// prune removes what no path from the start gets to.
+func (o *optimizer) prune() bool {
+	var (
+		reached = make([]bool, len(o.insts)+1)
+		todo    = []int{0}
+	)
+
+	for len(todo) > 0 {
+		i := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if reached[i] || i >= len(o.insts) {
+			continue
+		}
+		reached[i] = true
+
+		in := o.insts[i]
+		if in.target >= 0 {
+			todo = append(todo, in.target)
+		}
+		switch in.op {
+		case code.OpJump, code.OpReturn, code.OpReturnValue, code.OpHalt:
+		case code.OpSelect:
+			for k := 1; k <= in.operands[0]+1; k++ {
+				todo = append(todo, i+k)
+			}
+		case code.OpSwitchTable:
+			for k := 1; k <= in.operands[1]+1; k++ {
+				todo = append(todo, i+k)
+			}
+		default:
+			todo = append(todo, i+1)
+		}
+	}
+
+	var changed bool
+	for i := range o.insts {
+		if !reached[i] {
+			o.insts[i].dead = true
+			changed = true
+		}
+	}
+	if changed {
+		o.compact()
+	}
+	return changed
+}
+
+func (o *optimizer) encode() (code.Instructions, []tauerr.Bookmark) {
+	var (
+		offsets   = make([]int, len(o.insts)+1)
+		ins       code.Instructions
+		bookmarks []tauerr.Bookmark
+	)
+
+	for i, in := range o.insts {
+		offsets[i+1] = offsets[i] + len(code.Make(in.op, in.operands...))
+	}
+	for i, in := range o.insts {
+		if t := targetOperand(in.op); t >= 0 {
+			in.operands[t] = offsets[in.target]
+		}
+		ins = append(ins, code.Make(in.op, in.operands...)...)
+		for _, b := range in.bookmarks {
+			bookmarks = append(bookmarks, b.At(offsets[i+1]))
+		}
+	}
+	return ins, bookmarks
+}
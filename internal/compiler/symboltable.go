@@ -1,5 +1,7 @@
 package compiler
 
+import "fmt"
+
 type SymbolScope int
 
 const (
@@ -14,6 +16,11 @@ type Symbol struct {
 	Name  string
 	Scope SymbolScope
 	Index int
+	// Set on the entries of FreeSymbols a closure assigns through nonlocal:
+	// it takes the variable itself, in a cell, and not its value.
+	Cell bool
+	// Set on a name declared with const, which nothing can assign again.
+	Const bool
 }
 
 type SymbolTable struct {
@@ -24,6 +31,9 @@ type SymbolTable struct {
 	// Names used before their definition, with the position of their first
 	// use for the error message. They are cleared as the definitions show up.
 	pending map[string]int
+	// The names declared nonlocal in this function, which an assignment
+	// writes to where they are defined rather than making a local.
+	nonlocal map[string]bool
 }
 
 func NewSymbolTable() *SymbolTable {
@@ -87,14 +97,20 @@ func (s *SymbolTable) Define(name string) Symbol {
 	// The name is defined now: whoever used it earlier was right to.
 	delete(s.global().pending, name)
 
+	if s.nonlocal[name] {
+		symbol, _ := s.Resolve(name)
+		return symbol
+	}
+
 	// A builtin is only a default: a name given to something else takes it
 	// over, the way a module called hex or a variable called len does.
 	//
 	// A captured name is only a default too. A closure reads what it takes
 	// from the function around it but writing to that name makes a local of
-	// its own, which shadows it from here on. The value it starts from is
-	// whatever was read on the right of the assignment, which was compiled
-	// while the name still meant the captured one.
+	// its own, which shadows it from here on, unless it was declared
+	// nonlocal. The value it starts from is whatever was read on the right
+	// of the assignment, which was compiled while the name still meant the
+	// captured one.
 	if symbol, ok := s.Store[name]; ok && symbol.Scope != BuiltinScope && symbol.Scope != FreeScope {
 		return symbol
 	}
@@ -133,6 +149,86 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	return obj, ok
 }
 
+// DefineConst defines name as a constant: the value it is about to be given is
+// the only one it will ever have. A name the function already gave a value to
+// can't become one, since what it held until now would have been a variable.
+func (s *SymbolTable) DefineConst(name string) (Symbol, error) {
+	if err := s.Assignable(name); err != nil {
+		return Symbol{}, err
+	}
+
+	_, forward := s.global().pending[name]
+	if symbol, ok := s.Store[name]; ok && !forward && (symbol.Scope == GlobalScope || symbol.Scope == LocalScope) {
+		return Symbol{}, fmt.Errorf("%s is already a variable, it can't be made a constant", name)
+	}
+	if s.nonlocal[name] {
+		return Symbol{}, fmt.Errorf("%s is declared nonlocal, it can't be made a constant", name)
+	}
+
+	symbol := s.Define(name)
+	symbol.Const = true
+	s.Store[name] = symbol
+	return symbol, nil
+}
+
+// Assignable tells whether an assignment to name, here, is allowed: it is
+// not when the name means a constant, whether of this function or of one
+// around it. Shadowing a constant with a local would make a name mean two
+// things in the same function, and the compiler has already put its value
+// wherever the constant was read.
+func (s *SymbolTable) Assignable(name string) error {
+	for t := s; t != nil; t = t.outer {
+		if symbol, ok := t.Store[name]; ok && symbol.Scope != BuiltinScope {
+			if symbol.Const {
+				return fmt.Errorf("cannot assign to constant %s", name)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// Nonlocal makes name, in the function this table is for, the variable of that
+// name outside it: from here on an assignment changes that one instead of
+// making a local. A global is written where it is; a variable of a function
+// around this one is captured as a cell, by this function and by every one in
+// between, so that all of them and the one it belongs to share it.
+func (s *SymbolTable) Nonlocal(name string) (Symbol, error) {
+	if s.outer == nil {
+		return Symbol{}, fmt.Errorf("nonlocal outside of a function")
+	}
+	if symbol, ok := s.Store[name]; ok && symbol.Scope == LocalScope && !s.nonlocal[name] {
+		return Symbol{}, fmt.Errorf("%s is already a local of this function", name)
+	}
+
+	symbol, ok := s.Resolve(name)
+	switch {
+	case !ok:
+		return Symbol{}, fmt.Errorf("no %s outside this function", name)
+	case symbol.Scope == BuiltinScope:
+		return Symbol{}, fmt.Errorf("%s is a builtin, not a variable", name)
+	case symbol.Scope == FunctionScope:
+		return Symbol{}, fmt.Errorf("%s is the function itself, not a variable", name)
+	case symbol.Const:
+		return Symbol{}, fmt.Errorf("%s is a constant, not a variable", name)
+	}
+
+	// Down the chain of free symbols to the local they come from.
+	for t, free := s, symbol; free.Scope == FreeScope; t = t.outer {
+		t.FreeSymbols[free.Index].Cell = true
+		free = t.FreeSymbols[free.Index]
+		if free.Scope == FunctionScope {
+			return Symbol{}, fmt.Errorf("%s is a function itself, not a variable", name)
+		}
+	}
+
+	if s.nonlocal == nil {
+		s.nonlocal = make(map[string]bool)
+	}
+	s.nonlocal[name] = true
+	return symbol, nil
+}
+
 func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
 	s.Store[name] = symbol
@@ -145,6 +241,7 @@ func (s *SymbolTable) DefineFree(original Symbol) Symbol {
 		Name:  original.Name,
 		Index: len(s.FreeSymbols) - 1,
 		Scope: FreeScope,
+		Const: original.Const,
 	}
 	s.Store[original.Name] = symbol
 	return symbol
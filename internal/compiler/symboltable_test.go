@@ -272,3 +272,71 @@ func TestResolveUnresolvableFree(t *testing.T) {
 		}
 	}
 }
+
+func TestNonlocal(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	firstLocal := NewEnclosedSymbolTable(global)
+	firstLocal.Define("b")
+	secondLocal := NewEnclosedSymbolTable(firstLocal)
+	thirdLocal := NewEnclosedSymbolTable(secondLocal)
+
+	if _, err := thirdLocal.Nonlocal("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := thirdLocal.Nonlocal("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Assigning the names now writes them where they are.
+	if s := thirdLocal.Define("b"); s != (Symbol{Name: "b", Scope: FreeScope, Index: 0}) {
+		t.Errorf("expected b to stay free, got=%+v", s)
+	}
+	if s := thirdLocal.Define("a"); s != (Symbol{Name: "a", Scope: GlobalScope, Index: 0}) {
+		t.Errorf("expected a to stay global, got=%+v", s)
+	}
+
+	// Every function down to the one b belongs to takes it as a cell.
+	if s := thirdLocal.FreeSymbols[0]; s != (Symbol{Name: "b", Scope: FreeScope, Index: 0, Cell: true}) {
+		t.Errorf("wrong free symbol. got=%+v", s)
+	}
+	if s := secondLocal.FreeSymbols[0]; s != (Symbol{Name: "b", Scope: LocalScope, Index: 0, Cell: true}) {
+		t.Errorf("wrong free symbol. got=%+v", s)
+	}
+
+	global.DefineBuiltin(0, "len")
+	for _, name := range []string{"b", "len", "nope"} {
+		if _, err := firstLocal.Nonlocal(name); err == nil {
+			t.Errorf("expected nonlocal %s to fail", name)
+		}
+	}
+	if _, err := global.Nonlocal("a"); err == nil {
+		t.Errorf("expected nonlocal outside of a function to fail")
+	}
+}
+
+func TestDefineConst(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	if _, err := global.DefineConst("K"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := global.DefineConst("a"); err == nil {
+		t.Errorf("expected a, a variable, not to become a constant")
+	}
+
+	local := NewEnclosedSymbolTable(global)
+	local.Define("K2")
+	if err := local.Assignable("K"); err == nil {
+		t.Errorf("expected K not to be assignable in a function")
+	}
+	if err := local.Assignable("a"); err != nil {
+		t.Errorf("expected a to be assignable, got %v", err)
+	}
+
+	// A name used before its definition can still be a constant.
+	global.DefineForward("L", 0)
+	if s, err := global.DefineConst("L"); err != nil || !s.Const {
+		t.Errorf("expected L to become a constant, got %+v, %v", s, err)
+	}
+}
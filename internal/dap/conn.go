@@ -0,0 +1,129 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// request is a message from the editor. The protocol has requests, responses
+// and events; only the first kind ever comes in.
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type response struct {
+	Seq        int    `json:"seq"`
+	Type       string `json:"type"`
+	RequestSeq int    `json:"request_seq"`
+	Success    bool   `json:"success"`
+	Command    string `json:"command"`
+	Message    string `json:"message,omitempty"`
+	Body       any    `json:"body,omitempty"`
+}
+
+type event struct {
+	Seq   int    `json:"seq"`
+	Type  string `json:"type"`
+	Event string `json:"event"`
+	Body  any    `json:"body,omitempty"`
+}
+
+// conn is the framed transport, the same Content-Length headers LSP uses.
+// Unlike a language server an adapter writes from more than one goroutine:
+// the events come from the program, whenever it stops or prints.
+type conn struct {
+	in  *bufio.Reader
+	mu  sync.Mutex
+	out *bufio.Writer
+	seq int
+}
+
+func newConn(in io.Reader, out io.Writer) *conn {
+	return &conn{in: bufio.NewReader(in), out: bufio.NewWriter(out)}
+}
+
+// read returns the body of the next message. A frame without a usable
+// Content-Length is not something we can resynchronise from, so it ends the
+// stream rather than leaving the reader at an unknown offset.
+func (c *conn) read() ([]byte, error) {
+	length := -1
+
+	for {
+		line, err := c.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("bad Content-Length %q", value)
+			}
+			length = n
+		}
+	}
+
+	if length < 0 {
+		return nil, errors.New("message without Content-Length")
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.in, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// write numbers the message and sends it. The numbers are the adapter's own,
+// one sequence for the responses and the events together.
+func (c *conn) write(msg func(seq int) any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	data, err := json.Marshal(msg(c.seq))
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(c.out, "Content-Length: %d\r\n\r\n", len(data))
+	c.out.Write(data)
+	c.out.Flush()
+}
+
+func (c *conn) reply(req request, body any) {
+	c.write(func(seq int) any {
+		return response{Seq: seq, Type: "response", RequestSeq: req.Seq, Success: true, Command: req.Command, Body: body}
+	})
+}
+
+func (c *conn) replyErr(req request, format string, a ...any) {
+	c.write(func(seq int) any {
+		return response{
+			Seq:        seq,
+			Type:       "response",
+			RequestSeq: req.Seq,
+			Command:    req.Command,
+			Message:    fmt.Sprintf(format, a...),
+		}
+	})
+}
+
+func (c *conn) event(name string, body any) {
+	c.write(func(seq int) any {
+		return event{Seq: seq, Type: "event", Event: name, Body: body}
+	})
+}
@@ -0,0 +1,243 @@
+package dap_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NicoNex/tau"
+	"github.com/NicoNex/tau/internal/dap"
+)
+
+// client drives the adapter the way an editor does. Unlike a language server
+// a debug adapter can't be fed a whole session up front: what the editor asks
+// depends on where the program stopped, so the session runs live, over pipes.
+type client struct {
+	t    *testing.T
+	in   *io.PipeWriter
+	msgs chan map[string]any
+	seq  int
+}
+
+func newClient(t *testing.T) (*client, chan error) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+
+	c := &client{t: t, in: inW, msgs: make(chan map[string]any, 64)}
+	done := make(chan error, 1)
+
+	go func() {
+		done <- dap.Serve(inR, outW, nil, tau.RunDebugged)
+		outW.Close()
+	}()
+	go c.decode(bufio.NewReader(outR))
+	return c, done
+}
+
+func (c *client) decode(r *bufio.Reader) {
+	defer close(c.msgs)
+
+	for {
+		length := -1
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			if line == "" {
+				break
+			}
+			if name, value, ok := strings.Cut(line, ":"); ok && name == "Content-Length" {
+				length, _ = strconv.Atoi(strings.TrimSpace(value))
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		var m map[string]any
+		if err := json.Unmarshal(body, &m); err != nil {
+			return
+		}
+		c.msgs <- m
+	}
+}
+
+func (c *client) request(command string, args any) int {
+	c.t.Helper()
+	c.seq++
+	data, err := json.Marshal(map[string]any{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fmt.Fprintf(c.in, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return c.seq
+}
+
+// wait returns the next message that match accepts, skipping the others: the
+// events the program sends come whenever they come.
+func (c *client) wait(what string, match func(map[string]any) bool) map[string]any {
+	c.t.Helper()
+	timeout := time.After(10 * time.Second)
+
+	for {
+		select {
+		case m, ok := <-c.msgs:
+			if !ok {
+				c.t.Fatalf("adapter gone while waiting for %s", what)
+			}
+			if match(m) {
+				return m
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// call sends a request and returns the body of its response, which has to
+// be a success.
+func (c *client) call(command string, args any) map[string]any {
+	c.t.Helper()
+	resp := c.response(c.request(command, args))
+	if resp["success"] != true {
+		c.t.Fatalf("%s failed: %v", command, resp["message"])
+	}
+	body, _ := resp["body"].(map[string]any)
+	return body
+}
+
+func (c *client) response(seq int) map[string]any {
+	c.t.Helper()
+	return c.wait("response to "+strconv.Itoa(seq), func(m map[string]any) bool {
+		return m["type"] == "response" && m["request_seq"] == float64(seq)
+	})
+}
+
+func (c *client) event(name string) map[string]any {
+	c.t.Helper()
+	m := c.wait(name+" event", func(m map[string]any) bool {
+		return m["type"] == "event" && m["event"] == name
+	})
+	body, _ := m["body"].(map[string]any)
+	return body
+}
+
+// stoppedAt waits for the program to stop and returns the name and the line
+// of the innermost call, and the id of its frame.
+func (c *client) stoppedAt(reason string) (string, int, float64) {
+	c.t.Helper()
+	ev := c.event("stopped")
+	if ev["reason"] != reason {
+		c.t.Errorf("stopped for %v, expected %s", ev["reason"], reason)
+	}
+
+	st := c.call("stackTrace", map[string]any{"threadId": ev["threadId"]})
+	frames := st["stackFrames"].([]any)
+	top := frames[0].(map[string]any)
+	return top["name"].(string), int(top["line"].(float64)), top["id"].(float64)
+}
+
+func TestSession(t *testing.T) {
+	main := filepath.Join(t.TempDir(), "main.tau")
+	err := os.WriteFile(main, []byte(`sq = fn(n) {
+	r = n * n
+	return r
+}
+
+total = 0
+for i = 0; i < 3; i++ {
+	total += sq(i)
+}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, done := newClient(t)
+
+	caps := c.call("initialize", map[string]any{"adapterID": "tau"})
+	if caps["supportsConfigurationDoneRequest"] != true {
+		t.Errorf("capabilities: %v", caps)
+	}
+	c.event("initialized")
+
+	c.call("launch", map[string]any{"program": main})
+	bps := c.call("setBreakpoints", map[string]any{
+		"source":      map[string]any{"path": main},
+		"breakpoints": []any{map[string]any{"line": 2}},
+	})
+	if b := bps["breakpoints"].([]any)[0].(map[string]any); b["verified"] != true || b["line"] != float64(2) {
+		t.Errorf("breakpoint: %v", b)
+	}
+	c.call("configurationDone", nil)
+
+	// Not stopping on entry, the first stop is the breakpoint.
+	name, line, frame := c.stoppedAt("breakpoint")
+	if name != "sq" || line != 2 {
+		t.Errorf("stopped in %s at %d, expected sq at 2", name, line)
+	}
+
+	threads := c.call("threads", nil)["threads"].([]any)
+	if id := threads[0].(map[string]any)["id"]; len(threads) != 1 || id != float64(1) {
+		t.Errorf("threads: %v", threads)
+	}
+
+	st := c.call("stackTrace", map[string]any{"threadId": 1})
+	frames := st["stackFrames"].([]any)
+	if len(frames) != 2 || frames[1].(map[string]any)["line"] != float64(8) {
+		t.Errorf("stack: %v", frames)
+	}
+	if src := frames[0].(map[string]any)["source"].(map[string]any); src["path"] != main {
+		t.Errorf("source: %v", src)
+	}
+
+	scopes := c.call("scopes", map[string]any{"frameId": frame})["scopes"].([]any)
+	locals := scopes[0].(map[string]any)
+	if locals["name"] != "Locals" {
+		t.Errorf("scopes: %v", scopes)
+	}
+	vars := c.call("variables", map[string]any{"variablesReference": locals["variablesReference"]})
+	got := fmt.Sprint(vars["variables"])
+	for _, want := range []string{"name:n", "value:0", "name:r", "value:null"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %s in locals: %s", want, got)
+		}
+	}
+
+	if ev := c.call("evaluate", map[string]any{"expression": "total", "frameId": frame}); ev["result"] != "0" {
+		t.Errorf("total = %v", ev["result"])
+	}
+	if resp := c.response(c.request("evaluate", map[string]any{"expression": "nope", "frameId": frame})); resp["success"] != false {
+		t.Errorf("evaluating an unknown name succeeded: %v", resp)
+	}
+
+	c.call("next", map[string]any{"threadId": 1})
+	if name, line, _ := c.stoppedAt("step"); name != "sq" || line != 3 {
+		t.Errorf("next went to %s at %d, expected sq at 3", name, line)
+	}
+	c.call("stepOut", map[string]any{"threadId": 1})
+	if name, line, _ := c.stoppedAt("step"); name != "<top level>" || line != 8 {
+		t.Errorf("stepOut went to %s at %d, expected <top level> at 8", name, line)
+	}
+
+	c.call("setBreakpoints", map[string]any{"source": map[string]any{"path": main}, "breakpoints": []any{}})
+	c.call("continue", map[string]any{"threadId": 1})
+	if ev := c.event("exited"); ev["exitCode"] != float64(0) {
+		t.Errorf("exit code %v", ev["exitCode"])
+	}
+	c.event("terminated")
+
+	c.call("disconnect", nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
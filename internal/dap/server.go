@@ -0,0 +1,463 @@
+// Package dap is the debug adapter of tau: it speaks the Debug Adapter
+// Protocol, which is how VS Code, nvim-dap and Helix drive a debugger, and
+// runs the program with the same hooks `tau debug` uses. The program runs in
+// the adapter's own process, so everything the prompt can look at the editor
+// can too, and nothing is sent over a second wire.
+//
+// A routine of the program is a thread for the editor, numbered the way the
+// prompt numbers them, and every one of them stops when one does.
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/NicoNex/tau/internal/vm"
+)
+
+// Runner compiles and runs a tau file under the debugger, calling stopped
+// every time it stops. The root package has the one `tau debug` uses; it is
+// handed in rather than called because that package is the one that serves.
+type Runner func(path string, stopped func(*vm.Stop) vm.Resume) error
+
+type server struct {
+	conn   *conn
+	run    Runner
+	output sync.WaitGroup
+
+	mu sync.Mutex
+	// What the editor asked for: the program, its arguments, and the
+	// breakpoints of every source it has set some in.
+	program     string
+	args        []string
+	stopOnEntry bool
+	bps         map[string][]vm.Breakpoint
+	launched    bool
+	configured  bool
+	started     bool
+	entered     bool
+	// Set once the editor is gone: from then on nothing stops.
+	detached bool
+
+	// The program as it is at the current stop, nil while it runs. The ids
+	// the editor got for its frames and variables are good only until the
+	// next stop, which is what the protocol says they are.
+	stop   *vm.Stop
+	frames []vm.Frame
+	refs   []func() []vm.Var
+	resume chan vm.Resume
+}
+
+// Serve answers the requests read from in until the editor disconnects or the
+// input ends. What the program writes, read from output by category, goes to
+// the editor as events; every reader has to end when the program does, for
+// the editor to hear about the program's end after all it wrote. output may
+// be nil.
+func Serve(in io.Reader, out io.Writer, output map[string]io.Reader, run Runner) error {
+	s := &server{
+		conn:   newConn(in, out),
+		run:    run,
+		bps:    make(map[string][]vm.Breakpoint),
+		resume: make(chan vm.Resume),
+	}
+
+	for category, r := range output {
+		s.output.Add(1)
+		go s.forward(category, r)
+	}
+
+	for {
+		body, err := s.conn.read()
+		if err != nil {
+			s.detach()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		var req request
+		if err := json.Unmarshal(body, &req); err != nil {
+			continue
+		}
+		if !s.dispatch(req) {
+			return nil
+		}
+	}
+}
+
+// forward turns what the program writes into output events, a line at a
+// time so that the editor doesn't show half a line.
+func (s *server) forward(category string, r io.Reader) {
+	defer s.output.Done()
+	br := bufio.NewReader(r)
+
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			s.conn.event("output", map[string]any{"category": category, "output": line})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dispatch answers one request and reports whether to go on reading.
+func (s *server) dispatch(req request) bool {
+	switch req.Command {
+	case "initialize":
+		s.conn.reply(req, map[string]any{
+			"supportsConfigurationDoneRequest": true,
+			"supportsTerminateRequest":         true,
+			"supportsEvaluateForHovers":        true,
+		})
+		s.conn.event("initialized", nil)
+
+	case "launch":
+		s.launch(req)
+	case "setBreakpoints":
+		s.setBreakpoints(req)
+	case "setExceptionBreakpoints":
+		s.conn.reply(req, map[string]any{"breakpoints": []any{}})
+	case "configurationDone":
+		s.mu.Lock()
+		s.configured = true
+		s.mu.Unlock()
+		s.conn.reply(req, nil)
+		s.start()
+
+	case "threads":
+		s.threads(req)
+	case "stackTrace":
+		s.stackTrace(req)
+	case "scopes":
+		s.scopes(req)
+	case "variables":
+		s.variables(req)
+	case "evaluate":
+		s.evaluate(req)
+
+	case "continue":
+		s.resumeWith(req, vm.Continue, map[string]any{"allThreadsContinued": true})
+	case "next":
+		s.resumeWith(req, vm.Next, nil)
+	case "stepIn":
+		s.resumeWith(req, vm.Step, nil)
+	case "stepOut":
+		s.resumeWith(req, vm.Finish, nil)
+	case "pause":
+		vm.Interrupt()
+		s.conn.reply(req, nil)
+
+	case "disconnect", "terminate":
+		// The program runs in this process: the editor going away ends it,
+		// since whoever started the adapter stops it once this returns.
+		s.detach()
+		s.conn.reply(req, nil)
+		return false
+
+	default:
+		s.conn.replyErr(req, "%s is not supported", req.Command)
+	}
+	return true
+}
+
+func (s *server) launch(req request) {
+	var args struct {
+		Program     string   `json:"program"`
+		Args        []string `json:"args"`
+		StopOnEntry bool     `json:"stopOnEntry"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil || args.Program == "" {
+		s.conn.replyErr(req, "launch: no program given")
+		return
+	}
+
+	// Absolute, so that the breakpoints the editor sets, which always are,
+	// match the program's own file and no other file of the same name.
+	program, err := filepath.Abs(args.Program)
+	if err != nil {
+		s.conn.replyErr(req, "launch: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	s.program, s.args, s.stopOnEntry = program, args.Args, args.StopOnEntry
+	s.launched = true
+	s.mu.Unlock()
+
+	s.conn.reply(req, nil)
+	s.start()
+}
+
+// start runs the program once the editor has said both what to run and that
+// it is done setting it up, whichever of the two comes last.
+func (s *server) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.launched || !s.configured || s.started {
+		return
+	}
+	s.started = true
+
+	vm.SetArgs(append([]string{s.program}, s.args...))
+	go func(program string) {
+		code := 0
+		if err := s.run(program, s.stopped); err != nil {
+			code = 1
+			s.conn.event("output", map[string]any{"category": "stderr", "output": err.Error() + "\n"})
+		}
+		s.output.Wait()
+		s.conn.event("exited", map[string]any{"exitCode": code})
+		s.conn.event("terminated", nil)
+	}(s.program)
+}
+
+// stopped is called by the program, on the thread of the routine that
+// stopped, and holds it there until the editor says how to go on.
+func (s *server) stopped(st *vm.Stop) vm.Resume {
+	s.mu.Lock()
+	entry := !s.entered
+	s.entered = true
+	if s.detached || (entry && !s.stopOnEntry) {
+		s.mu.Unlock()
+		return vm.Continue
+	}
+	s.stop, s.frames, s.refs = st, nil, nil
+	s.mu.Unlock()
+
+	reason := st.Reason.String()
+	if entry {
+		reason = "entry"
+	}
+	s.conn.event("stopped", map[string]any{
+		"reason":            reason,
+		"threadId":          st.Routine,
+		"allThreadsStopped": true,
+	})
+
+	r := <-s.resume
+
+	s.mu.Lock()
+	s.stop, s.frames, s.refs = nil, nil, nil
+	s.mu.Unlock()
+	return r
+}
+
+// resumeWith lets the program go. The answer goes out first, so that the
+// editor hears the program is running before it hears it stopped again.
+func (s *server) resumeWith(req request, r vm.Resume, body any) {
+	s.mu.Lock()
+	stopped := s.stop != nil
+	s.mu.Unlock()
+
+	if !stopped {
+		s.conn.replyErr(req, "the program is not stopped")
+		return
+	}
+	s.conn.reply(req, body)
+	s.resume <- r
+}
+
+// detach lets the program run to its end with nothing to stop it.
+func (s *server) detach() {
+	s.mu.Lock()
+	s.detached = true
+	stopped := s.stop != nil
+	s.mu.Unlock()
+
+	vm.SetBreakpoints(nil)
+	if stopped {
+		s.resume <- vm.Continue
+	}
+}
+
+func (s *server) setBreakpoints(req request) {
+	var args struct {
+		Source struct {
+			Path string `json:"path"`
+		} `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(req.Arguments, &args); err != nil || args.Source.Path == "" {
+		s.conn.replyErr(req, "setBreakpoints: no source given")
+		return
+	}
+
+	var (
+		bps      []vm.Breakpoint
+		verified []map[string]any
+	)
+	for _, b := range args.Breakpoints {
+		bps = append(bps, vm.Breakpoint{File: args.Source.Path, Line: b.Line})
+		verified = append(verified, map[string]any{"verified": true, "line": b.Line})
+	}
+
+	s.mu.Lock()
+	s.bps[args.Source.Path] = bps
+	var all []vm.Breakpoint
+	for _, b := range s.bps {
+		all = append(all, b...)
+	}
+	s.mu.Unlock()
+
+	vm.SetBreakpoints(all)
+	s.conn.reply(req, map[string]any{"breakpoints": verified})
+}
+
+func (s *server) threads(req request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Asked while the program runs there is nothing to look at; the main
+	// routine is always there.
+	if s.stop == nil {
+		s.conn.reply(req, map[string]any{"threads": []any{map[string]any{"id": 1, "name": "routine 1"}}})
+		return
+	}
+
+	var threads []any
+	for _, r := range s.stop.Routines() {
+		name := fmt.Sprintf("routine %d", r.ID)
+		if len(r.Frames) > 0 {
+			name += " (" + r.Frames[len(r.Frames)-1].Name + ")"
+		}
+		threads = append(threads, map[string]any{"id": r.ID, "name": name})
+	}
+	s.conn.reply(req, map[string]any{"threads": threads})
+}
+
+func (s *server) stackTrace(req request) {
+	var args struct {
+		ThreadID   int `json:"threadId"`
+		StartFrame int `json:"startFrame"`
+		Levels     int `json:"levels"`
+	}
+	json.Unmarshal(req.Arguments, &args)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop == nil {
+		s.conn.replyErr(req, "the program is not stopped")
+		return
+	}
+
+	frames := s.stop.Frames(args.ThreadID)
+	total := len(frames)
+	if args.StartFrame > 0 && args.StartFrame < len(frames) {
+		frames = frames[args.StartFrame:]
+	} else if args.StartFrame >= len(frames) {
+		frames = nil
+	}
+	if args.Levels > 0 && args.Levels < len(frames) {
+		frames = frames[:args.Levels]
+	}
+
+	out := []any{}
+	for _, f := range frames {
+		s.frames = append(s.frames, f)
+		path, _ := filepath.Abs(f.File)
+		out = append(out, map[string]any{
+			"id":     len(s.frames),
+			"name":   f.Name,
+			"source": map[string]any{"name": filepath.Base(path), "path": path},
+			"line":   f.Line,
+			"column": 1,
+		})
+	}
+	s.conn.reply(req, map[string]any{"stackFrames": out, "totalFrames": total})
+}
+
+// frame returns the frame the editor got the id of.
+func (s *server) frame(id int) (vm.Frame, bool) {
+	if s.stop == nil || id < 1 || id > len(s.frames) {
+		return vm.Frame{}, false
+	}
+	return s.frames[id-1], true
+}
+
+func (s *server) scopes(req request) {
+	var args struct {
+		FrameID int `json:"frameId"`
+	}
+	json.Unmarshal(req.Arguments, &args)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.frame(args.FrameID)
+	if !ok {
+		s.conn.replyErr(req, "no frame %d", args.FrameID)
+		return
+	}
+
+	s.refs = append(s.refs, f.Locals)
+	locals := len(s.refs)
+	s.refs = append(s.refs, f.Globals)
+	globals := len(s.refs)
+
+	s.conn.reply(req, map[string]any{"scopes": []any{
+		map[string]any{"name": "Locals", "variablesReference": locals, "expensive": false},
+		map[string]any{"name": "Globals", "variablesReference": globals, "expensive": false},
+	}})
+}
+
+func (s *server) variables(req request) {
+	var args struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	json.Unmarshal(req.Arguments, &args)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref := args.VariablesReference
+	if s.stop == nil || ref < 1 || ref > len(s.refs) {
+		s.conn.replyErr(req, "no variables %d", ref)
+		return
+	}
+
+	vars := s.refs[ref-1]()
+	sort.SliceStable(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+
+	out := []any{}
+	for _, v := range vars {
+		out = append(out, map[string]any{"name": v.Name, "value": v.Value, "variablesReference": 0})
+	}
+	s.conn.reply(req, map[string]any{"variables": out})
+}
+
+// evaluate looks a name up, which is as much of an expression as can be
+// evaluated without running anything in a program that is stopped.
+func (s *server) evaluate(req request) {
+	var args struct {
+		Expression string `json:"expression"`
+		FrameID    int    `json:"frameId"`
+	}
+	json.Unmarshal(req.Arguments, &args)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.frame(args.FrameID)
+	if !ok {
+		s.conn.replyErr(req, "the program is not stopped")
+		return
+	}
+	v, ok := f.Lookup(args.Expression)
+	if !ok {
+		s.conn.replyErr(req, "no %s here", args.Expression)
+		return
+	}
+	s.conn.reply(req, map[string]any{"result": v, "variablesReference": 0})
+}
@@ -45,6 +45,8 @@ type Entry struct {
 	// Val is what a name that isn't a function is assigned, when that fits on
 	// a line. A long expression is left out: the source is the place for it.
 	Val string
+	// Const is set for a name declared with const.
+	Const bool
 	// Doc is the comment above the name, with the '#' and one space after it
 	// taken off, still holding the empty lines that separate its paragraphs.
 	Doc      string
@@ -444,6 +446,11 @@ func assignment(toks []tok, i, end int) (Entry, int, bool) {
 		name = i
 	)
 
+	konst := toks[i].Is(item.Const) && i+1 < end
+	if konst {
+		i++
+		name = i
+	}
 	if !toks[i].Is(item.Ident) {
 		return e, statement(toks, i, end), false
 	}
@@ -460,9 +467,10 @@ func assignment(toks []tok, i, end int) (Entry, int, bool) {
 	}
 
 	e = Entry{
-		Name: toks[name].Val,
-		File: toks[name].file,
-		Line: toks[name].line,
+		Name:  toks[name].Val,
+		Const: konst,
+		File:  toks[name].file,
+		Line:  toks[name].line,
 	}
 
 	rhs := eq + 1
@@ -511,6 +519,8 @@ func function(toks []tok, i, end int) (string, []Entry, []string) {
 				}
 			} else if depth == 1 && toks[j].Is(item.Comma) {
 				sig.WriteString(", ")
+			} else if depth == 1 && toks[j].Is(item.Assign) {
+				sig.WriteString(" = ")
 			} else if depth == 1 {
 				sig.WriteString(toks[j].text())
 			}
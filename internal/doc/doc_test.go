@@ -18,6 +18,9 @@ other = import("other")
 # Answer is the number.
 Answer = 42
 
+# Size can't change.
+const Size = 1 << 10
+
 # hidden is not given away.
 hidden = fn() { 1 }
 
@@ -81,7 +84,7 @@ func TestExported(t *testing.T) {
 		names = append(names, e.Name)
 	}
 
-	want := "Answer Counter Loose"
+	want := "Answer Size Counter Loose"
 	if got := strings.Join(names, " "); got != want {
 		t.Errorf("top level names are %q, want %q", got, want)
 	}
@@ -113,6 +116,14 @@ func TestSignatureAndValue(t *testing.T) {
 	if a.Val != "42" {
 		t.Errorf("Answer holds %q, want %q", a.Val, "42")
 	}
+
+	s, _ := p.Find("Size")
+	if !s.Const || s.Doc != "Size can't change." {
+		t.Errorf("Size is %+v, want a documented constant", s)
+	}
+	if d := decl(s); d != "const Size = 1 << 10" {
+		t.Errorf("Size is declared as %q", d)
+	}
 }
 
 // TestDescent is the point of the package: what Go documents as methods is
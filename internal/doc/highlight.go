@@ -180,7 +180,8 @@ func class(toks []item.Item, at int) string {
 		return "c-num"
 
 	case item.Function, item.For, item.If, item.Else, item.Return, item.Import,
-		item.Tau, item.Break, item.Continue:
+		item.Tau, item.Defer, item.Break, item.Continue, item.Select, item.Switch,
+		item.Case, item.Default, item.Nonlocal, item.Const:
 		return "c-kw"
 
 	case item.True, item.False, item.Null:
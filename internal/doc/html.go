@@ -235,6 +235,8 @@ func nav(entries []Entry, prefix string) []navItem {
 		kind := "value"
 		if e.Sig != "" {
 			kind = "fn"
+		} else if e.Const {
+			kind = "const"
 		}
 		depth := strings.Count(id, ".")
 		out = append(out, navItem{ID: id, Name: e.Name, Kind: kind, Depth: depth, Top: depth == 0})
@@ -255,6 +257,8 @@ func sections(p Package, entries []Entry, prefix string, depth int) []section {
 		kind := "value"
 		if e.Sig != "" {
 			kind = "fn"
+		} else if e.Const {
+			kind = "const"
 		}
 
 		out = append(out, section{
@@ -63,6 +63,11 @@ func children(w io.Writer, entries []Entry, under string) error {
 // decl is the one line that names an entry: its signature if it is a
 // function, what it holds if that is short, its name alone otherwise.
 func decl(e Entry) string {
+	if e.Const {
+		e.Const = false
+		return "const " + decl(e)
+	}
+
 	switch {
 	case e.Sig != "":
 		return e.Name + " = " + e.Sig
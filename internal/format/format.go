@@ -198,10 +198,11 @@ func join(line []tok, kinds *[]bool) string {
 		}
 
 		// A brace is a block when something it could belong to comes before
-		// it, and a map literal otherwise: "if x {" and "else {" against
-		// "m = {".
+		// it, and a map literal otherwise: "if x {", "else {", "select {" and
+		// "switch {" against "m = {".
 		if t.Is(item.LBrace) {
-			*kinds = append(*kinds, i > 0 && (value(prev) || prev.Is(item.Else)))
+			*kinds = append(*kinds, i > 0 && (value(prev) || prev.Is(item.Else) ||
+				prev.Is(item.Select) || prev.Is(item.Switch) || prev.Is(item.Default)))
 		}
 
 		block := true
@@ -230,9 +231,9 @@ func join(line []tok, kinds *[]bool) string {
 // block says whether the innermost open brace is a block or a map literal.
 func space(prev, cur tok, before []tok, block bool) bool {
 	switch {
-	// Nothing follows these: an open bracket, a dot, a negation.
+	// Nothing follows these: an open bracket, a dot, a spread, a negation.
 	case prev.Is(item.LParen) || prev.Is(item.LBracket) || prev.Is(item.Dot) ||
-		prev.Is(item.Bang) || prev.Is(item.BwNot):
+		prev.Is(item.Ellipsis) || prev.Is(item.Bang) || prev.Is(item.BwNot):
 		return false
 
 	// Brackets stick to the name in front of them, which makes a call or an
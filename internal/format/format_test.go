@@ -65,6 +65,75 @@ t.AssertEq(1, 1)
 	}
 }
 
+// TestSelect checks that the braces of a select and of its cases are blocks,
+// which nothing in front of them would tell otherwise.
+func TestSelect(t *testing.T) {
+	const src = `x = select {
+case v = recv(p) {
+println(v)
+}
+default {}
+}
+`
+	const want = `x = select {
+	case v = recv(p) {
+		println(v)
+	}
+	default {}
+}
+`
+
+	out, err := Source("test.tau", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+// TestSwitch checks that the braces of a switch are blocks while those of a
+// map pattern in a case are not.
+func TestSwitch(t *testing.T) {
+	const src = `x = switch y {
+case {"k": v}, [v] if v > 0 {
+println(v)
+}
+default { 0 }
+}
+`
+	const want = `x = switch y {
+	case {"k": v}, [v] if v > 0 {
+		println(v)
+	}
+	default { 0 }
+}
+`
+
+	out, err := Source("test.tau", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
+// TestSpread checks that the three dots of a rest parameter and of a spread
+// stick to what follows them.
+func TestSpread(t *testing.T) {
+	const src = "f = fn(a, b = 10, ... rest) { g(a, ...  rest) }\n"
+	const want = "f = fn(a, b = 10, ...rest) { g(a, ...rest) }\n"
+
+	out, err := Source("test.tau", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+}
+
 // TestStdlib formats every module of the standard library: they are the
 // largest tau sources around, and each of them has to survive untouched.
 func TestStdlib(t *testing.T) {
@@ -48,6 +48,7 @@ const (
 	MinusMinus
 
 	Dot
+	Ellipsis
 	Comma
 	Colon
 	Semicolon
@@ -74,6 +75,13 @@ const (
 	Return
 	Import
 	Tau
+	Select
+	Case
+	Default
+	Switch
+	Defer
+	Nonlocal
+	Const
 )
 
 var typemap = map[Type]string{
@@ -122,6 +130,7 @@ var typemap = map[Type]string{
 	RShift:         ">>",
 
 	Dot:       ".",
+	Ellipsis:  "...",
 	Comma:     ",",
 	Colon:     ":",
 	Semicolon: ";",
@@ -147,6 +156,13 @@ var typemap = map[Type]string{
 	False:    "false",
 	Return:   "return",
 	Import:   "import",
+	Select:   "select",
+	Case:     "case",
+	Default:  "default",
+	Switch:   "switch",
+	Defer:    "defer",
+	Nonlocal: "nonlocal",
+	Const:    "const",
 }
 
 var keywords = map[string]Type{
@@ -162,6 +178,13 @@ var keywords = map[string]Type{
 	"null":     Null,
 	"import":   Import,
 	"tau":      Tau,
+	"select":   Select,
+	"case":     Case,
+	"default":  Default,
+	"switch":   Switch,
+	"defer":    Defer,
+	"nonlocal": Nonlocal,
+	"const":    Const,
 }
 
 func (t Type) String() string {
@@ -302,8 +302,15 @@ func lexExpression(l *lexer) stateFn {
 		l.ignoreSpaces()
 
 	case r == '.':
-		l.emit(item.Dot)
-		l.ignoreSpaces()
+		// Three of them are the parameter that takes the rest of the
+		// arguments, or a list spread over the arguments of a call.
+		if strings.HasPrefix(l.input[l.pos:], "..") {
+			l.pos += 2
+			l.emit(item.Ellipsis)
+		} else {
+			l.emit(item.Dot)
+			l.ignoreSpaces()
+		}
 
 	case r == '{':
 		l.emit(item.LBrace)
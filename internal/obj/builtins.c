@@ -74,11 +74,15 @@ static struct object input_b(struct object *args, size_t len) {
 	char *input = NULL;
 	size_t ilen = 0;
 
+	// Nobody knows when the line comes: the collector doesn't wait for it, and
+	// the other routines get the proc of this thread.
+	gc_park();
 	do {
         tmp = getchar();
         char *reinput = realloc(input, ilen + 1);
         if (reinput == NULL) {
         	free(input);
+        	gc_unpark();
             return errorf("input: error allocating memory");
         }
         input = reinput;
@@ -86,6 +90,7 @@ static struct object input_b(struct object *args, size_t len) {
             input[ilen++] = tmp;
         }
     } while (tmp != '\n' && tmp != '\0');
+	gc_unpark();
 
     if (input != NULL) {
         input[ilen] = '\0';
@@ -120,13 +125,22 @@ static struct object string_b(struct object *args, size_t len) {
 	}
 }
 
+// error(msg) and error(msg, cause), the second making an error that wraps
+// cause: the message is the caller's to write, most often with cause in it.
 static struct object error_b(struct object *args, size_t len) {
-	if (len != 1) {
-		return errorf("error: wrong number of arguments, expected 1, got %lu", len);
+	if (len != 1 && len != 2) {
+		return errorf("error: wrong number of arguments, expected 1 or 2, got %lu", len);
 	} else if (args[0].type != obj_string) {
 		return errorf("error: argument must be a string, got %s", otype_str(args[0].type));
+	} else if (len == 2 && args[1].type != obj_error && args[1].type != obj_null) {
+		return errorf("error: cause must be an error, got %s", otype_str(args[1].type));
+	}
+
+	struct object err = new_error_obj(strndup(args[0].data.str->str, args[0].data.str->len), args[0].data.str->len);
+	if (len == 2) {
+		err.data.err->cause = args[1];
 	}
-	return new_error_obj(strndup(args[0].data.str->str, args[0].data.str->len), args[0].data.str->len);
+	return err;
 }
 
 static struct object type_b(struct object *args, size_t len) {
@@ -293,6 +307,9 @@ static struct object append_b(struct object *args, size_t len) {
 		struct object ret = new_list_obj_data(old->list, old->len, old->cap);
 		struct list *new = ret.data.list;
 		old->owner = obj_gc(ret);
+		// The array was counted when it was allocated, not again for
+		// every list that takes it over.
+		obj_gc(ret)->mark |= GC_INHERITED;
 
 		for (size_t i = 1; i < len; i++) {
 			new->list[new->len++] = args[i];
@@ -651,6 +668,183 @@ static struct object slice_b(struct object *args, size_t len) {
 	}
 }
 
+// gc() collects now, rather than when the heap has grown enough to be worth
+// it. It is for measuring, through memstats, and for tests.
+static struct object gc_b(struct object *args, size_t len) {
+	(void) args;
+	if (len != 0) {
+		return errorf("gc: wrong number of arguments, expected 0, got %lu", len);
+	}
+	gc_collect();
+	return null_obj;
+}
+
+// memstats() is what the collector knows, see MemStats in the runtime module.
+static struct object memstats_b(struct object *args, size_t len) {
+	(void) args;
+	if (len != 0) {
+		return errorf("memstats: wrong number of arguments, expected 0, got %lu", len);
+	}
+	return gc_memstats();
+}
+
+// timer(p, ms, period) sends the monotonic time on p in ms milliseconds, and
+// every period milliseconds after that if period isn't 0. A pipe with no room
+// misses what is sent. With a fourth argument that is sent instead, waiting
+// for room. It returns a number for stoptimer, see the time module.
+static struct object timer_b(struct object *args, size_t len) {
+	if (len != 3 && len != 4) {
+		return errorf("timer: wrong number of arguments, expected 3 or 4, got %lu", len);
+	} else if (args[0].type != obj_pipe) {
+		return errorf("timer: first argument must be a pipe, got %s instead", otype_str(args[0].type));
+	} else if (args[1].type != obj_integer || args[2].type != obj_integer) {
+		return errorf("timer: the delay and the period must be int, got %s and %s instead",
+			otype_str(args[1].type), otype_str(args[2].type));
+	}
+
+	int64_t id = timer_start(args[0], args[1].data.i, args[2].data.i, len == 4 ? &args[3] : NULL);
+	if (id < 0) {
+		return errorf("timer: cannot start the timers");
+	}
+	return new_integer_obj(id);
+}
+
+// stoptimer(id) stops a timer, and reports whether it did before it went
+// off. A ticker is always stopped.
+static struct object stoptimer_b(struct object *args, size_t len) {
+	if (len != 1) {
+		return errorf("stoptimer: wrong number of arguments, expected 1, got %lu", len);
+	} else if (args[0].type != obj_integer) {
+		return errorf("stoptimer: argument must be an int, got %s instead", otype_str(args[0].type));
+	}
+	return parse_bool(timer_stop(args[0].data.i));
+}
+
+// try(fn, args...) calls fn with the arguments and returns what it returns, or
+// an error in place of the runtime error that would have ended the routine:
+// an operator on the wrong types, an index out of range, a stack overflow.
+static struct object try_b(struct object *args, size_t len) {
+	if (len < 1) {
+		return errorf("try: wrong number of arguments, expected at least 1, got 0");
+	}
+
+	struct vm *vm = gc_current_vm();
+	if (vm == NULL) {
+		return errorf("try: there is no virtual machine here");
+	}
+	return vm_try(vm, args[0], &args[1], len - 1);
+}
+
+// sprintf(format, args...) is format with each of its verbs, %d %x %o %b %f
+// %e %g %s %q %v %T, replaced by the argument it is for.
+static struct object sprintf_b(struct object *args, size_t len) {
+	if (len < 1) {
+		return errorf("sprintf: wrong number of arguments, expected at least 1, got 0");
+	} else if (args[0].type != obj_string) {
+		return errorf("sprintf: first argument must be a string, got %s instead", otype_str(args[0].type));
+	}
+	return fmt_sprintf(args[0].data.str->str, args[0].data.str->len, &args[1], len - 1);
+}
+
+// numroutine() is how many tau routines there are, the one running the
+// program included, see NumRoutine in the runtime module.
+static struct object numroutine_b(struct object *args, size_t len) {
+	(void) args;
+	if (len != 0) {
+		return errorf("numroutine: wrong number of arguments, expected 0, got %lu", len);
+	}
+	return new_integer_obj(sched_numroutine());
+}
+
+// The mode of a poll builtin, "r" or "w", and "rw" for both where both go:
+// a bit each, or 0 for none of them.
+static int poll_modes(struct object o, int both) {
+	if (o.type != obj_string) return 0;
+	char *m = o.data.str->str;
+	size_t n = o.data.str->len;
+	if (n == 1 && m[0] == 'r') return 1 << NETPOLL_READ;
+	if (n == 1 && m[0] == 'w') return 1 << NETPOLL_WRITE;
+	if (both && n == 2 && memcmp(m, "rw", 2) == 0) return (1 << NETPOLL_READ) | (1 << NETPOLL_WRITE);
+	return 0;
+}
+
+// pollopen(fd) makes the socket fd non blocking and has the runtime watch it,
+// and returns true, or false when there is nothing here to watch it with and
+// fd is left as it was. See the net module.
+static struct object pollopen_b(struct object *args, size_t len) {
+	if (len != 1) {
+		return errorf("pollopen: wrong number of arguments, expected 1, got %lu", len);
+	} else if (args[0].type != obj_integer) {
+		return errorf("pollopen: argument must be an int, got %s instead", otype_str(args[0].type));
+	}
+
+	int ret = netpoll_open(args[0].data.i);
+	if (ret < 0) {
+		return errorf("pollopen: %s", strerror(errno));
+	}
+	return parse_bool(ret);
+}
+
+// pollwait(fd, mode) waits for the socket fd to be ready for a read, mode
+// "r", or a write, "w", after one said it would block. It returns true when
+// it may be, false when the deadline of polldeadline passed first, and an
+// error when fd is closed or was never opened with pollopen.
+static struct object pollwait_b(struct object *args, size_t len) {
+	if (len != 2) {
+		return errorf("pollwait: wrong number of arguments, expected 2, got %lu", len);
+	} else if (args[0].type != obj_integer) {
+		return errorf("pollwait: first argument must be an int, got %s instead", otype_str(args[0].type));
+	}
+
+	int modes = poll_modes(args[1], 0);
+	if (modes == 0) {
+		return errorf("pollwait: mode must be \"r\" or \"w\"");
+	}
+
+	int ret = netpoll_wait(args[0].data.i, modes == 1 << NETPOLL_READ ? NETPOLL_READ : NETPOLL_WRITE);
+	if (ret < 0) {
+		return errorf("pollwait: the socket is closed");
+	}
+	return parse_bool(ret);
+}
+
+// polldeadline(fd, mode, when) sets when the waits of pollwait on fd give up,
+// a monotonic time in milliseconds like time.Mono says, or null for never.
+// mode is "r", "w" or "rw", and the waits already under way see it too.
+static struct object polldeadline_b(struct object *args, size_t len) {
+	if (len != 3) {
+		return errorf("polldeadline: wrong number of arguments, expected 3, got %lu", len);
+	} else if (args[0].type != obj_integer) {
+		return errorf("polldeadline: first argument must be an int, got %s instead", otype_str(args[0].type));
+	} else if (args[2].type != obj_integer && args[2].type != obj_null) {
+		return errorf("polldeadline: deadline must be int or null, got %s instead", otype_str(args[2].type));
+	}
+
+	int modes = poll_modes(args[1], 1);
+	if (modes == 0) {
+		return errorf("polldeadline: mode must be \"r\", \"w\" or \"rw\"");
+	}
+
+	// A deadline before the clock started is one that has passed.
+	int64_t when = args[2].type == obj_null ? -1 : args[2].data.i < 0 ? 0 : args[2].data.i;
+	for (int m = NETPOLL_READ; m <= NETPOLL_WRITE; m++) {
+		if (modes & (1 << m)) netpoll_deadline(args[0].data.i, m, when);
+	}
+	return null_obj;
+}
+
+// pollclose(fd) stops watching the socket fd, before it is closed: whoever
+// waits on it in pollwait gets an error, and so does whoever comes after.
+static struct object pollclose_b(struct object *args, size_t len) {
+	if (len != 1) {
+		return errorf("pollclose: wrong number of arguments, expected 1, got %lu", len);
+	} else if (args[0].type != obj_integer) {
+		return errorf("pollclose: argument must be an int, got %s instead", otype_str(args[0].type));
+	}
+	netpoll_close(args[0].data.i);
+	return null_obj;
+}
+
 static struct object keys_b(struct object *args, size_t len) {
 	if (len != 1) {
 		return errorf("keys: wrong number of arguments, expected 1, got %lu", len);
@@ -770,5 +964,16 @@ const builtin builtins[] = {
 	delete_b,
 	bytes_b,
 	cfunc_b,
-	cexport_b
+	cexport_b,
+	gc_b,
+	memstats_b,
+	timer_b,
+	stoptimer_b,
+	try_b,
+	sprintf_b,
+	numroutine_b,
+	pollopen_b,
+	pollwait_b,
+	polldeadline_b,
+	pollclose_b
 };
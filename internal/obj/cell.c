@@ -0,0 +1,24 @@
+#include "object.h"
+
+char *cell_str(struct object o) {
+	return object_str(*o.data.cell);
+}
+
+void mark_cell_obj(struct object o) {
+	obj_gc(o)->mark |= GC_MARK;
+	mark_obj(*o.data.cell);
+}
+
+// The cell holds the value in its own payload, there is nothing else to free
+// with it.
+struct object new_cell_obj(struct object val) {
+	struct gc_header *h = gc_alloc(sizeof(struct object));
+	struct object *cell = GC_PAYLOAD(h);
+	*cell = val;
+
+	h->obj = (struct object) {
+		.data.cell = cell,
+		.type = obj_cell,
+	};
+	return h->obj;
+}
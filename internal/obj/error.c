@@ -5,22 +5,79 @@
 #include "object.h"
 
 void dispose_error_obj(struct object o) {
-	free(o.data.str->str);
+	free(o.data.err->msg.str);
+	free(o.data.err->file);
+}
+
+void mark_error_obj(struct object o) {
+	obj_gc(o)->mark |= GC_MARK;
+	mark_obj(o.data.err->cause);
+	mark_obj(o.data.err->code);
+	mark_obj(o.data.err->fields);
 }
 
 char *error_str(struct object o) {
 	return strndup(o.data.str->str, o.data.str->len);
 }
 
+struct object error_get(struct object o, char *name) {
+	struct error *e = o.data.err;
+
+	if (strcmp(name, "Message") == 0) {
+		return new_string_obj(strndup(e->msg.str, e->msg.len), e->msg.len);
+	} else if (strcmp(name, "Cause") == 0) {
+		return e->cause;
+	} else if (strcmp(name, "Code") == 0) {
+		return e->code;
+	} else if (strcmp(name, "File") == 0) {
+		return e->file != NULL ? new_string_obj(strdup(e->file), strlen(e->file)) : null_obj;
+	} else if (strcmp(name, "Line") == 0) {
+		return e->file != NULL ? new_integer_obj(e->line) : null_obj;
+	} else if (e->fields.type == obj_object) {
+		return object_get(e->fields, name);
+	}
+	return null_obj;
+}
+
+int error_set(struct object o, char *name, struct object val) {
+	struct error *e = o.data.err;
+
+	if (strcmp(name, "Message") == 0 || strcmp(name, "File") == 0 || strcmp(name, "Line") == 0) {
+		return -1;
+	} else if (strcmp(name, "Cause") == 0) {
+		e->cause = val;
+	} else if (strcmp(name, "Code") == 0) {
+		e->code = val;
+	} else {
+		if (e->fields.type != obj_object) {
+			e->fields = new_object();
+		}
+		object_set(e->fields, name, val);
+	}
+	return 0;
+}
+
+// The error takes str, and is placed where the VM of this thread is: the
+// builtin that failed, or the call to error(), is what the program wants to
+// find when it looks at one.
 struct object new_error_obj(char *str, size_t len) {
-	struct gc_header *h = gc_alloc(sizeof(struct string));
-	struct string *s = GC_PAYLOAD(h);
-	s->str = str;
-	s->len = len;
-	s->owner = NULL;
+	struct gc_header *h = gc_alloc(sizeof(struct error));
+	struct error *e = GC_PAYLOAD(h);
+	e->msg = (struct string) {
+		.str = str,
+		.len = len,
+		.owner = NULL,
+	};
+	e->cause = null_obj;
+	e->code = null_obj;
+	e->fields = null_obj;
+
+	char *file;
+	vm_where(gc_current_vm(), &file, &e->line);
+	e->file = file != NULL ? strdup(file) : NULL;
 
 	h->obj = (struct object) {
-		.data.str = s,
+		.data.err = e,
 		.type = obj_error,
 	};
 	return h->obj;
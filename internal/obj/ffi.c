@@ -370,9 +370,12 @@ static void cexport_entry(ffi_cif *cif, void *ret, void **args, void *user) {
 	}
 
 	// Running tau again, so this thread is no longer parked: it was, for the
-	// call into C that led here.
+	// call into C that led here. The routine stays on this thread until it is
+	// back in C, which may well care what thread it is on.
 	gc_unpark();
+	sched_pin();
 	struct object res = vm_call_tau(vm, cb->fn, objs, cb->nargs);
+	sched_unpin();
 	gc_park();
 
 	if (cb->ret == 'v') {
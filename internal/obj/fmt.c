@@ -0,0 +1,412 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdint.h>
+#include <stdarg.h>
+#include "object.h"
+
+// A verb as it is written after the %: the flags, the width, the precision and
+// the letter saying what to make of the value.
+struct spec {
+	int minus;
+	int plus;
+	int space;
+	int zero;
+	int sharp;
+	int width;
+	int prec;
+	char verb;
+};
+
+// The text being built, which grows as it needs to.
+struct fmtbuf {
+	char *s;
+	size_t len;
+	size_t cap;
+};
+
+static void buf_grow(struct fmtbuf *b, size_t n) {
+	if (b->len + n + 1 > b->cap) {
+		b->cap = (b->len + n + 1) * 2;
+		b->s = realloc(b->s, b->cap);
+	}
+}
+
+static void buf_write(struct fmtbuf *b, const char *s, size_t n) {
+	buf_grow(b, n);
+	memcpy(b->s + b->len, s, n);
+	b->len += n;
+	b->s[b->len] = '\0';
+}
+
+static void buf_fill(struct fmtbuf *b, char c, int n) {
+	if (n <= 0) return;
+	buf_grow(b, n);
+	memset(b->s + b->len, c, n);
+	b->len += n;
+	b->s[b->len] = '\0';
+}
+
+// The characters in s, which is what a width counts: a table of names has to
+// line up whatever the names are written in.
+static int runes(const char *s, size_t len) {
+	int n = 0;
+	for (size_t i = 0; i < len; i++) {
+		n += ((uint8_t) s[i] & 0xc0) != 0x80;
+	}
+	return n;
+}
+
+// parse_spec reads the verb at the start of s, which is len bytes long, and
+// returns how many of them it took, or -1 if they make no verb.
+static int parse_spec(const char *s, size_t len, struct spec *sp) {
+	size_t i = 0;
+
+	*sp = (struct spec) {.prec = -1};
+	for (; i < len; i++) {
+		switch (s[i]) {
+		case '-': sp->minus = 1; continue;
+		case '+': sp->plus = 1; continue;
+		case ' ': sp->space = 1; continue;
+		case '0': sp->zero = 1; continue;
+		case '#': sp->sharp = 1; continue;
+		}
+		break;
+	}
+	for (; i < len && s[i] >= '0' && s[i] <= '9'; i++) {
+		sp->width = sp->width * 10 + s[i] - '0';
+	}
+	if (i < len && s[i] == '.') {
+		sp->prec = 0;
+		for (i++; i < len && s[i] >= '0' && s[i] <= '9'; i++) {
+			sp->prec = sp->prec * 10 + s[i] - '0';
+		}
+	}
+	if (i >= len || strchr("dxXobfeEgGsqvT", s[i]) == NULL || s[i] == '\0') {
+		return -1;
+	}
+	sp->verb = s[i];
+	return i + 1;
+}
+
+// pad writes the parts of a value where the width puts them: the spaces, or
+// the zeros that go between the sign and the digits, before it or after it.
+static void pad(struct fmtbuf *b, struct spec *sp, const char *sign, const char *body, size_t len) {
+	size_t signlen = strlen(sign);
+	int fill = sp->width - (int) signlen - runes(body, len);
+
+	if (sp->minus) {
+		buf_write(b, sign, signlen);
+		buf_write(b, body, len);
+		buf_fill(b, ' ', fill);
+	} else if (sp->zero) {
+		buf_write(b, sign, signlen);
+		buf_fill(b, '0', fill);
+		buf_write(b, body, len);
+	} else {
+		buf_fill(b, ' ', fill);
+		buf_write(b, sign, signlen);
+		buf_write(b, body, len);
+	}
+}
+
+static void fmt_int(struct fmtbuf *b, struct spec *sp, int64_t v) {
+	char digits[72];
+	char *d = digits + sizeof(digits);
+	const char *alpha = sp->verb == 'X' ? "0123456789ABCDEF" : "0123456789abcdef";
+	const char *prefix = "";
+	int base = 10;
+
+	switch (sp->verb) {
+	case 'x': base = 16; prefix = "0x"; break;
+	case 'X': base = 16; prefix = "0X"; break;
+	case 'o': base = 8; prefix = "0o"; break;
+	case 'b': base = 2; prefix = "0b"; break;
+	}
+
+	// The magnitude, which for the smallest int is one past the largest.
+	uint64_t u = v < 0 ? -(uint64_t) v : (uint64_t) v;
+	int n = 0;
+	do {
+		*--d = alpha[u % base];
+		u /= base;
+		n++;
+	} while (u > 0);
+	for (; n < sp->prec; n++) {
+		*--d = '0';
+	}
+
+	char sign[8] = {0};
+	if (v < 0) {
+		strcpy(sign, "-");
+	} else if (sp->plus) {
+		strcpy(sign, "+");
+	} else if (sp->space) {
+		strcpy(sign, " ");
+	}
+	if (sp->sharp && base != 10) {
+		strcat(sign, prefix);
+	}
+
+	// A precision says how many digits there are, the width does not add to
+	// them.
+	if (sp->prec >= 0) {
+		sp->zero = 0;
+	}
+	pad(b, sp, sign, d, digits + sizeof(digits) - d);
+}
+
+static void fmt_float(struct fmtbuf *b, struct spec *sp, double f) {
+	char verb = sp->verb;
+	int prec = sp->prec;
+
+	// %g with no precision is the fewest digits that read back as the same
+	// number, which is how a float prints anywhere else. They are written
+	// with an exponent from a million up, as Go does, and not from where the
+	// digits run out: 100 is 100 and not 1e+02.
+	if ((verb == 'g' || verb == 'G') && prec < 0) {
+		char probe[40];
+		int digits;
+		for (digits = 1; digits < 17; digits++) {
+			snprintf(probe, sizeof(probe), "%.*e", digits - 1, f);
+			if (strtod(probe, NULL) == f) {
+				break;
+			}
+		}
+
+		// Infinities and NaN have no exponent, and no digits to count. This
+		// looks at the text and not at isfinite(), which -Ofast makes lie.
+		char *e = strchr(probe, 'e');
+		int exp = e != NULL ? atoi(e + 1) : 0;
+		if (e == NULL) {
+			prec = 0;
+		} else if (exp < -4 || exp >= 6) {
+			verb = verb == 'g' ? 'e' : 'E';
+			prec = digits - 1;
+		} else {
+			verb = 'f';
+			prec = digits - 1 - exp > 0 ? digits - 1 - exp : 0;
+		}
+	} else if (prec < 0) {
+		prec = 6;
+	}
+
+	char cfmt[16];
+	snprintf(cfmt, sizeof(cfmt), "%%%s%s%s%s*.*%c",
+		sp->minus ? "-" : "",
+		sp->plus ? "+" : (sp->space ? " " : ""),
+		sp->zero ? "0" : "",
+		sp->sharp ? "#" : "",
+		verb
+	);
+
+	int n = snprintf(NULL, 0, cfmt, sp->width, prec, f);
+	buf_grow(b, n);
+	snprintf(b->s + b->len, n + 1, cfmt, sp->width, prec, f);
+	b->len += n;
+}
+
+// quote writes s between double quotes, with what isn't printable escaped the
+// way a tau string literal would write it.
+static void quote(struct fmtbuf *b, const char *s, size_t len) {
+	buf_write(b, "\"", 1);
+	for (size_t i = 0; i < len; i++) {
+		uint8_t c = s[i];
+		char esc[8];
+
+		switch (c) {
+		case '"': buf_write(b, "\\\"", 2); continue;
+		case '\\': buf_write(b, "\\\\", 2); continue;
+		case '\n': buf_write(b, "\\n", 2); continue;
+		case '\t': buf_write(b, "\\t", 2); continue;
+		case '\r': buf_write(b, "\\r", 2); continue;
+		}
+		if (c < 0x20 || c == 0x7f) {
+			snprintf(esc, sizeof(esc), "\\x%02x", c);
+			buf_write(b, esc, 4);
+		} else {
+			buf_write(b, (char *) &c, 1);
+		}
+	}
+	buf_write(b, "\"", 1);
+}
+
+// The text a value stands for in %s and %v, and what %q quotes: a string is
+// itself, anything else is what printing it shows.
+static char *text(struct object o, size_t *len) {
+	switch (o.type) {
+	case obj_string:
+		*len = o.data.str->len;
+		return strndup(o.data.str->str, o.data.str->len);
+	case obj_bytes:
+		*len = o.data.bytes->len;
+		return strndup((char *) o.data.bytes->bytes, o.data.bytes->len);
+	default: {
+		char *s = object_str(o);
+		*len = strlen(s);
+		return s;
+	}
+	}
+}
+
+static void fmt_text(struct fmtbuf *b, struct spec *sp, struct object o) {
+	size_t len;
+	char *s = text(o, &len);
+
+	// The precision is how many characters of it are kept.
+	if (sp->prec >= 0) {
+		size_t i = 0;
+		for (int n = 0; i < len; i++) {
+			if (((uint8_t) s[i] & 0xc0) != 0x80 && n++ == sp->prec) {
+				break;
+			}
+		}
+		len = i;
+	}
+
+	if (sp->verb == 'q') {
+		struct fmtbuf q = {0};
+		quote(&q, s, len);
+		pad(b, sp, "", q.s, q.len);
+		free(q.s);
+	} else {
+		pad(b, sp, "", s, len);
+	}
+	free(s);
+}
+
+// The bytes of a string, or of a bytes, two hex digits each.
+static void fmt_hex(struct fmtbuf *b, struct spec *sp, const uint8_t *s, size_t len) {
+	const char *alpha = sp->verb == 'X' ? "0123456789ABCDEF" : "0123456789abcdef";
+	char *hex = malloc(len * 2 + 1);
+
+	for (size_t i = 0; i < len; i++) {
+		hex[i*2] = alpha[s[i] >> 4];
+		hex[i*2+1] = alpha[s[i] & 0xf];
+	}
+	pad(b, sp, sp->sharp ? (sp->verb == 'X' ? "0X" : "0x") : "", hex, len * 2);
+	free(hex);
+}
+
+// fmt_one writes o the way the verb sp says, or writes a message to err and
+// returns -1 when the verb doesn't take that kind of value.
+static int fmt_one(struct fmtbuf *b, struct spec *sp, struct object o, char *err, size_t errlen) {
+	switch (sp->verb) {
+	case 'd':
+	case 'o':
+	case 'b':
+		if (o.type == obj_integer) {
+			fmt_int(b, sp, o.data.i);
+			return 0;
+		}
+		break;
+
+	case 'x':
+	case 'X':
+		if (o.type == obj_integer) {
+			fmt_int(b, sp, o.data.i);
+			return 0;
+		} else if (o.type == obj_string) {
+			fmt_hex(b, sp, (uint8_t *) o.data.str->str, o.data.str->len);
+			return 0;
+		} else if (o.type == obj_bytes) {
+			fmt_hex(b, sp, o.data.bytes->bytes, o.data.bytes->len);
+			return 0;
+		}
+		break;
+
+	case 'f':
+	case 'e':
+	case 'E':
+	case 'g':
+	case 'G':
+		if (o.type == obj_float) {
+			fmt_float(b, sp, o.data.f);
+			return 0;
+		} else if (o.type == obj_integer) {
+			fmt_float(b, sp, o.data.i);
+			return 0;
+		}
+		break;
+
+	case 's':
+	case 'q':
+	case 'v':
+		fmt_text(b, sp, o);
+		return 0;
+
+	case 'T': {
+		char *t = otype_str(o.type);
+		pad(b, sp, "", t, strlen(t));
+		return 0;
+	}
+	}
+
+	snprintf(err, errlen, "%%%c can't format %s", sp->verb, otype_str(o.type));
+	return -1;
+}
+
+// fmt_value is o as the spec of an interpolation, "08.3f" in "{x:08.3f}",
+// says to write it. It returns NULL, with the reason in err, when the spec is
+// no verb or the verb doesn't take o.
+char *fmt_value(struct object o, const char *spec, size_t speclen, size_t *len, char *err, size_t errlen) {
+	struct spec sp;
+	if (parse_spec(spec, speclen, &sp) != (int) speclen) {
+		snprintf(err, errlen, "bad format \"%.*s\"", (int) speclen, spec);
+		return NULL;
+	}
+
+	struct fmtbuf b = {0};
+	buf_grow(&b, 0);
+	if (fmt_one(&b, &sp, o, err, errlen) < 0) {
+		free(b.s);
+		return NULL;
+	}
+	*len = b.len;
+	return b.s;
+}
+
+// fmt_sprintf is the sprintf builtin: format, len bytes long, with a verb for
+// each of the args. Every argument has to be used, and by a verb that takes
+// it, or what comes back is an error saying which one wasn't.
+struct object fmt_sprintf(const char *format, size_t len, struct object *args, size_t nargs) {
+	struct fmtbuf b = {0};
+	size_t argi = 0;
+	char err[128];
+
+	buf_grow(&b, len);
+	for (size_t i = 0; i < len; i++) {
+		if (format[i] != '%') {
+			buf_write(&b, &format[i], 1);
+			continue;
+		}
+		if (i + 1 < len && format[i+1] == '%') {
+			buf_write(&b, "%", 1);
+			i++;
+			continue;
+		}
+
+		struct spec sp;
+		int n = parse_spec(&format[i+1], len - i - 1, &sp);
+		if (n < 0) {
+			free(b.s);
+			return errorf("sprintf: bad verb at %lu in \"%.*s\"", i, (int) len, format);
+		}
+		if (argi >= nargs) {
+			free(b.s);
+			return errorf("sprintf: %%%c has no argument", sp.verb);
+		}
+		if (fmt_one(&b, &sp, args[argi], err, sizeof(err)) < 0) {
+			free(b.s);
+			return errorf("sprintf: argument %lu: %s", argi + 1, err);
+		}
+		argi++;
+		i += n;
+	}
+
+	if (argi < nargs) {
+		free(b.s);
+		return errorf("sprintf: %lu arguments for %lu verbs", nargs, argi);
+	}
+	return new_string_obj(b.s, b.len);
+}
@@ -10,6 +10,8 @@ static void dispose_function_parts(struct function *fn) {
 	}
 	free(fn->bookmarks);
 	free(fn->instructions);
+	free(fn->name);
+	free(fn->file);
 }
 
 inline void dispose_function_data(struct function *fn) {
@@ -37,8 +39,9 @@ char *function_str(struct object o) {
 // to it, and the interpreter went on executing whatever landed there next.
 //
 // The line of a bookmark is already a C string, so copying the array keeps
-// it as it was.
-static void function_init(struct function *fn, uint8_t *insts, size_t len, uint32_t num_locals, uint32_t num_params, struct bookmark *bmarks, uint32_t bklen) {
+// it as it was. The name and the file are copied for the same reason the
+// instructions are.
+static void function_init(struct function *fn, uint8_t *insts, size_t len, uint32_t num_locals, uint32_t num_params, struct bookmark *bmarks, uint32_t bklen, char *name, char *file) {
 	fn->instructions = malloc(len > 0 ? len : 1);
 	if (len > 0) {
 		memcpy(fn->instructions, insts, len);
@@ -53,22 +56,26 @@ static void function_init(struct function *fn, uint8_t *insts, size_t len, uint3
 	fn->len = len;
 	fn->num_locals = num_locals;
 	fn->num_params = num_params;
+	fn->num_required = num_params;
+	fn->variadic = 0;
 	fn->bklen = bklen;
+	fn->name = name != NULL ? strdup(name) : NULL;
+	fn->file = file != NULL ? strdup(file) : NULL;
 }
 
 // A function nobody collects: the one a VM runs, which outlives every object.
-inline struct function *new_function(uint8_t *insts, size_t len, uint32_t num_locals, uint32_t num_params, struct bookmark *bmarks, uint32_t bklen) {
+inline struct function *new_function(uint8_t *insts, size_t len, uint32_t num_locals, uint32_t num_params, struct bookmark *bmarks, uint32_t bklen, char *name, char *file) {
 	struct function *fn = malloc(sizeof(struct function));
 
-	function_init(fn, insts, len, num_locals, num_params, bmarks, bklen);
+	function_init(fn, insts, len, num_locals, num_params, bmarks, bklen, name, file);
 	return fn;
 }
 
-inline struct object new_function_obj(uint8_t *insts, size_t len, uint32_t num_locals, uint32_t num_params, struct bookmark *bmarks, uint32_t bklen) {
+inline struct object new_function_obj(uint8_t *insts, size_t len, uint32_t num_locals, uint32_t num_params, struct bookmark *bmarks, uint32_t bklen, char *name, char *file) {
 	struct gc_header *h = gc_alloc(sizeof(struct function));
 	struct function *fn = GC_PAYLOAD(h);
 
-	function_init(fn, insts, len, num_locals, num_params, bmarks, bklen);
+	function_init(fn, insts, len, num_locals, num_params, bmarks, bklen, name, file);
 	h->obj = (struct object) {
 		.data.fn = fn,
 		.type = obj_function,
@@ -162,6 +162,33 @@ struct object map_keys(struct object map) {
 	return list;
 }
 
+// map_next returns the pair that comes after key in the order of the tree,
+// the first one when key is NULL, and a pair with a null key after the last.
+// It finds its way by the hash alone, so a key that has been deleted meanwhile
+// still says where to go on from: a for loop goes through a map that changes
+// under it seeing every pair at most once, and the ones added after the
+// point it reached.
+struct map_pair map_next(struct object map, struct object *key) {
+	struct map_node *n = map.data.map->root;
+	struct map_node *next = NULL;
+	struct key_hash k;
+
+	if (key != NULL) k = hash(*key);
+	while (n != NULL) {
+		if (key == NULL || memcmp(&n->key, &k, sizeof(struct key_hash)) > 0) {
+			next = n;
+			n = n->l;
+		} else {
+			n = n->r;
+		}
+	}
+
+	if (next == NULL) {
+		return (struct map_pair) {.key = null_obj, .val = null_obj};
+	}
+	return next->val;
+}
+
 struct map_pair map_get(struct object map, struct object o) {
 	return _map_get(map.data.map->root, hash(o));
 }
@@ -19,6 +19,13 @@ static inline struct object _object_get(struct object_node * restrict n, uint64_
 	}
 }
 
+static inline struct object_node *_object_find(struct object_node * restrict n, uint64_t key) {
+	while (n != NULL && n->key != key) {
+		n = key < n->key ? n->l : n->r;
+	}
+	return n;
+}
+
 static void mark_object_children(struct object_node * restrict n) {
 	if (n != NULL) {
 		mark_obj(n->val);
@@ -32,10 +39,12 @@ struct object object_to_module(struct object o);
 static void _object_to_module(struct object mod, struct object_node * restrict n) {
 	if (n != NULL) {
 		if (isupper(*n->name)) {
-			if (n->val.type == obj_object) {
-				object_set(mod, n->name, object_to_module(n->val));
+			struct object val = n->val.type == obj_object ? object_to_module(n->val) : n->val;
+
+			if (n->readonly) {
+				object_set_const(mod, n->name, val);
 			} else {
-				object_set(mod, n->name, n->val);
+				object_set(mod, n->name, val);
 			}
 		}
 		_object_to_module(mod, n->l);
@@ -49,6 +58,7 @@ static inline void _object_set(struct object_node **n, uint64_t key, char *name,
 		(*n)->name = strdup(name);
 		(*n)->key = key;
 		(*n)->val = val;
+		(*n)->readonly = 0;
 		(*n)->l = NULL;
 		(*n)->r = NULL;
 		return;
@@ -82,6 +92,21 @@ struct object object_set(struct object obj, char *name, struct object val) {
 	return val;
 }
 
+// object_set_const sets the field name of obj and makes it one that can't be
+// assigned again. Only the VM looks at that: C code, the loader of a module
+// first, sets what it needs to.
+void object_set_const(struct object obj, char *name, struct object val) {
+	uint64_t key = fnv64a(name, strlen(name));
+
+	_object_set(obj.data.obj, key, name, val);
+	_object_find(*obj.data.obj, key)->readonly = 1;
+}
+
+int object_is_const(struct object obj, char *name) {
+	struct object_node *n = _object_find(*obj.data.obj, fnv64a(name, strlen(name)));
+	return n != NULL && n->readonly;
+}
+
 void dispose_object_obj(struct object obj) {
 	_object_dispose(*obj.data.obj);
 }
@@ -104,6 +104,17 @@ var (
 		"bytes",
 		"cfunc",
 		"cexport",
+		"gc",
+		"memstats",
+		"timer",
+		"stoptimer",
+		"try",
+		"sprintf",
+		"numroutine",
+		"pollopen",
+		"pollwait",
+		"polldeadline",
+		"pollclose",
 	}
 
 	NullObj  = Object(C.null_obj)
@@ -210,15 +221,39 @@ func CArray[CT, GoT any](s []GoT) *CT {
 	return nil
 }
 
-func NewFunctionCompiled(ins code.Instructions, nlocals, nparams int, bmarks []tauerr.Bookmark) Object {
-	return Object(C.new_function_obj(
+// NewFunctionCompiled makes a function out of what the compiler produced. The
+// name and the file are only for the traces of the errors, either can be
+// empty; nrequired and variadic are what a call is checked against.
+func NewFunctionCompiled(ins code.Instructions, nlocals, nparams, nrequired int, variadic bool, bmarks []tauerr.Bookmark, name, file string) Object {
+	cname, cfile := cstringOrNil(name), cstringOrNil(file)
+	defer C.free(unsafe.Pointer(cname))
+	defer C.free(unsafe.Pointer(cfile))
+
+	fn := C.new_function_obj(
 		(*C.uchar)(unsafe.Pointer(&ins[0])),
 		C.size_t(len(ins)),
 		C.uint(nlocals),
 		C.uint(nparams),
 		CArray[C.struct_bookmark, tauerr.Bookmark](bmarks),
 		C.uint(len(bmarks)),
-	))
+		cname,
+		cfile,
+	)
+	cf := C.function_val(fn)
+	cf.num_required = C.uint(nrequired)
+	if variadic {
+		cf.variadic = 1
+	}
+	return Object(fn)
+}
+
+// cstringOrNil is C.CString with NULL for the empty string, which is how the
+// C side says that something is missing.
+func cstringOrNil(s string) *C.char {
+	if s == "" {
+		return nil
+	}
+	return C.CString(s)
 }
 
 func AssertTypes(o Object, types ...Type) bool {
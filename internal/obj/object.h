@@ -10,7 +10,11 @@
 //
 //   bit  0    GC_MARK: reachable, set by the mark phase, cleared by the sweep.
 //   bit  1    GC_TRACKED: already in the heap, prevents adding it twice.
-//   bits 2..  epoch of the last visit of the mark phase.
+//   bit  2    GC_SAMPLED: picked by the heap profiler, which wants to hear
+//             when it is freed.
+//   bit  3    GC_INHERITED: the buffer came from an object already in the
+//             heap, which was charged for it, see heap_add.
+//   bits 4..  epoch of the last visit of the mark phase.
 //
 // The mark bit alone can't say whether an object was already traversed: a
 // slice marks the header of its owner before the owner itself is visited.
@@ -18,7 +22,9 @@
 // bit it needs no cleanup for the objects that aren't in the heap.
 #define GC_MARK        1
 #define GC_TRACKED     2
-#define GC_EPOCH_SHIFT 2
+#define GC_SAMPLED     4
+#define GC_INHERITED   8
+#define GC_EPOCH_SHIFT 4
 
 extern uint32_t gc_epoch;
 
@@ -43,16 +49,34 @@ enum obj_type {
 	// A native function with a declared signature. It is added at the end so
 	// that the values of the ones before it, which the bytecode carries, stay
 	// where they were.
-	obj_native_fn
+	obj_native_fn,
+	// A variable a closure shares with the function it was made in, because
+	// one of them declared it nonlocal. It lives in the slot of the variable
+	// and among the free values of the closures and holds the value, so that
+	// both see what either assigns. The program never gets hold of one: the
+	// instructions that read the variable read what it holds.
+	obj_cell
 };
 
+#define OBJ_NTYPES (obj_cell + 1)
+
 struct function {
 	uint8_t *instructions;
 	size_t len;
 	uint32_t num_locals;
 	uint32_t num_params;
+	// The parameters a call can't leave out, the ones up to the last with no
+	// default, and whether the function takes the arguments past num_params
+	// as a list, in the local after the parameters.
+	uint32_t num_required;
+	uint32_t variadic;
 	uint32_t bklen;
 	struct bookmark *bookmarks;
+	// The name the function was assigned to and the file it was written in,
+	// for the traces of the errors. NULL for an anonymous function and for
+	// one that comes from the file the VM is running.
+	char *name;
+	char *file;
 };
 
 struct closure {
@@ -87,6 +111,15 @@ struct bytes {
 	struct gc_header *owner;
 };
 
+// Who waits for something guarded by a mutex, a condition variable for routines
+// and threads alike, implemented in waitq.c: a routine parks and a thread
+// blocks. It is all zeroes to start with and needs nothing to end.
+struct waiter;
+struct waitq {
+	struct waiter *head;
+	struct waiter *tail;
+};
+
 struct pipe {
 	struct object *buf;
 	size_t cap;
@@ -101,9 +134,25 @@ struct pipe {
 	// the buffer, is what tells a sender its value has been taken.
 	uint64_t sent;
 	uint64_t recvd;
+	// How many threads are blocked in a recv on this pipe, ready to take a
+	// value right now. An unbuffered send in a select only puts its value down
+	// if one of them is there to take it: a select waiting to receive counts
+	// for nothing here, it may go with another case.
+	uint32_t receivers;
+	// The selects waiting on this pipe, woken up whenever a value goes in or
+	// comes out, when a receiver shows up and when the pipe is closed.
+	struct select_node *selects;
+	// Where the pipe was made, which is how the trace and the dump of a
+	// deadlock name it. NULL when it was made by no tau code.
+	char *file;
+	int32_t line;
 	mtx_t mu;
-	cnd_t not_empty;
-	cnd_t not_full;
+	struct waitq not_empty;
+	struct waitq not_full;
+	// The unbuffered senders waiting for their value to be taken, apart from
+	// those waiting for room: each value taken makes room for one sender, and
+	// may be the one any of these is waiting for.
+	struct waitq taken;
 };
 
 union data {
@@ -113,6 +162,8 @@ union data {
 	struct function *fn;
 	struct closure *cl;
 	struct string *str;
+	struct error *err;
+	struct object *cell;
 	struct bytes *bytes;
 	struct list *list;
 	struct map *map;
@@ -126,6 +177,36 @@ struct object {
 	enum obj_type type;
 };
 
+// An error: its message first, so that what only needs the message (string(),
+// len(), a map key) reads it as a string, then what the program attached to
+// it. cause is the error it wraps and code what tells it apart from others
+// (an errno, a status), both null for none; fields holds any other field set
+// on it and stays null until the first one is. file and line are where the tau
+// code that made it was, NULL and 0 if none was running.
+struct error {
+	struct string msg;
+	struct object cause;
+	struct object code;
+	struct object fields;
+	char *file;
+	int32_t line;
+};
+
+enum select_kind {
+	select_recv,
+	select_send
+};
+
+// A case of a select. The value is the one to send for a send case and what
+// was received for a receive case once it has been chosen. A send to a closed
+// pipe is a case that is ready like any other, only closed is set.
+struct select_case {
+	struct object pipe;
+	struct object val;
+	enum select_kind kind;
+	int closed;
+};
+
 // Every collectable object owns one of these: it holds the state the
 // collector keeps about the object, doubles as its node in the heap, and is
 // allocated in one block with what `data` points at, which follows it.
@@ -182,6 +263,9 @@ struct object_node {
 	char *name;
 	uint64_t key;
 	struct object val;
+	// Set on the constants a module exports, which the program that imported
+	// it can read but not assign.
+	uint32_t readonly;
 	struct object_node *l;
 	struct object_node *r;
 };
@@ -230,6 +314,11 @@ void dispose_bytes_obj(struct object o);
 struct object new_error_obj(char *msg, size_t len);
 struct object errorf(char *fmt, ...);
 char *error_str(struct object o);
+// The field of an error, null if it has none by that name, and the setting of
+// one: -1 for the ones that can only be read (Message, File, Line).
+struct object error_get(struct object o, char *name);
+int error_set(struct object o, char *name, struct object val);
+void mark_error_obj(struct object o);
 void dispose_error_obj(struct object o);
 
 // List object.
@@ -247,7 +336,9 @@ struct object new_pipe();
 struct object new_buffered_pipe(size_t size);
 int pipe_send(struct object pipe, struct object o);
 struct object pipe_recv(struct object pipe);
+int pipe_next(struct object pipe, struct object *val);
 int pipe_close(struct object pipe);
+int pipe_select(struct select_case *cases, size_t n, int64_t timeout);
 void mark_pipe_obj(struct object pipe);
 void dispose_pipe_obj(struct object pipe);
 
@@ -260,11 +351,14 @@ char *map_str(struct object map);
 void map_delete(struct object map, struct object key);
 void dispose_map_obj(struct object map);
 struct object map_keys(struct object map);
+struct map_pair map_next(struct object map, struct object *key);
 
 // Object object.
 struct object new_object();
 struct object object_get(struct object obj, char *name);
 struct object object_set(struct object obj, char *name, struct object val);
+void object_set_const(struct object obj, char *name, struct object val);
+int object_is_const(struct object obj, char *name);
 struct object object_to_module(struct object o);
 struct object object_keys(struct object o);
 void mark_object_obj(struct object o);
@@ -278,7 +372,9 @@ struct function *new_function(
 	uint32_t num_locals,
 	uint32_t num_params,
 	struct bookmark *bmarks,
-	uint32_t num_bookmarks
+	uint32_t num_bookmarks,
+	char *name,
+	char *file
 );
 struct object new_function_obj(
 	uint8_t *insts,
@@ -286,7 +382,9 @@ struct object new_function_obj(
 	uint32_t num_locals,
 	uint32_t num_params,
 	struct bookmark *bmarks,
-	uint32_t num_bookmarks
+	uint32_t num_bookmarks,
+	char *name,
+	char *file
 );
 char *function_str(struct object o);
 void dispose_function_obj(struct object o);
@@ -298,6 +396,11 @@ char *closure_str(struct object o);
 void dispose_closure_obj(struct object o);
 void mark_closure_obj(struct object c);
 
+// Cell object.
+struct object new_cell_obj(struct object val);
+char *cell_str(struct object o);
+void mark_cell_obj(struct object o);
+
 // Native function object: a C function plus the signature that says how to
 // talk to it, see ffi.c.
 struct object new_native_obj(void *fn, int64_t ret, const int64_t *args, size_t nargs);
@@ -311,6 +414,10 @@ typedef struct object (*builtin)(struct object *args, size_t len);
 extern const builtin builtins[];
 struct object new_builtin_obj(struct object (*builtin)(struct object *args, size_t len));
 
+// Formatting with printf-style verbs, see fmt.c.
+struct object fmt_sprintf(const char *format, size_t len, struct object *args, size_t nargs);
+char *fmt_value(struct object o, const char *spec, size_t speclen, size_t *len, char *err, size_t errlen);
+
 // Util functions.
 char *otype_str(enum obj_type t);
 char *object_str(struct object o);
@@ -345,13 +452,106 @@ static inline struct gc_header *slice_owner(struct object o) {
 // Park before blocking so the collector doesn't wait for this thread.
 void gc_park(void);
 void gc_unpark(void);
+// A collection now, and what the collector has to say: the gc and memstats
+// builtins, which the runtime module is made of.
+void gc_collect(void);
+struct object gc_memstats(void);
+// Timers, implemented in ../vm/timer.c: the timer and stoptimer builtins,
+// which the time module is made of. val is what to send, NULL for the time.
+int64_t timer_start(struct object pipe, int64_t ms, int64_t period, struct object *val);
+int timer_stop(int64_t id);
+// A call to fn at when, on the monotonic clock of timer_now in milliseconds,
+// for the waits with a deadline. fn runs on the thread of the timers with its
+// mutex held, so it does no more than wake somebody up; timer_stop takes it
+// back.
+int64_t timer_call(int64_t when, void (*fn)(void *), void *arg);
+int64_t timer_now(void);
+// The network poller, implemented in ../vm/netpoll.c: the pollopen, pollwait,
+// polldeadline and pollclose builtins, which the net module is made of.
+// netpoll_open makes a socket non blocking and watched, and says 1, or 0 when
+// there is no poller here, -1 with errno set when it can't. netpoll_wait waits
+// for the socket to be ready in mode, 1, for its deadline to pass, 0, or for
+// it to be closed, -1. The deadline is on the clock of timer_now, -1 for none.
+#define NETPOLL_READ  0
+#define NETPOLL_WRITE 1
+int netpoll_open(int64_t fd);
+int netpoll_wait(int64_t fd, int mode);
+void netpoll_deadline(int64_t fd, int mode, int64_t when);
+void netpoll_close(int64_t fd);
+
+// The scheduler, implemented in ../vm/sched.c: the tau routines are not
+// threads, and a routine that waits should leave its thread to the others.
+// sched_current is the routine running here, NULL when there is none or it
+// can't leave; sched_park parks it and lets go of mu, and sched_ready wakes it
+// up. A wait that blocks the thread all the same says so around it with
+// sched_block and sched_unblock, which gc_park and gc_unpark do too.
+void *sched_current(void);
+void sched_park(mtx_t *mu);
+void sched_ready(void *routine);
+int sched_block(void);
+void sched_unblock(void);
+// A call back into Go stays on the thread it started on.
+void sched_pin(void);
+void sched_unpin(void);
+int64_t sched_numroutine(void);
+
+// Wait queues, see struct waitq.
+void waitq_wait(struct waitq *q, mtx_t *mu);
+// deadline is on the clock of timer_now, -1 for none; returns whether it passed.
+int waitq_timedwait(struct waitq *q, mtx_t *mu, int64_t deadline);
+void waitq_signal(struct waitq *q);
+void waitq_broadcast(struct waitq *q);
+
+// What a routine asleep on pipes waits for.
+enum wait_reason {
+	wait_send,   // For room, or for an unbuffered value to be taken.
+	wait_recv,   // For a value.
+	wait_select  // For any of the cases of a select.
+};
+
+// A routine asleep on pipes tells the collector what would wake it, through
+// gc_park_wait, and that is how a deadlock is told: every routine asleep, and
+// none of them on a wait that is over. ready is asked with every VM asleep on
+// one of these, so nobody is touching the pipes and it reads them as they are.
+struct pipe_wait {
+	enum wait_reason why;
+	struct pipe **pipes;
+	size_t n;
+	int (*ready)(struct pipe_wait *w);
+	// What an unbuffered send waits to see taken, and the flag a select is
+	// woken with.
+	uint64_t ticket;
+	int *fired;
+};
+
+// Parks the routine, like gc_park, for as long as it sleeps on w. Unlike
+// gc_park it doesn't give up the thread: it comes before a wait on a waitq,
+// which does that itself. A NULL w is a sleep that nothing can tell the end of,
+// like one with a deadline.
+void gc_park_wait(struct pipe_wait *w);
+
+// Tracer hooks, implemented in ../vm/trace.c: what the pipes did, for `tau run
+// -trace`. They cost a call and a load while nobody is tracing.
+int trace_enabled(void);
+void trace_pipe_new(struct pipe *p);
+void trace_pipe_send(struct pipe *p);
+void trace_pipe_recv(struct pipe *p);
+void trace_pipe_close(struct pipe *p);
+void trace_block(struct pipe_wait *w);
+void trace_unblock(void);
 
 // The VM of this thread and a call into it, for a C function that calls back
-// into tau. Both live in internal/vm; declared here because the FFI is the
-// only thing in obj that needs them.
+// into tau. They live in internal/vm; declared here because the FFI and the
+// try builtin are the only things in obj that need them.
 struct vm;
 struct vm *gc_current_vm(void);
+// The file and the line the VM is at, in the innermost frame running tau code.
+// NULL and 0 for no VM.
+void vm_where(struct vm *vm, char **file, int32_t *line);
 struct object vm_call_tau(struct vm *vm, struct object cl, struct object *args, size_t nargs);
+// The try builtin: fn called with the arguments, the runtime error it stopped
+// on given back as an error value.
+struct object vm_try(struct vm *vm, struct object fn, struct object *args, size_t nargs);
 void *gc_add_roots(struct object *objs, size_t len);
 uint64_t fnv64a(const char *s, size_t len);
 uint32_t is_truthy(struct object * restrict o);
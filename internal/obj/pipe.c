@@ -4,10 +4,51 @@
 #include "../vm/thrd.h"
 #include "object.h"
 
+// What a select sleeps on. It can't sleep on the queues of the pipes, it
+// waits on many of them at once, so each pipe keeps a list of the selects
+// interested in it and wakes them up through here.
+//
+// A select asleep can also be claimed, by another select that hands it a value
+// or takes one from it: done goes from 0 to 1 once, and won is the case it
+// went with. Only one can claim it, and it does with the mutex of the pipe of
+// the case held.
+struct select_waiter {
+	mtx_t mu;
+	struct waitq q;
+	int fired;
+	int done;
+	size_t won;
+};
+
+struct select_node {
+	struct select_waiter *w;
+	struct select_node *next;
+	struct select_case *c;
+	size_t idx;
+	enum select_kind kind;
+	// The value handed over to a receive case, until the select wakes up and
+	// takes it. The pipe marks it meanwhile, nothing else holds it.
+	struct object val;
+};
+
+// Called with the mutex of the pipe held. The lock order is always the pipe
+// first and the waiter second, a select never takes a pipe while holding its
+// waiter.
+static void pipe_notify(struct pipe *p) {
+	for (struct select_node *n = p->selects; n != NULL; n = n->next) {
+		mtx_lock(&n->w->mu);
+		n->w->fired = 1;
+		waitq_signal(&n->w->q);
+		mtx_unlock(&n->w->mu);
+	}
+}
+
 // Waiting for the mutex must not stall the collector: a thread blocked here
 // while the lock owner waits for the world to restart would deadlock the GC.
+// The thread keeps its proc: the mutex is only ever held for a moment, and
+// nobody holding one waits for a proc, see waitq.c.
 static void pipe_lock(struct pipe *p) {
-	gc_park();
+	gc_park_wait(NULL);
 	mtx_lock(&p->mu);
 	gc_unpark();
 }
@@ -24,9 +65,12 @@ int pipe_close(struct object pipe) {
 		return 0;
 	}
 	p->is_closed = 1;
-	// Unblock all the threads waiting on the pipe.
-	cnd_broadcast(&p->not_empty);
-	cnd_broadcast(&p->not_full);
+	trace_pipe_close(p);
+	// Wake up everybody waiting on the pipe.
+	waitq_broadcast(&p->not_empty);
+	waitq_broadcast(&p->not_full);
+	waitq_broadcast(&p->taken);
+	pipe_notify(p);
 	mtx_unlock(&p->mu);
 
 	// The buffer and the mutex are freed by dispose_pipe_obj, when the
@@ -41,8 +85,6 @@ void dispose_pipe_obj(struct object pipe) {
 	p->is_closed = 1;
 	free(p->buf);
 	mtx_destroy(&p->mu);
-	cnd_destroy(&p->not_empty);
-	cnd_destroy(&p->not_full);
 }
 
 void mark_pipe_obj(struct object pipe) {
@@ -52,9 +94,46 @@ void mark_pipe_obj(struct object pipe) {
 	for (uint32_t i = 0; i < p->len; i++) {
 		mark_obj(p->buf[(p->head + i) % p->cap]);
 	}
+	for (struct select_node *n = p->selects; n != NULL; n = n->next) {
+		mark_obj(n->val);
+	}
 	obj_gc(pipe)->mark |= GC_MARK;
 }
 
+// What would wake a routine asleep on a pipe, for the collector to tell a
+// deadlock with: the same conditions the loops below sleep on.
+static int recv_ready(struct pipe_wait *w) {
+	return w->pipes[0]->len > 0 || w->pipes[0]->is_closed;
+}
+
+static int send_ready(struct pipe_wait *w) {
+	return w->pipes[0]->len < w->pipes[0]->cap || w->pipes[0]->is_closed;
+}
+
+static int handoff_ready(struct pipe_wait *w) {
+	return w->pipes[0]->recvd > w->ticket || w->pipes[0]->is_closed;
+}
+
+static int select_ready(struct pipe_wait *w) {
+	return __atomic_load_n(w->fired, __ATOMIC_ACQUIRE);
+}
+
+// Waits for the receiver of an unbuffered send to take the value, with the
+// mutex of the pipe held.
+static void handoff_wait(struct pipe *p, uint64_t ticket) {
+	if (p->recvd > ticket || p->is_closed) {
+		return;
+	}
+	struct pipe_wait w = {.why = wait_send, .pipes = &p, .n = 1, .ready = handoff_ready, .ticket = ticket};
+	trace_block(&w);
+	while (p->recvd <= ticket && !p->is_closed) {
+		gc_park_wait(&w);
+		waitq_wait(&p->taken, &p->mu);
+		gc_unpark();
+	}
+	trace_unblock();
+}
+
 int pipe_send(struct object pipe, struct object o) {
 	struct pipe *p = pipe.data.pipe;
 
@@ -62,10 +141,15 @@ int pipe_send(struct object pipe, struct object o) {
 	// Wait for room. Both kinds of pipe block here: an unbuffered one holds a
 	// single value, a buffered one as many as it was made with. Neither grows,
 	// a pipe that grows is a queue and never makes a sender wait.
-	while (p->len == p->cap && !p->is_closed) {
-		gc_park();
-		cnd_wait(&p->not_full, &p->mu);
-		gc_unpark();
+	if (p->len == p->cap && !p->is_closed) {
+		struct pipe_wait w = {.why = wait_send, .pipes = &p, .n = 1, .ready = send_ready};
+		trace_block(&w);
+		while (p->len == p->cap && !p->is_closed) {
+			gc_park_wait(&w);
+			waitq_wait(&p->not_full, &p->mu);
+			gc_unpark();
+		}
+		trace_unblock();
 	}
 	if (p->is_closed) {
 		mtx_unlock(&p->mu);
@@ -76,18 +160,16 @@ int pipe_send(struct object pipe, struct object o) {
 	p->tail = (p->tail + 1) % p->cap;
 	p->len++;
 	uint64_t ticket = p->sent++;
-	cnd_signal(&p->not_empty);
+	trace_pipe_send(p);
+	waitq_signal(&p->not_empty);
+	pipe_notify(p);
 
 	// An unbuffered send is a rendezvous: it is done when a receiver has taken
 	// the value, not when the value has been put down. Waiting for the buffer
 	// to have room again would not do, another sender could take that room
 	// first and this one would wait for a receiver that already came.
 	if (!p->is_buffered) {
-		while (p->recvd <= ticket && !p->is_closed) {
-			gc_park();
-			cnd_wait(&p->not_full, &p->mu);
-			gc_unpark();
-		}
+		handoff_wait(p, ticket);
 	}
 
 	mtx_unlock(&p->mu);
@@ -95,34 +177,307 @@ int pipe_send(struct object pipe, struct object o) {
 }
 
 struct object pipe_recv(struct object pipe) {
+	struct object val = null_obj;
+
+	pipe_next(pipe, &val);
+	return val;
+}
+
+// pipe_next is pipe_recv telling a null that was sent from the pipe being
+// closed: it returns 0, and leaves val alone, once the pipe is closed and
+// there is nothing left in it. A for loop over a pipe stops there.
+int pipe_next(struct object pipe, struct object *val) {
 	struct pipe *p = pipe.data.pipe;
 
 	pipe_lock(p);
-	while (p->len == 0 && !p->is_closed) {
-		// Parked: the collector must not wait for a thread that is sleeping
-		// on a pipe, and this thread isn't touching any object meanwhile.
-		gc_park();
-		cnd_wait(&p->not_empty, &p->mu);
-		gc_unpark();
+	if (p->len == 0 && !p->is_closed) {
+		// A select that wants to send on an unbuffered pipe is waiting for
+		// exactly this.
+		p->receivers++;
+		pipe_notify(p);
+		struct pipe_wait w = {.why = wait_recv, .pipes = &p, .n = 1, .ready = recv_ready};
+		trace_block(&w);
+		while (p->len == 0 && !p->is_closed) {
+			// Parked: the collector must not wait for a thread that is
+			// sleeping on a pipe, and this thread isn't touching any object
+			// meanwhile.
+			gc_park_wait(&w);
+			waitq_wait(&p->not_empty, &p->mu);
+			gc_unpark();
+		}
+		trace_unblock();
+		p->receivers--;
 	}
 
 	// Values already in the buffer are still delivered after close.
 	if (p->len == 0 && p->is_closed) {
 		mtx_unlock(&p->mu);
-		return null_obj;
+		return 0;
 	}
 
-	struct object val = p->buf[p->head];
+	*val = p->buf[p->head];
 	p->head = (p->head + 1) % p->cap;
 	p->len--;
 	p->recvd++;
-	// Broadcast, not signal: on not_full wait both the senders that want room
-	// and the unbuffered ones that want their value taken, and only the right
-	// one can tell that it is its turn.
-	cnd_broadcast(&p->not_full);
+	trace_pipe_recv(p);
+	// One sender gets the room, and every unbuffered one that waits for its
+	// value to be taken hears of it: only the right one can tell that it is
+	// its turn. Waking up every sender for a room only one can have would
+	// make a pipe with thousands of them waiting slower the more there are.
+	waitq_signal(&p->not_full);
+	waitq_broadcast(&p->taken);
+	pipe_notify(p);
 	mtx_unlock(&p->mu);
 
-	return val;
+	return 1;
+}
+
+// Claims the select of the node, with the mutex of its pipe held, and wakes it
+// up with the case of the node as the one that went. It fails if somebody
+// else claimed it first.
+static int select_claim(struct select_node *n) {
+	int free = 0;
+
+	if (!__atomic_compare_exchange_n(&n->w->done, &free, 1, 0, __ATOMIC_ACQ_REL, __ATOMIC_ACQUIRE)) {
+		return 0;
+	}
+	n->w->won = n->idx;
+	mtx_lock(&n->w->mu);
+	n->w->fired = 1;
+	waitq_signal(&n->w->q);
+	mtx_unlock(&n->w->mu);
+	return 1;
+}
+
+// A select asleep on the pipe with a case of the kind, claimed, or NULL if
+// there is none to claim. A select never finds itself.
+static struct select_node *select_match(struct pipe *p, enum select_kind kind, struct select_waiter *self) {
+	for (struct select_node *n = p->selects; n != NULL; n = n->next) {
+		if (n->kind == kind && n->w != self && select_claim(n)) {
+			return n;
+		}
+	}
+	return NULL;
+}
+
+// Tries the case without blocking, with the mutexes of all the pipes of the
+// select held. It is the same as pipe_recv and pipe_send, except it gives up
+// where they would wait for the pipe to be ready.
+//
+// An unbuffered send never waits for its value to be taken, it only goes to
+// somebody who can't change their mind about taking it: a routine blocked in a
+// recv, or another select asleep, which it claims. Putting the value down for
+// a select that may then pick another case would leave it waiting for nobody.
+static int select_try(struct select_case *c, struct select_waiter *w) {
+	struct pipe *p = c->pipe.data.pipe;
+	struct select_node *n;
+
+	if (c->kind == select_recv) {
+		if (p->len > 0) {
+			c->val = p->buf[p->head];
+			p->head = (p->head + 1) % p->cap;
+			p->len--;
+			p->recvd++;
+			trace_pipe_recv(p);
+			waitq_signal(&p->not_full);
+			waitq_broadcast(&p->taken);
+			pipe_notify(p);
+			return 1;
+		}
+		if (p->is_closed) {
+			c->val = null_obj;
+			return 1;
+		}
+		// The value goes from one select to the other, it never is in the
+		// pipe: the counts of what went through it stay as they are.
+		if (!p->is_buffered && (n = select_match(p, select_send, w)) != NULL) {
+			c->val = n->c->val;
+			trace_pipe_recv(p);
+			return 1;
+		}
+		return 0;
+	}
+
+	if (p->is_closed) {
+		c->closed = 1;
+		return 1;
+	}
+	if (p->len < p->cap && (p->is_buffered || p->receivers > 0)) {
+		p->buf[p->tail] = c->val;
+		p->tail = (p->tail + 1) % p->cap;
+		p->len++;
+		p->sent++;
+		trace_pipe_send(p);
+		waitq_signal(&p->not_empty);
+		pipe_notify(p);
+		return 1;
+	}
+	if (!p->is_buffered && (n = select_match(p, select_recv, w)) != NULL) {
+		n->val = c->val;
+		trace_pipe_send(p);
+		return 1;
+	}
+	return 0;
+}
+
+// Tries all the cases once, starting from a random one so that a select
+// always finding more than one ready doesn't starve the ones further down.
+static int select_poll(struct select_case *cases, size_t n, struct select_waiter *w) {
+	size_t start = n > 0 ? rand() % n : 0;
+
+	for (size_t i = 0; i < n; i++) {
+		size_t idx = (start + i) % n;
+
+		if (select_try(&cases[idx], w)) {
+			return idx;
+		}
+	}
+	return -1;
+}
+
+static int by_addr(const void *a, const void *b) {
+	uintptr_t x = (uintptr_t) *(struct pipe *const *) a;
+	uintptr_t y = (uintptr_t) *(struct pipe *const *) b;
+
+	return (x > y) - (x < y);
+}
+
+// The pipes of the select in the order they are locked in, each once, and how
+// many they are. Two selects on the same pipes lock them in the same order,
+// whatever the order of their cases, or they would deadlock each other.
+static size_t lock_order(struct select_case *cases, size_t n, struct pipe **order) {
+	size_t m = 0;
+
+	for (size_t i = 0; i < n; i++) {
+		order[i] = cases[i].pipe.data.pipe;
+	}
+	qsort(order, n, sizeof(struct pipe *), by_addr);
+	for (size_t i = 0; i < n; i++) {
+		if (m == 0 || order[m-1] != order[i]) {
+			order[m++] = order[i];
+		}
+	}
+	return m;
+}
+
+static void select_lock(struct pipe **order, size_t m) {
+	for (size_t i = 0; i < m; i++) {
+		pipe_lock(order[i]);
+	}
+}
+
+static void select_unlock(struct pipe **order, size_t m) {
+	for (size_t i = m; i > 0; i--) {
+		mtx_unlock(&order[i-1]->mu);
+	}
+}
+
+// Both with the mutexes of all the pipes held.
+static void select_register(struct select_case *cases, struct select_node *nodes, size_t n, struct select_waiter *w) {
+	for (size_t i = 0; i < n; i++) {
+		struct pipe *p = cases[i].pipe.data.pipe;
+
+		nodes[i] = (struct select_node) {.w = w, .c = &cases[i], .idx = i, .kind = cases[i].kind, .val = null_obj};
+		nodes[i].next = p->selects;
+		p->selects = &nodes[i];
+	}
+}
+
+static void select_unregister(struct select_case *cases, struct select_node *nodes, size_t n) {
+	for (size_t i = 0; i < n; i++) {
+		struct pipe *p = cases[i].pipe.data.pipe;
+
+		for (struct select_node **n = &p->selects; *n != NULL; n = &(*n)->next) {
+			if (*n == &nodes[i]) {
+				*n = nodes[i].next;
+				break;
+			}
+		}
+	}
+}
+
+// Waits for the first of the cases that can go and returns its index, or -1
+// if none could within the timeout. The timeout is in milliseconds, 0 means
+// not waiting at all and a negative one waiting forever.
+//
+// The select holds the mutexes of all its pipes whenever it looks at them, so
+// that what it finds stays true until it has done something about it. Nothing
+// ready, it registers on the pipes before letting go of them, so nothing that
+// happens after it looked is lost: it is woken up and looks again, or it is
+// claimed by another select and goes with the case that one picked.
+int pipe_select(struct select_case *cases, size_t n, int64_t timeout) {
+	struct select_waiter w = {.fired = 0, .done = 0};
+	struct pipe **order = malloc(sizeof(struct pipe *) * (n > 0 ? n : 1));
+	size_t m = lock_order(cases, n, order);
+
+	select_lock(order, m);
+	int idx = select_poll(cases, n, &w);
+	if (idx >= 0 || timeout == 0) {
+		select_unlock(order, m);
+		free(order);
+		return idx;
+	}
+
+	int64_t deadline = timeout > 0 ? timer_now() + timeout : -1;
+	struct select_node *nodes = malloc(sizeof(struct select_node) * (n > 0 ? n : 1));
+	struct pipe **pipes = malloc(sizeof(struct pipe *) * (n > 0 ? n : 1));
+	mtx_init(&w.mu, mtx_plain);
+	select_register(cases, nodes, n, &w);
+
+	for (size_t i = 0; i < n; i++) {
+		pipes[i] = cases[i].pipe.data.pipe;
+	}
+	// Only a select that waits forever can be part of a deadlock, one with a
+	// timeout wakes up on its own.
+	struct pipe_wait wait = {.why = wait_select, .pipes = pipes, .n = n, .ready = select_ready, .fired = &w.fired};
+
+	int blocked = 0;
+	for (int timedout = 0;;) {
+		mtx_lock(&w.mu);
+		w.fired = 0;
+		mtx_unlock(&w.mu);
+		select_unlock(order, m);
+
+		if (!blocked && trace_enabled()) {
+			blocked = 1;
+			trace_block(&wait);
+		}
+		gc_park_wait(timeout < 0 ? &wait : NULL);
+		mtx_lock(&w.mu);
+		while (!w.fired && !timedout) {
+			timedout = waitq_timedwait(&w.q, &w.mu, deadline);
+		}
+		mtx_unlock(&w.mu);
+		gc_unpark();
+		select_lock(order, m);
+
+		// Claimed: the other select did the sending or the receiving, the
+		// value is where it left it.
+		if (__atomic_load_n(&w.done, __ATOMIC_ACQUIRE)) {
+			idx = w.won;
+			if (cases[idx].kind == select_recv) {
+				cases[idx].val = nodes[idx].val;
+				trace_pipe_recv(pipes[idx]);
+			} else {
+				trace_pipe_send(pipes[idx]);
+			}
+			break;
+		}
+		if ((idx = select_poll(cases, n, &w)) >= 0 || timedout) {
+			break;
+		}
+	}
+
+	if (blocked) {
+		trace_unblock();
+	}
+	select_unregister(cases, nodes, n);
+	select_unlock(order, m);
+	free(nodes);
+	free(pipes);
+	free(order);
+	mtx_destroy(&w.mu);
+	return idx;
 }
 
 // An unbuffered pipe is one slot deep and hands the value over directly, a
@@ -137,13 +492,13 @@ static struct object pipe_new(size_t cap, uint32_t is_buffered) {
 	pipe->cap = cap;
 	pipe->is_buffered = is_buffered;
 	mtx_init(&pipe->mu, mtx_plain);
-	cnd_init(&pipe->not_empty);
-	cnd_init(&pipe->not_full);
+	vm_where(gc_current_vm(), &pipe->file, &pipe->line);
 
 	h->obj = (struct object) {
 		.data.pipe = pipe,
 		.type = obj_pipe,
 	};
+	trace_pipe_new(pipe);
 	return h->obj;
 }
 
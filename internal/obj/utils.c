@@ -1,6 +1,7 @@
 #include <stdlib.h>
 #include <string.h>
 #include <stdio.h>
+#include <time.h>
 #include "object.h"
 #include "plugin.h"
 
@@ -10,6 +11,61 @@
 __attribute__((weak)) uint32_t gc_epoch = 1;
 __attribute__((weak)) void gc_park(void) {}
 __attribute__((weak)) void gc_unpark(void) {}
+__attribute__((weak)) void gc_park_wait(struct pipe_wait *w) { (void) w; }
+__attribute__((weak)) void gc_collect(void) {}
+__attribute__((weak)) struct object gc_memstats(void) {
+	return errorf("memstats: there is no collector");
+}
+__attribute__((weak)) int64_t timer_start(struct object pipe, int64_t ms, int64_t period, struct object *val) {
+	(void) pipe;
+	(void) ms;
+	(void) period;
+	(void) val;
+	return -1;
+}
+__attribute__((weak)) int timer_stop(int64_t id) {
+	(void) id;
+	return 0;
+}
+__attribute__((weak)) int64_t timer_call(int64_t when, void (*fn)(void *), void *arg) {
+	(void) when;
+	(void) fn;
+	(void) arg;
+	return -1;
+}
+__attribute__((weak)) int64_t timer_now(void) {
+	struct timespec ts;
+	timespec_get(&ts, TIME_UTC);
+	return (int64_t) ts.tv_sec * 1000 + ts.tv_nsec / 1000000;
+}
+
+// Without the poller no socket is polled, and so none is ever waited for.
+__attribute__((weak)) int netpoll_open(int64_t fd) {
+	(void) fd;
+	return 0;
+}
+__attribute__((weak)) int netpoll_wait(int64_t fd, int mode) {
+	(void) fd;
+	(void) mode;
+	return -1;
+}
+__attribute__((weak)) void netpoll_deadline(int64_t fd, int mode, int64_t when) {
+	(void) fd;
+	(void) mode;
+	(void) when;
+}
+__attribute__((weak)) void netpoll_close(int64_t fd) { (void) fd; }
+
+// Without the scheduler every routine is a thread of its own, and none of them
+// ever parks: sched_current says there is none.
+__attribute__((weak)) void *sched_current(void) { return NULL; }
+__attribute__((weak)) void sched_park(mtx_t *mu) { mtx_unlock(mu); }
+__attribute__((weak)) void sched_ready(void *routine) { (void) routine; }
+__attribute__((weak)) int sched_block(void) { return 0; }
+__attribute__((weak)) void sched_unblock(void) {}
+__attribute__((weak)) void sched_pin(void) {}
+__attribute__((weak)) void sched_unpin(void) {}
+__attribute__((weak)) int64_t sched_numroutine(void) { return 1; }
 
 __attribute__((weak)) struct gc_header *gc_alloc(size_t size) {
 	struct gc_header *h = malloc(sizeof(struct gc_header) + size);
@@ -19,10 +75,24 @@ __attribute__((weak)) struct gc_header *gc_alloc(size_t size) {
 	return h;
 }
 
+// And for the tracer, which without a VM has nothing to trace.
+__attribute__((weak)) int trace_enabled(void) { return 0; }
+__attribute__((weak)) void trace_pipe_new(struct pipe *p) { (void) p; }
+__attribute__((weak)) void trace_pipe_send(struct pipe *p) { (void) p; }
+__attribute__((weak)) void trace_pipe_recv(struct pipe *p) { (void) p; }
+__attribute__((weak)) void trace_pipe_close(struct pipe *p) { (void) p; }
+__attribute__((weak)) void trace_block(struct pipe_wait *w) { (void) w; }
+__attribute__((weak)) void trace_unblock(void) {}
+
 // The same for the three the FFI needs to call back into tau. Without a VM
 // there is nobody to call and nothing to keep alive, which is exactly the
 // truth in a program that links only this package.
 __attribute__((weak)) struct vm *gc_current_vm(void) { return NULL; }
+__attribute__((weak)) void vm_where(struct vm *vm, char **file, int32_t *line) {
+	(void) vm;
+	*file = NULL;
+	*line = 0;
+}
 __attribute__((weak)) void *gc_add_roots(struct object *objs, size_t len) {
 	(void) objs;
 	(void) len;
@@ -37,6 +107,14 @@ __attribute__((weak)) struct object vm_call_tau(struct vm *vm, struct object cl,
 	return errorf("callback: there is no virtual machine here");
 }
 
+__attribute__((weak)) struct object vm_try(struct vm *vm, struct object fn, struct object *args, size_t nargs) {
+	(void) vm;
+	(void) fn;
+	(void) args;
+	(void) nargs;
+	return errorf("try: there is no virtual machine here");
+}
+
 char *otype_str(enum obj_type t) {
 	static char *strings[] = {
 		"null",
@@ -54,9 +132,10 @@ char *otype_str(enum obj_type t) {
 		"pipe",
 		"bytes",
 		"native",
-		"native"
+		"native",
+		"cell"
 	};
-	return t <= obj_native_fn ? strings[t] : "corrupted";
+	return t <= obj_cell ? strings[t] : "corrupted";
 }
 
 char *object_str(struct object o) {
@@ -93,6 +172,8 @@ char *object_str(struct object o) {
 		return strdup("<native>");
 	case obj_native_fn:
 		return native_str(o);
+	case obj_cell:
+		return cell_str(o);
 	default:
 		return strdup("<corrupted>");
 	}
@@ -111,7 +192,7 @@ inline void mark_obj(struct object o) {
 	struct gc_header *h = obj_gc(o);
 
 	if (h != NULL && (h->mark >> GC_EPOCH_SHIFT) != gc_epoch) {
-		h->mark = (h->mark & (GC_MARK | GC_TRACKED)) | (gc_epoch << GC_EPOCH_SHIFT);
+		h->mark = (h->mark & (GC_MARK | GC_TRACKED | GC_SAMPLED | GC_INHERITED)) | (gc_epoch << GC_EPOCH_SHIFT);
 
 		switch (o.type) {
 		case obj_object:
@@ -129,12 +210,18 @@ inline void mark_obj(struct object o) {
 		case obj_string:
 			mark_string_obj(o);
 			break;
+		case obj_error:
+			mark_error_obj(o);
+			break;
 		case obj_bytes:
 			mark_bytes_obj(o);
 			break;
 		case obj_pipe:
 			mark_pipe_obj(o);
 			break;
+		case obj_cell:
+			mark_cell_obj(o);
+			break;
 		default:
 			h->mark |= GC_MARK;
 			break;
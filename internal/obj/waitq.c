@@ -0,0 +1,178 @@
+#include <stdlib.h>
+#include <time.h>
+#include "../vm/thrd.h"
+#include "object.h"
+
+/*
+ * Wait queues: what the pipes sleep on. A routine waiting for a value must
+ * not keep the thread it runs on, which is one of the few the scheduler has,
+ * so it parks and leaves it to the others; a thread that runs no routine - the
+ * one of the timers, a C library calling back - or one that can't leave its
+ * thread, sleeps on a condition variable of its own like it always did. Both
+ * kinds wait in the same queue, in the order they came.
+ *
+ * A waiter lives on the stack of whoever waits, and is only ever touched with
+ * the mutex the queue is guarded by held, but for its state: a waiter with a
+ * deadline may be woken by the timer and by a signal at the same time, and
+ * the one that gets to change it from waiting is the one that wakes it up. A
+ * signal that loses goes on to the next waiter, and the waiter that timed out
+ * takes itself out of the queue once it has the mutex back.
+ */
+
+enum waiter_state {
+	waiter_waiting,
+	waiter_woken,
+	waiter_timedout,
+};
+
+struct waiter {
+	void *routine;  // NULL for a thread.
+	cnd_t cnd;
+	int state;
+	int queued;
+	struct waiter *prev;
+	struct waiter *next;
+};
+
+static void push(struct waitq *q, struct waiter *w) {
+	w->prev = q->tail;
+	w->next = NULL;
+	if (q->tail != NULL) {
+		q->tail->next = w;
+	} else {
+		q->head = w;
+	}
+	q->tail = w;
+	w->queued = 1;
+}
+
+static void drop(struct waitq *q, struct waiter *w) {
+	if (!w->queued) return;
+	if (w->prev != NULL) {
+		w->prev->next = w->next;
+	} else {
+		q->head = w->next;
+	}
+	if (w->next != NULL) {
+		w->next->prev = w->prev;
+	} else {
+		q->tail = w->prev;
+	}
+	w->queued = 0;
+}
+
+// Whether whoever calls it is the one that changes the state of w from waiting.
+static int settle(struct waiter *w, int state) {
+	int s = waiter_waiting;
+	return __atomic_compare_exchange_n(&w->state, &s, state, 0, __ATOMIC_SEQ_CST, __ATOMIC_SEQ_CST);
+}
+
+// The deadline of a routine, run by the thread of the timers.
+static void timeout(void *arg) {
+	struct waiter *w = arg;
+
+	if (settle(w, waiter_timedout)) sched_ready(w->routine);
+}
+
+// A thread waits on the wall clock, which is what a condition variable has.
+static struct timespec wall_deadline(int64_t deadline) {
+	struct timespec ts;
+	int64_t left = deadline - timer_now();
+
+	if (left < 0) left = 0;
+	timespec_get(&ts, TIME_UTC);
+	ts.tv_sec += left / 1000;
+	ts.tv_nsec += (left % 1000) * 1000000;
+	if (ts.tv_nsec >= 1000000000) {
+		ts.tv_sec++;
+		ts.tv_nsec -= 1000000000;
+	}
+	return ts;
+}
+
+// A thread blocks the proc it may be holding for as long as it sleeps, and
+// gives it up: the proc goes to another worker if somebody needs it. Getting
+// it back may mean waiting for one, which it does without mu, so that whoever
+// holds the proc is free to take mu meanwhile.
+static int thread_wait(struct waitq *q, mtx_t *mu, struct waiter *w, int64_t deadline) {
+	int blocked = sched_block();
+	int timedout = 0;
+
+	cnd_init(&w->cnd);
+	push(q, w);
+	while (__atomic_load_n(&w->state, __ATOMIC_SEQ_CST) == waiter_waiting) {
+		if (deadline < 0) {
+			cnd_wait(&w->cnd, mu);
+			continue;
+		}
+
+		struct timespec ts = wall_deadline(deadline);
+		if (cnd_timedwait(&w->cnd, mu, &ts) == thrd_timedout || timer_now() >= deadline) {
+			if (settle(w, waiter_timedout)) {
+				timedout = 1;
+				break;
+			}
+		}
+	}
+	drop(q, w);
+	cnd_destroy(&w->cnd);
+
+	if (blocked) {
+		mtx_unlock(mu);
+		sched_unblock();
+		mtx_lock(mu);
+	}
+	return timedout;
+}
+
+int waitq_timedwait(struct waitq *q, mtx_t *mu, int64_t deadline) {
+	struct waiter w = {.routine = sched_current(), .state = waiter_waiting};
+
+	if (deadline >= 0 && timer_now() >= deadline) return 1;
+	if (w.routine == NULL) return thread_wait(q, mu, &w, deadline);
+
+	int64_t id = -1;
+	if (deadline >= 0 && (id = timer_call(deadline, timeout, &w)) < 0) {
+		// No thread for the timers: the routine waits like a thread does.
+		w.routine = NULL;
+		return thread_wait(q, mu, &w, deadline);
+	}
+
+	push(q, &w);
+	sched_park(mu);
+	// Back on a worker, woken by a signal or by the timer. Whichever it was,
+	// the timer is over before mu is taken again: it is the timer that holds
+	// the mutex of the timers while it runs, and is waited for here.
+	if (id >= 0) timer_stop(id);
+	mtx_lock(mu);
+	drop(q, &w);
+	return w.state == waiter_timedout;
+}
+
+void waitq_wait(struct waitq *q, mtx_t *mu) {
+	waitq_timedwait(q, mu, -1);
+}
+
+// Wakes the first waiter up, called with the mutex of the queue held.
+void waitq_signal(struct waitq *q) {
+	struct waiter *w;
+
+	while ((w = q->head) != NULL) {
+		void *r = w->routine;
+
+		drop(q, w);
+		if (!settle(w, waiter_woken)) continue;
+		if (r != NULL) {
+			sched_ready(r);
+		} else {
+			cnd_signal(&w->cnd);
+		}
+		return;
+	}
+}
+
+void waitq_broadcast(struct waitq *q) {
+	while (q->head != NULL) {
+		waitq_signal(q);
+	}
+}
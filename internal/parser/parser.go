@@ -7,6 +7,7 @@ import (
 	"github.com/NicoNex/tau/internal/ast"
 	"github.com/NicoNex/tau/internal/item"
 	"github.com/NicoNex/tau/internal/lexer"
+	"github.com/NicoNex/tau/internal/obj"
 	"github.com/NicoNex/tau/internal/tauerr"
 )
 
@@ -20,6 +21,11 @@ type Parser struct {
 	peek          item.Item
 	errs          []error
 	nestedLoops   uint
+	// The constants of the functions being parsed, the innermost last, with
+	// the value of each one that has a constant expression for it. A name
+	// with no value there is a constant worked out when the program runs, or
+	// a parameter hiding a constant of the same name from outside.
+	consts []map[string]*obj.Object
 }
 
 type (
@@ -94,6 +100,7 @@ func newParser(file, input string, items <-chan item.Item) *Parser {
 		input:         input,
 		prefixParsers: make(map[item.Type]parsePrefixFn),
 		infixParsers:  make(map[item.Type]parseInfixFn),
+		consts:        []map[string]*obj.Object{{}},
 	}
 	p.registerPrefix(item.Ident, p.parseIdentifier)
 	p.registerPrefix(item.Int, p.parseInteger)
@@ -119,6 +126,12 @@ func newParser(file, input string, items <-chan item.Item) *Parser {
 	p.registerPrefix(item.Import, p.parseImport)
 	p.registerPrefix(item.Error, p.parseError)
 	p.registerPrefix(item.Tau, p.parseTauCall)
+	p.registerPrefix(item.Defer, p.parseDefer)
+	p.registerPrefix(item.Select, p.parseSelect)
+	p.registerPrefix(item.Switch, p.parseSwitch)
+	p.registerPrefix(item.Ellipsis, p.parseSpread)
+	p.registerPrefix(item.Nonlocal, p.parseNonlocal)
+	p.registerPrefix(item.Const, p.parseConst)
 
 	p.registerInfix(item.Equals, p.parseEquals)
 	p.registerInfix(item.NotEquals, p.parseNotEquals)
@@ -217,7 +230,56 @@ func (p *Parser) parseStatement() ast.Node {
 	if p.cur.Is(item.Return) {
 		return p.parseReturn()
 	}
-	return p.parseExpr(Lowest)
+
+	expr := p.parseExpr(Lowest)
+	if _, ok := expr.(ast.Identifier); ok && p.peek.Is(item.Comma) {
+		return p.parseMultiAssign(expr)
+	}
+	return expr
+}
+
+// parseMultiAssign parses an assignment to more than one name, the first of
+// which is already parsed, with one value for each or a list of them:
+//
+//	a, b = b, a
+//	q, r = divmod(7, 2)
+//
+// It is the same as [a, b] = [b, a], which is what it becomes.
+func (p *Parser) parseMultiAssign(first ast.Node) ast.Node {
+	names := []ast.Node{first}
+
+	for p.peek.Is(item.Comma) {
+		p.next()
+		if !p.expectPeek(item.Ident) {
+			return nil
+		}
+		names = append(names, p.parseIdentifier())
+	}
+	if !p.expectPeek(item.Assign) {
+		return nil
+	}
+
+	pos := p.cur.Pos
+	p.next()
+	return ast.NewAssign(ast.NewList(names...), p.parseValues(), pos)
+}
+
+// parseValues parses one expression, or several separated by commas, which
+// are then the list of them: what is returned or assigned to more than one
+// name.
+func (p *Parser) parseValues() ast.Node {
+	first := p.parseExpr(Lowest)
+	if !p.peek.Is(item.Comma) {
+		return first
+	}
+
+	values := []ast.Node{first}
+	for p.peek.Is(item.Comma) {
+		p.next()
+		p.next()
+		values = append(values, p.parseExpr(Lowest))
+	}
+	return ast.NewList(values...)
 }
 
 func (p *Parser) parseReturn() ast.Node {
@@ -225,7 +287,7 @@ func (p *Parser) parseReturn() ast.Node {
 
 	p.next()
 	if !p.cur.Is(item.Semicolon) {
-		ret = ast.NewReturn(p.parseExpr(Lowest), p.cur.Pos)
+		ret = ast.NewReturn(p.parseValues(), p.cur.Pos)
 	} else {
 		ret = ast.NewReturn(ast.NewNull(), p.cur.Pos)
 	}
@@ -328,8 +390,54 @@ func (p *Parser) parseList() ast.Node {
 
 func (p *Parser) parseMap() ast.Node {
 	pos := p.cur.Pos
-	couples := p.parseNodePairs(item.RBrace)
-	return ast.NewMap(pos, couples...)
+	if !p.peek.Is(item.Ident) {
+		return ast.NewMap(pos, p.parseNodePairs(item.RBrace)...)
+	}
+
+	// A name with no colon after it starts the left side of {a, b} = o.
+	p.next()
+	key := p.parseExpr(Lowest)
+	if id, ok := key.(ast.Identifier); ok && (p.peek.Is(item.Comma) || p.peek.Is(item.RBrace)) {
+		return p.parseFields(id, pos)
+	}
+
+	pairs := [][2]ast.Node{p.parseValueOf(key)}
+	for p.peek.Is(item.Comma) {
+		p.next()
+		// The trailing comma of a map written over several lines.
+		if p.peek.Is(item.RBrace) {
+			break
+		}
+		p.next()
+		pairs = append(pairs, p.parsePair())
+	}
+
+	if !p.expectPeek(item.RBrace) {
+		return nil
+	}
+	return ast.NewMap(pos, pairs...)
+}
+
+// parseFields parses the names in braces on the left of {a, b} = o, the
+// first of which is already parsed.
+func (p *Parser) parseFields(first ast.Identifier, pos int) ast.Node {
+	names := []string{first.String()}
+
+	for p.peek.Is(item.Comma) {
+		p.next()
+		if p.peek.Is(item.RBrace) {
+			break
+		}
+		if !p.expectPeek(item.Ident) {
+			return nil
+		}
+		names = append(names, p.cur.Val)
+	}
+
+	if !p.expectPeek(item.RBrace) {
+		return nil
+	}
+	return ast.NewFields(names, pos)
 }
 
 func (p *Parser) parseImport() ast.Node {
@@ -354,46 +462,121 @@ func (p *Parser) parseFunction() ast.Node {
 		return nil
 	}
 
-	params := p.parseFunctionParams()
+	// The constants of the function, and the parameters hiding the ones
+	// from outside, are only there until its end.
+	p.consts = append(p.consts, map[string]*obj.Object{})
+	defer func() { p.consts = p.consts[:len(p.consts)-1] }()
+
+	params, defaults, rest := p.parseFunctionParams()
 	if !p.expectPeek(item.LBrace) {
 		return nil
 	}
 
-	return ast.NewFunction(params, p.parseBlock(), pos)
+	return ast.NewFunction(params, defaults, rest, p.parseBlock(), pos)
 }
 
-func (p *Parser) parseFunctionParams() []ast.Identifier {
-	var ret []ast.Identifier
-
+// parseFunctionParams reads the parameters of a function: names, any of them
+// followed by = and the value it takes when left out, and last ...name, the
+// one that takes the arguments past the others as a list. defaults has an
+// entry for every parameter, nil for the ones with no default.
+func (p *Parser) parseFunctionParams() (params []ast.Identifier, defaults []ast.Node, rest *ast.Identifier) {
 	if p.peek.Is(item.RParen) {
 		p.next()
-		return ret
+		return
 	}
 
-	p.next()
-	ret = append(ret, ast.NewIdentifier(p.cur.Val, p.cur.Pos))
+	for {
+		p.next()
+		if rest != nil {
+			p.errorf("...%s must be the last parameter", rest.String())
+		}
 
-	for p.peek.Is(item.Comma) {
+		if p.cur.Is(item.Ellipsis) {
+			if !p.expectPeek(item.Ident) {
+				return nil, nil, nil
+			}
+			id := ast.NewIdentifier(p.cur.Val, p.cur.Pos)
+			p.consts[len(p.consts)-1][id.String()] = nil
+			rest = &id
+		} else {
+			params = append(params, ast.NewIdentifier(p.cur.Val, p.cur.Pos))
+			p.consts[len(p.consts)-1][p.cur.Val] = nil
+			var def ast.Node
+			if p.peek.Is(item.Assign) {
+				p.next()
+				p.next()
+				def = p.parseExpr(Lowest)
+			}
+			defaults = append(defaults, def)
+		}
+
+		if !p.peek.Is(item.Comma) {
+			break
+		}
 		p.next()
 		// The trailing comma of a parameter list written over several lines.
 		if p.peek.Is(item.RParen) {
 			break
 		}
-		p.next()
-		ret = append(ret, ast.NewIdentifier(p.cur.Val, p.cur.Pos))
 	}
 
 	if !p.expectPeek(item.RParen) {
-		return nil
+		return nil, nil, nil
 	}
-	return ret
+	return
 }
 
 // Returns an identifier node.
 func (p *Parser) parseIdentifier() ast.Node {
+	if val, ok := p.constant(p.cur.Val); ok {
+		return ast.NewConstIdentifier(p.cur.Val, val, p.cur.Pos)
+	}
 	return ast.NewIdentifier(p.cur.Val, p.cur.Pos)
 }
 
+// constant returns the value of the constant name stands for here, if there is
+// one and its value is known before the program runs.
+func (p *Parser) constant(name string) (obj.Object, bool) {
+	for i := len(p.consts) - 1; i >= 0; i-- {
+		if val, ok := p.consts[i][name]; ok {
+			if val == nil {
+				return obj.NullObj, false
+			}
+			return *val, true
+		}
+	}
+	return obj.NullObj, false
+}
+
+// parseConst reads const NAME = value. The value is worked out here when it
+// is a constant expression, so that every use of the name after this one is a
+// constant expression too.
+func (p *Parser) parseConst() ast.Node {
+	pos := p.cur.Pos
+	if !p.expectPeek(item.Ident) {
+		return nil
+	}
+	name := p.cur.Val
+	if !p.expectPeek(item.Assign) {
+		return nil
+	}
+	p.next()
+
+	val := p.parseExpr(Lowest)
+	if val == nil {
+		return nil
+	}
+
+	var known *obj.Object
+	if val.IsConstExpression() {
+		if o, err := val.Eval(); err == nil {
+			known = &o
+		}
+	}
+	p.consts[len(p.consts)-1][name] = known
+	return ast.NewConst(name, val, pos)
+}
+
 func (p *Parser) parseNull() ast.Node {
 	return ast.NewNull()
 }
@@ -496,6 +679,9 @@ func (p *Parser) parseFor() ast.Node {
 	if p.cur.Is(item.LBrace) {
 		return ast.NewFor(ast.NewBoolean(true), p.parseBlock(), nil, nil, pos)
 	}
+	if p.cur.Is(item.Ident) && (p.peek.Is(item.Comma) || p.peekIsIn()) {
+		return p.parseForIn(pos)
+	}
 
 	for !p.cur.Is(item.LBrace) && !p.cur.Is(item.EOF) {
 		arg = append(arg, p.parseExpr(Lowest))
@@ -515,6 +701,223 @@ func (p *Parser) parseFor() ast.Node {
 	}
 }
 
+// parseForIn parses a loop over a collection, with a name for the values or
+// two for the keys and the values:
+//
+//	for v in list { ... }
+//	for k, v in m { ... }
+//
+// in is a keyword only there, after the names of a for, and a name like any
+// other everywhere else, which is what the code written before it has it as.
+func (p *Parser) parseForIn(pos int) ast.Node {
+	var key, val = "", p.cur.Val
+
+	if p.peek.Is(item.Comma) {
+		p.next()
+		if !p.expectPeek(item.Ident) {
+			return nil
+		}
+		key, val = val, p.cur.Val
+	}
+	if !p.peekIsIn() {
+		p.errorf(`expected "in" after the names of the loop, got %v instead`, p.peek.Typ)
+		return nil
+	}
+	p.next()
+	p.next()
+
+	expr := p.parseExpr(Lowest)
+	if !p.expectPeek(item.LBrace) {
+		return nil
+	}
+	return ast.NewForIn(key, val, expr, p.parseBlock(), pos)
+}
+
+func (p *Parser) peekIsIn() bool {
+	return p.peek.Is(item.Ident) && p.peek.Val == "in"
+}
+
+// parseSelect parses the cases of a select. Each is a recv or a send, which
+// may assign what it returns to a name, or an after with the milliseconds
+// to wait before giving up; there is also a default, run if no case is ready.
+//
+//	select {
+//	case v = recv(p) { ... }
+//	case send(q, x) { ... }
+//	case after(500) { ... }
+//	}
+func (p *Parser) parseSelect() ast.Node {
+	var (
+		cases   []ast.SelectCase
+		timeout ast.Node
+		alt     ast.Node
+		pos     = p.cur.Pos
+	)
+
+	if !p.expectPeek(item.LBrace) {
+		return nil
+	}
+	p.skipSemicolons()
+
+	for !p.peek.Is(item.RBrace) && !p.peek.Is(item.EOF) {
+		p.next()
+
+		switch {
+		case p.cur.Is(item.Default):
+			if alt != nil {
+				p.errorf("multiple defaults or timeouts in select")
+				return nil
+			}
+			if !p.expectPeek(item.LBrace) {
+				return nil
+			}
+			alt = p.parseBlock()
+
+		case p.cur.Is(item.Case):
+			p.next()
+			var target string
+			if p.cur.Is(item.Ident) && p.peek.Is(item.Assign) {
+				target = p.cur.Val
+				p.next()
+				p.next()
+			}
+
+			if !p.cur.Is(item.Ident) || !p.peek.Is(item.LParen) {
+				p.errorf("a select case must be a call to recv, send or after")
+				return nil
+			}
+			name := p.cur.Val
+			p.next()
+			args := p.parseNodeList(item.RParen)
+
+			if !p.expectPeek(item.LBrace) {
+				return nil
+			}
+			body := p.parseBlock()
+
+			switch {
+			case name == "recv" && len(args) == 1:
+				cases = append(cases, ast.NewRecvCase(target, args[0], body))
+			case name == "send" && len(args) == 2:
+				cases = append(cases, ast.NewSendCase(target, args[0], args[1], body))
+			case name == "after" && len(args) == 1 && target == "":
+				if alt != nil {
+					p.errorf("multiple defaults or timeouts in select")
+					return nil
+				}
+				timeout, alt = args[0], body
+			case name == "after" && len(args) == 1:
+				p.errorf("after returns no value to assign")
+				return nil
+			case name == "recv" || name == "send" || name == "after":
+				p.errorf("wrong number of arguments to %s in select case", name)
+				return nil
+			default:
+				p.errorf("a select case must be a call to recv, send or after")
+				return nil
+			}
+
+		default:
+			p.errorf(`expected "case" or "default" in select, got %v`, p.cur.Typ)
+			return nil
+		}
+		p.skipSemicolons()
+	}
+
+	if !p.expectPeek(item.RBrace) {
+		return nil
+	}
+	return ast.NewSelect(cases, timeout, alt, pos)
+}
+
+// parseSwitch parses a switch on the value of an expression, or on conditions
+// when there is none. A case has one or more values or patterns separated by
+// commas, and may have a guard after them; there is also a default, run if no
+// case matches. A brace right after switch opens the cases, so a map literal
+// to switch on has to be in parentheses.
+//
+//	switch x {
+//	case 1, 2 { ... }
+//	case [a, b] if a < b { ... }
+//	default { ... }
+//	}
+func (p *Parser) parseSwitch() ast.Node {
+	var (
+		subject ast.Node
+		cases   []ast.SwitchCase
+		alt     ast.Node
+		pos     = p.cur.Pos
+	)
+
+	if !p.peek.Is(item.LBrace) {
+		p.next()
+		subject = p.parseExpr(Lowest)
+	}
+	if !p.expectPeek(item.LBrace) {
+		return nil
+	}
+	p.skipSemicolons()
+
+	for !p.peek.Is(item.RBrace) && !p.peek.Is(item.EOF) {
+		p.next()
+
+		switch {
+		case p.cur.Is(item.Default):
+			if alt != nil {
+				p.errorf("multiple defaults in switch")
+				return nil
+			}
+			if !p.expectPeek(item.LBrace) {
+				return nil
+			}
+			alt = p.parseBlock()
+
+		case p.cur.Is(item.Case):
+			var (
+				values []ast.Node
+				guard  ast.Node
+			)
+
+			p.next()
+			values = append(values, p.parseExpr(Lowest))
+			for p.peek.Is(item.Comma) {
+				p.next()
+				p.next()
+				values = append(values, p.parseExpr(Lowest))
+			}
+
+			if p.peek.Is(item.If) {
+				p.next()
+				p.next()
+				guard = p.parseExpr(Lowest)
+			}
+
+			if !p.expectPeek(item.LBrace) {
+				return nil
+			}
+			cases = append(cases, ast.NewSwitchCase(values, guard, p.parseBlock()))
+
+		default:
+			p.errorf(`expected "case" or "default" in switch, got %v`, p.cur.Typ)
+			return nil
+		}
+		p.skipSemicolons()
+	}
+
+	if !p.expectPeek(item.RBrace) {
+		return nil
+	}
+	return ast.NewSwitch(subject, cases, alt, pos)
+}
+
+// skipSemicolons moves past the semicolons in peek, the ones the lexer puts
+// at the end of each line.
+func (p *Parser) skipSemicolons() {
+	for p.peek.Is(item.Semicolon) {
+		p.next()
+	}
+}
+
 // Returns a node of type Bang.
 func (p *Parser) parseBang() ast.Node {
 	pos := p.cur.Pos
@@ -732,6 +1135,7 @@ func (p *Parser) parseRShiftAssign(left ast.Node) ast.Node {
 }
 
 func (p *Parser) parseTauCall() ast.Node {
+	pos := p.cur.Pos
 	p.next()
 
 	n := p.parseExpr(Lowest)
@@ -741,7 +1145,48 @@ func (p *Parser) parseTauCall() ast.Node {
 		return nil
 	}
 
-	return ast.NewConcurrentCall(c.Fn, c.Args)
+	return ast.NewConcurrentCall(c.Fn, c.Args, pos)
+}
+
+func (p *Parser) parseDefer() ast.Node {
+	pos := p.cur.Pos
+	p.next()
+
+	n := p.parseExpr(Lowest)
+	c, ok := n.(ast.Call)
+	if !ok {
+		p.errs = append(p.errs, errors.New("expected function call after defer"))
+		return nil
+	}
+
+	return ast.NewDefer(c.Fn, c.Args, pos)
+}
+
+// parseNonlocal reads the names after nonlocal, one or more separated by
+// commas.
+func (p *Parser) parseNonlocal() ast.Node {
+	pos := p.cur.Pos
+	var names []string
+
+	for {
+		if !p.expectPeek(item.Ident) {
+			return nil
+		}
+		names = append(names, p.cur.Val)
+		if !p.peek.Is(item.Comma) {
+			break
+		}
+		p.next()
+	}
+	return ast.NewNonlocal(names, pos)
+}
+
+// parseSpread reads ...list, the elements of a list given to a call as its
+// arguments. Anywhere else the compiler rejects it.
+func (p *Parser) parseSpread() ast.Node {
+	pos := p.cur.Pos
+	p.next()
+	return ast.NewSpread(p.parseExpr(Lowest), pos)
 }
 
 func (p *Parser) parseCall(fn ast.Node) ast.Node {
@@ -767,14 +1212,16 @@ func (p *Parser) parseDot(left ast.Node) ast.Node {
 }
 
 func (p *Parser) parsePair() [2]ast.Node {
-	l := p.parseExpr(Lowest)
+	return p.parseValueOf(p.parseExpr(Lowest))
+}
+
+// parseValueOf parses the colon and the value that follow the key of a pair.
+func (p *Parser) parseValueOf(key ast.Node) [2]ast.Node {
 	if !p.expectPeek(item.Colon) {
 		return [2]ast.Node{}
 	}
 	p.next()
-	r := p.parseExpr(Lowest)
-
-	return [2]ast.Node{l, r}
+	return [2]ast.Node{key, p.parseExpr(Lowest)}
 }
 
 func (p *Parser) parseNodePairs(end item.Type) [][2]ast.Node {
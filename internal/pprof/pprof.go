@@ -0,0 +1,241 @@
+// Package pprof writes profiles in the format of pprof, the one `go tool
+// pprof` and the flame graph tools read: a gzipped protocol buffer, described
+// in github.com/google/pprof/proto/profile.proto. Only the part of it a
+// profile of tau code needs is written, functions and lines and no addresses,
+// and it is encoded by hand to spare a dependency for a dozen fields.
+package pprof
+
+import (
+	"compress/gzip"
+	"io"
+	"time"
+)
+
+// Frame is a line of a function, the unit a profile is made of.
+type Frame struct {
+	Func string
+	File string
+	Line int
+	// The line the function starts at, which tells apart two functions of a
+	// file with the same name.
+	StartLine int
+}
+
+// Sample is a stack, the innermost frame first, and what was measured on it,
+// one value per sample type.
+type Sample struct {
+	Stack  []Frame
+	Values []int64
+	// Labels tell apart samples with the same stack, e.g. by routine.
+	Labels map[string]int64
+}
+
+// ValueType names what a value measures and its unit, like "cpu" and
+// "nanoseconds".
+type ValueType struct {
+	Type string
+	Unit string
+}
+
+// Profile is what is written.
+type Profile struct {
+	SampleTypes []ValueType
+	Samples     []Sample
+	// How often a sample was taken, for a sampling profile.
+	PeriodType ValueType
+	Period     int64
+	Start      time.Time
+	Duration   time.Duration
+}
+
+// The field numbers of profile.proto.
+const (
+	profileSampleType    = 1
+	profileSample        = 2
+	profileLocation      = 4
+	profileFunction      = 5
+	profileStringTable   = 6
+	profileTimeNanos     = 9
+	profileDurationNanos = 10
+	profilePeriodType    = 11
+	profilePeriod        = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+	sampleLabel      = 3
+
+	labelKey = 1
+	labelNum = 3
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID        = 1
+	functionName      = 2
+	functionFilename  = 4
+	functionStartLine = 5
+)
+
+// Write encodes the profile to w.
+func (p *Profile) Write(w io.Writer) error {
+	e := encoder{strings: map[string]int64{"": 0}, table: []string{""}}
+	funcs := make(map[Frame]uint64)
+	locs := make(map[Frame]uint64)
+	var funcbuf, locbuf buffer
+
+	// A location is a line of a function and a function is a name in a file,
+	// both numbered from 1 in the order they are first seen.
+	location := func(f Frame) uint64 {
+		if id, ok := locs[f]; ok {
+			return id
+		}
+		fkey := Frame{Func: f.Func, File: f.File, StartLine: f.StartLine}
+		fid, ok := funcs[fkey]
+		if !ok {
+			fid = uint64(len(funcs) + 1)
+			funcs[fkey] = fid
+
+			var fn buffer
+			fn.uint(functionID, fid)
+			fn.int(functionName, e.str(f.Func))
+			fn.int(functionFilename, e.str(f.File))
+			fn.int(functionStartLine, int64(f.StartLine))
+			funcbuf.message(profileFunction, fn)
+		}
+
+		id := uint64(len(locs) + 1)
+		locs[f] = id
+
+		var line, loc buffer
+		line.uint(lineFunctionID, fid)
+		line.int(lineLine, int64(f.Line))
+		loc.uint(locationID, id)
+		loc.message(locationLine, line)
+		locbuf.message(profileLocation, loc)
+		return id
+	}
+
+	var out buffer
+	for _, t := range p.SampleTypes {
+		out.message(profileSampleType, e.valueType(t))
+	}
+
+	for _, s := range p.Samples {
+		ids := make([]uint64, len(s.Stack))
+		for i, f := range s.Stack {
+			ids[i] = location(f)
+		}
+		values := make([]uint64, len(s.Values))
+		for i, v := range s.Values {
+			values[i] = uint64(v)
+		}
+
+		var sample buffer
+		sample.packed(sampleLocationID, ids)
+		sample.packed(sampleValue, values)
+		for k, v := range s.Labels {
+			var label buffer
+			label.int(labelKey, e.str(k))
+			label.int(labelNum, v)
+			sample.message(sampleLabel, label)
+		}
+		out.message(profileSample, sample)
+	}
+
+	out = append(out, locbuf...)
+	out = append(out, funcbuf...)
+	out.int(profileTimeNanos, p.Start.UnixNano())
+	out.int(profileDurationNanos, int64(p.Duration))
+	if p.PeriodType != (ValueType{}) {
+		out.message(profilePeriodType, e.valueType(p.PeriodType))
+	}
+	out.int(profilePeriod, p.Period)
+	// Last, once every string has been seen.
+	for _, s := range e.table {
+		out.bytes(profileStringTable, []byte(s))
+	}
+
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(out); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// encoder keeps the string table: every string of a profile is written once
+// and referred to by its index, the empty string being always the first.
+type encoder struct {
+	strings map[string]int64
+	table   []string
+}
+
+func (e *encoder) str(s string) int64 {
+	if i, ok := e.strings[s]; ok {
+		return i
+	}
+	i := int64(len(e.table))
+	e.strings[s] = i
+	e.table = append(e.table, s)
+	return i
+}
+
+func (e *encoder) valueType(t ValueType) buffer {
+	var b buffer
+	b.int(valueTypeType, e.str(t.Type))
+	b.int(valueTypeUnit, e.str(t.Unit))
+	return b
+}
+
+// buffer is a protocol buffer message being written. Zero values are left
+// out, the way the protocol wants them.
+type buffer []byte
+
+func (b *buffer) varint(v uint64) {
+	for v >= 0x80 {
+		*b = append(*b, byte(v)|0x80)
+		v >>= 7
+	}
+	*b = append(*b, byte(v))
+}
+
+func (b *buffer) key(field, wire int) {
+	b.varint(uint64(field<<3 | wire))
+}
+
+func (b *buffer) uint(field int, v uint64) {
+	if v != 0 {
+		b.key(field, 0)
+		b.varint(v)
+	}
+}
+
+func (b *buffer) int(field int, v int64) {
+	b.uint(field, uint64(v))
+}
+
+func (b *buffer) bytes(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	*b = append(*b, data...)
+}
+
+func (b *buffer) message(field int, m buffer) {
+	b.bytes(field, m)
+}
+
+func (b *buffer) packed(field int, vs []uint64) {
+	if len(vs) == 0 {
+		return
+	}
+	var p buffer
+	for _, v := range vs {
+		p.varint(v)
+	}
+	b.bytes(field, p)
+}
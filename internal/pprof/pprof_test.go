@@ -0,0 +1,155 @@
+package pprof
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// field is a field of a decoded message: a number, or the bytes of a string
+// or of a nested message.
+type field struct {
+	num  uint64
+	data []byte
+}
+
+// decode splits a protocol buffer message into its fields, by number.
+func decode(t *testing.T, b []byte) map[int][]field {
+	t.Helper()
+	out := make(map[int][]field)
+
+	varint := func() uint64 {
+		var v uint64
+		for shift := 0; ; shift += 7 {
+			if len(b) == 0 {
+				t.Fatal("truncated varint")
+			}
+			c := b[0]
+			b = b[1:]
+			v |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				return v
+			}
+		}
+	}
+
+	for len(b) > 0 {
+		key := varint()
+		switch key & 7 {
+		case 0:
+			out[int(key>>3)] = append(out[int(key>>3)], field{num: varint()})
+		case 2:
+			n := varint()
+			out[int(key>>3)] = append(out[int(key>>3)], field{data: b[:n]})
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return out
+}
+
+func unpack(t *testing.T, b []byte) (vs []uint64) {
+	for len(b) > 0 {
+		var v uint64
+		for shift := 0; ; shift += 7 {
+			c := b[0]
+			b = b[1:]
+			v |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				break
+			}
+		}
+		vs = append(vs, v)
+	}
+	return
+}
+
+func TestWrite(t *testing.T) {
+	fib := Frame{Func: "fib", File: "main.tau", Line: 3, StartLine: 1}
+	fib5 := Frame{Func: "fib", File: "main.tau", Line: 5, StartLine: 1}
+	top := Frame{Func: "<top level>", File: "main.tau", Line: 9}
+
+	p := Profile{
+		SampleTypes: []ValueType{{"samples", "count"}, {"cpu", "nanoseconds"}},
+		Samples: []Sample{
+			{Stack: []Frame{fib, top}, Values: []int64{1, 10}},
+			{Stack: []Frame{fib, fib5, top}, Values: []int64{2, 20}, Labels: map[string]int64{"routine": 2}},
+		},
+		PeriodType: ValueType{"cpu", "nanoseconds"},
+		Period:     10,
+		Start:      time.Unix(1, 0),
+		Duration:   time.Second,
+	}
+
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := decode(t, raw)
+	var strs []string
+	for _, f := range msg[profileStringTable] {
+		strs = append(strs, string(f.data))
+	}
+	if len(strs) == 0 || strs[0] != "" {
+		t.Fatalf("the string table has to start with the empty string: %q", strs)
+	}
+	str := func(i uint64) string { return strs[i] }
+
+	// Two functions, fib and the top level, and three lines of them.
+	funcs := make(map[uint64]string)
+	for _, f := range msg[profileFunction] {
+		fn := decode(t, f.data)
+		funcs[fn[functionID][0].num] = str(fn[functionName][0].num) + "@" + str(fn[functionFilename][0].num)
+	}
+	if len(funcs) != 2 || funcs[1] != "fib@main.tau" || funcs[2] != "<top level>@main.tau" {
+		t.Errorf("functions: %v", funcs)
+	}
+
+	lines := make(map[uint64]string)
+	for _, f := range msg[profileLocation] {
+		loc := decode(t, f.data)
+		line := decode(t, loc[locationLine][0].data)
+		lines[loc[locationID][0].num] = funcs[line[lineFunctionID][0].num] + ":" + strconv.FormatUint(line[lineLine][0].num, 10)
+	}
+	if len(lines) != 3 {
+		t.Errorf("locations: %v", lines)
+	}
+
+	samples := msg[profileSample]
+	if len(samples) != 2 {
+		t.Fatalf("%d samples, expected 2", len(samples))
+	}
+	s := decode(t, samples[1].data)
+	var stack []string
+	for _, id := range unpack(t, s[sampleLocationID][0].data) {
+		stack = append(stack, lines[id])
+	}
+	want := []string{"fib@main.tau:3", "fib@main.tau:5", "<top level>@main.tau:9"}
+	if len(stack) != 3 || stack[0] != want[0] || stack[1] != want[1] || stack[2] != want[2] {
+		t.Errorf("stack %q, expected %q", stack, want)
+	}
+	if vs := unpack(t, s[sampleValue][0].data); len(vs) != 2 || vs[0] != 2 || vs[1] != 20 {
+		t.Errorf("values %v", vs)
+	}
+	label := decode(t, s[sampleLabel][0].data)
+	if str(label[labelKey][0].num) != "routine" || label[labelNum][0].num != 2 {
+		t.Errorf("label %v", label)
+	}
+
+	if msg[profilePeriod][0].num != 10 || msg[profileDurationNanos][0].num != uint64(time.Second) {
+		t.Errorf("period %v, duration %v", msg[profilePeriod], msg[profileDurationNanos])
+	}
+}
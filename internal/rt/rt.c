@@ -42,7 +42,7 @@ static inline int setenv(const char *name, const char *value, int overwrite) {
 
 #define TRAILER_LEN 12
 static const char exec_magic[4] = {'T', 'A', 'U', 'X'};
-static const char bundle_magic[5] = {'T', 'A', 'U', 'B', 0x03};
+static const char bundle_magic[5] = {'T', 'A', 'U', 'B', 0x04};
 
 __attribute__((noreturn))
 static void fatalf(const char *fmt, ...) {
@@ -58,6 +58,8 @@ static void fatalf(const char *fmt, ...) {
 struct rt_export {
 	char *name;
 	uint32_t idx;
+	// Whether the name is a constant, which the importer can't assign.
+	uint8_t readonly;
 };
 
 struct rt_module {
@@ -68,6 +70,8 @@ struct rt_module {
 };
 
 struct rt_bundle {
+	// The source file of the program, what its errors point at.
+	char *file;
 	struct rt_module *mods;
 	uint32_t nmods;
 	struct bytecode bc;
@@ -194,6 +198,7 @@ static struct rt_bundle rt_decode(const uint8_t *raw, size_t len) {
 	};
 	struct rt_bundle b = {0};
 
+	b.file = rt_str(&r);
 	b.nmods = rt_uint32(&r);
 	b.mods = calloc(b.nmods, sizeof(struct rt_module));
 
@@ -211,6 +216,7 @@ static struct rt_bundle rt_decode(const uint8_t *raw, size_t len) {
 		for (uint32_t j = 0; j < m->nexports; j++) {
 			m->exports[j].name = rt_str(&r);
 			m->exports[j].idx = rt_uint32(&r);
+			m->exports[j].readonly = *rt_take(&r, 1);
 		}
 	}
 
@@ -285,7 +291,10 @@ static void load_modules(struct vm *vm, struct rt_bundle *b) {
 			struct object o = vm->state.globals->list[m->exports[j].idx];
 
 			if (o.type == obj_object) {
-				object_set(mod, m->exports[j].name, object_to_module(o));
+				o = object_to_module(o);
+			}
+			if (m->exports[j].readonly) {
+				object_set_const(mod, m->exports[j].name, o);
 			} else {
 				object_set(mod, m->exports[j].name, o);
 			}
@@ -329,15 +338,55 @@ static void set_args(int argc, char **argv) {
 	}
 }
 
+// SIGQUIT dumps the stacks of the routines, as it does under `tau run`. It is
+// waited for by a thread of its own and blocked in every other one: what
+// gc_dump does can't be done in a signal handler. Windows has no SIGQUIT.
+#if !defined(_WIN32) && !defined(WIN32)
+#include <signal.h>
+#include <pthread.h>
+
+static sigset_t quit_set;
+
+static void *quit_loop(void *arg) {
+	(void) arg;
+	int sig;
+
+	while (sigwait(&quit_set, &sig) != 0);
+	gc_dump();
+	return NULL;
+}
+
+// Blocks it before any thread is started, for all of them to inherit the mask.
+static void block_quit(void) {
+	sigemptyset(&quit_set);
+	sigaddset(&quit_set, SIGQUIT);
+	pthread_sigmask(SIG_BLOCK, &quit_set, NULL);
+}
+
+// Once the collector is there to ask.
+static void dump_on_quit(void) {
+	pthread_t t;
+
+	if (pthread_create(&t, NULL, quit_loop, NULL) == 0) {
+		pthread_detach(t);
+	}
+}
+#else
+static void block_quit(void) {}
+static void dump_on_quit(void) {}
+#endif
+
 int main(int argc, char **argv) {
 	set_exit();
 	set_args(argc, argv);
+	block_quit();
 
 	size_t len;
 	uint8_t *raw = rt_payload(argv[0], &len);
 	struct rt_bundle b = rt_decode(raw, len);
 
-	struct vm *vm = new_vm(strdup(argv[0]), b.bc);
+	struct vm *vm = new_vm(b.file, b.bc);
+	dump_on_quit();
 	load_modules(vm, &b);
 
 	int ret = vm_run(vm);
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/NicoNex/tau/internal/code"
 	"github.com/NicoNex/tau/internal/compiler"
 	"github.com/NicoNex/tau/internal/obj"
 	"github.com/NicoNex/tau/internal/parser"
@@ -421,6 +422,131 @@ func TestTau(t *testing.T) {
 
 	// Test loop
 	tt.add(`for i = 0; i < 10; ++i {}; i`, obj.NewInteger(10))
+	// An inner loop starts once for every round of the outer one, and its
+	// init expression must not be left on the stack every time.
+	tt.add(`n = 0; for i = 0; i < 5000; ++i { for j = 0; j < 1; ++j { ++n } }; n`, obj.NewInteger(5000))
+
+	// Test for in
+	tt.add(`s = 0; for i, v in [10, 20, 30] { s += i * v }; s`, obj.NewInteger(80))
+	tt.add(`s = 0; for v in [1, 2, 3] { s += v }; s`, obj.NewInteger(6))
+	tt.add(`s = 0; for k, v in {1: 10, 2: 20} { s += k * v }; s`, obj.NewInteger(50))
+	tt.add(`s = ""; for k in {"a": 1} { s += k }; s`, obj.NewString("a"))
+	tt.add(`s = 0; for i, r in "città" { s = i * 1000 + r }; s`, obj.NewInteger(4224))
+	tt.add(`n = 0; for r in "città" { n++ }; n`, obj.NewInteger(5))
+	tt.add(`s = 0; for b in bytes("ab") { s = s * 1000 + b }; s`, obj.NewInteger(97098))
+	tt.add(`p = pipe(3); send(p, 1); send(p, null); close(p); n = 0; for i, v in p { n = i }; n`, obj.NewInteger(1))
+	tt.add(`s = 0; for v in [1, 2, 3, 4] { if v == 2 { continue }; if v == 4 { break }; s += v }; s`, obj.NewInteger(4))
+	tt.add(`m = {1: 1, 2: 2, 3: 3}; n = 0; for k in m { delete(m, k); n++ }; n`, obj.NewInteger(3))
+	tt.add(`f = fn(l) { for i, v in l { if v == 3 { return i } } }; f([5, 4, 3])`, obj.NewInteger(2))
+	tt.add(`n = 0; for i = 0; i < 5000; ++i { for v in [1] { if v { break } } ; n++ }; n`, obj.NewInteger(5000))
+	tt.add(`in = 2; in`, obj.NewInteger(2))
+
+	// Test destructuring
+	tt.add(`a, b = 1, 2; a * 10 + b`, obj.NewInteger(12))
+	tt.add(`a, b = 1, 2; a, b = b, a; a * 10 + b`, obj.NewInteger(21))
+	tt.add(`f = fn() { return 3, 4 }; a, b = f(); a * 10 + b`, obj.NewInteger(34))
+	tt.add(`[a, b] = [5, 6]; a * 10 + b`, obj.NewInteger(56))
+	tt.add(`o = new(); o.x = 7; o.y = 8; {x, y} = o; x * 10 + y`, obj.NewInteger(78))
+	tt.add(`o = new(); {x} = o; x`, obj.NullObj)
+	tt.add(`f = fn(l) { a, b = l; g = fn() { c, d = [b, a]; c - d }; g() }; f([1, 5])`, obj.NewInteger(4))
+	tt.add(`v = ([a, b] = [1, 2]); len(v)`, obj.NewInteger(2))
+
+	// Test defer
+	tt.add(`o = new(); o.s = ""; f = fn() { defer fn() { o.s += "a" }(); defer fn() { o.s += "b" }(); o.s += "f" }; f(); o.s`, obj.NewString("fba"))
+	tt.add(`o = new(); o.s = ""; add = fn(x) { o.s += x }; f = fn() { x = "1"; defer add(x); x = "2" }; f(); o.s`, obj.NewString("1"))
+	tt.add(`o = new(); o.n = 0; f = fn() { defer fn() { o.n++ }(); return 5 }; f() * 10 + o.n`, obj.NewInteger(51))
+	tt.add(`o = new(); o.n = 0; f = fn(x) { defer fn() { o.n++ }(); if x { return 1 }; 2 }; f(true) + f(false) + o.n * 10`, obj.NewInteger(23))
+	tt.add(`o = new(); o.n = 0; f = fn() { for i = 0; i < 3; ++i { defer fn(i) { o.n = o.n * 10 + i }(i) } }; f(); o.n`, obj.NewInteger(210))
+	tt.add(`o = new(); o.n = 0; f = fn() { defer fn() { o.n++ }(); 7 }; g = fn() { defer fn() { o.n *= 10 }(); f() }; g() + o.n`, obj.NewInteger(17))
+	tt.add(`p = pipe(1); f = fn() { defer send(p, 3) }; f(); recv(p)`, obj.NewInteger(3))
+	tt.add(`f = fn() { defer fn() { return 9 }(); 4 }; f()`, obj.NewInteger(4))
+
+	// Test tail calls
+	tt.add(`f = fn(n, acc) { if n == 0 { return acc }; return f(n - 1, acc + 1) }; f(100000, 0)`, obj.NewInteger(100000))
+	tt.add(`even = fn(n) { if n == 0 { true } else { odd(n - 1) } }; odd = fn(n) { if n == 0 { false } else { even(n - 1) } }; even(100001)`, obj.FalseObj)
+	tt.add(`f = fn(n, acc) { g = fn() { n }; if n == 0 { return acc }; f(n - 1, acc + g()) }; f(100000, 0)`, obj.NewInteger(5000050000))
+	tt.add(`f = fn(n, ...xs) { if n == 0 { len(xs) } else { f(n - 1, ...xs, n) } }; f(100)`, obj.NewInteger(100))
+	tt.add(`f = fn(x) { len(x) }; f("abc")`, obj.NewInteger(3))
+	tt.add(`o = new(); o.s = ""; f = fn(n) { defer fn() { o.s += string(n) }(); if n > 0 { f(n - 1) } }; f(3); o.s`, obj.NewString("0123"))
+	tt.add(`f = fn(a) { a }; g = fn() { f(1, 2) }; string(try(g))`, obj.NewString("<tautest>:1: wrong number of arguments: expected 1, got 2"))
+	tt.add(`f = fn(a) { a }; string(try(f, 1, 2))`, obj.NewString("<tautest>:1: wrong number of arguments: expected 1, got 2"))
+
+	// Test literals that pile up more values than a call leaves room for
+	elems, pairs := make([]string, 3000), make([]string, 3000)
+	for i := range elems {
+		elems[i] = "x"
+		pairs[i] = fmt.Sprintf("%d: x", i)
+	}
+	tt.add(`x = 1; f = fn() { [`+strings.Join(elems[:300], ", ")+`] }; len(f())`, obj.NewInteger(300))
+	tt.add(`x = 1; len([`+strings.Join(elems, ", ")+`])`, obj.NewInteger(3000))
+	tt.add(`x = 1; m = {`+strings.Join(pairs, ", ")+`}; m[2999]`, obj.NewInteger(1))
+	tt.add(`x = 1; f = fn() { m = {`+strings.Join(pairs, ", ")+`}; m }; f()[1500]`, obj.NewInteger(1))
+
+	// Test try
+	tt.add(`try(fn(a, b) { a + b }, 1, 2)`, obj.NewInteger(3))
+	tt.add(`failed(try(fn() { null.x }))`, obj.TrueObj)
+	tt.add(`z = 0; string(try(fn() { 1 / z }))`, obj.NewString("<tautest>:1: can't divide by 0"))
+	tt.add(`f = fn(n) { 1 + f(n + 1) }; string(try(f, 0))`, obj.NewString("<tautest>:1: stack overflow"))
+	tt.add(`o = new(); o.n = 0; try(fn() { defer fn() { o.n++ }(); [][1] + 1 }); o.n`, obj.NewInteger(1))
+	tt.add(`a = "a"; string(try(fn() { try(fn() { null.x }); 1 + a }))`, obj.NewString("<tautest>:1: unsupported operator '+' for types int and string"))
+	tt.add(`string(try(fn() { error("returned") }))`, obj.NewString("returned"))
+	tt.add(`string(try(3))`, obj.NewString("try: int is not a function"))
+	tt.add(`try(len, "abc")`, obj.NewInteger(3))
+	tt.add(`n = 0; for i = 0; i < 100; ++i { if failed(try(fn() { null.x })) { n++ } }; n`, obj.NewInteger(100))
+	tt.add(`f = fn(n) { r = try(f, n + 1); if failed(r) { return n }; r }; f(0) > 100`, obj.TrueObj)
+	tt.add(`f = fn(n) { r = try(f, n + 1); if failed(r) { return n }; r }; p = pipe(); tau fn() { send(p, f(0)) }(); recv(p) > 100`, obj.TrueObj)
+
+	// Test default and variadic parameters
+	tt.add(`f = fn(a, b = 10) { a + b }; f(1)`, obj.NewInteger(11))
+	tt.add(`f = fn(a, b = 10) { a + b }; f(1, 2)`, obj.NewInteger(3))
+	tt.add(`f = fn(a, b = 10) { a + b }; f(1, null)`, obj.NewInteger(11))
+	tt.add(`f = fn(a, b = a * 2) { a + b }; f(3)`, obj.NewInteger(9))
+	tt.add(`o = new(); o.n = 0; f = fn(a = (o.n = o.n + 1)) { a }; f(); f(); f(7); o.n`, obj.NewInteger(2))
+	tt.add(`f = fn(a = 1) {}; f()`, obj.NullObj)
+	tt.add(`f = fn(...xs) { len(xs) }; f()`, obj.NewInteger(0))
+	tt.add(`f = fn(a, ...xs) { xs }; string(f(1, 2, 3))`, obj.NewString("[2, 3]"))
+	tt.add(`f = fn(a, b = 2, ...xs) { "{a} {b} {xs}" }; f(1)`, obj.NewString("1 2 []"))
+	tt.add(`f = fn(a, b, c) { a * 100 + b * 10 + c }; f(...[1, 2, 3])`, obj.NewInteger(123))
+	tt.add(`f = fn(a, b, c) { a * 100 + b * 10 + c }; f(1, ...[2], ...[], 3)`, obj.NewInteger(123))
+	tt.add(`f = fn(...xs) { xs }; string(f(...[1, 2], 3))`, obj.NewString("[1, 2, 3]"))
+	tt.add(`len(...["abc"])`, obj.NewInteger(3))
+	tt.add(`f = fn(a, b = 2) { a }; string(try(f))`, obj.NewString("<tautest>:1: wrong number of arguments: expected 1 to 2, got 0"))
+	tt.add(`f = fn(a, b = 2) { a }; string(try(f, 1, 2, 3))`, obj.NewString("<tautest>:1: wrong number of arguments: expected 1 to 2, got 3"))
+	tt.add(`f = fn(a, ...xs) { a }; string(try(f))`, obj.NewString("<tautest>:1: wrong number of arguments: expected at least 1, got 0"))
+	tt.add(`f = fn(a) { a }; string(try(fn() { f(...3) }))`, obj.NewString("<tautest>:1: cannot spread int, only a list"))
+
+	// Test nonlocal
+	tt.add(`mk = fn() { n = 0; fn() { nonlocal n; n = n + 1 } }; next = mk(); next(); next()`, obj.NewInteger(2))
+	tt.add(`f = fn() { n = 0; inc = fn() { nonlocal n; n++ }; inc(); inc(); n }; f()`, obj.NewInteger(2))
+	tt.add(`f = fn() { n = 0; inc = fn() { nonlocal n; n += 1 }; get = fn() { n }; inc(); n = 10; inc(); get() }; f()`, obj.NewInteger(11))
+	tt.add(`f = fn() { n = 1; fn() { fn() { nonlocal n; n *= 3 } }()(); n }; f()`, obj.NewInteger(3))
+	tt.add(`mk = fn() { n = 0; fn() { nonlocal n; ++n } }; a = mk(); b = mk(); a(); a(); "{a()} {b()}"`, obj.NewString("3 1"))
+	tt.add(`g = 1; f = fn() { nonlocal g; g = 5 }; f(); g`, obj.NewInteger(5))
+	tt.add(`f = fn() { a = 0; b = 0; fn() { nonlocal a, b; a = 1; b = 2 }(); a + b }; f()`, obj.NewInteger(3))
+	tt.add(`f = fn() { n = 0; fn() { n = 5 }(); n }; f()`, obj.NewInteger(0))
+
+	// Test const
+	tt.add(`const K = 1 << 20; K`, obj.NewInteger(1048576))
+	tt.add(`const K = 2; const L = K * 3 + 1; L`, obj.NewInteger(7))
+	tt.add(`const S = "a" + "b"; f = fn() { S + "c" }; f()`, obj.NewString("abc"))
+	tt.add(`const K = 2; f = fn(K) { K }; f(5)`, obj.NewInteger(5))
+	tt.add(`f = fn() { const K = 4; fn() { K * K }() }; f()`, obj.NewInteger(16))
+	tt.add(`const L = len("abc"); L`, obj.NewInteger(3))
+	tt.add(`const fact = fn(n) { if n < 2 { 1 } else { n * fact(n - 1) } }; fact(5)`, obj.NewInteger(120))
+	tt.add(`f = fn() { K }; const K = 9; f()`, obj.NewInteger(9))
+
+	// Test error values
+	tt.add(`e = error("boom"); e.Message`, obj.NewString("boom"))
+	tt.add(`e = error("boom"); "{e.File}:{e.Line} {e.Cause} {e.Code} {e.Other}"`, obj.NewString("<tautest>:1 null null null"))
+	tt.add(`e = error("boom"); e.Code = 2; e.Path = "/x"; "{e.Code} {e.Path}"`, obj.NewString("2 /x"))
+	tt.add(`c = error("c"); e = error("e: {c}", c); "{e} {e.Cause == c}"`, obj.NewString("e: c true"))
+	tt.add(`failed(error("a", null))`, obj.TrueObj)
+	tt.add(`string(error("a", 1))`, obj.NewString("error: cause must be an error, got int"))
+	tt.add(`string(try(fn() { e = error("a"); e.Line = 3 }))`, obj.NewString("<tautest>:1: cannot assign to Line of an error"))
+	tt.add(`f = fn() {
+		error("deep")
+	}
+	f().Line`, obj.NewInteger(2))
 
 	// Test list
 	tt.add(`a = [1, 2, 3, 4, 5]; a[3]`, obj.NewInteger(4))
@@ -435,6 +561,143 @@ func TestTau(t *testing.T) {
 
 	// Test string interpolation
 	tt.add(`a = 123; b = 456; "test {a} and {b}"`, obj.NewString("test 123 and 456"))
+	tt.add(`x = 3.14159; n = 42; "{x:08.3f}|{n:5d}|{n:-4x}|{n:#b}"`, obj.NewString("0003.142|   42|2a  |0b101010"))
+	tt.add(`m = {"a": 1}; k = "a"; "{m[k]:03d} { {k: 2}[k]:T} {k:q}"`, obj.NewString(`001 int "a"`))
+	tt.add(`s = "x"; string(try(fn() { "{s:d}" }))`, obj.NewString("<tautest>:1: interpolation: %d can't format string"))
+
+	// Test sprintf
+	tt.add(`sprintf("%d|%5.2f|%-3s|%x|%T", 7, 2.5, "ab", 255, [])`, obj.NewString("7| 2.50|ab |ff|list"))
+	tt.add(`sprintf("%g %g %g", 100, 0.1, 1e21)`, obj.NewString("100 0.1 1e+21"))
+	tt.add(`string(sprintf("%d %d", 1))`, obj.NewString("sprintf: %d has no argument"))
+	tt.add(`string(sprintf("%s", 1, 2))`, obj.NewString("sprintf: 2 arguments for 1 verbs"))
+
+	// Test select
+	tt.add(`p = pipe(1); send(p, 3); select { case v = recv(p) { v * 2 } }`, obj.NewInteger(6))
+	tt.add(`p = pipe(); select { case v = recv(p) { v } default { 1 } }`, obj.NewInteger(1))
+	tt.add(`p = pipe(); select { case recv(p) { 0 } case after(1) { 2 } }`, obj.NewInteger(2))
+	tt.add(`p = pipe(1); select { case v = send(p, 4) { v } }; recv(p)`, obj.NewInteger(4))
+	tt.add(`p = pipe(1); close(p); select { case v = recv(p) { v } }`, obj.NullObj)
+	tt.add(`p = pipe(1); close(p); select { case e = send(p, 1) { string(e) } }`, obj.NewString("send: closed pipe"))
+	tt.add(`p = pipe(1); q = pipe(1); send(q, 5); select { case recv(p) { 1 } case v = recv(q) {} }`, obj.NullObj)
+	tt.add(`f = fn(p) { select { case v = recv(p) { return v + 1 } } }; p = pipe(1); send(p, 1); f(p)`, obj.NewInteger(2))
+
+	// Test switch
+	tt.add(`switch 2 { case 1 { "a" } case 2, 3 { "b" } default { "c" } }`, obj.NewString("b"))
+	tt.add(`switch "x" { case "y" { 1 } default { 2 } }`, obj.NewInteger(2))
+	tt.add(`switch 4 { case 1 { 1 } }`, obj.NullObj)
+	tt.add(`switch 2.0 { case 1 { 1 } case 2 { 2 } }`, obj.NewInteger(2))
+	tt.add(`x = 5; switch x { case 5 if false { 1 } case 5 { 2 } }`, obj.NewInteger(2))
+	tt.add(`x = -3; switch { case x > 0 { 1 } case x == 0, x == -3 { 2 } default { 3 } }`, obj.NewInteger(2))
+	tt.add(`switch [1, 2] { case [a] { a } case [a, b] { a * 10 + b } }`, obj.NewInteger(12))
+	tt.add(`switch [1, 2] { case [a, b] if a > b { 1 } case [_, b] { b } }`, obj.NewInteger(2))
+	tt.add(`switch [3, [4]] { case [3, [x]] { x } }`, obj.NewInteger(4))
+	tt.add(`switch ({"op": "add", "n": 2}) { case {"op": "sub"} { 0 } case {"op": "add", "n": n} { n } }`, obj.NewInteger(2))
+	tt.add(`switch ({"a": 1}) { case {"b": b} { b } default { 9 } }`, obj.NewInteger(9))
+	tt.add(`f = fn(v) { switch v { case [a, b], [a, b, _] { a + b } case {"x": x} { x } default { 0 } } }; f([1, 2, 3]) + f({"x": 10}) + f("s")`, obj.NewInteger(13))
+	tt.add(`f = fn(d) { switch d { case 0 { 1 } case 1, 2 { 2 } case 3 { 3 } case 5 { 5 } } }; f(2) * 100 + f(5) * 10 + f(3)`, obj.NewInteger(253))
+	tt.add(`f = fn(d) { switch d { case 0 { 1 } case 1, 2 { 2 } case 3 { 3 } case 5 { 5 } default { 9 } } }; f(4) + f(-1) + f(6) + f("1") + f(2.5)`, obj.NewInteger(45))
+	tt.add(`f = fn(d) { switch d { case 0 { 1 } case 1 { 2 } case 2 { 3 } case 1 { 4 } } }; f(1)`, obj.NewInteger(2))
+	tt.add(`n = 0; for i = 0; i < 10; ++i { switch i { case 3 { break } }; n++ }; n`, obj.NewInteger(3))
+	tt.add(`n = 0; for i = 0; i < 1000; ++i { n += switch [i, i] { case [1, 2], [[_]] { 1 } case [_, x] if x % 2 == 0 { 1 } default { 0 } } }; n`, obj.NewInteger(500))
+
+	tt.run(t)
+}
+
+// TestConstFolding checks that what is worked out of constants is worked out
+// once, by the compiler: nothing is left to compute when the program runs.
+func TestConstFolding(t *testing.T) {
+	bc, err := compile(`const K = 1 << 20; const S = "a" + "b"; x = K * 2 + 1; S + "c"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ins := bc.Insts().String()
+	for _, op := range []string{"OpBwLShift", "OpMul", "OpAdd", "OpGetGlobal"} {
+		if strings.Contains(ins, op) {
+			t.Errorf("%s left in the program:\n%s", op, ins)
+		}
+	}
+}
 
+// TestTailCalls checks which calls are made in tail position: the ones whose
+// value the function returns as it is, and no other.
+func TestTailCalls(t *testing.T) {
+	for src, want := range map[string]bool{
+		`fn(n) { return f(n) }`:                     true,
+		`fn(n) { f(n) }`:                            true,
+		`fn(n) { if n { f(n) } else { g(n) } }`:     true,
+		`fn(n) { x = if n { f(n) } else { 0 }; x }`: false,
+		`fn(n) { 1 + f(n) }`:                        false,
+		`fn(n) { f(n); null }`:                      false,
+	} {
+		bc, err := compile("f = null; g = null; " + src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ins string
+		for _, c := range bc.Consts() {
+			if c.Type() == obj.FunctionType {
+				ins = code.Instructions(c.CompiledFunction().Instructions()).String()
+			}
+		}
+		if got := strings.Contains(ins, "OpTailCall"); got != want {
+			t.Errorf("%s: tail call %t, expected %t:\n%s", src, got, want, ins)
+		}
+	}
+}
+
+func TestConstAssign(t *testing.T) {
+	for _, code := range []string{
+		`const K = 1; K = 2`,
+		`const K = 1; K += 1`,
+		`const K = 1; f = fn() { K = 2 }`,
+		`const K = 1; a, K = [1, 2]`,
+		`const K = 1; for K in [1] {}`,
+		`const K = 1; const K = 2`,
+	} {
+		if _, err := compile(code); err == nil || !strings.Contains(err.Error(), "cannot assign to constant K") {
+			t.Errorf("%s: expected an error assigning K, got %v", code, err)
+		}
+	}
+}
+
+// TestOptimizer checks that the hot pairs of a loop come out of the compiler
+// fused, and that nothing is left after a return.
+func TestOptimizer(t *testing.T) {
+	bc, err := compile(`f = fn(n) { s = 0; for i = 0; i < n; ++i { if i % 2 == 0 { s += i } }; return s; println("dead") }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ins string
+	for _, c := range bc.Consts() {
+		if c.Type() == obj.FunctionType {
+			ins = code.Instructions(c.CompiledFunction().Instructions()).String()
+		}
+	}
+	for _, op := range []string{"OpUpdateLocal", "OpLocalConst", "OpCompareJump"} {
+		if !strings.Contains(ins, op) {
+			t.Errorf("no %s in the function:\n%s", op, ins)
+		}
+	}
+	for _, op := range []string{"OpGreaterThan", "OpMod", "OpGetBuiltin"} {
+		if strings.Contains(ins, op) {
+			t.Errorf("%s left in the function:\n%s", op, ins)
+		}
+	}
+
+	var tt = make(TauTest)
+	tt.add(`f = fn(n) { s = 0; for i = 0; i < n; ++i { if i % 2 == 0 { s += i } }; s }; f(10)`, obj.NewInteger(20))
+	tt.add(`f = fn() { i = 1; x = i++; x * 10 + i }; f()`, obj.NewInteger(12))
+	tt.add(`f = fn() { s = "a"; for i = 0; i < 3; ++i { s += "b" }; s }; f()`, obj.NewString("abbb"))
+	tt.add(`f = fn() { x = 1.5; x += 1; x -= 0.5; x }; f()`, obj.NewFloat(2))
+	tt.add(`f = fn() { n = 0; g = fn() { nonlocal n; n += 2 }; g(); g(); n }; f()`, obj.NewInteger(4))
+	tt.add(`f = fn(x) { if 1 < 2 { return x }; 0 }; f(3)`, obj.NewInteger(3))
+	tt.add(`f = fn(x) { for { if x > 3 { break }; ++x }; x }; f(0)`, obj.NewInteger(4))
+	tt.add(`f = fn(d) { switch d { case 0 { 1 } case 1 { 2 } case 2 { 3 } } }; f(0) + f(2)`, obj.NewInteger(4))
+	tt.add(`f = fn() { a = 1; try(fn() { a += "x" }) }; string(f())`, obj.NewString("<tautest>:1: unsupported operator '+' for types int and string"))
+	tt.add("f = fn() {\n\ta = 1\n\ta += \"x\"\n}\nstring(try(f))", obj.NewString("<tautest>:3: unsupported operator '+' for types int and string"))
+	tt.add("f = fn(a) {\n\tif a < \"x\" {\n\t\treturn 1\n\t}\n}\nstring(try(f, 1))", obj.NewString("<tautest>:2: unsupported operator '>' for types string and int"))
 	tt.run(t)
 }
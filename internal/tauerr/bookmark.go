@@ -49,6 +49,13 @@ func (b Bookmark) Offset() int {
 	return int(b.offset)
 }
 
+// At is the bookmark moved to another offset, for code that was rewritten
+// after the bookmark was made.
+func (b Bookmark) At(offset int) Bookmark {
+	b.offset = C.int32_t(offset)
+	return b
+}
+
 func (b Bookmark) LineNo() int {
 	return int(b.lineno)
 }
@@ -0,0 +1,124 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"time"
+)
+
+// chromeEvent is an event of the Trace Event Format, the JSON that
+// chrome://tracing and Perfetto open.
+type chromeEvent struct {
+	Name  string         `json:"name"`
+	Phase string         `json:"ph"`
+	Ts    float64        `json:"ts"`
+	Dur   *float64       `json:"dur,omitempty"`
+	Pid   int            `json:"pid"`
+	Tid   uint32         `json:"tid"`
+	Scope string         `json:"s,omitempty"`
+	Args  map[string]any `json:"args,omitempty"`
+}
+
+// In microseconds, the unit of the format.
+func micros(d time.Duration) float64 {
+	return float64(d) / float64(time.Microsecond)
+}
+
+// WriteChrome writes the trace in the Trace Event Format, to be opened in a
+// browser: every routine is a thread, its lifetime a span on it with the
+// waits on pipes and for the collector inside, and the values sent and
+// received marks along it. The collections are on a thread of their own, 0,
+// shared with the builtins run with `tau`.
+func WriteChrome(w io.Writer, t *Trace) error {
+	s := Summarize(t)
+	var out []chromeEvent
+
+	span := func(name string, tid uint32, from, to time.Duration, args map[string]any) {
+		dur := micros(to - from)
+		out = append(out, chromeEvent{Name: name, Phase: "X", Ts: micros(from), Dur: &dur, Tid: tid, Args: args})
+	}
+	instant := func(name string, tid uint32, at time.Duration, args map[string]any) {
+		out = append(out, chromeEvent{Name: name, Phase: "i", Ts: micros(at), Tid: tid, Scope: "t", Args: args})
+	}
+	meta := func(tid uint32, name string) {
+		out = append(out, chromeEvent{Name: "thread_name", Phase: "M", Tid: tid, Args: map[string]any{"name": name}})
+	}
+
+	meta(0, "collector")
+	for _, r := range s.Routines {
+		if r.ID == 0 {
+			continue
+		}
+		meta(r.ID, fmt.Sprintf("routine %d: %s", r.ID, r.Func))
+		args := map[string]any{}
+		if r.File != "" {
+			args["started at"] = fmt.Sprintf("%s:%d", r.File, r.Line)
+		}
+		span(r.Func, r.ID, r.Start, r.End, args)
+	}
+
+	type wait struct {
+		since  time.Duration
+		reason Reason
+		pipes  []uint64
+	}
+	blocked := make(map[uint32]wait)
+	parked := make(map[uint32]time.Duration)
+	var gcStart time.Duration
+
+	endWait := func(id uint32, at time.Duration) {
+		b, ok := blocked[id]
+		if !ok {
+			return
+		}
+		delete(blocked, id)
+		span(fmt.Sprintf("blocked on %s", b.reason), id, b.since, at, map[string]any{"pipes": b.pipes})
+	}
+
+	for _, e := range t.Events {
+		switch e.Kind {
+		case Block:
+			endWait(e.Routine, e.Time)
+			blocked[e.Routine] = wait{since: e.Time, reason: e.Reason, pipes: e.Pipes}
+		case Unblock, RoutineEnd:
+			endWait(e.Routine, e.Time)
+		case PipeNew:
+			instant("make pipe", e.Routine, e.Time, map[string]any{"pipe": e.Pipe, "at": fmt.Sprintf("%s:%d", e.File, e.Line)})
+		case PipeSend:
+			instant("send", e.Routine, e.Time, map[string]any{"pipe": e.Pipe})
+		case PipeRecv:
+			instant("recv", e.Routine, e.Time, map[string]any{"pipe": e.Pipe})
+		case PipeClose:
+			instant("close", e.Routine, e.Time, map[string]any{"pipe": e.Pipe})
+		case RoutineCreate:
+			instant("start routine", e.Routine, e.Time, map[string]any{"routine": e.ID, "func": e.Func})
+		case GCStart:
+			gcStart = e.Time
+		case GCEnd:
+			span("GC", 0, gcStart, e.Time, nil)
+		case Park:
+			parked[e.Routine] = e.Time
+		case Unpark:
+			if at, ok := parked[e.Routine]; ok {
+				span("GC wait", e.Routine, at, e.Time, nil)
+				delete(parked, e.Routine)
+			}
+		}
+	}
+	// What was still waiting waited to the end.
+	for _, id := range slices.Sorted(maps.Keys(blocked)) {
+		endWait(id, s.Duration)
+	}
+
+	for i := range out {
+		out[i].Pid = 1
+	}
+	return json.NewEncoder(w).Encode(map[string]any{
+		"traceEvents":     out,
+		"displayTimeUnit": "ns",
+		"otherData":       map[string]any{"start": t.Start.Format(time.RFC3339Nano)},
+	})
+}
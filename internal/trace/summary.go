@@ -0,0 +1,258 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Routine is what a routine did over the trace.
+type Routine struct {
+	ID   uint32
+	Func string
+	// Where it was started, empty for the main routine and for the ones
+	// started before the trace was.
+	File string
+	Line int
+
+	Start, End time.Duration
+	// Whether it ended before the trace did.
+	Ended bool
+
+	// How long it waited on pipes, in total and by what for.
+	Blocked  time.Duration
+	ByReason [3]time.Duration
+	// How long it stood still for the collector.
+	GCWait time.Duration
+
+	// What it was waiting for when the trace ended, a deadlock being a trace
+	// that ends with every routine in here.
+	BlockedAtEnd bool
+	Reason       Reason
+	Pipes        []uint64
+	Since        time.Duration
+}
+
+// Pipe is what went through a pipe over the trace.
+type Pipe struct {
+	ID       uint64
+	File     string
+	Line     int
+	Cap      int
+	Buffered bool
+
+	Sent, Received int
+	Closed         bool
+	// How long routines waited on it, in total and by what for. A select
+	// waiting on several pipes counts for all of them.
+	Blocked  time.Duration
+	ByReason [3]time.Duration
+}
+
+// Summary is a trace boiled down, routine by routine and pipe by pipe.
+type Summary struct {
+	Duration time.Duration
+	// The routines and the pipes, the ones blocked the longest first.
+	Routines []*Routine
+	Pipes    []*Pipe
+
+	Collections int
+	GCTotal     time.Duration
+	GCMax       time.Duration
+}
+
+// Summarize tells how long every routine waited and on what.
+func Summarize(t *Trace) *Summary {
+	s := &Summary{}
+	routines := make(map[uint32]*Routine)
+	pipes := make(map[uint64]*Pipe)
+	if n := len(t.Events); n > 0 {
+		s.Duration = t.Events[n-1].Time
+	}
+
+	routine := func(id uint32, at time.Duration) *Routine {
+		r, ok := routines[id]
+		if !ok {
+			r = &Routine{ID: id, Start: at}
+			switch id {
+			case 0:
+				r.Func = "<builtin>"
+			case 1:
+				r.Func = "<main>"
+			default:
+				r.Func = fmt.Sprintf("routine %d", id)
+			}
+			routines[id] = r
+		}
+		return r
+	}
+	pipe := func(id uint64) *Pipe {
+		p, ok := pipes[id]
+		if !ok {
+			p = &Pipe{ID: id}
+			pipes[id] = p
+		}
+		return p
+	}
+
+	unblock := func(r *Routine, at time.Duration) {
+		if !r.BlockedAtEnd {
+			return
+		}
+		d := at - r.Since
+		r.Blocked += d
+		r.ByReason[r.Reason%3] += d
+		for _, id := range r.Pipes {
+			p := pipe(id)
+			p.Blocked += d
+			p.ByReason[r.Reason%3] += d
+		}
+		r.BlockedAtEnd = false
+		r.Pipes = nil
+	}
+
+	parked := make(map[uint32]time.Duration)
+	var gcStart time.Duration
+	for _, e := range t.Events {
+		switch e.Kind {
+		case RoutineCreate:
+			r := routine(e.ID, e.Time)
+			r.Func, r.File, r.Line = e.Func, e.File, e.Line
+			routine(e.Routine, e.Time)
+		case RoutineStart:
+			routine(e.Routine, e.Time)
+		case RoutineEnd:
+			r := routine(e.Routine, e.Time)
+			unblock(r, e.Time)
+			r.End, r.Ended = e.Time, true
+		case PipeNew:
+			p := pipe(e.Pipe)
+			p.File, p.Line, p.Cap, p.Buffered = e.File, e.Line, e.Cap, e.Buffered
+			routine(e.Routine, e.Time)
+		case PipeSend:
+			pipe(e.Pipe).Sent++
+		case PipeRecv:
+			pipe(e.Pipe).Received++
+		case PipeClose:
+			pipe(e.Pipe).Closed = true
+		case Block:
+			r := routine(e.Routine, e.Time)
+			unblock(r, e.Time)
+			r.BlockedAtEnd, r.Reason, r.Pipes, r.Since = true, e.Reason, e.Pipes, e.Time
+			for _, id := range e.Pipes {
+				pipe(id)
+			}
+		case Unblock:
+			unblock(routine(e.Routine, e.Time), e.Time)
+		case GCStart:
+			gcStart = e.Time
+		case GCEnd:
+			d := e.Time - gcStart
+			s.Collections++
+			s.GCTotal += d
+			s.GCMax = max(s.GCMax, d)
+		case Park:
+			parked[e.Routine] = e.Time
+		case Unpark:
+			if at, ok := parked[e.Routine]; ok {
+				routine(e.Routine, at).GCWait += e.Time - at
+				delete(parked, e.Routine)
+			}
+		}
+	}
+
+	// The waits that never ended count up to the end, and stay in the
+	// summary as waits that never ended.
+	for _, r := range routines {
+		if r.Ended {
+			continue
+		}
+		r.End = s.Duration
+		if r.BlockedAtEnd {
+			reason, ids, since := r.Reason, r.Pipes, r.Since
+			unblock(r, s.Duration)
+			r.BlockedAtEnd, r.Reason, r.Pipes, r.Since = true, reason, ids, since
+		}
+	}
+
+	for _, r := range routines {
+		s.Routines = append(s.Routines, r)
+	}
+	sort.Slice(s.Routines, func(i, j int) bool {
+		a, b := s.Routines[i], s.Routines[j]
+		if a.Blocked != b.Blocked {
+			return a.Blocked > b.Blocked
+		}
+		return a.ID < b.ID
+	})
+	for _, p := range pipes {
+		s.Pipes = append(s.Pipes, p)
+	}
+	sort.Slice(s.Pipes, func(i, j int) bool {
+		a, b := s.Pipes[i], s.Pipes[j]
+		if a.Blocked != b.Blocked {
+			return a.Blocked > b.Blocked
+		}
+		return a.ID < b.ID
+	})
+	return s
+}
+
+// Write prints the summary as the tables `tau trace` shows.
+func (s *Summary) Write(w io.Writer) error {
+	pipeName := make(map[uint64]string)
+	for _, p := range s.Pipes {
+		pipeName[p.ID] = fmt.Sprintf("pipe %d", p.ID)
+		if p.File != "" {
+			pipeName[p.ID] += fmt.Sprintf(" (%s:%d)", p.File, p.Line)
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "%v traced, %d routines, %d pipes, %d collections pausing %v (%v the longest)\n\n",
+		s.Duration, len(s.Routines), len(s.Pipes), s.Collections, s.GCTotal, s.GCMax)
+
+	fmt.Fprintln(tw, "ROUTINE\tFUNCTION\tSTARTED AT\tLIFETIME\tBLOCKED\tSEND\tRECV\tSELECT\tGC WAIT\t")
+	for _, r := range s.Routines {
+		at := "-"
+		if r.File != "" {
+			at = fmt.Sprintf("%s:%d", r.File, r.Line)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%v\t%v\t%v\t%v\t%v\t%v\t\n", r.ID, r.Func, at, r.End-r.Start,
+			r.Blocked, r.ByReason[BlockSend], r.ByReason[BlockRecv], r.ByReason[BlockSelect], r.GCWait)
+	}
+
+	fmt.Fprintln(tw, "\nPIPE\tMADE AT\tSIZE\tSENT\tRECEIVED\tBLOCKED\tSEND\tRECV\tSELECT\tCLOSED\t")
+	for _, p := range s.Pipes {
+		at, size := "-", "unbuffered"
+		if p.File != "" {
+			at = fmt.Sprintf("%s:%d", p.File, p.Line)
+		}
+		if p.Buffered {
+			size = fmt.Sprint(p.Cap)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%v\t%v\t%v\t%v\t%v\t\n", p.ID, at, size, p.Sent, p.Received,
+			p.Blocked, p.ByReason[BlockSend], p.ByReason[BlockRecv], p.ByReason[BlockSelect], p.Closed)
+	}
+
+	var stuck []*Routine
+	for _, r := range s.Routines {
+		if r.BlockedAtEnd {
+			stuck = append(stuck, r)
+		}
+	}
+	if len(stuck) > 0 {
+		fmt.Fprintln(tw, "\nblocked when the trace ended:")
+		for _, r := range stuck {
+			var on []string
+			for _, id := range r.Pipes {
+				on = append(on, pipeName[id])
+			}
+			fmt.Fprintf(tw, "  routine %d (%s) on %s of %s, for %v\n", r.ID, r.Func, r.Reason, strings.Join(on, ", "), s.Duration-r.Since)
+		}
+	}
+	return tw.Flush()
+}
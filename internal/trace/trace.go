@@ -0,0 +1,225 @@
+// Package trace reads the traces `tau run -trace` writes, and tells what is in
+// them: how long every routine waited and on which pipe, in Summarize, and
+// the whole of it on a timeline a browser shows, in WriteChrome.
+//
+// A trace is written by internal/vm/trace.c. It starts with the line
+// "tau trace", the version of the format and the time it started, in
+// nanoseconds since 1970. Records follow, each one its kind in a byte, the
+// nanoseconds since the start, the routine it happened on and what the kind
+// adds to that:
+//
+//	RoutineCreate  the routine, the line and the file it was started at, the function
+//	RoutineStart   nothing
+//	RoutineEnd     nothing
+//	PipeNew        the pipe, its size, whether it is buffered, the line and the file
+//	PipeSend       the pipe
+//	PipeRecv       the pipe
+//	PipeClose      the pipe
+//	Block          why, how many pipes, the pipes
+//	Unblock        nothing
+//	GCStart        nothing
+//	GCEnd          nothing
+//	Park           nothing
+//	Unpark         nothing
+//	Tick           nothing, written every time the trace is flushed
+//
+// Numbers are varints, strings a varint length and the bytes. A routine is
+// the number the VM running it has, the main one being 1 and 0 no routine at
+// all: a builtin run with `tau`. A pipe is its address.
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Kind is what a record says happened.
+type Kind uint8
+
+const (
+	RoutineCreate Kind = iota + 1
+	RoutineStart
+	RoutineEnd
+	PipeNew
+	PipeSend
+	PipeRecv
+	PipeClose
+	Block
+	Unblock
+	GCStart
+	GCEnd
+	// A routine stopping for a collection, and going on after it.
+	Park
+	Unpark
+	// Nothing happening, but at this time: a program that hangs says for
+	// how long with these.
+	Tick
+)
+
+// Reason is what a routine is blocked for.
+type Reason uint8
+
+const (
+	BlockSend Reason = iota
+	BlockRecv
+	BlockSelect
+)
+
+func (r Reason) String() string {
+	switch r {
+	case BlockSend:
+		return "send"
+	case BlockRecv:
+		return "recv"
+	case BlockSelect:
+		return "select"
+	default:
+		return fmt.Sprintf("reason %d", uint8(r))
+	}
+}
+
+// Event is a record of the trace.
+type Event struct {
+	Kind Kind
+	// Since the trace started.
+	Time    time.Duration
+	Routine uint32
+
+	// RoutineCreate: the routine created.
+	ID uint32
+	// PipeNew and the other pipe events. Pipes are numbered from 1 in the
+	// order they are first seen, and not by address: a pipe that is freed
+	// and one made at the same address later are two pipes.
+	Pipe uint64
+	// Block: the pipes the routine waits on, more than one for a select.
+	Pipes  []uint64
+	Reason Reason
+	// PipeNew.
+	Cap      int
+	Buffered bool
+	// RoutineCreate and PipeNew: where.
+	File string
+	Line int
+	// RoutineCreate: the function the routine runs.
+	Func string
+}
+
+// Trace is a trace read back.
+type Trace struct {
+	Start  time.Time
+	Events []Event
+}
+
+const magic = "tau trace\n"
+
+// Parse reads a trace. One cut short, the way a program that crashes leaves
+// it, is read up to the last whole record.
+func Parse(r io.Reader) (*Trace, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, head); err != nil || !bytes.Equal(head, []byte(magic)) {
+		return nil, errors.New("not a tau trace")
+	}
+
+	d := decoder{r: br}
+	if v := d.uint(); d.err != nil || v != 1 {
+		return nil, fmt.Errorf("unknown trace version %d", v)
+	}
+	t := &Trace{Start: time.Unix(0, int64(d.uint()))}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	pipes := make(map[uint64]uint64)
+	pipe := func(addr uint64) uint64 {
+		id, ok := pipes[addr]
+		if !ok {
+			id = uint64(len(pipes) + 1)
+			pipes[addr] = id
+		}
+		return id
+	}
+
+	for {
+		k, err := br.ReadByte()
+		if err == io.EOF {
+			return t, nil
+		}
+		e := Event{
+			Kind:    Kind(k),
+			Time:    time.Duration(d.uint()),
+			Routine: uint32(d.uint()),
+		}
+
+		switch e.Kind {
+		case RoutineCreate:
+			e.ID = uint32(d.uint())
+			e.Line = int(d.uint())
+			e.File = d.str()
+			e.Func = d.str()
+		case PipeNew:
+			// A new pipe at an address seen before is another pipe.
+			addr := d.uint()
+			delete(pipes, addr)
+			e.Pipe = pipe(addr)
+			e.Cap = int(d.uint())
+			e.Buffered = d.uint() != 0
+			e.Line = int(d.uint())
+			e.File = d.str()
+		case PipeSend, PipeRecv, PipeClose:
+			e.Pipe = pipe(d.uint())
+		case Block:
+			e.Reason = Reason(d.uint())
+			n := d.uint()
+			for i := uint64(0); i < n && d.err == nil; i++ {
+				e.Pipes = append(e.Pipes, pipe(d.uint()))
+			}
+		case RoutineStart, RoutineEnd, Unblock, GCStart, GCEnd, Park, Unpark, Tick:
+		default:
+			return nil, fmt.Errorf("unknown record %d at %v", k, e.Time)
+		}
+
+		// Cut short: what is whole is what there is.
+		if d.err != nil {
+			return t, nil
+		}
+		t.Events = append(t.Events, e)
+	}
+}
+
+type decoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *decoder) uint() uint64 {
+	var v uint64
+	for shift := 0; d.err == nil; shift += 7 {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			d.err = io.ErrUnexpectedEOF
+			return 0
+		}
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return v
+		}
+	}
+	return 0
+}
+
+func (d *decoder) str() string {
+	n := d.uint()
+	if d.err != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		d.err = io.ErrUnexpectedEOF
+	}
+	return string(b)
+}
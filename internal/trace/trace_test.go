@@ -0,0 +1,180 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writer writes a trace the way internal/vm/trace.c does.
+type writer struct {
+	bytes.Buffer
+}
+
+func newWriter() *writer {
+	w := &writer{}
+	w.WriteString(magic)
+	w.uint(1)
+	w.uint(uint64(time.Unix(10, 0).UnixNano()))
+	return w
+}
+
+func (w *writer) uint(v uint64) {
+	for v >= 0x80 {
+		w.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	w.WriteByte(byte(v))
+}
+
+func (w *writer) str(s string) {
+	w.uint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *writer) record(k Kind, ms int, routine uint32, args ...any) {
+	w.WriteByte(byte(k))
+	w.uint(uint64(time.Duration(ms) * time.Millisecond))
+	w.uint(uint64(routine))
+	for _, a := range args {
+		switch a := a.(type) {
+		case int:
+			w.uint(uint64(a))
+		case string:
+			w.str(a)
+		}
+	}
+}
+
+// A worker fed by main over an unbuffered pipe, and another one waiting on a
+// pipe nobody sends on: the second is what a deadlock looks like.
+func sample() *writer {
+	w := newWriter()
+	w.record(PipeNew, 0, 1, 0xa0, 1, 0, 3, "main.tau")
+	w.record(RoutineCreate, 1, 1, 2, 4, "main.tau", "worker")
+	w.record(RoutineStart, 1, 2)
+	w.record(Block, 2, 2, int(BlockRecv), 1, 0xa0)
+	w.record(PipeSend, 5, 1, 0xa0)
+	w.record(Unblock, 5, 2)
+	w.record(PipeRecv, 5, 2, 0xa0)
+	w.record(GCStart, 6, 1)
+	w.record(GCEnd, 8, 1)
+	w.record(PipeNew, 9, 1, 0xb0, 4, 1, 7, "main.tau")
+	w.record(RoutineCreate, 9, 1, 3, 8, "main.tau", "fn@8")
+	w.record(Block, 10, 3, int(BlockSelect), 2, 0xa0, 0xb0)
+	w.record(PipeClose, 11, 1, 0xa0)
+	w.record(RoutineEnd, 12, 2)
+	w.record(Tick, 20, 0)
+	return w
+}
+
+func TestParse(t *testing.T) {
+	tr, err := Parse(bytes.NewReader(sample().Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tr.Start.Equal(time.Unix(10, 0)) {
+		t.Errorf("start %v", tr.Start)
+	}
+	if len(tr.Events) != 15 {
+		t.Fatalf("%d events, expected 15", len(tr.Events))
+	}
+
+	create := tr.Events[1]
+	if create.Kind != RoutineCreate || create.ID != 2 || create.Func != "worker" || create.Line != 4 {
+		t.Errorf("routine created: %+v", create)
+	}
+	// Pipes are numbered, not addressed.
+	if sel := tr.Events[11]; len(sel.Pipes) != 2 || sel.Pipes[0] != 1 || sel.Pipes[1] != 2 || sel.Reason != BlockSelect {
+		t.Errorf("select: %+v", sel)
+	}
+
+	// Cut anywhere, what is whole is read.
+	full := sample().Bytes()
+	cut, err := Parse(bytes.NewReader(full[:len(full)-3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cut.Events) != 14 {
+		t.Errorf("%d events in a cut trace, expected 14", len(cut.Events))
+	}
+
+	if _, err := Parse(strings.NewReader("not a trace")); err == nil {
+		t.Error("parsed something that is not a trace")
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	tr, err := Parse(bytes.NewReader(sample().Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Summarize(tr)
+
+	if s.Duration != 20*time.Millisecond || s.Collections != 1 || s.GCTotal != 2*time.Millisecond {
+		t.Errorf("duration %v, %d collections, %v paused", s.Duration, s.Collections, s.GCTotal)
+	}
+
+	routines := make(map[uint32]*Routine)
+	for _, r := range s.Routines {
+		routines[r.ID] = r
+	}
+	if w := routines[2]; w.Blocked != 3*time.Millisecond || w.ByReason[BlockRecv] != 3*time.Millisecond || !w.Ended || w.BlockedAtEnd {
+		t.Errorf("worker: %+v", w)
+	}
+	// Still waiting when the trace ended, for as long as it lasted.
+	stuck := routines[3]
+	if !stuck.BlockedAtEnd || stuck.Blocked != 10*time.Millisecond || stuck.Reason != BlockSelect || len(stuck.Pipes) != 2 {
+		t.Errorf("stuck: %+v", stuck)
+	}
+	if s.Routines[0] != stuck {
+		t.Errorf("the routine blocked the longest isn't first: %+v", s.Routines[0])
+	}
+
+	p := s.Pipes[0]
+	if p.ID != 1 || p.Sent != 1 || p.Received != 1 || !p.Closed || p.Blocked != 13*time.Millisecond {
+		t.Errorf("pipe 1: %+v", p)
+	}
+
+	var out strings.Builder
+	if err := s.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"worker", "main.tau:4", "blocked when the trace ended", "routine 3 (fn@8) on select of pipe 1 (main.tau:3), pipe 2 (main.tau:7)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("no %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestWriteChrome(t *testing.T) {
+	tr, err := Parse(bytes.NewReader(sample().Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteChrome(&buf, tr); err != nil {
+		t.Fatal(err)
+	}
+
+	var out struct {
+		TraceEvents []chromeEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, e := range out.TraceEvents {
+		found[e.Phase+" "+e.Name] = true
+		if e.Name == "blocked on recv" && (e.Tid != 2 || *e.Dur != 3000) {
+			t.Errorf("the worker's wait: %+v", e)
+		}
+	}
+	for _, want := range []string{"M thread_name", "X worker", "X blocked on recv", "X blocked on select", "X GC", "i send", "i recv"} {
+		if !found[want] {
+			t.Errorf("no %q event", want)
+		}
+	}
+}
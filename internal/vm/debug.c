@@ -0,0 +1,217 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "vm.h"
+#include "debug.h"
+#include "thrd.h"
+#include "_cgo_export.h"
+
+/*
+ * The half of the debugger that runs before every instruction, written in C
+ * because it runs before every instruction. All it does is decide whether to
+ * stop; once it has, the VM that stopped stops the others and calls into
+ * debug.go, which talks to whoever is debugging and says how to go on.
+ *
+ * A stop is decided on lines and not on instructions: a VM arrives at a line
+ * when the bookmark of the instruction it is about to run says another line
+ * than the one its frame was on. That is what a breakpoint waits for and what
+ * a step goes to.
+ */
+
+struct breakpoint {
+	char *file;
+	int32_t line;
+};
+
+struct breakpoints {
+	size_t len;
+	struct breakpoint list[];
+};
+
+// Read by every VM at every new line without a lock, and replaced whole by
+// whoever changes them, which may be while the program runs: an editor sets
+// its breakpoints whenever its user clicks.
+//
+// ponytail: a replaced list is never freed, there is no telling when the
+// last VM that loaded it is done with it. It is a few bytes every time
+// somebody changes the breakpoints by hand.
+static struct breakpoints *breakpoints = NULL;
+
+// What to stop for and, for a step, which VM is stepping and how deep it was
+// when it started. The mode is written by the VM that stopped, with the world
+// stopped, and by Pause from anywhere, so it is an atomic.
+static enum debug_mode mode = debug_pause;
+static uint32_t mode_vm = 0;
+static uint32_t mode_depth = 0;
+
+// Held by the VM that stopped, the others that want to stop queue on it.
+static mtx_t mu;
+
+// The bookmark of the instruction at offset, the first one past it. Unlike
+// frame_bookmark it looks for an instruction that hasn't been fetched yet.
+static struct bookmark *bookmark_at(struct function *fn, uint32_t offset) {
+	size_t lo = 0, hi = fn->bklen;
+
+	while (lo < hi) {
+		size_t mid = (lo + hi) / 2;
+		if ((uint32_t) fn->bookmarks[mid].offset <= offset) {
+			lo = mid + 1;
+		} else {
+			hi = mid;
+		}
+	}
+	return lo < fn->bklen ? &fn->bookmarks[lo] : NULL;
+}
+
+// Whether two paths name the same file, one of them possibly written relative
+// to somewhere the other isn't: "main.tau" is "/home/me/src/main.tau", and so
+// is "src/main.tau", but "lib/main.tau" is not.
+static int same_file(const char *a, const char *b) {
+	size_t la = strlen(a), lb = strlen(b);
+
+	if (la < lb) {
+		const char *t = a; a = b; b = t;
+		size_t tl = la; la = lb; lb = tl;
+	}
+	if (strcmp(a + la - lb, b) != 0) {
+		return 0;
+	}
+	return la == lb || a[la-lb-1] == '/' || a[la-lb-1] == '\\';
+}
+
+static int at_breakpoint(struct vm *vm, struct frame *f, struct bookmark *b) {
+	struct breakpoints *bps = __atomic_load_n(&breakpoints, __ATOMIC_ACQUIRE);
+	if (bps == NULL) {
+		return 0;
+	}
+
+	char *file = NULL;
+	for (size_t i = 0; i < bps->len; i++) {
+		if (bps->list[i].line != b->lineno) {
+			continue;
+		}
+		if (file == NULL) {
+			file = frame_file(vm, f, b);
+		}
+		if (same_file(file, bps->list[i].file)) {
+			return 1;
+		}
+	}
+	return 0;
+}
+
+static enum debug_reason should_stop(struct vm *vm, struct frame *f, struct bookmark *b, int newline) {
+	switch (__atomic_load_n(&mode, __ATOMIC_RELAXED)) {
+	case debug_pause:
+		if (newline) return debug_paused;
+		break;
+	case debug_step:
+		if (newline && vm->id == mode_vm) return debug_stepped;
+		break;
+	case debug_next:
+		if (newline && vm->id == mode_vm && vm->frame_idx <= mode_depth) return debug_stepped;
+		break;
+	case debug_finish:
+		// Right after the return, in the middle of the line that made the call.
+		if (vm->id == mode_vm && vm->frame_idx < mode_depth) return debug_stepped;
+		break;
+	case debug_continue:
+		break;
+	}
+
+	if (newline && at_breakpoint(vm, f, b)) {
+		return debug_breakpoint;
+	}
+	return 0;
+}
+
+static void debug_hook(struct vm *vm) {
+	vm->dbg_held = 1;
+
+	// Every VM comes through here at every instruction, and this is where it
+	// waits while another one is stopped.
+	if (gc_pending()) gc_safepoint();
+
+	struct frame *f = &vm->frames[vm->frame_idx];
+	struct bookmark *b = bookmark_at(f->cl.data.cl->fn, f->ip - f->start);
+	if (b == NULL) {
+		vm->dbg_held = 0;
+		return;
+	}
+
+	int newline = (uint32_t) b->lineno != f->dbg_line;
+	f->dbg_line = b->lineno;
+
+	if (should_stop(vm, f, b, newline)) {
+		// Waiting for the VM that is stopped is blocking like any other, and
+		// that one has to be able to stop the world around this one.
+		gc_park();
+		mtx_lock(&mu);
+		gc_unpark();
+
+		// What the debugger was told while this VM waited may have changed
+		// what it wants: a step of some other VM doesn't stop this one.
+		enum debug_reason reason = should_stop(vm, f, b, newline);
+		if (reason) {
+			gc_stop_world();
+			// What the program wrote so far goes before what the debugger
+			// is about to say.
+			fflush(stdout);
+			goDebugStop(vm, reason);
+			gc_start_world();
+		}
+		mtx_unlock(&mu);
+	}
+	vm->dbg_held = 0;
+}
+
+// Hooks the debugger into every VM started from now on. The program starts
+// paused, at its first line. Called again, for the next program, it starts
+// that one paused as well.
+void debug_enable(void) {
+	static int initialised = 0;
+
+	if (!initialised) {
+		mtx_init(&mu, mtx_plain);
+		initialised = 1;
+	}
+	mode = debug_pause;
+	vm_debug_hook = debug_hook;
+}
+
+// How to go on, said from inside goDebugStop about the VM that stopped.
+void debug_resume(enum debug_mode m, struct vm *vm) {
+	mode_vm = vm->id;
+	mode_depth = vm->frame_idx;
+	__atomic_store_n(&mode, m, __ATOMIC_RELAXED);
+}
+
+// Stops the program at the next line any of its VMs reaches, from a thread
+// that isn't running any of them.
+void debug_pause_all(void) {
+	__atomic_store_n(&mode, debug_pause, __ATOMIC_RELAXED);
+}
+
+// Replaces the breakpoints with a copy of these, at any time.
+void debug_set_breakpoints(char **files, int32_t *lines, size_t n) {
+	struct breakpoints *bps = malloc(sizeof(struct breakpoints) + n * sizeof(struct breakpoint));
+
+	bps->len = n;
+	for (size_t i = 0; i < n; i++) {
+		bps->list[i] = (struct breakpoint) {strdup(files[i]), lines[i]};
+	}
+	__atomic_store_n(&breakpoints, bps, __ATOMIC_RELEASE);
+}
+
+// The bookmark of a frame of a stopped VM. The innermost frame of a VM in the
+// hook has not fetched its instruction yet; every other frame is past the
+// instruction it is at, a call or whatever it parked in.
+struct bookmark *debug_frame_bookmark(struct vm *vm, uint32_t idx) {
+	struct frame *f = &vm->frames[idx];
+
+	if (vm->dbg_held && idx == vm->frame_idx) {
+		return bookmark_at(f->cl.data.cl->fn, f->ip - f->start);
+	}
+	return frame_bookmark(f);
+}
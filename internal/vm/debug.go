@@ -0,0 +1,295 @@
+package vm
+
+/*
+#include <stdlib.h>
+#include "vm.h"
+#include "debug.h"
+*/
+import "C"
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"unsafe"
+
+	"github.com/NicoNex/tau/internal/compiler"
+	"github.com/NicoNex/tau/internal/obj"
+)
+
+// StopReason says why the program stopped.
+type StopReason int
+
+const (
+	StopPause      StopReason = C.debug_paused
+	StopBreakpoint StopReason = C.debug_breakpoint
+	StopStep       StopReason = C.debug_stepped
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopPause:
+		return "pause"
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopStep:
+		return "step"
+	default:
+		return "unknown"
+	}
+}
+
+// Resume says how the program goes on after a stop.
+type Resume int
+
+const (
+	Continue Resume = C.debug_continue // Until a breakpoint.
+	Step     Resume = C.debug_step     // To the next line, into the calls.
+	Next     Resume = C.debug_next     // To the next line, over the calls.
+	Finish   Resume = C.debug_finish   // Out of the function.
+	Pause    Resume = C.debug_pause    // To the next line any routine reaches.
+)
+
+// Breakpoint is a line of a file. The file is matched on its trailing path
+// elements: "main.tau" is any main.tau the program runs, "lib/main.tau" only
+// the one in a directory called lib.
+type Breakpoint struct {
+	File string
+	Line int
+}
+
+// Frame is a call still going on, the innermost first.
+type Frame struct {
+	Name string
+	File string
+	Line int
+	// How many frames the tail calls that led to this one have taken away,
+	// between it and the one under it.
+	Elided int
+
+	vm  *C.struct_vm
+	idx C.uint32_t
+}
+
+// Var is a name and what it holds, written the way a program would write it.
+type Var struct {
+	Name  string
+	Value string
+}
+
+// Routine is one of the VMs of the program: the main one, the tau routines
+// and the modules being imported.
+type Routine struct {
+	ID     int
+	Frames []Frame
+}
+
+// Stop is the program, stopped. It is only good until the handler it was
+// given to returns: from then on everything in it moves again.
+type Stop struct {
+	Reason StopReason
+	// The routine that stopped.
+	Routine int
+
+	vms map[int]*C.struct_vm
+}
+
+var debugHandler func(*Stop) Resume
+
+// Debug attaches a debugger to the programs compiled and run from now on,
+// which start paused. Whenever one of them stops, every one of its routines
+// stops with it and the handler is called, on the thread of the routine that
+// stopped, to say how to go on.
+func Debug(handler func(*Stop) Resume) {
+	debugHandler = handler
+	compiler.KeepDebugInfo()
+	C.debug_enable()
+}
+
+// SetBreakpoints replaces the breakpoints, whenever and from wherever: the
+// program picks them up at the next line it reaches.
+func SetBreakpoints(bps []Breakpoint) {
+	files := make([]*C.char, len(bps))
+	lines := make([]C.int32_t, len(bps))
+
+	for i, b := range bps {
+		files[i] = C.CString(filepath.Clean(b.File))
+		lines[i] = C.int32_t(b.Line)
+	}
+	C.debug_set_breakpoints(
+		obj.CArray[*C.char, *C.char](files),
+		obj.CArray[C.int32_t, C.int32_t](lines),
+		C.size_t(len(bps)),
+	)
+	for _, f := range files {
+		C.free(unsafe.Pointer(f))
+	}
+}
+
+// Interrupt stops the program at the next line any of its routines reaches,
+// as if it had been told to Pause at its last stop.
+func Interrupt() {
+	C.debug_pause_all()
+}
+
+//export goDebugStop
+func goDebugStop(vm *C.struct_vm, reason C.int) {
+	s := &Stop{Reason: StopReason(reason), Routine: int(vm.id), vms: make(map[int]*C.struct_vm)}
+
+	// Nothing registers or unregisters while the world is stopped, but there
+	// is no telling beforehand how many there are.
+	buf := make([]*C.struct_vm, 64)
+	for {
+		n := int(C.gc_vms(&buf[0], C.size_t(len(buf))))
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]*C.struct_vm, len(buf)*2)
+	}
+	for _, v := range buf {
+		s.vms[int(v.id)] = v
+	}
+
+	C.debug_resume(C.enum_debug_mode(debugHandler(s)), vm)
+}
+
+// Routines returns every routine of the program, in the order they started.
+func (s *Stop) Routines() []Routine {
+	ids := make([]int, 0, len(s.vms))
+	for id := range s.vms {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	out := make([]Routine, len(ids))
+	for i, id := range ids {
+		out[i] = Routine{ID: id, Frames: s.Frames(id)}
+	}
+	return out
+}
+
+// Frames returns the calls the routine is in, the innermost first.
+func (s *Stop) Frames(routine int) []Frame {
+	vm, ok := s.vms[routine]
+	if !ok {
+		return nil
+	}
+
+	var out []Frame
+	for i := int(vm.frame_idx); i >= 0; i-- {
+		f := &vmFrames(vm)[i]
+		// The frame a call from C stops at, and the empty one at the bottom
+		// of a routine.
+		if f.ip == nil || f.cl.data == [8]byte{} {
+			continue
+		}
+
+		fn := frameFunction(f)
+		frame := Frame{vm: vm, idx: C.uint32_t(i), Name: "fn", Elided: int(f.tail_calls)}
+		switch {
+		case fn.name != nil:
+			frame.Name = C.GoString(fn.name)
+		case i == 0:
+			frame.Name = "<top level>"
+		}
+
+		b := C.debug_frame_bookmark(vm, C.uint32_t(i))
+		frame.File = C.GoString(C.frame_file(vm, f, b))
+		if b != nil {
+			frame.Line = int(b.lineno)
+		}
+		out = append(out, frame)
+	}
+	return out
+}
+
+// Locals returns the arguments and the locals of the frame, and what its
+// function captured. The top level of a file has none, its names are the
+// globals.
+func (f Frame) Locals() []Var {
+	cf := &vmFrames(f.vm)[f.idx]
+	fn := frameFunction(cf)
+	info, _ := compiler.FuncDebugInfo(uintptr(unsafe.Pointer(fn)))
+
+	var out []Var
+	for i, name := range info.Locals {
+		if name != "" && i < int(fn.num_locals) {
+			out = append(out, Var{name, show(vmStack(f.vm)[int(cf.base_ptr)+i])})
+		}
+	}
+
+	cl := frameClosure(cf)
+	free := unsafe.Slice(cl.free, cl.num_free)
+	for i, name := range info.Free {
+		if i < len(free) {
+			out = append(out, Var{name, show(free[i])})
+		}
+	}
+	return out
+}
+
+// Globals returns the globals of the program or of the module the frame is
+// in, sorted by name.
+func (f Frame) Globals() []Var {
+	globals := compiler.DebugGlobals(f.File)
+
+	out := make([]Var, 0, len(globals))
+	for name, idx := range globals {
+		out = append(out, Var{name, show(global(f.vm, idx))})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Lookup returns what a name holds as seen from the frame: a local, a
+// captured name or a global, in this order.
+func (f Frame) Lookup(name string) (string, bool) {
+	for _, v := range f.Locals() {
+		if v.Name == name {
+			return v.Value, true
+		}
+	}
+	if idx, ok := compiler.DebugGlobals(f.File)[name]; ok {
+		return show(global(f.vm, idx)), true
+	}
+	return "", false
+}
+
+func global(vm *C.struct_vm, idx int) C.struct_object {
+	if idx >= int(vm.state.globals.len) {
+		return C.struct_object{}
+	}
+	return C.get_global(vm.state.globals, C.size_t(idx))
+}
+
+func frameClosure(f *C.struct_frame) *C.struct_closure {
+	return *(**C.struct_closure)(unsafe.Pointer(&f.cl.data))
+}
+
+func frameFunction(f *C.struct_frame) *C.struct_function {
+	return frameClosure(f).fn
+}
+
+// vmStack and vmFrames are the stack and the frames of the VM, good until the
+// next call it makes grows them.
+func vmStack(vm *C.struct_vm) []C.struct_object {
+	return unsafe.Slice(vm.stack, vm.stack_cap)
+}
+
+func vmFrames(vm *C.struct_vm) []C.struct_frame {
+	return unsafe.Slice(vm.frames, vm.frames_cap)
+}
+
+// show writes a value the way it would be written in a program: a string
+// in quotes, so that "1" and 1 don't look the same.
+func show(co C.struct_object) string {
+	// A variable shared with a closure is shown as the value it holds.
+	if co._type == C.obj_cell {
+		co = **(**C.struct_object)(unsafe.Pointer(&co.data))
+	}
+	o := *(*obj.Object)(unsafe.Pointer(&co))
+	if o.Type() == obj.StringType {
+		return strconv.Quote(o.String())
+	}
+	return o.String()
+}
@@ -0,0 +1,28 @@
+#pragma once
+
+#include <stdint.h>
+#include <stddef.h>
+#include "vm.h"
+
+// What the debugger does once it lets the program go again. The values are
+// the ones the Go side hands back, see debug.go.
+enum debug_mode {
+	debug_continue, // Until a breakpoint.
+	debug_step,     // Until the VM that stopped reaches a new line, calls included.
+	debug_next,     // The same, stepping over the calls.
+	debug_finish,   // Until the function the VM stopped in returns.
+	debug_pause     // Until any VM reaches a new line.
+};
+
+// Why a VM stopped.
+enum debug_reason {
+	debug_paused = 1,
+	debug_breakpoint,
+	debug_stepped
+};
+
+void debug_enable(void);
+void debug_resume(enum debug_mode mode, struct vm *vm);
+void debug_pause_all(void);
+void debug_set_breakpoints(char **files, int32_t *lines, size_t n);
+struct bookmark *debug_frame_bookmark(struct vm *vm, uint32_t idx);
@@ -1,7 +1,10 @@
 #include <stdio.h>
 #include <stdlib.h>
+#include <string.h>
+#include <time.h>
 #include "vm.h"
 #include "thrd.h"
+#include "trace.h"
 
 /*
  * Global stop-the-world mark & sweep collector.
@@ -18,8 +21,20 @@
  */
 
 struct vm_node {
+	// NULL for a thread that runs no VM but touches objects all the same, the
+	// one of the timers: it stops for a collection like a VM, and has nothing
+	// to mark, no number and no stack to show.
 	struct vm *vm;
 	int parked;
+	// Parked because it waits for something - a pipe, a native call, a module
+	// it imports - rather than because a collection asked it to. Only the
+	// profiler cares: a VM that waits is not using the CPU.
+	int waiting;
+	// What it sleeps on when what it waits for is a pipe, NULL otherwise.
+	struct pipe_wait *wait;
+	// Both ways, for a routine that ends to leave the list without walking
+	// it: there may be as many as there are routines.
+	struct vm_node *prev;
 	struct vm_node *next;
 };
 
@@ -52,13 +67,43 @@ static int64_t heap_treshold = HEAP_TRESHOLD;
 // of an allocation can afford: everything exact needs the lock, and the lock
 // is what a collection is for.
 static __thread int64_t budget = HEAP_TRESHOLD;
+
+// What runtime.MemStats reports. Everything but the allocations, which every
+// segment counts for itself, is written by the collector with the world
+// stopped; the numbers of the live objects are the ones its sweep counted.
+static struct gc_stats {
+	uint64_t numgc;
+	uint64_t pause_total;
+	uint64_t pauses[GC_NPAUSES];
+	int64_t last_gc;
+	uint64_t live[OBJ_NTYPES];
+	uint64_t live_bytes[OBJ_NTYPES];
+} stats;
+
+// The heap profiler: one object in gc_sample_rate on average is a sample, 0
+// turns it off. gc_sample_hook hears of every sample on the thread that
+// allocated it; the samples that are freed wait in sampled_freed until
+// gc_freed_samples takes them.
+int64_t gc_sample_rate = 0;
+void (*gc_sample_hook)(struct gc_header *h, size_t bytes) = NULL;
+static __thread int64_t sample_left = 0;
+static __thread uint64_t sample_seed = 0;
+static mtx_t sampled_mu;
+static struct gc_header **sampled_freed = NULL;
+static size_t nsampled_freed = 0;
+static size_t capsampled_freed = 0;
 static mtx_t mu;
 static cnd_t cnd;
 static struct vm_node *vms = NULL;
 static struct root_node *roots = NULL;
 static int nvms = 0;
+// How many of the nvms run no VM.
+static int nthreads = 0;
 static int nparked = 0;
+// How many of them sleep on a wait, which is where telling a deadlock starts.
+static int nasleep = 0;
 static int initialised = 0;
+static uint32_t next_id = 1;
 
 int gc_wanted = 0;
 // Bumped at every collection, tells apart the objects visited by the current
@@ -140,14 +185,18 @@ void gc_init(void) {
 	if (initialised) return;
 	initialised = 1;
 	mtx_init(&mu, mtx_plain);
+	mtx_init(&sampled_mu, mtx_plain);
 	cnd_init(&cnd);
+	timers_init();
+	netpoll_init();
+	sched_init();
 }
 
 // Locks the heap mutex joining any collection that is pending or in progress,
 // so that a thread waiting for the mutex can never stall the collector.
 static void gc_lock(void) {
 	mtx_lock(&mu);
-	while (gc_pending()) {
+	while (gc_collecting()) {
 		if (self != NULL && !self->parked) {
 			self->parked = 1;
 			nparked++;
@@ -161,18 +210,127 @@ static void gc_lock(void) {
 	}
 }
 
+// Whether no routine can ever go on again: every VM asleep on pipes, none of
+// them on a wait that is over, and nobody left who could end one. The roots
+// that belong to no VM are exactly those somebodies: the arguments of a
+// builtin started with `tau`, still running, and the tau functions handed to
+// C, which C may call from any thread whenever it likes. It is only a program
+// that deadlocks, so the main VM or a module has to be among the sleepers: the
+// routines an ended program left behind, under `tau test`, are nobody's.
+//
+// Called with mu held. The waits are read with no lock on their pipes, and
+// they can be: with every VM asleep nobody is touching a pipe, and a VM that
+// wakes up takes mu in gc_unpark before it touches anything.
+//
+// It is called every time a routine goes to sleep, so it has to be quick when
+// the answer is no, with thousands of routines asleep: it only looks at them
+// one by one when they all are, and none has been woken up to run.
+static int deadlocked(void) {
+	int program = 0;
+
+	if (vms == NULL || roots != NULL || nasleep < nvms) return 0;
+	if (sched_runnable()) return 0;
+	for (struct vm_node *n = vms; n != NULL; n = n->next) {
+		if (n->wait == NULL || n->wait->ready(n->wait)) return 0;
+		if (n->vm != NULL && !n->vm->routine) program = 1;
+	}
+	return program;
+}
+
+static int by_id(const void *a, const void *b) {
+	uint32_t x = (*(struct vm_node **) a)->vm->id;
+	uint32_t y = (*(struct vm_node **) b)->vm->id;
+	return (x > y) - (x < y);
+}
+
+// What the VM is doing, the way the dumps below put it next to its number.
+static void print_state(FILE *out, struct vm_node *n) {
+	static const char *why[] = {"send", "recv", "select"};
+	struct pipe_wait *w = n->wait;
+
+	if (w == NULL) {
+		fputs(n->waiting ? "waiting" : "running", out);
+		return;
+	}
+	fprintf(out, "%s on ", why[w->why]);
+	for (size_t i = 0; i < w->n; i++) {
+		struct pipe *p = w->pipes[i];
+
+		if (i > 0) fputs(", ", out);
+		if (p->file != NULL) {
+			fprintf(out, "pipe made at %s:%d", p->file, p->line);
+		} else {
+			fputs("pipe", out);
+		}
+	}
+}
+
+// Every VM, what it is doing and its stack, the main one first. Called with mu
+// held and none of them moving.
+static void print_vms(FILE *out) {
+	struct vm_node **all = malloc(sizeof(struct vm_node *) * (nvms > 0 ? nvms : 1));
+	size_t n = 0;
+
+	for (struct vm_node *v = vms; v != NULL; v = v->next) {
+		if (v->vm != NULL) all[n++] = v;
+	}
+	qsort(all, n, sizeof(struct vm_node *), by_id);
+	for (size_t i = 0; i < n; i++) {
+		fprintf(out, "\nroutine %u [", all[i]->vm->id);
+		print_state(out, all[i]);
+		fputs("]:\n", out);
+		vm_print_stack(out, all[i]->vm);
+	}
+	free(all);
+}
+
+// Ends a program that deadlocked the way Go ends one, with what every routine
+// waits for, its stack and 2. Called with mu held, which it lets go of before
+// exiting: on the way out the profilers stop, and they may need it.
+static void deadlock(void) {
+	fflush(stdout);
+	fputs("fatal error: all routines are asleep - deadlock!\n", stderr);
+	print_vms(stderr);
+	mtx_unlock(&mu);
+	exit(2);
+}
+
+void gc_dump(void) {
+	gc_stop_world();
+	mtx_lock(&mu);
+	fflush(stdout);
+	fputs("SIGQUIT: quit\n", stderr);
+	print_vms(stderr);
+	mtx_unlock(&mu);
+	gc_start_world();
+	exit(2);
+}
+
+// Puts n first in the list of the VMs, with mu held.
+static void link_node(struct vm_node *n) {
+	n->prev = NULL;
+	n->next = vms;
+	if (vms != NULL) vms->prev = n;
+	vms = n;
+}
+
 void gc_register(struct vm *vm) {
 	struct vm_node *n = malloc(sizeof(struct vm_node));
 	n->vm = vm;
+	n->waiting = 0;
+	n->wait = NULL;
 	// A registered VM starts parked: its roots are already reachable but no
 	// thread is mutating them yet.
 	n->parked = 1;
 
 	mtx_lock(&mu);
-	n->next = vms;
-	vms = n;
+	link_node(n);
+	// A program that starts when no other is running counts from 1 again,
+	// the main VM being the first.
+	if (nvms == nthreads) next_id = 1;
 	nvms++;
 	nparked++;
+	vm->id = next_id++;
 	cnd_broadcast(&cnd);
 	mtx_unlock(&mu);
 
@@ -184,15 +342,19 @@ void gc_unregister(struct vm *vm) {
 	if (n == NULL) return;
 
 	mtx_lock(&mu);
-	for (struct vm_node **p = &vms; *p != NULL; p = &(*p)->next) {
-		if (*p == n) {
-			*p = n->next;
-			break;
-		}
+	if (n->prev != NULL) {
+		n->prev->next = n->next;
+	} else {
+		vms = n->next;
 	}
+	if (n->next != NULL) n->next->prev = n->prev;
 	nvms--;
 	if (n->parked) nparked--;
+	if (n->wait != NULL) nasleep--;
 	cnd_broadcast(&cnd);
+	// The routine that ended may have been the last one that could wake the
+	// others up.
+	if (deadlocked()) deadlock();
 	mtx_unlock(&mu);
 
 	if (self == n) self = NULL;
@@ -200,12 +362,36 @@ void gc_unregister(struct vm *vm) {
 	free(n);
 }
 
+// A node for a thread that runs no VM, see vm_node, made by whoever starts the
+// thread: it is known to the collector, and counts as running, before it
+// runs. The thread makes it its own with gc_restore.
+void *gc_register_thread(void) {
+	struct vm_node *n = malloc(sizeof(struct vm_node));
+	n->vm = NULL;
+	n->waiting = 0;
+	n->wait = NULL;
+	// Parked until the thread takes it, like a VM; and running as far as a
+	// deadlock is concerned, which it is about to.
+	n->parked = 1;
+
+	mtx_lock(&mu);
+	link_node(n);
+	nvms++;
+	nthreads++;
+	nparked++;
+	cnd_broadcast(&cnd);
+	mtx_unlock(&mu);
+
+	return n;
+}
+
 // park_node marks a VM as not running, so that a collection does not wait for
 // it. Unlike gc_park it works on a VM that isn't the current one.
 static void park_node(struct vm_node *n) {
 	if (n == NULL) return;
 
 	mtx_lock(&mu);
+	n->waiting = 1;
 	if (!n->parked) {
 		n->parked = 1;
 		nparked++;
@@ -269,32 +455,121 @@ void gc_remove_roots(void *handle) {
 			break;
 		}
 	}
+	if (deadlocked()) deadlock();
 	mtx_unlock(&mu);
 	free(handle);
 }
 
-void gc_park(void) {
+static void park(int waiting, struct pipe_wait *w) {
 	if (self == NULL) return;
 
 	mtx_lock(&mu);
+	self->waiting = waiting;
+	nasleep += (w != NULL) - (self->wait != NULL);
+	self->wait = w;
 	if (!self->parked) {
 		self->parked = 1;
 		nparked++;
 		cnd_broadcast(&cnd);
 	}
+	if (w != NULL && deadlocked()) deadlock();
 	mtx_unlock(&mu);
 }
 
-void gc_unpark(void) {
+// gc_park is for a call that blocks the thread, and tells the scheduler too:
+// the routine keeps the thread, not the proc, see sched.c.
+void gc_park(void) {
+	park(1, NULL);
+	sched_block();
+}
+
+void gc_park_wait(struct pipe_wait *w) {
+	park(1, w);
+}
+
+// Apart from gc_unpark, and not inlined, because a routine may come back from
+// its wait on another thread: self is looked up here afresh, and not where it
+// was before the wait.
+static __attribute__((noinline)) void unpark(void) {
 	if (self == NULL) return;
 	gc_lock();
+	self->waiting = 0;
+	if (self->wait != NULL) nasleep--;
+	self->wait = NULL;
 	mtx_unlock(&mu);
 }
 
-void gc_safepoint(void) {
-	if (!gc_pending() || self == NULL) return;
-	gc_park();
-	gc_unpark();
+void gc_unpark(void) {
+	sched_unblock();
+	unpark();
+}
+
+void *gc_swap_self(void *node) {
+	struct vm_node *prev = self;
+
+	self = node;
+	return prev;
+}
+
+// Like the first half of a collection, without the collection: the others
+// park at their next safepoint and stay there until gc_start_world. Nothing
+// here may take the heap through gc_lock meanwhile, it would park the very
+// thread that is meant to start the world again. The thread stopping it may
+// be one that runs no VM, the profiler's, and then there is no one to leave
+// out.
+void gc_stop_world(void) {
+	gc_lock();
+	gc_want(GC_COLLECT);
+	while (nparked < nvms - (self != NULL)) {
+		cnd_wait(&cnd, &mu);
+	}
+	mtx_unlock(&mu);
+}
+
+void gc_start_world(void) {
+	mtx_lock(&mu);
+	gc_unwant(GC_COLLECT);
+	cnd_broadcast(&cnd);
+	mtx_unlock(&mu);
+}
+
+// Whether the VM is parked waiting for something, see vm_node. Meant for a
+// stopped world, when nothing can change it.
+int gc_waiting(struct vm *vm) {
+	struct vm_node *n = vm->gc_node;
+	return n != NULL && n->waiting;
+}
+
+// The VMs registered right now, the most recent first.
+size_t gc_vms(struct vm **out, size_t max) {
+	size_t n = 0;
+
+	mtx_lock(&mu);
+	for (struct vm_node *v = vms; v != NULL && n < max; v = v->next) {
+		if (v->vm != NULL) out[n++] = v->vm;
+	}
+	mtx_unlock(&mu);
+	return n;
+}
+
+// Where a routine stops for a collection, and where it makes room for the
+// others when the scheduler asks. Not inlined: the routine may be on another
+// thread when it returns, and its caller must not have read a thread local
+// before that it would use after.
+__attribute__((noinline)) void gc_safepoint(void) {
+	int wanted = gc_pending();
+
+	if ((wanted & GC_COLLECT) && self != NULL) {
+		trace_gc(trace_ev_park);
+		park(0, NULL);
+		gc_unpark();
+		trace_gc(trace_ev_unpark);
+	}
+	if ((wanted & GC_YIELD) && sched_preempted()) {
+		park(0, NULL);
+		sched_requeue();
+		gc_unpark();
+	}
 }
 
 // The segment of this thread, taken over from a thread that ended or made on
@@ -309,16 +584,13 @@ static struct heap *heap_segment(void) {
 		free_segments = s->free_next;
 		s->free_next = NULL;
 	} else {
-		s = malloc(sizeof(struct heap));
-		s->root = NULL;
-		s->len = 0;
-		s->treshold = 0;
-		s->free_next = NULL;
+		s = calloc(1, sizeof(struct heap));
 		s->next = segments;
 		segments = s;
 	}
 	mtx_unlock(&mu);
 
+	s->owned = 1;
 	segment = s;
 	return s;
 }
@@ -330,6 +602,7 @@ void gc_release_segment(void) {
 	if (segment == NULL) return;
 
 	gc_lock();
+	segment->owned = 0;
 	segment->free_next = free_segments;
 	free_segments = segment;
 	mtx_unlock(&mu);
@@ -337,6 +610,43 @@ void gc_release_segment(void) {
 	segment = NULL;
 }
 
+// How much memory an object holds: its block, and the buffer of a string, of
+// bytes or of a list that owns one. The nodes of maps and objects aren't
+// counted, so for those it is a floor.
+static size_t gc_obj_bytes(struct gc_header *h) {
+	size_t n = sizeof(struct gc_header) + h->size;
+	struct object o = h->obj;
+
+	switch (o.type) {
+	case obj_string:
+		if (o.data.str->owner == NULL) n += o.data.str->len;
+		break;
+	case obj_error:
+		n += o.data.err->msg.len;
+		break;
+	case obj_bytes:
+		if (o.data.bytes->owner == NULL) n += o.data.bytes->len;
+		break;
+	case obj_list:
+		if (o.data.list->owner == NULL) n += o.data.list->cap * sizeof(struct object);
+		break;
+	default:
+		break;
+	}
+	return n;
+}
+
+// How many objects to the next sample: anything from 1 to twice the rate, so
+// that on average it is the rate and a program allocating in a loop of the
+// same length doesn't always have the same object picked.
+static int64_t sample_interval(void) {
+	if (sample_seed == 0) sample_seed = (uintptr_t) &sample_seed | 1;
+	sample_seed ^= sample_seed << 13;
+	sample_seed ^= sample_seed >> 7;
+	sample_seed ^= sample_seed << 17;
+	return 1 + (int64_t) (sample_seed % (uint64_t) (2 * gc_sample_rate));
+}
+
 // Takes ownership of the object. Objects that are already tracked (e.g. one
 // received from a pipe and returned by a builtin) are ignored.
 void heap_add(struct object obj) {
@@ -351,16 +661,35 @@ void heap_add(struct object obj) {
 	s->root = node;
 	s->len++;
 	budget--;
+
+	// A list that took over the array of another one is the new owner of
+	// it, and what it holds from now on, but allocating it cost the header.
+	size_t bytes = gc_obj_bytes(node);
+	if (node->mark & GC_INHERITED) {
+		node->mark &= ~GC_INHERITED;
+		bytes = sizeof(struct gc_header) + node->size;
+	}
+	s->bytes += bytes;
+	s->allocs[obj.type]++;
+	s->alloc_bytes[obj.type] += bytes;
+
+	// Only the objects of a VM have a place they were allocated at.
+	if (gc_sample_rate > 0 && self != NULL && --sample_left <= 0) {
+		sample_left = sample_interval();
+		node->mark |= GC_SAMPLED;
+		if (gc_sample_hook != NULL) gc_sample_hook(node, bytes);
+	}
 }
 
 static void mark_vm(struct vm *vm) {
 	// Only up to sp: the slots above it hold stale copies of objects that may
 	// have been collected already.
-	for (uint32_t i = 0; i < vm->sp && i < STACK_SIZE; i++) {
+	for (uint32_t i = 0; i < vm->sp && i < vm->stack_cap; i++) {
 		mark_obj(vm->stack[i]);
 	}
 	for (uint32_t i = 0; i <= vm->frame_idx; i++) {
 		mark_obj(vm->frames[i].cl);
+		mark_obj(vm->frames[i].defers);
 	}
 
 	struct pool *globals = vm->state.globals;
@@ -383,15 +712,20 @@ static void mark_vm(struct vm *vm) {
 	}
 }
 
+static void sample_freed(struct gc_header *h);
+
 // Frees the unmarked objects of every segment and clears the mark of the
 // surviving ones. Must be called with the world stopped, which is what makes
 // it safe to walk segments other threads own.
 static void sweep(void) {
 	heap_len = 0;
+	memset(stats.live, 0, sizeof(stats.live));
+	memset(stats.live_bytes, 0, sizeof(stats.live_bytes));
 
 	for (struct heap *s = segments; s != NULL; s = s->next) {
 		struct gc_header **prev = &s->root;
 		struct gc_header *n = s->root;
+		s->bytes = 0;
 
 		while (n != NULL) {
 			struct gc_header *next = n->next;
@@ -399,9 +733,18 @@ static void sweep(void) {
 			if (n->mark & GC_MARK) {
 				n->mark &= ~GC_MARK;
 				prev = &n->next;
+
+				size_t bytes = gc_obj_bytes(n);
+				s->bytes += bytes;
+				stats.live[n->obj.type]++;
+				stats.live_bytes[n->obj.type] += bytes;
 			} else {
 				*prev = next;
 				s->len--;
+				// Before the block is recycled: the next sample may well be
+				// the same block, and it has to be heard of after this. With
+				// the profiler off no one would ever take it.
+				if ((n->mark & GC_SAMPLED) && gc_sample_rate > 0) sample_freed(n);
 				free_obj(n->obj);
 				gc_mark_recycle(n);
 			}
@@ -412,6 +755,28 @@ static void sweep(void) {
 	}
 }
 
+static void sample_freed(struct gc_header *h) {
+	mtx_lock(&sampled_mu);
+	if (nsampled_freed == capsampled_freed) {
+		capsampled_freed = capsampled_freed ? capsampled_freed * 2 : 64;
+		sampled_freed = realloc(sampled_freed, capsampled_freed * sizeof(*sampled_freed));
+	}
+	sampled_freed[nsampled_freed++] = h;
+	mtx_unlock(&sampled_mu);
+}
+
+// Takes the samples freed since the last call, at most max of them, in the
+// order they were freed.
+size_t gc_freed_samples(struct gc_header **out, size_t max) {
+	mtx_lock(&sampled_mu);
+	size_t n = nsampled_freed < max ? nsampled_freed : max;
+	memcpy(out, sampled_freed, n * sizeof(*out));
+	memmove(sampled_freed, sampled_freed + n, (nsampled_freed - n) * sizeof(*out));
+	nsampled_freed -= n;
+	mtx_unlock(&sampled_mu);
+	return n;
+}
+
 // The share of the room left that one thread may fill on its own before it
 // asks whether a collection is due.
 static int64_t gc_budget(void) {
@@ -421,6 +786,59 @@ static int64_t gc_budget(void) {
 	return left > HEAP_TRESHOLD ? left : HEAP_TRESHOLD;
 }
 
+static int64_t now_ns(void) {
+	struct timespec ts;
+	timespec_get(&ts, TIME_UTC);
+	return (int64_t) ts.tv_sec * 1000000000 + ts.tv_nsec;
+}
+
+// Marks and sweeps, with the heap mutex held. The pause is from asking the
+// others to stop to letting them go: waiting for them is part of it.
+static void collect(void) {
+	int64_t start = now_ns();
+	trace_gc(trace_ev_gc_start);
+
+	gc_want(GC_COLLECT);
+	while (nparked < nvms - (self != NULL)) {
+		cnd_wait(&cnd, &mu);
+	}
+
+	// ponytail: the epoch wraps after 2^29 collections, an object visited
+	// exactly that many collections ago would be skipped once.
+	if (++gc_epoch > (UINT32_MAX >> GC_EPOCH_SHIFT)) gc_epoch = 1;
+
+	for (struct vm_node *n = vms; n != NULL; n = n->next) {
+		if (n->vm != NULL) mark_vm(n->vm);
+	}
+	timers_mark();
+	for (struct root_node *r = roots; r != NULL; r = r->next) {
+		for (size_t i = 0; i < r->len; i++) {
+			mark_obj(r->objs[i]);
+		}
+	}
+	sweep();
+
+	// Grows with the live set and always leaves room for HEAP_TRESHOLD new
+	// objects, otherwise a program with few live objects and lots of garbage
+	// would collect at every single allocation burst.
+	// The room left for new objects grows with the number of threads: every
+	// one of them allocates, and every collection stops all of them, so the
+	// more there are the less often it is worth stopping them.
+	heap_treshold = heap_len * 2 + HEAP_TRESHOLD * (nvms > 0 ? nvms : 1);
+	budget = gc_budget();
+
+	int64_t end = now_ns();
+	stats.pauses[stats.numgc % GC_NPAUSES] = end - start;
+	stats.pause_total += end - start;
+	stats.last_gc = end;
+	stats.numgc++;
+	trace_gc(trace_ev_gc_end);
+
+	gc_unwant(GC_COLLECT);
+	cnd_broadcast(&cnd);
+	mtx_unlock(&mu);
+}
+
 void gc(void) {
 	if (gc_pending()) {
 		gc_safepoint();
@@ -448,38 +866,122 @@ void gc(void) {
 	printf("heap size before: %lu\n", heap_len);
 #endif
 
-	gc_set_wanted(1);
-	while (nparked < nvms - 1) {
-		cnd_wait(&cnd, &mu);
+	collect();
+
+#ifdef GC_DEBUG
+	printf("heap size after: %lu\n", heap_len);
+#endif
+}
+
+// A collection now, whatever the budget says: runtime.GC.
+void gc_collect(void) {
+	if (gc_pending()) gc_safepoint();
+
+	gc_lock();
+	collect();
+}
+
+// Sets a field of a stats object. The objects and lists in it are new, and
+// tracked from here: only the outermost one would be otherwise.
+static void stat_set(struct object o, char *name, struct object v) {
+	if (v.type > obj_builtin) heap_add(v);
+	object_set(o, name, v);
+}
+
+static struct object stat_list(uint64_t *vals, size_t n) {
+	struct object *list = malloc(sizeof(struct object) * (n > 0 ? n : 1));
+
+	for (size_t i = 0; i < n; i++) {
+		list[i] = new_integer_obj(vals[i]);
 	}
+	return new_list_obj(list, n);
+}
 
-	// ponytail: the epoch wraps after 2^30 collections, an object visited
-	// exactly that many collections ago would be skipped once.
-	if (++gc_epoch > (UINT32_MAX >> GC_EPOCH_SHIFT)) gc_epoch = 1;
+// What runtime.MemStats returns. The numbers are read with the world stopped,
+// so that they add up, and the objects holding them are made after: nothing
+// may allocate while the others wait.
+struct object gc_memstats(void) {
+	uint64_t allocs[OBJ_NTYPES] = {0};
+	uint64_t alloc_bytes[OBJ_NTYPES] = {0};
+	uint64_t heap_objects = 0, heap_bytes = 0;
+	size_t nsegs = 0;
 
-	for (struct vm_node *n = vms; n != NULL; n = n->next) {
-		mark_vm(n->vm);
+	gc_stop_world();
+	for (struct heap *s = segments; s != NULL; s = s->next) {
+		nsegs++;
 	}
-	for (struct root_node *r = roots; r != NULL; r = r->next) {
-		for (size_t i = 0; i < r->len; i++) {
-			mark_obj(r->objs[i]);
+	uint64_t *seg_objects = calloc(nsegs + 1, sizeof(uint64_t));
+	uint64_t *seg_bytes = calloc(nsegs + 1, sizeof(uint64_t));
+	int *seg_owned = calloc(nsegs + 1, sizeof(int));
+
+	size_t i = 0;
+	for (struct heap *s = segments; s != NULL; s = s->next, i++) {
+		for (int t = 0; t < OBJ_NTYPES; t++) {
+			allocs[t] += s->allocs[t];
+			alloc_bytes[t] += s->alloc_bytes[t];
 		}
+		seg_objects[i] = s->len;
+		seg_bytes[i] = s->bytes;
+		seg_owned[i] = s->owned;
+		heap_objects += s->len;
+		heap_bytes += s->bytes;
 	}
-	sweep();
-
-	// Grows with the live set and always leaves room for HEAP_TRESHOLD new
-	// objects, otherwise a program with few live objects and lots of garbage
-	// would collect at every single allocation burst.
-	// The room left for new objects grows with the number of threads: every
-	// one of them allocates, and every collection stops all of them, so the
-	// more there are the less often it is worth stopping them.
-	heap_treshold = heap_len * 2 + HEAP_TRESHOLD * (nvms > 0 ? nvms : 1);
-	budget = gc_budget();
-	gc_set_wanted(0);
-	cnd_broadcast(&cnd);
-	mtx_unlock(&mu);
+	struct gc_stats st = stats;
+	int64_t next_gc = heap_treshold;
+	gc_start_world();
+
+	struct object o = new_object();
+	stat_set(o, "NumGC", new_integer_obj(st.numgc));
+	stat_set(o, "PauseTotalNs", new_integer_obj(st.pause_total));
+
+	// The most recent pauses, the oldest first.
+	size_t npauses = st.numgc < GC_NPAUSES ? st.numgc : GC_NPAUSES;
+	uint64_t pauses[GC_NPAUSES];
+	for (size_t k = 0; k < npauses; k++) {
+		pauses[k] = st.pauses[(st.numgc - npauses + k) % GC_NPAUSES];
+	}
+	stat_set(o, "PauseNs", stat_list(pauses, npauses));
+	stat_set(o, "LastGC", new_integer_obj(st.last_gc));
+	stat_set(o, "HeapObjects", new_integer_obj(heap_objects));
+	stat_set(o, "HeapBytes", new_integer_obj(heap_bytes));
+	stat_set(o, "NextGC", new_integer_obj(next_gc));
+
+	uint64_t total = 0, total_bytes = 0;
+	struct object types = new_map();
+	for (int t = 0; t < OBJ_NTYPES; t++) {
+		total += allocs[t];
+		total_bytes += alloc_bytes[t];
+		if (allocs[t] == 0) continue;
+
+		struct object ts = new_object();
+		stat_set(ts, "Allocs", new_integer_obj(allocs[t]));
+		stat_set(ts, "AllocBytes", new_integer_obj(alloc_bytes[t]));
+		stat_set(ts, "Live", new_integer_obj(st.live[t]));
+		stat_set(ts, "LiveBytes", new_integer_obj(st.live_bytes[t]));
+		heap_add(ts);
+
+		const char *name = otype_str(t);
+		struct object key = new_string_obj(strdup(name), strlen(name));
+		heap_add(key);
+		map_set(types, key, ts);
+	}
+	stat_set(o, "Allocs", new_integer_obj(total));
+	stat_set(o, "AllocBytes", new_integer_obj(total_bytes));
+	stat_set(o, "ByType", types);
+
+	struct object *segs = malloc(sizeof(struct object) * (nsegs > 0 ? nsegs : 1));
+	for (size_t k = 0; k < nsegs; k++) {
+		struct object so = new_object();
+		stat_set(so, "Objects", new_integer_obj(seg_objects[k]));
+		stat_set(so, "Bytes", new_integer_obj(seg_bytes[k]));
+		stat_set(so, "Owned", parse_bool(seg_owned[k]));
+		heap_add(so);
+		segs[k] = so;
+	}
+	stat_set(o, "Segments", new_list_obj(segs, nsegs));
 
-#ifdef GC_DEBUG
-	printf("heap size after: %lu\n", heap_len);
-#endif
+	free(seg_objects);
+	free(seg_bytes);
+	free(seg_owned);
+	return o;
 }
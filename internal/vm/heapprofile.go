@@ -0,0 +1,188 @@
+package vm
+
+/*
+#include "vm.h"
+
+void profile_on_exit(void);
+void profile_heap(int64_t rate);
+*/
+import "C"
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NicoNex/tau/internal/pprof"
+)
+
+// How many objects to a sample on average when none is asked for: often enough
+// for a short program to show, rare enough that sampling costs close to nothing.
+const DefaultHeapRate = 512
+
+// site is where objects were allocated, a stack, and what became of them.
+type site struct {
+	stack      []pprof.Frame
+	allocs     int64
+	allocBytes int64
+	inuse      int64
+	inuseBytes int64
+}
+
+// sampled is an object the profiler looked at and hasn't seen freed yet.
+type sampled struct {
+	site  *site
+	bytes int64
+}
+
+var heapProfiler struct {
+	sync.Mutex
+	w     io.Writer
+	rate  int64
+	start time.Time
+	sites map[string]*site
+	live  map[*C.struct_gc_header]sampled
+}
+
+// StartHeapProfile profiles where the tau code run from now on allocates, until
+// StopHeapProfile writes the profile to w. A program that calls exit writes it
+// on the way out as well. One object in rate on average is looked at, 0 being
+// DefaultHeapRate, and counts for rate of them.
+//
+// A sample is the stack the object was allocated at, kept until the collector
+// frees it: the profile has what was allocated there in total and what of it
+// is still in use, which is what was there after the last collection plus
+// whatever was allocated since.
+//
+// ponytail: the objects a builtin run with `tau` allocates belong to no tau
+// code and aren't sampled, and the bytes are the ones MemStats counts, a
+// floor for maps and objects.
+func StartHeapProfile(w io.Writer, rate int64) error {
+	heapProfiler.Lock()
+	defer heapProfiler.Unlock()
+
+	if heapProfiler.w != nil {
+		return errors.New("heap profiling already in use")
+	}
+	if rate <= 0 {
+		rate = DefaultHeapRate
+	}
+	heapProfiler.w = w
+	heapProfiler.rate = rate
+	heapProfiler.start = time.Now()
+	heapProfiler.sites = make(map[string]*site)
+	heapProfiler.live = make(map[*C.struct_gc_header]sampled)
+
+	C.profile_on_exit()
+	C.profile_heap(C.int64_t(rate))
+	return nil
+}
+
+// StopHeapProfile stops the profiler and writes what it gathered.
+func StopHeapProfile() error {
+	C.profile_heap(0)
+
+	heapProfiler.Lock()
+	defer heapProfiler.Unlock()
+
+	w := heapProfiler.w
+	if w == nil {
+		return nil
+	}
+	heapProfiler.w = nil
+	drainFreed()
+
+	rate := heapProfiler.rate
+	var samples []pprof.Sample
+	for _, s := range heapProfiler.sites {
+		samples = append(samples, pprof.Sample{
+			Stack:  s.stack,
+			Values: []int64{s.allocs * rate, s.allocBytes * rate, s.inuse * rate, s.inuseBytes * rate},
+		})
+	}
+	p := pprof.Profile{
+		SampleTypes: []pprof.ValueType{
+			{Type: "alloc_objects", Unit: "count"},
+			{Type: "alloc_space", Unit: "bytes"},
+			{Type: "inuse_objects", Unit: "count"},
+			{Type: "inuse_space", Unit: "bytes"},
+		},
+		Samples:    samples,
+		PeriodType: pprof.ValueType{Type: "objects", Unit: "count"},
+		Period:     rate,
+		Start:      heapProfiler.start,
+		Duration:   time.Since(heapProfiler.start),
+	}
+	heapProfiler.sites = nil
+	heapProfiler.live = nil
+	return p.Write(w)
+}
+
+// goHeapSample is the collector telling of a sample, on the thread of the VM
+// that allocated it, which makes the stack of that VM safe to read.
+//
+//export goHeapSample
+func goHeapSample(h *C.struct_gc_header, bytes C.size_t) {
+	heapProfiler.Lock()
+	defer heapProfiler.Unlock()
+
+	if heapProfiler.w == nil {
+		return
+	}
+	// The frees first: the block may be one that was freed and came back.
+	drainFreed()
+
+	vm := C.gc_current_vm()
+	if vm == nil {
+		return
+	}
+	stack := profileStack(vm)
+	key := stackKey(stack)
+	s, ok := heapProfiler.sites[key]
+	if !ok {
+		s = &site{stack: stack}
+		heapProfiler.sites[key] = s
+	}
+	s.allocs++
+	s.allocBytes += int64(bytes)
+	s.inuse++
+	s.inuseBytes += int64(bytes)
+	heapProfiler.live[h] = sampled{site: s, bytes: int64(bytes)}
+}
+
+// drainFreed takes the samples the collector freed off what is in use. It is
+// called with the profiler locked.
+func drainFreed() {
+	var buf [256]*C.struct_gc_header
+
+	for {
+		n := int(C.gc_freed_samples(&buf[0], C.size_t(len(buf))))
+		for _, h := range buf[:n] {
+			if o, ok := heapProfiler.live[h]; ok {
+				o.site.inuse--
+				o.site.inuseBytes -= o.bytes
+				delete(heapProfiler.live, h)
+			}
+		}
+		if n < len(buf) {
+			return
+		}
+	}
+}
+
+func stackKey(stack []pprof.Frame) string {
+	var b strings.Builder
+	for _, f := range stack {
+		b.WriteString(f.Func)
+		b.WriteByte(0)
+		b.WriteString(f.File)
+		b.WriteByte(0)
+		b.WriteString(strconv.Itoa(f.StartLine))
+		b.WriteByte(0)
+		b.WriteString(strconv.Itoa(f.Line))
+		b.WriteByte(0)
+	}
+	return b.String()
+}
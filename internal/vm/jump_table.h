@@ -55,4 +55,22 @@ static const void *jump_table[] = {
 	&&TARGET_GET_FREE,
 	&&TARGET_LOAD_MODULE,
 	&&TARGET_INTERPOLATE,
+	&&TARGET_SELECT,
+	&&TARGET_ITER,
+	&&TARGET_ITER_NEXT,
+	&&TARGET_UNPACK,
+	&&TARGET_UNPACK_FIELDS,
+	&&TARGET_DUP,
+	&&TARGET_MATCH_LIST,
+	&&TARGET_MATCH_MAP,
+	&&TARGET_SWITCH_TABLE,
+	&&TARGET_DEFER,
+	&&TARGET_CALL_SPREAD,
+	&&TARGET_SET_FREE,
+	&&TARGET_CAPTURE_LOCAL,
+	&&TARGET_CAPTURE_FREE,
+	&&TARGET_LOCAL_CONST,
+	&&TARGET_UPDATE_LOCAL,
+	&&TARGET_COMPARE_JUMP,
+	&&TARGET_TAIL_CALL,
 };
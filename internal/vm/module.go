@@ -90,7 +90,7 @@ func vm_exec_load_module(vm *C.struct_vm, cpath *C.char) int {
 	defer C.free(unsafe.Pointer(cp))
 	var mod C.struct_object
 	if C.modtab_get(vm.state.mods, cp, &mod) != 0 {
-		vm.stack[vm.sp] = mod
+		vmStack(vm)[vm.sp] = mod
 		vm.sp++
 		return 0
 	}
@@ -181,7 +181,11 @@ func vm_exec_load_module(vm *C.struct_vm, cpath *C.char) int {
 			if isExported(name) {
 				cname := C.CString(name)
 				if o._type == C.obj_object {
-					C.object_set(mod, cname, C.object_to_module(o))
+					o = C.object_to_module(o)
+				}
+				// A constant stays one for whoever imports it.
+				if sym.Const {
+					C.object_set_const(mod, cname, o)
 				} else {
 					C.object_set(mod, cname, o)
 				}
@@ -191,7 +195,7 @@ func vm_exec_load_module(vm *C.struct_vm, cpath *C.char) int {
 	}
 
 	C.modtab_put(vm.state.mods, cp, mod)
-	vm.stack[vm.sp] = mod
+	vmStack(vm)[vm.sp] = mod
 	vm.sp++
 	return 0
 }
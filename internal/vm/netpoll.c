@@ -0,0 +1,242 @@
+#if defined(__linux__)
+	#include <sys/epoll.h>
+	#include <fcntl.h>
+	#include <unistd.h>
+#endif
+#include <errno.h>
+#include <stdlib.h>
+
+#include "vm.h"
+#include "thrd.h"
+
+/*
+ * The network poller: the sockets of the net module never block, and a
+ * routine whose call on one would waits here for the socket to be ready
+ * instead, parked like on a pipe. One thread sleeps in epoll_wait for all the
+ * sockets there are and makes ready whoever waits on the ones that are, so a
+ * thousand connections are a thousand parked routines and not a thousand
+ * threads asleep in the kernel.
+ *
+ * Every socket is registered once, for both ways, edge triggered: the kernel
+ * says when it becomes readable or writable and not for as long as it is, so
+ * a socket is only waited for once a call on it has said it would block, and
+ * the edge is remembered for a call that is yet to wait. An edge remembered
+ * for a call that then didn't need it makes the next one try once for
+ * nothing, which is the whole cost.
+ *
+ * Each way has a deadline of its own, a time on the clock of timer_now that a
+ * wait gives up at. Changing it wakes those waiting, who look again, so that a
+ * deadline moved to the past ends a wait already under way. Closing a socket
+ * wakes them too, and from then on every wait on it ends right away, until it
+ * is opened again: the descriptor of a socket closed is the next one's.
+ *
+ * A desc lives as long as the program, and is the one of every socket with
+ * that descriptor, so the thread of the poller can hold on to one that has
+ * just been closed: at worst it remembers an edge for the socket opened next.
+ * Nothing in here is on the heap of tau, the collector needs to know nothing
+ * about the thread, and a routine takes the mutex of a desc parked, like the
+ * one of a pipe, since the one holding it may be waiting for the collector.
+ *
+ * ponytail: epoll only. Elsewhere netpoll_open says there is no poller, and
+ * the net module keeps its sockets blocking and its deadlines a timeout of the
+ * socket, with the thread handed off while it waits.
+ */
+
+struct desc {
+	mtx_t mu;
+	int open;
+	// By mode, NETPOLL_READ and NETPOLL_WRITE: whether an edge came since
+	// the last wait, the deadline, -1 for none, and who waits.
+	int ready[2];
+	int64_t deadline[2];
+	struct waitq q[2];
+};
+
+static mtx_t tabmu;
+static struct desc **descs = NULL;
+static int64_t ndescs = 0;
+static int started = 0;
+
+#if defined(__linux__)
+static int epfd = -1;
+#endif
+
+void netpoll_init(void) {
+	mtx_init(&tabmu, mtx_plain);
+}
+
+static void lock(struct desc *d) {
+	gc_park_wait(NULL);
+	mtx_lock(&d->mu);
+	gc_unpark();
+}
+
+static struct desc *lookup(int64_t fd) {
+	struct desc *d = NULL;
+
+	mtx_lock(&tabmu);
+	if (fd >= 0 && fd < ndescs) d = descs[fd];
+	mtx_unlock(&tabmu);
+	return d;
+}
+
+#if defined(__linux__)
+// Wakes up whoever waits on d for mode, with its mutex held.
+static void wake(struct desc *d, int mode) {
+	d->ready[mode] = 1;
+	waitq_broadcast(&d->q[mode]);
+}
+
+static int poller(void *arg) {
+	(void) arg;
+	struct epoll_event evs[128];
+
+	for (;;) {
+		int n = epoll_wait(epfd, evs, 128, -1);
+
+		for (int i = 0; i < n; i++) {
+			struct desc *d = evs[i].data.ptr;
+			uint32_t ev = evs[i].events;
+
+			mtx_lock(&d->mu);
+			if (ev & (EPOLLIN | EPOLLRDHUP | EPOLLHUP | EPOLLERR)) wake(d, NETPOLL_READ);
+			if (ev & (EPOLLOUT | EPOLLHUP | EPOLLERR)) wake(d, NETPOLL_WRITE);
+			mtx_unlock(&d->mu);
+		}
+	}
+	return 0;
+}
+
+// The desc of fd, made along with the table and the thread the first time.
+static struct desc *get(int64_t fd) {
+	mtx_lock(&tabmu);
+	if (!started) {
+		thrd_t thread;
+
+		if ((epfd = epoll_create1(EPOLL_CLOEXEC)) < 0) goto fail;
+		if (thrd_create(&thread, poller, NULL) != thrd_success) {
+			close(epfd);
+			goto fail;
+		}
+		thrd_detach(thread);
+		started = 1;
+	}
+	if (fd >= ndescs) {
+		int64_t n = ndescs ? ndescs : 64;
+		while (n <= fd) n *= 2;
+
+		struct desc **grown = realloc(descs, sizeof(struct desc *) * n);
+		if (grown == NULL) goto fail;
+		for (int64_t i = ndescs; i < n; i++) grown[i] = NULL;
+		descs = grown;
+		ndescs = n;
+	}
+	if (descs[fd] == NULL) {
+		struct desc *d = calloc(1, sizeof(struct desc));
+		if (d == NULL) goto fail;
+		mtx_init(&d->mu, mtx_plain);
+		descs[fd] = d;
+	}
+
+	struct desc *d = descs[fd];
+	mtx_unlock(&tabmu);
+	return d;
+
+fail:
+	mtx_unlock(&tabmu);
+	errno = ENOMEM;
+	return NULL;
+}
+
+int netpoll_open(int64_t fd) {
+	int flags = fcntl(fd, F_GETFL);
+	struct desc *d;
+
+	if (fd < 0 || flags < 0) return -1;
+	if ((d = get(fd)) == NULL) return -1;
+	if (fcntl(fd, F_SETFL, flags | O_NONBLOCK) < 0) return -1;
+
+	lock(d);
+	if (d->open) {
+		mtx_unlock(&d->mu);
+		return 1;
+	}
+	d->ready[0] = d->ready[1] = 0;
+	d->deadline[0] = d->deadline[1] = -1;
+	struct epoll_event ev = {.events = EPOLLIN | EPOLLOUT | EPOLLRDHUP | EPOLLET, .data.ptr = d};
+	if (epoll_ctl(epfd, EPOLL_CTL_ADD, fd, &ev) < 0) {
+		int err = errno;
+		mtx_unlock(&d->mu);
+		fcntl(fd, F_SETFL, flags);
+		errno = err;
+		return -1;
+	}
+	d->open = 1;
+	mtx_unlock(&d->mu);
+	return 1;
+}
+
+void netpoll_close(int64_t fd) {
+	struct desc *d = lookup(fd);
+
+	if (d == NULL) return;
+	lock(d);
+	if (d->open) {
+		d->open = 0;
+		epoll_ctl(epfd, EPOLL_CTL_DEL, fd, NULL);
+		waitq_broadcast(&d->q[NETPOLL_READ]);
+		waitq_broadcast(&d->q[NETPOLL_WRITE]);
+	}
+	mtx_unlock(&d->mu);
+}
+#else
+int netpoll_open(int64_t fd) {
+	(void) fd;
+	(void) started;
+	return 0;
+}
+
+void netpoll_close(int64_t fd) {
+	(void) fd;
+}
+#endif
+
+int netpoll_wait(int64_t fd, int mode) {
+	struct desc *d = lookup(fd);
+	int ret;
+
+	if (d == NULL) return -1;
+	lock(d);
+	for (;;) {
+		if (!d->open) {
+			ret = -1;
+			break;
+		}
+		if (d->ready[mode]) {
+			d->ready[mode] = 0;
+			ret = 1;
+			break;
+		}
+		if (d->deadline[mode] >= 0 && timer_now() >= d->deadline[mode]) {
+			ret = 0;
+			break;
+		}
+		// Whatever wakes it up, it looks again: an edge, a deadline that
+		// passed or moved, or the socket closed.
+		gc_park_wait(NULL);
+		waitq_timedwait(&d->q[mode], &d->mu, d->deadline[mode]);
+		gc_unpark();
+	}
+	mtx_unlock(&d->mu);
+	return ret;
+}
+
+void netpoll_deadline(int64_t fd, int mode, int64_t when) {
+	struct desc *d = lookup(fd);
+
+	if (d == NULL) return;
+	lock(d);
+	d->deadline[mode] = when;
+	waitq_broadcast(&d->q[mode]);
+	mtx_unlock(&d->mu);
+}
@@ -54,7 +54,25 @@ enum opcode {
 	op_get_builtin,
 	op_get_free,
 	op_load_module,
-	op_interpolate
+	op_interpolate,
+	op_select,
+	op_iter,
+	op_iter_next,
+	op_unpack,
+	op_unpack_fields,
+	op_dup,
+	op_match_list,
+	op_match_map,
+	op_switch_table,
+	op_defer,
+	op_call_spread,
+	op_set_free,
+	op_capture_local,
+	op_capture_free,
+	op_local_const,
+	op_update_local,
+	op_compare_jump,
+	op_tail_call
 };
 
 char *opcode_str(enum opcode op) {
@@ -113,6 +131,24 @@ char *opcode_str(enum opcode op) {
 		"op_get_free",
 		"op_load_module",
 		"op_interpolate",
+		"op_select",
+		"op_iter",
+		"op_iter_next",
+		"op_unpack",
+		"op_unpack_fields",
+		"op_dup",
+		"op_match_list",
+		"op_match_map",
+		"op_switch_table",
+		"op_defer",
+		"op_call_spread",
+		"op_set_free",
+		"op_capture_local",
+		"op_capture_free",
+		"op_local_const",
+		"op_update_local",
+		"op_compare_jump",
+		"op_tail_call",
 	};
 
 	return strings[op];
@@ -0,0 +1,30 @@
+#include <stdlib.h>
+#include "vm.h"
+#include "_cgo_export.h"
+
+static void profile_atexit(void) {
+	goProfileExit();
+}
+
+// The exit builtin ends the process from C, where no deferred Go call runs:
+// the profiles and the trace are written by atexit then, once, however many
+// times they were started.
+void profile_on_exit(void) {
+	static int registered = 0;
+
+	if (!registered) {
+		registered = 1;
+		atexit(profile_atexit);
+	}
+}
+
+static void profile_heap_sample(struct gc_header *h, size_t bytes) {
+	goHeapSample(h, bytes);
+}
+
+// Samples one object in rate on average, 0 stops. The hook goes in first, so
+// that no sample is taken with no one to hear of it.
+void profile_heap(int64_t rate) {
+	if (rate > 0) gc_sample_hook = profile_heap_sample;
+	gc_sample_rate = rate;
+}
@@ -0,0 +1,200 @@
+package vm
+
+/*
+#include "vm.h"
+
+void profile_on_exit(void);
+*/
+import "C"
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/NicoNex/tau/internal/pprof"
+)
+
+// How often the profiler looks, the rate Go's own profiler uses.
+const profileHz = 100
+
+var profiler struct {
+	sync.Mutex
+	w       io.Writer
+	samples []pprof.Sample
+	start   time.Time
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// StartCPUProfile profiles the tau code that runs from now on until
+// StopCPUProfile, which writes the profile to w. A program that calls exit
+// writes it on the way out as well.
+//
+// A hundred times a second the VMs are stopped, the way a collection stops
+// them, and the calls of every one of them that was running are a sample:
+// the ones waiting on a pipe, a native call or anything else are using no
+// CPU and are left out. The samples are of tau functions and lines, and not
+// of the interpreter running them.
+//
+// A VM stops at its next call, return or jump, so that is where the samples
+// land: a line doing none of those is counted at the one that follows it.
+//
+// ponytail: a native call counts as waiting, since it may well be. The time
+// spent in C through the ffi module doesn't show.
+func StartCPUProfile(w io.Writer) error {
+	profiler.Lock()
+	defer profiler.Unlock()
+
+	if profiler.w != nil {
+		return errors.New("cpu profiling already in use")
+	}
+	profiler.w = w
+	profiler.samples = nil
+	profiler.start = time.Now()
+	profiler.done = make(chan struct{})
+	profiler.stopped = make(chan struct{})
+
+	C.profile_on_exit()
+	go sampleLoop(profiler.done, profiler.stopped)
+	return nil
+}
+
+// StopCPUProfile stops the profiler and writes what it gathered.
+func StopCPUProfile() error {
+	profiler.Lock()
+	w := profiler.w
+	if w == nil {
+		profiler.Unlock()
+		return nil
+	}
+	profiler.w = nil
+	close(profiler.done)
+	stopped := profiler.stopped
+	profiler.Unlock()
+
+	// The last sample may be waiting for a world that stops no more: the
+	// thread of the exit builtin is running and stays so.
+	select {
+	case <-stopped:
+	case <-time.After(time.Second / profileHz):
+	}
+
+	profiler.Lock()
+	defer profiler.Unlock()
+	p := pprof.Profile{
+		SampleTypes: []pprof.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		Samples:     profiler.samples,
+		PeriodType:  pprof.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:      int64(time.Second / profileHz),
+		Start:       profiler.start,
+		Duration:    time.Since(profiler.start),
+	}
+	profiler.samples = nil
+	return p.Write(w)
+}
+
+//export goProfileExit
+func goProfileExit() {
+	StopCPUProfile()
+	StopHeapProfile()
+	StopTrace()
+}
+
+func sampleLoop(done, stopped chan struct{}) {
+	defer close(stopped)
+	t := time.NewTicker(time.Second / profileHz)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		samples := sample()
+		select {
+		case <-done:
+			return
+		default:
+		}
+		profiler.Lock()
+		profiler.samples = append(profiler.samples, samples...)
+		profiler.Unlock()
+	}
+}
+
+// sample takes the calls of every running VM, with the world stopped.
+func sample() []pprof.Sample {
+	C.gc_stop_world()
+	defer C.gc_start_world()
+
+	buf := make([]*C.struct_vm, 64)
+	for {
+		n := int(C.gc_vms(&buf[0], C.size_t(len(buf))))
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]*C.struct_vm, len(buf)*2)
+	}
+
+	var out []pprof.Sample
+	for _, vm := range buf {
+		if C.gc_waiting(vm) != 0 {
+			continue
+		}
+		if stack := profileStack(vm); len(stack) > 0 {
+			out = append(out, pprof.Sample{
+				Stack:  stack,
+				Values: []int64{1, int64(time.Second / profileHz)},
+				Labels: map[string]int64{"routine": int64(vm.id)},
+			})
+		}
+	}
+	return out
+}
+
+func profileStack(vm *C.struct_vm) []pprof.Frame {
+	var stack []pprof.Frame
+
+	for i := int(vm.frame_idx); i >= 0; i-- {
+		f := &vmFrames(vm)[i]
+		// The frame a call from C stops at, and the empty one at the bottom
+		// of a routine.
+		if f.ip == nil || f.cl.data == [8]byte{} {
+			continue
+		}
+
+		fn := frameFunction(f)
+		// Past the last bookmark is the return a function without one ends
+		// with, which belongs to the last line.
+		b := C.frame_bookmark(f)
+		if b == nil && fn.bklen > 0 {
+			b = &unsafe.Slice(fn.bookmarks, fn.bklen)[fn.bklen-1]
+		}
+		frame := pprof.Frame{File: C.GoString(C.frame_file(vm, f, b))}
+		if b != nil {
+			frame.Line = int(b.lineno)
+		}
+		if fn.bklen > 0 {
+			frame.StartLine = int(fn.bookmarks.lineno)
+		}
+
+		// An anonymous function is named after the line it starts at, or
+		// all of them would be one function called fn.
+		switch {
+		case fn.name != nil:
+			frame.Func = C.GoString(fn.name)
+		case i == 0:
+			frame.Func = "<top level>"
+		default:
+			frame.Func = "fn@" + strconv.Itoa(frame.StartLine)
+		}
+		stack = append(stack, frame)
+	}
+	return stack
+}
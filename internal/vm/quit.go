@@ -0,0 +1,29 @@
+package vm
+
+/*
+#include "vm.h"
+*/
+import "C"
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var quitOnce sync.Once
+
+// dumpOnQuit makes SIGQUIT print what every routine of the program is doing
+// and its stack, and end the program with 2, the way Go does it for its
+// goroutines. The goroutines of the interpreter say nothing about the program
+// it runs, so this takes their place from the first program run on.
+func dumpOnQuit() {
+	quitOnce.Do(func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGQUIT)
+		go func() {
+			<-c
+			C.gc_dump()
+		}()
+	})
+}
@@ -0,0 +1,1085 @@
+#if !defined(_WIN32) && !defined(WIN32)
+	// ucontext is only declared for XSI on macOS, where it is deprecated and
+	// still there. It has to be said before any system header is read.
+	#if defined(__APPLE__)
+		#define _XOPEN_SOURCE 700
+		#define _DARWIN_C_SOURCE
+		#pragma clang diagnostic ignored "-Wdeprecated-declarations"
+	#endif
+	#include <ucontext.h>
+	#include <sys/mman.h>
+	#include <unistd.h>
+#endif
+#include <errno.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+
+#include "vm.h"
+#include "thrd.h"
+
+/*
+ * The scheduler: tau routines multiplexed onto a few threads.
+ *
+ * A routine is a C stack of its own and the context to switch to it, and it
+ * runs on whichever thread picks it up. The threads are workers, and a worker
+ * only runs routines while it holds a proc: there are TAUMAXPROCS of them, as
+ * many as there are CPUs unless it says otherwise, and so at most that many
+ * routines run at once however many there are.
+ *
+ * Every proc has a queue of the routines ready to run, and there is one more
+ * for everybody. A routine made ready by a running one goes on the queue of
+ * the proc of the latter, where it is likely to find what it works on still
+ * in the cache; the others go on the global one. A worker with an empty queue
+ * looks at the global one, then steals half of the queue of another proc, and
+ * when there is nothing anywhere it gives its proc back and sleeps. Whoever
+ * makes a routine ready wakes a worker up when there is an idle proc and no
+ * worker already looking for work.
+ *
+ * A routine leaves its worker when it parks - on a pipe, a timer or anything
+ * else that goes through sched_park - and whoever makes it ready puts it back
+ * on a queue. The switch happens on the stack of the worker: a routine that
+ * parks is not yet parked until it is off its own stack, and one woken in
+ * between is queued by the worker that took it off, see run.
+ *
+ * A call that blocks the thread - a native function, a pipe used from C, the
+ * terminal - can't switch anywhere, and goes through sched_block instead: the
+ * proc stays with the worker but is free to take. sysmon, a thread of its own,
+ * gives the procs that have been blocked for longer than a tick to another
+ * worker when somebody is waiting for one. The worker that comes back from
+ * the call takes its proc back if it is still there, and waits for one
+ * otherwise, with the routine it is in the middle of.
+ *
+ * sysmon also asks a routine that has been running for longer than a time
+ * slice while others wait to make room for them. There is no signal for it: it
+ * raises GC_YIELD on gc_wanted, the routine sees it at its next safepoint like
+ * it sees a collection, and goes at the back of the global queue.
+ *
+ * The collector needs nothing of this. A routine that is not on a worker has
+ * parked for it before leaving, the node of its VM travels with it from one
+ * worker to the next, and the node of a worker is that of the routine it runs.
+ *
+ * Go callbacks are fine on the stack of a routine, and a routine that calls
+ * back into Go is pinned to its worker for the whole call: Go code running on
+ * a thread must find that thread in the same state it left it, so a routine
+ * that is pinned never switches and blocks the thread like C does, see
+ * sched_pin.
+ *
+ * A stack has a guard page below it, so that a routine that runs out of it
+ * faults rather than write over a neighbour. The guard splits the mapping of
+ * the stack in two, and Linux allows a process 65530 mappings by default
+ * (vm.max_map_count): a guard for every routine would stop a program at some
+ * thirty thousand of them. Past GUARDED_MAX routines at once, or when the
+ * kernel won't protect one more page, the stacks are cut out of chunks
+ * without guards, which are one mapping for CHUNK_STACKS of them.
+ *
+ * ponytail: what keeps a routine on an unguarded stack inside it is only that
+ * tau code doesn't run on the C stack: a call of tau is a frame of the VM, and
+ * how deep calls from C into tau nest is capped by the size of the stack, see
+ * vm_reenter. A C function that recurses deep enough on its own still writes
+ * over the stack below.
+ */
+
+// How much C stack a routine gets, and the one running a program, which is
+// what the thread it used to run on had. It is address space, and only what a
+// routine uses of it is memory.
+#define ROUTINE_STACK (1 << 20)
+#define MAIN_STACK    (8 << 20)
+// How many stacks of routines that have ended are kept for the next ones,
+// how many routines at most get a guard page, and how many stacks the ones
+// that don't are cut out of at a time, see stack_new.
+#define STACK_CACHE   64
+#define GUARDED_MAX   16384
+#define CHUNK_STACKS  64
+// How many routines a proc queues, the rest go on the global queue.
+#define LOCAL_QUEUE   256
+// How often sysmon looks, and for how long a routine may run while others
+// wait, in milliseconds.
+#define SYSMON_TICK   1
+#define TIME_SLICE    10
+#define MAX_PROCS     4096
+
+// How many routines there are: the queued, the running and the parked. It is
+// what runtime.NumRoutine returns, and is the same in both builds.
+static int64_t nroutines = 0;
+
+int64_t sched_numroutine(void) {
+	return __atomic_load_n(&nroutines, __ATOMIC_RELAXED);
+}
+
+#if defined(_WIN32) || defined(WIN32)
+
+/*
+ * ponytail: Windows gets a thread per routine, the way every platform did
+ * before the scheduler. Fibers are what ucontext is on POSIX, and they would
+ * do the same job here.
+ */
+
+struct thread_call {
+	int (*fn)(void *);
+	void *arg;
+};
+
+static int thread_main(void *arg) {
+	struct thread_call c = *(struct thread_call *) arg;
+	free(arg);
+
+	int ret = c.fn(c.arg);
+	// The thread ends with the routine, and with it what it kept of the heap.
+	gc_release_segment();
+	gc_flush_headers();
+	__atomic_sub_fetch(&nroutines, 1, __ATOMIC_RELAXED);
+	return ret;
+}
+
+void sched_init(void) {}
+
+int sched_go(int (*fn)(void *), void *arg) {
+	struct thread_call *c = malloc(sizeof(struct thread_call));
+	thrd_t thread;
+
+	c->fn = fn;
+	c->arg = arg;
+	__atomic_add_fetch(&nroutines, 1, __ATOMIC_RELAXED);
+	if (thrd_create(&thread, thread_main, c) != thrd_success) {
+		__atomic_sub_fetch(&nroutines, 1, __ATOMIC_RELAXED);
+		free(c);
+		return -1;
+	}
+	thrd_detach(thread);
+	return 0;
+}
+
+int sched_main(int (*fn)(void *), void *arg) {
+	__atomic_add_fetch(&nroutines, 1, __ATOMIC_RELAXED);
+	int ret = fn(arg);
+	__atomic_sub_fetch(&nroutines, 1, __ATOMIC_RELAXED);
+	return ret;
+}
+
+int sched_inside(void) { return 1; }
+size_t sched_stack_size(void) { return ROUTINE_STACK; }
+void *sched_current(void) { return NULL; }
+void sched_park(mtx_t *mu) { mtx_unlock(mu); }
+void sched_ready(void *r) { (void) r; }
+int sched_block(void) { return 0; }
+void sched_unblock(void) {}
+void sched_pin(void) {}
+void sched_unpin(void) {}
+int sched_preempted(void) { return 0; }
+void sched_requeue(void) {}
+int sched_runnable(void) { return 0; }
+
+#else
+
+enum routine_state {
+	routine_runnable,
+	routine_running,
+	// On its way off its worker to sleep, and woken before it got there: the
+	// worker that takes it off queues it again, see run, or it doesn't leave at
+	// all, see sched_park.
+	routine_parking,
+	routine_woken,
+	routine_parked,
+};
+
+// What a routine that leaves its worker wants done once it is off its stack.
+enum routine_after {
+	after_park,
+	after_requeue,
+	after_exit,
+};
+
+// How the thread that started a program hears that it ended, see sched_main.
+struct done {
+	mtx_t mu;
+	cnd_t cnd;
+	int finished;
+	int ret;
+};
+
+struct routine {
+	ucontext_t ctx;
+	// The mapping of the stack, the page at the bottom of it included, which
+	// is a guard or not, see stack_new.
+	char *stack;
+	size_t stack_size;
+	int guarded;
+	int (*fn)(void *);
+	void *arg;
+	int ret;
+	int state;
+	enum routine_after after;
+	// The node of the VM it runs and errno, which belong to the routine and not
+	// to the thread it happens to be on.
+	void *gc_self;
+	int err;
+	// How many calls back into Go it is in, see sched_pin.
+	int pinned;
+	struct done *done;
+	struct routine *next;
+};
+
+enum proc_status {
+	proc_idle,
+	proc_running,
+	proc_blocked,
+};
+
+struct proc {
+	// Changed from idle by whoever holds mu, and between running and blocked
+	// by its worker and by sysmon, which races it with a compare and swap.
+	int status;
+	mtx_t mu;
+	struct routine *queue[LOCAL_QUEUE];
+	uint32_t head;
+	uint32_t len;
+	// Bumped every time a routine is switched to, and every time the running
+	// one blocks: sysmon tells what has been going on for a while from the
+	// ones that didn't change since it last looked.
+	uint32_t schedtick;
+	uint32_t blocktick;
+	uint32_t seen_sched;
+	uint32_t seen_block;
+	int64_t sched_since;
+	int64_t block_since;
+	// Set by sysmon for the routine running on it to make room.
+	int preempt;
+	struct proc *next_idle;
+};
+
+struct worker {
+	// Where the worker goes back to when the routine it runs leaves.
+	ucontext_t ctx;
+	struct proc *p;
+	struct routine *cur;
+	int blocked;
+	// Started or woken to look for work, and not found any yet.
+	int spinning;
+	// Where it sleeps, and the proc it is given to wake up with.
+	cnd_t cnd;
+	struct proc *nextp;
+	struct worker *next_idle;
+};
+
+// mu guards the global queue, the idle procs and workers and the waiting. The
+// counts are written with it held and read without it too, with the atomic
+// builtins.
+static mtx_t mu;
+static struct routine *runq_head = NULL;
+static struct routine *runq_tail = NULL;
+static uint32_t runq_len = 0;
+static struct proc *procs = NULL;
+static int nprocs = 0;
+static struct proc *idle_procs = NULL;
+static int nidle = 0;
+static struct worker *idle_workers = NULL;
+static int nspinning = 0;
+// Workers back from a blocking call whose proc was taken, waiting for one.
+static int nwaiting = 0;
+static cnd_t waiting_cnd;
+static int sysmon_started = 0;
+static int sysmon_asleep = 0;
+static cnd_t sysmon_cnd;
+static int initialised = 0;
+static size_t page = 4096;
+
+// The guarded stacks of routines that ended and how many of them there are,
+// cached or not, and the unguarded ones that are free. Guarded by stacks_mu.
+static mtx_t stacks_mu;
+static char *stacks[STACK_CACHE];
+static int nstacks = 0;
+static int nguarded = 0;
+static char **spare = NULL;
+static size_t nspare = 0;
+static size_t capspare = 0;
+
+static __thread struct worker *current = NULL;
+
+// The worker of this thread. A routine moves to another thread whenever it
+// leaves its worker, and a compiler sure that a thread local stays where it is
+// may keep its address across the call that moved it: thread locals are only
+// ever read through here, and from here nothing is kept.
+static __attribute__((noinline)) struct worker *this_worker(void) {
+	__asm__ volatile("" ::: "memory");
+	return current;
+}
+
+static int64_t mono_ms(void) {
+	struct timespec ts;
+	clock_gettime(CLOCK_MONOTONIC, &ts);
+	return (int64_t) ts.tv_sec * 1000 + ts.tv_nsec / 1000000;
+}
+
+// How many procs there are, from TAUMAXPROCS or else the CPUs. A value that
+// doesn't read as a number is ignored, like the one of TAUMAXSTACK.
+static int procs_wanted(void) {
+	char *s = getenv("TAUMAXPROCS");
+
+	if (s != NULL && *s != '\0') {
+		char *end;
+		long n = strtol(s, &end, 10);
+
+		if (*end == '\0' && n > 0) return n < MAX_PROCS ? n : MAX_PROCS;
+	}
+	long n = sysconf(_SC_NPROCESSORS_ONLN);
+	return n > 0 ? n : 1;
+}
+
+// Called by gc_init, once and before there is any routine.
+void sched_init(void) {
+	if (initialised) return;
+	initialised = 1;
+
+	long sz = sysconf(_SC_PAGESIZE);
+	if (sz > 0) page = sz;
+
+	mtx_init(&mu, mtx_plain);
+	mtx_init(&stacks_mu, mtx_plain);
+	cnd_init(&waiting_cnd);
+	cnd_init(&sysmon_cnd);
+
+	nprocs = procs_wanted();
+	procs = calloc(nprocs, sizeof(struct proc));
+	for (int i = nprocs - 1; i >= 0; i--) {
+		mtx_init(&procs[i].mu, mtx_plain);
+		procs[i].next_idle = idle_procs;
+		idle_procs = &procs[i];
+	}
+	nidle = nprocs;
+}
+
+static char *map(size_t size) {
+	int flags = MAP_PRIVATE | MAP_ANON;
+#if defined(MAP_NORESERVE)
+	flags |= MAP_NORESERVE;
+#endif
+#if defined(MAP_STACK)
+	flags |= MAP_STACK;
+#endif
+	char *s = mmap(NULL, size, PROT_READ | PROT_WRITE, flags, -1, 0);
+	return s != MAP_FAILED ? s : NULL;
+}
+
+// A stack of size bytes, the first page of which is a guard when *guarded
+// says so: a routine that runs out of stack faults there, rather than write
+// over whatever is mapped below. Only the stacks of routines, and not the
+// bigger one of a program, come from the cache, and past GUARDED_MAX of them
+// from chunks that are never unmapped, see the top of the file: unguarded
+// stacks side by side are one mapping for the kernel, and one unmapped in
+// the middle of the others would be two more. NULL when there can't be one.
+static char *stack_new(size_t size, int *guarded) {
+	char *s = NULL;
+
+	*guarded = 1;
+	if (size != ROUTINE_STACK + page) {
+		if ((s = map(size)) != NULL && mprotect(s, page, PROT_NONE) != 0) {
+			munmap(s, size);
+			s = NULL;
+		}
+		return s;
+	}
+
+	mtx_lock(&stacks_mu);
+	if (nstacks > 0) {
+		s = stacks[--nstacks];
+		mtx_unlock(&stacks_mu);
+		return s;
+	}
+	if (nguarded < GUARDED_MAX && (s = map(size)) != NULL) {
+		if (mprotect(s, page, PROT_NONE) == 0) {
+			nguarded++;
+			mtx_unlock(&stacks_mu);
+			return s;
+		}
+		munmap(s, size);
+	}
+
+	if (nspare == 0) {
+		char *chunk = map(size * CHUNK_STACKS);
+
+		if (chunk == NULL) {
+			mtx_unlock(&stacks_mu);
+			return NULL;
+		}
+		if (capspare < CHUNK_STACKS) {
+			capspare = capspare ? capspare * 2 : CHUNK_STACKS;
+			spare = realloc(spare, sizeof(char *) * capspare);
+		}
+		for (size_t i = 0; i < CHUNK_STACKS; i++) {
+			spare[nspare++] = chunk + i * size;
+		}
+	}
+	s = spare[--nspare];
+	*guarded = 0;
+	mtx_unlock(&stacks_mu);
+	return s;
+}
+
+// An unguarded stack keeps its addresses for the next routine and gives back
+// its memory; a guarded one is cached or unmapped.
+static void stack_free(char *s, size_t size, int guarded) {
+	if (size != ROUTINE_STACK + page) {
+		munmap(s, size);
+		return;
+	}
+
+	if (!guarded) {
+		madvise(s, size, MADV_DONTNEED);
+		mtx_lock(&stacks_mu);
+		if (nspare == capspare) {
+			capspare *= 2;
+			spare = realloc(spare, sizeof(char *) * capspare);
+		}
+		spare[nspare++] = s;
+		mtx_unlock(&stacks_mu);
+		return;
+	}
+
+	mtx_lock(&stacks_mu);
+	if (nstacks < STACK_CACHE) {
+		stacks[nstacks++] = s;
+		s = NULL;
+	} else {
+		nguarded--;
+	}
+	mtx_unlock(&stacks_mu);
+	if (s != NULL) munmap(s, size);
+}
+
+static void routine_main(void);
+
+static struct routine *routine_new(int (*fn)(void *), void *arg, size_t size) {
+	struct routine *r = calloc(1, sizeof(struct routine));
+	if (r == NULL) return NULL;
+
+	r->stack_size = size + page;
+	if ((r->stack = stack_new(r->stack_size, &r->guarded)) == NULL) {
+		free(r);
+		return NULL;
+	}
+	r->fn = fn;
+	r->arg = arg;
+	r->state = routine_runnable;
+
+	getcontext(&r->ctx);
+	r->ctx.uc_stack.ss_sp = r->stack + page;
+	r->ctx.uc_stack.ss_size = size;
+	r->ctx.uc_link = NULL;
+	makecontext(&r->ctx, routine_main, 0);
+
+	__atomic_add_fetch(&nroutines, 1, __ATOMIC_RELAXED);
+	return r;
+}
+
+static void routine_free(struct routine *r) {
+	stack_free(r->stack, r->stack_size, r->guarded);
+	free(r);
+	__atomic_sub_fetch(&nroutines, 1, __ATOMIC_RELAXED);
+}
+
+// The queue of a proc. Its worker pushes and pops, the others steal, and all
+// of them lock it: a queue is only ever touched for a moment, and rarely by
+// more than one at a time.
+static int local_put(struct proc *p, struct routine *r) {
+	int ok = 0;
+
+	mtx_lock(&p->mu);
+	if (p->len < LOCAL_QUEUE) {
+		p->queue[(p->head + p->len) % LOCAL_QUEUE] = r;
+		__atomic_store_n(&p->len, p->len + 1, __ATOMIC_SEQ_CST);
+		ok = 1;
+	}
+	mtx_unlock(&p->mu);
+	return ok;
+}
+
+static struct routine *local_get(struct proc *p) {
+	struct routine *r = NULL;
+
+	if (__atomic_load_n(&p->len, __ATOMIC_RELAXED) == 0) return NULL;
+	mtx_lock(&p->mu);
+	if (p->len > 0) {
+		r = p->queue[p->head];
+		p->head = (p->head + 1) % LOCAL_QUEUE;
+		__atomic_store_n(&p->len, p->len - 1, __ATOMIC_SEQ_CST);
+	}
+	mtx_unlock(&p->mu);
+	return r;
+}
+
+// Moves half of what victim has queued to p, and returns one of them.
+static struct routine *local_steal(struct proc *p, struct proc *victim) {
+	struct routine *batch[LOCAL_QUEUE / 2];
+	uint32_t n = 0;
+
+	if (__atomic_load_n(&victim->len, __ATOMIC_RELAXED) == 0) return NULL;
+	mtx_lock(&victim->mu);
+	n = victim->len - victim->len / 2;
+	if (n > LOCAL_QUEUE / 2) n = LOCAL_QUEUE / 2;
+	for (uint32_t i = 0; i < n; i++) {
+		batch[i] = victim->queue[victim->head];
+		victim->head = (victim->head + 1) % LOCAL_QUEUE;
+	}
+	__atomic_store_n(&victim->len, victim->len - n, __ATOMIC_SEQ_CST);
+	mtx_unlock(&victim->mu);
+
+	if (n == 0) return NULL;
+	// p is the proc of the thief, whose queue is empty: it was looking for work.
+	for (uint32_t i = 1; i < n; i++) {
+		local_put(p, batch[i]);
+	}
+	return batch[0];
+}
+
+// Called with mu held.
+static void global_put_locked(struct routine *r) {
+	r->next = NULL;
+	if (runq_tail != NULL) {
+		runq_tail->next = r;
+	} else {
+		runq_head = r;
+	}
+	runq_tail = r;
+	__atomic_store_n(&runq_len, runq_len + 1, __ATOMIC_SEQ_CST);
+}
+
+// Takes a routine off the global queue, and its share of the others for p, as
+// many as there is room for. Only the worker of p ever makes its queue longer,
+// and it is the one here, so the room can only grow meanwhile. Called with mu
+// held.
+static struct routine *global_get_locked(struct proc *p) {
+	if (runq_head == NULL) return NULL;
+
+	uint32_t room = LOCAL_QUEUE - __atomic_load_n(&p->len, __ATOMIC_SEQ_CST);
+	uint32_t n = runq_len / nprocs + 1;
+	if (n > runq_len) n = runq_len;
+	if (n > LOCAL_QUEUE / 2) n = LOCAL_QUEUE / 2;
+	if (n > room + 1) n = room + 1;
+
+	struct routine *r = runq_head;
+	runq_head = r->next;
+	for (uint32_t i = 1; i < n; i++) {
+		struct routine *q = runq_head;
+
+		runq_head = q->next;
+		local_put(p, q);
+	}
+	if (runq_head == NULL) runq_tail = NULL;
+	__atomic_store_n(&runq_len, runq_len - n, __ATOMIC_SEQ_CST);
+	return r;
+}
+
+static struct routine *global_get(struct proc *p) {
+	if (__atomic_load_n(&runq_len, __ATOMIC_RELAXED) == 0) return NULL;
+
+	mtx_lock(&mu);
+	struct routine *r = global_get_locked(p);
+	mtx_unlock(&mu);
+	return r;
+}
+
+// Whether any routine waits to run, in any queue.
+static int work_anywhere(void) {
+	if (__atomic_load_n(&runq_len, __ATOMIC_SEQ_CST) > 0) return 1;
+	for (int i = 0; i < nprocs; i++) {
+		if (__atomic_load_n(&procs[i].len, __ATOMIC_SEQ_CST) > 0) return 1;
+	}
+	return 0;
+}
+
+// Called with mu held. Taking a proc is what wakes sysmon up, which sleeps
+// for as long as all of them are idle.
+static struct proc *proc_take_locked(void) {
+	struct proc *p = idle_procs;
+
+	if (p == NULL) return NULL;
+	idle_procs = p->next_idle;
+	__atomic_store_n(&nidle, nidle - 1, __ATOMIC_SEQ_CST);
+	__atomic_store_n(&p->status, proc_running, __ATOMIC_SEQ_CST);
+	p->seen_sched = p->schedtick;
+	p->sched_since = mono_ms();
+	if (sysmon_asleep) cnd_signal(&sysmon_cnd);
+	return p;
+}
+
+// Called with mu held. The workers back from a blocking call come first.
+static void proc_put_locked(struct proc *p) {
+	__atomic_store_n(&p->status, proc_idle, __ATOMIC_SEQ_CST);
+	__atomic_store_n(&p->preempt, 0, __ATOMIC_RELAXED);
+	p->next_idle = idle_procs;
+	idle_procs = p;
+	__atomic_store_n(&nidle, nidle + 1, __ATOMIC_SEQ_CST);
+	if (nwaiting > 0) cnd_signal(&waiting_cnd);
+}
+
+static int worker_main(void *arg);
+static int sysmon(void *arg);
+
+// Hands p to a worker, an idle one or a new one, that looks for work with it.
+// Called with mu held.
+static void start_worker_locked(struct proc *p) {
+	struct worker *w = idle_workers;
+
+	if (!sysmon_started) {
+		thrd_t thread;
+
+		if (thrd_create(&thread, sysmon, NULL) == thrd_success) {
+			thrd_detach(thread);
+			sysmon_started = 1;
+		}
+	}
+
+	if (w != NULL) {
+		idle_workers = w->next_idle;
+	} else {
+		thrd_t thread;
+
+		w = calloc(1, sizeof(struct worker));
+		cnd_init(&w->cnd);
+		if (thrd_create(&thread, worker_main, w) != thrd_success) {
+			// The routines wait for the workers there are.
+			cnd_destroy(&w->cnd);
+			free(w);
+			proc_put_locked(p);
+			return;
+		}
+		thrd_detach(thread);
+	}
+	w->spinning = 1;
+	__atomic_store_n(&nspinning, nspinning + 1, __ATOMIC_SEQ_CST);
+	w->nextp = p;
+	cnd_signal(&w->cnd);
+}
+
+// Gets a worker going when a routine was just made ready and nobody may be
+// looking for it: there is an idle proc and no worker already looking. The
+// queue was written before, and the workers that give up check the queues
+// again after saying they are idle, so one side always sees the other.
+static void wakeup(void) {
+	__atomic_thread_fence(__ATOMIC_SEQ_CST);
+	if (__atomic_load_n(&nidle, __ATOMIC_SEQ_CST) == 0) return;
+	if (__atomic_load_n(&nspinning, __ATOMIC_SEQ_CST) > 0) return;
+
+	mtx_lock(&mu);
+	if (nspinning == 0 && nwaiting == 0 && idle_procs != NULL) {
+		start_worker_locked(proc_take_locked());
+	}
+	mtx_unlock(&mu);
+}
+
+// Queues a routine that is ready to run: on the proc of this thread if it has
+// one and there is room, on the global queue otherwise.
+static void runq_put(struct routine *r) {
+	struct worker *w = this_worker();
+
+	__atomic_store_n(&r->state, routine_runnable, __ATOMIC_SEQ_CST);
+	if (w == NULL || w->p == NULL || !local_put(w->p, r)) {
+		mtx_lock(&mu);
+		global_put_locked(r);
+		mtx_unlock(&mu);
+	}
+	wakeup();
+}
+
+static void stop_spinning(struct worker *w) {
+	if (!w->spinning) return;
+	w->spinning = 0;
+	// The last one looking found something: there may be more, and nobody
+	// looking for it.
+	if (__atomic_sub_fetch(&nspinning, 1, __ATOMIC_SEQ_CST) == 0) wakeup();
+}
+
+// Sleeps until handed a proc.
+static void worker_sleep(struct worker *w) {
+	mtx_lock(&mu);
+	if (w->nextp == NULL) {
+		w->next_idle = idle_workers;
+		idle_workers = w;
+		while (w->nextp == NULL) {
+			cnd_wait(&w->cnd, &mu);
+		}
+	}
+	w->p = w->nextp;
+	w->nextp = NULL;
+	mtx_unlock(&mu);
+}
+
+// The next routine for w to run, sleeping until there is one. Every 61 turns
+// the global queue comes first, or routines that two of them keep waking each
+// other up on a proc would keep it to themselves.
+static struct routine *find_runnable(struct worker *w) {
+	for (;;) {
+		if (w->p == NULL) worker_sleep(w);
+
+		struct proc *p = w->p;
+		struct routine *r = NULL;
+
+		if (p->schedtick % 61 == 0) r = global_get(p);
+		if (r == NULL) r = local_get(p);
+		if (r == NULL) r = global_get(p);
+		for (int i = 0, start = rand() % nprocs; r == NULL && i < nprocs; i++) {
+			struct proc *victim = &procs[(start + i) % nprocs];
+			if (victim != p) r = local_steal(p, victim);
+		}
+		if (r != NULL) {
+			stop_spinning(w);
+			return r;
+		}
+
+		// Nothing anywhere: the proc goes back, unless something came in the
+		// global queue meanwhile.
+		mtx_lock(&mu);
+		if ((r = global_get_locked(p)) != NULL) {
+			mtx_unlock(&mu);
+			stop_spinning(w);
+			return r;
+		}
+		if (w->spinning) {
+			w->spinning = 0;
+			__atomic_store_n(&nspinning, nspinning - 1, __ATOMIC_SEQ_CST);
+		}
+		proc_put_locked(p);
+		w->p = NULL;
+		mtx_unlock(&mu);
+
+		// A routine made ready between the looking and the giving back may
+		// have seen no idle proc and woken nobody: look once more, now that
+		// the proc is idle for everybody to see.
+		__atomic_thread_fence(__ATOMIC_SEQ_CST);
+		if (work_anywhere()) {
+			mtx_lock(&mu);
+			if (nwaiting == 0 && idle_procs != NULL) {
+				w->p = proc_take_locked();
+				w->spinning = 1;
+				__atomic_store_n(&nspinning, nspinning + 1, __ATOMIC_SEQ_CST);
+			}
+			mtx_unlock(&mu);
+		}
+	}
+}
+
+// Switches to r until it leaves, then does what it left for.
+static void run(struct worker *w, struct routine *r) {
+	w->cur = r;
+	w->p->schedtick++;
+	__atomic_store_n(&r->state, routine_running, __ATOMIC_SEQ_CST);
+	gc_swap_self(r->gc_self);
+	errno = r->err;
+
+	swapcontext(&w->ctx, &r->ctx);
+
+	r->err = errno;
+	r->gc_self = gc_swap_self(NULL);
+	w->cur = NULL;
+
+	switch (r->after) {
+	case after_park: {
+		int s = routine_parking;
+		if (!__atomic_compare_exchange_n(&r->state, &s, routine_parked, 0, __ATOMIC_SEQ_CST, __ATOMIC_SEQ_CST)) {
+			// Woken while it was on its way here.
+			runq_put(r);
+		}
+		break;
+	}
+
+	case after_requeue:
+		__atomic_store_n(&r->state, routine_runnable, __ATOMIC_SEQ_CST);
+		mtx_lock(&mu);
+		global_put_locked(r);
+		mtx_unlock(&mu);
+		wakeup();
+		break;
+
+	case after_exit: {
+		struct done *d = r->done;
+		int ret = r->ret;
+
+		routine_free(r);
+		if (d != NULL) {
+			mtx_lock(&d->mu);
+			d->ret = ret;
+			d->finished = 1;
+			cnd_signal(&d->cnd);
+			mtx_unlock(&d->mu);
+		}
+		break;
+	}
+	}
+}
+
+static int worker_main(void *arg) {
+	struct worker *w = arg;
+	current = w;
+
+	for (;;) {
+		run(w, find_runnable(w));
+
+		// A worker back from a blocking call already has a routine in hand,
+		// and gets the proc before the next one here is started.
+		if (__atomic_load_n(&nwaiting, __ATOMIC_SEQ_CST) > 0) {
+			mtx_lock(&mu);
+			if (nwaiting > 0) {
+				if (w->spinning) {
+					w->spinning = 0;
+					__atomic_store_n(&nspinning, nspinning - 1, __ATOMIC_SEQ_CST);
+				}
+				proc_put_locked(w->p);
+				w->p = NULL;
+			}
+			mtx_unlock(&mu);
+		}
+	}
+	return 0;
+}
+
+// Leaves the worker of the routine running here for it to do what after
+// says. Nothing that was read before from a thread local is any good after
+// this returns, see this_worker.
+static void switch_out(enum routine_after after) {
+	struct worker *w = this_worker();
+	struct routine *r = w->cur;
+
+	r->after = after;
+	swapcontext(&r->ctx, &w->ctx);
+}
+
+static void routine_main(void) {
+	struct routine *r = this_worker()->cur;
+
+	r->ret = r->fn(r->arg);
+	switch_out(after_exit);
+}
+
+// Watches the procs, see the top of the file. It sleeps for as long as every
+// proc is idle, and it is the proc taken first that wakes it up.
+static int sysmon(void *arg) {
+	(void) arg;
+
+	mtx_lock(&mu);
+	for (;;) {
+		if (nidle == nprocs) {
+			sysmon_asleep = 1;
+			cnd_wait(&sysmon_cnd, &mu);
+			sysmon_asleep = 0;
+			continue;
+		}
+
+		struct timespec deadline;
+		timespec_get(&deadline, TIME_UTC);
+		deadline.tv_nsec += SYSMON_TICK * 1000000;
+		if (deadline.tv_nsec >= 1000000000) {
+			deadline.tv_sec++;
+			deadline.tv_nsec -= 1000000000;
+		}
+		cnd_timedwait(&sysmon_cnd, &mu, &deadline);
+
+		int64_t now = mono_ms();
+		int wanted = nwaiting > 0 || work_anywhere();
+		int preempting = 0;
+
+		for (int i = 0; i < nprocs; i++) {
+			struct proc *p = &procs[i];
+			int status = __atomic_load_n(&p->status, __ATOMIC_SEQ_CST);
+
+			if (status == proc_blocked) {
+				uint32_t tick = __atomic_load_n(&p->blocktick, __ATOMIC_RELAXED);
+				int s = proc_blocked;
+
+				if (tick != p->seen_block) {
+					p->seen_block = tick;
+					p->block_since = now;
+				} else if (wanted && now - p->block_since >= SYSMON_TICK &&
+					__atomic_compare_exchange_n(&p->status, &s, proc_idle, 0, __ATOMIC_SEQ_CST, __ATOMIC_SEQ_CST)) {
+					// Its worker finds it gone when it comes back.
+					proc_put_locked(p);
+					if (nwaiting == 0 && nspinning == 0 && work_anywhere()) {
+						start_worker_locked(proc_take_locked());
+					}
+				}
+			} else if (status == proc_running) {
+				uint32_t tick = __atomic_load_n(&p->schedtick, __ATOMIC_RELAXED);
+
+				if (tick != p->seen_sched) {
+					p->seen_sched = tick;
+					p->sched_since = now;
+				} else if (wanted && now - p->sched_since >= TIME_SLICE) {
+					__atomic_store_n(&p->preempt, 1, __ATOMIC_RELAXED);
+				}
+			}
+			preempting |= __atomic_load_n(&p->preempt, __ATOMIC_RELAXED);
+		}
+		if (preempting) {
+			gc_want(GC_YIELD);
+		} else {
+			gc_unwant(GC_YIELD);
+		}
+	}
+	return 0;
+}
+
+int sched_go(int (*fn)(void *), void *arg) {
+	struct routine *r = routine_new(fn, arg, ROUTINE_STACK);
+
+	if (r == NULL) return -1;
+	runq_put(r);
+	return 0;
+}
+
+// Runs fn as a routine with the stack of a program, and waits for it on this
+// thread, which is not a worker: the thread of the Go side that runs the
+// program, or of a C program that embeds the runtime.
+int sched_main(int (*fn)(void *), void *arg) {
+	struct done d = {.finished = 0};
+	struct routine *r = routine_new(fn, arg, MAIN_STACK);
+
+	if (r == NULL) {
+		fputs("fatal error: out of memory starting the program\n", stderr);
+		return 1;
+	}
+	mtx_init(&d.mu, mtx_plain);
+	cnd_init(&d.cnd);
+	r->done = &d;
+	runq_put(r);
+
+	mtx_lock(&d.mu);
+	while (!d.finished) {
+		cnd_wait(&d.cnd, &d.mu);
+	}
+	mtx_unlock(&d.mu);
+	mtx_destroy(&d.mu);
+	cnd_destroy(&d.cnd);
+	return d.ret;
+}
+
+// Whether this thread runs a routine.
+int sched_inside(void) {
+	struct worker *w = this_worker();
+	return w != NULL && w->cur != NULL;
+}
+
+// How much C stack the routine running here has. A thread that runs none is
+// said to have what a routine gets, which is as much as can be counted on.
+size_t sched_stack_size(void) {
+	struct worker *w = this_worker();
+
+	if (w == NULL || w->cur == NULL) return ROUTINE_STACK;
+	return w->cur->stack_size;
+}
+
+// The routine running here, for it to park, NULL for a thread that runs none
+// and for a routine that can't leave its thread, see sched_pin: those block
+// the thread instead.
+void *sched_current(void) {
+	struct worker *w = this_worker();
+
+	if (w == NULL || w->cur == NULL || w->cur->pinned) return NULL;
+	return w->cur;
+}
+
+// Parks the routine running here, letting go of mu once it is sure to be
+// woken: whoever wakes it up takes mu to find it, and finding it it may wake
+// it up before it is off its worker, which run takes care of. Somebody that
+// wakes it up without mu, a deadline, may even come before this: then there is
+// nothing to park for.
+void sched_park(mtx_t *m) {
+	struct worker *w = this_worker();
+	int s = routine_running;
+
+	if (!__atomic_compare_exchange_n(&w->cur->state, &s, routine_parking, 0, __ATOMIC_SEQ_CST, __ATOMIC_SEQ_CST)) {
+		__atomic_store_n(&w->cur->state, routine_running, __ATOMIC_SEQ_CST);
+		mtx_unlock(m);
+		return;
+	}
+	mtx_unlock(m);
+	switch_out(after_park);
+}
+
+// Makes a routine parked with sched_park ready to run again.
+void sched_ready(void *arg) {
+	struct routine *r = arg;
+
+	for (;;) {
+		int s = __atomic_load_n(&r->state, __ATOMIC_SEQ_CST);
+
+		if (s == routine_parked) {
+			if (__atomic_compare_exchange_n(&r->state, &s, routine_runnable, 0, __ATOMIC_SEQ_CST, __ATOMIC_SEQ_CST)) {
+				runq_put(r);
+				return;
+			}
+		} else if (s == routine_parking || s == routine_running) {
+			if (__atomic_compare_exchange_n(&r->state, &s, routine_woken, 0, __ATOMIC_SEQ_CST, __ATOMIC_SEQ_CST)) {
+				return;
+			}
+		} else {
+			return;
+		}
+	}
+}
+
+// Before a call that blocks the thread: the proc is up for grabs until
+// sched_unblock. Returns whether there was one to give, which is whether
+// sched_unblock has anything to do.
+int sched_block(void) {
+	struct worker *w = this_worker();
+
+	if (w == NULL || w->cur == NULL || w->blocked) return 0;
+	w->blocked = 1;
+	__atomic_add_fetch(&w->p->blocktick, 1, __ATOMIC_RELAXED);
+	__atomic_store_n(&w->p->status, proc_blocked, __ATOMIC_SEQ_CST);
+	return 1;
+}
+
+// After the call: the proc comes back if sysmon left it, or the thread waits
+// for one to be idle, in the middle of its routine.
+void sched_unblock(void) {
+	struct worker *w = this_worker();
+	int s = proc_blocked;
+
+	if (w == NULL || !w->blocked) return;
+	w->blocked = 0;
+	if (__atomic_compare_exchange_n(&w->p->status, &s, proc_running, 0, __ATOMIC_SEQ_CST, __ATOMIC_SEQ_CST)) {
+		return;
+	}
+
+	mtx_lock(&mu);
+	nwaiting++;
+	while (idle_procs == NULL) {
+		cnd_wait(&waiting_cnd, &mu);
+	}
+	nwaiting--;
+	w->p = proc_take_locked();
+	mtx_unlock(&mu);
+}
+
+// A routine calling back into Go stays on this thread until it returns, see
+// the top of the file. Calls nest, and so do pins.
+void sched_pin(void) {
+	struct worker *w = this_worker();
+	if (w != NULL && w->cur != NULL) w->cur->pinned++;
+}
+
+void sched_unpin(void) {
+	struct worker *w = this_worker();
+	if (w != NULL && w->cur != NULL) w->cur->pinned--;
+}
+
+// Whether sysmon asked the routine running here to make room, which it
+// doesn't ask twice.
+int sched_preempted(void) {
+	struct worker *w = this_worker();
+
+	if (w == NULL || w->cur == NULL || w->p == NULL || w->cur->pinned) return 0;
+	return __atomic_exchange_n(&w->p->preempt, 0, __ATOMIC_RELAXED);
+}
+
+// Puts the routine running here at the back of the global queue.
+void sched_requeue(void) {
+	switch_out(after_requeue);
+}
+
+int sched_runnable(void) {
+	return work_anywhere();
+}
+
+#endif
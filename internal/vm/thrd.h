@@ -5,6 +5,8 @@
 #elif __has_include(<pthread.h>)
 	#include <pthread.h>
 	#include <stdlib.h>
+	#include <errno.h>
+	#include <time.h>
 
 	// The function to run and its argument, handed to the new thread. It has
 	// to outlive the call to pthread_create: the thread may well start after
@@ -47,10 +49,14 @@
 	#define cnd_broadcast pthread_cond_broadcast
 	#define cnd_signal pthread_cond_signal
 	#define cnd_wait pthread_cond_wait
+	#define cnd_timedwait pthread_cond_timedwait
 	#define cnd_destroy pthread_cond_destroy
+	#define thrd_timedout ETIMEDOUT
 #elif defined(_WIN32) || defined(WIN32)
 	#include <windows.h>
 	#include <process.h>
+	#include <stdint.h>
+	#include <time.h>
 
 	// Thread
 	#define thrd_t HANDLE
@@ -73,6 +79,23 @@
 	#define cnd_signal WakeConditionVariable
 	#define cnd_wait(cond, mtx) while (!SleepConditionVariableCS(cond, mtx, INFINITE)) {}
 	#define cnd_destroy(cnd)
+	#define thrd_timedout 2
+
+	// The deadline is absolute, like for the other two, and Windows wants
+	// the milliseconds left until then.
+	static inline int cnd_timedwait(cnd_t *cond, mtx_t *mtx, const struct timespec *ts) {
+		struct timespec now;
+		timespec_get(&now, TIME_UTC);
+
+		int64_t ms = (ts->tv_sec - now.tv_sec) * 1000 + (ts->tv_nsec - now.tv_nsec) / 1000000;
+		if (ms <= 0) {
+			return thrd_timedout;
+		}
+		if (!SleepConditionVariableCS(cond, mtx, (DWORD) ms)) {
+			return GetLastError() == ERROR_TIMEOUT ? thrd_timedout : 0;
+		}
+		return 0;
+	}
 #else
 	#error "unsupported threading library"
 #endif
@@ -0,0 +1,286 @@
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+
+#include "vm.h"
+#include "thrd.h"
+
+/*
+ * Timers: a value sent on a pipe when the time comes, and again every period
+ * after that for a ticker, or a call for the waits with a deadline. All of
+ * them are kept in one heap, the first to go off on top, and served by one
+ * thread, started with the first timer.
+ *
+ * The thread sends on pipes while the routines run, so the collector knows
+ * about it and stops it like a VM, and it sleeps parked. A timer still to go
+ * off is going to send, and a routine waiting for it is not stuck: the thread
+ * sleeps on a wait that is ready for as long as there are timers, and with
+ * none it is one more sleeper, which leaves a deadlock to be told.
+ *
+ * The heap is only changed with mu held and by a thread that isn't parked,
+ * so the collector reads it with no lock at all: whoever could be changing it
+ * is somebody it waits for. That is also why nobody waits for the collector,
+ * in gc_unpark, with mu held: a routine waiting for mu would never park.
+ *
+ * ponytail: the thread sleeps until a deadline on the wall clock, worked out
+ * afresh from the monotonic one every time it wakes up. A wall clock set back
+ * makes the timers due meanwhile late by as much.
+ */
+
+struct timer {
+	int64_t id;
+	int64_t when;    // Monotonic, in milliseconds.
+	int64_t period;  // 0 for a timer that goes off once.
+	// The pipe and what goes on it: the time for the timers of the time
+	// module, which leave a full pipe as it is, or a value of its own, which
+	// waits for room.
+	struct object pipe;
+	struct object val;
+	int has_val;
+	// Or what to call, see timer_call.
+	void (*fn)(void *);
+	void *arg;
+};
+
+static mtx_t mu;
+static cnd_t cnd;
+static struct timer *heap = NULL;
+static size_t len = 0;
+static size_t cap = 0;
+static int64_t next_id = 1;
+static int started = 0;
+
+// The timers popped off the heap and not yet sent, which nobody else may be
+// holding on to: the collector marks them here.
+static struct timer *firing = NULL;
+static size_t nfiring = 0;
+static size_t capfiring = 0;
+
+int64_t timer_now(void) {
+	struct timespec ts;
+#if defined(CLOCK_MONOTONIC)
+	clock_gettime(CLOCK_MONOTONIC, &ts);
+#else
+	timespec_get(&ts, TIME_UTC);
+#endif
+	return (int64_t) ts.tv_sec * 1000 + ts.tv_nsec / 1000000;
+}
+
+static void swap(size_t i, size_t j) {
+	struct timer t = heap[i];
+	heap[i] = heap[j];
+	heap[j] = t;
+}
+
+static void sift_up(size_t i) {
+	while (i > 0 && heap[(i - 1) / 2].when > heap[i].when) {
+		swap(i, (i - 1) / 2);
+		i = (i - 1) / 2;
+	}
+}
+
+static void sift_down(size_t i) {
+	for (;;) {
+		size_t min = i;
+		size_t l = 2 * i + 1;
+		size_t r = 2 * i + 2;
+
+		if (l < len && heap[l].when < heap[min].when) min = l;
+		if (r < len && heap[r].when < heap[min].when) min = r;
+		if (min == i) return;
+		swap(i, min);
+		i = min;
+	}
+}
+
+static void push(struct timer t) {
+	if (len == cap) {
+		cap = cap ? cap * 2 : 16;
+		heap = realloc(heap, sizeof(struct timer) * cap);
+	}
+	heap[len] = t;
+	sift_up(len++);
+}
+
+static void remove_at(size_t i) {
+	heap[i] = heap[--len];
+	if (i < len) {
+		sift_down(i);
+		sift_up(i);
+	}
+}
+
+// What the thread sleeps on, for the collector to tell a deadlock with: a
+// timer still to go off will wake it up.
+static int pending(struct pipe_wait *w) {
+	(void) w;
+	return __atomic_load_n(&len, __ATOMIC_ACQUIRE) > 0;
+}
+
+// Sends what a timer has to send. The time goes on a pipe with room for it
+// or nowhere, the way Go drops the ticks a slow receiver misses; a value of
+// its own waits for room.
+static void deliver(struct timer *t, int64_t now) {
+	if (t->has_val) {
+		pipe_send(t->pipe, t->val);
+		return;
+	}
+
+	struct select_case c = {.pipe = t->pipe, .kind = select_send, .val = new_integer_obj(now)};
+	pipe_select(&c, 1, 0);
+}
+
+// Takes the timers that are due off the heap, puts the tickers back for the
+// next tick, and sends for all of them. Called with mu held, which is let go
+// of while sending: a send may wait, for room or for the mutex of its pipe,
+// and parks meanwhile. The calls are made right away with mu held, which is
+// what timer_stop waits for: once it returns the call is over or never
+// happens, and what it was given can go.
+static void fire(int64_t now) {
+	nfiring = 0;
+	while (len > 0 && heap[0].when <= now) {
+		if (heap[0].fn != NULL) {
+			struct timer t = heap[0];
+
+			remove_at(0);
+			t.fn(t.arg);
+			continue;
+		}
+		if (nfiring == capfiring) {
+			capfiring = capfiring ? capfiring * 2 : 16;
+			firing = realloc(firing, sizeof(struct timer) * capfiring);
+		}
+		firing[nfiring++] = heap[0];
+
+		if (heap[0].period > 0) {
+			// A ticker that fell behind skips the ticks it missed rather
+			// than sending them all at once.
+			int64_t late = now - heap[0].when;
+			heap[0].when += heap[0].period * (1 + late / heap[0].period);
+			sift_down(0);
+		} else {
+			remove_at(0);
+		}
+	}
+	mtx_unlock(&mu);
+
+	for (size_t i = 0; i < nfiring; i++) {
+		deliver(&firing[i], now);
+	}
+
+	mtx_lock(&mu);
+	nfiring = 0;
+}
+
+static int timers_loop(void *node) {
+	// The node made for this thread by timer_start, its own from now on.
+	gc_restore(node);
+
+	struct pipe_wait idle = {.why = wait_send, .ready = pending};
+	mtx_lock(&mu);
+	for (;;) {
+		int64_t now = timer_now();
+		if (len > 0 && heap[0].when <= now) {
+			fire(now);
+			continue;
+		}
+
+		// Parked with mu held, which nobody changes the heap without, and
+		// unparked without it, see above.
+		gc_park_wait(&idle);
+		if (len == 0) {
+			cnd_wait(&cnd, &mu);
+		} else {
+			int64_t left = heap[0].when - now;
+			struct timespec deadline;
+
+			timespec_get(&deadline, TIME_UTC);
+			deadline.tv_sec += left / 1000;
+			deadline.tv_nsec += (left % 1000) * 1000000;
+			if (deadline.tv_nsec >= 1000000000) {
+				deadline.tv_sec++;
+				deadline.tv_nsec -= 1000000000;
+			}
+			cnd_timedwait(&cnd, &mu, &deadline);
+		}
+		mtx_unlock(&mu);
+		gc_unpark();
+		mtx_lock(&mu);
+	}
+	return 0;
+}
+
+void timers_init(void) {
+	mtx_init(&mu, mtx_plain);
+	cnd_init(&cnd);
+}
+
+void timers_mark(void) {
+	for (size_t i = 0; i < len; i++) {
+		mark_obj(heap[i].pipe);
+		mark_obj(heap[i].val);
+	}
+	for (size_t i = 0; i < nfiring; i++) {
+		mark_obj(firing[i].pipe);
+		mark_obj(firing[i].val);
+	}
+}
+
+// Puts a timer on the heap, starting the thread with the first one, and
+// returns its id, -1 if there is no thread for it.
+static int64_t add(struct timer t) {
+	mtx_lock(&mu);
+	if (!started) {
+		thrd_t thread;
+		void *node = gc_register_thread();
+
+		if (thrd_create(&thread, timers_loop, node) != thrd_success) {
+			mtx_unlock(&mu);
+			return -1;
+		}
+		thrd_detach(thread);
+		started = 1;
+	}
+	t.id = next_id++;
+	push(t);
+	// Only a timer that goes off before the others changes how long the
+	// thread sleeps.
+	if (heap[0].id == t.id) cnd_signal(&cnd);
+	mtx_unlock(&mu);
+	return t.id;
+}
+
+int64_t timer_start(struct object pipe, int64_t ms, int64_t period, struct object *val) {
+	return add((struct timer) {
+		.when = timer_now() + (ms > 0 ? ms : 0),
+		.period = period > 0 ? period : 0,
+		.pipe = pipe,
+		.val = val != NULL ? *val : null_obj,
+		.has_val = val != NULL,
+	});
+}
+
+int64_t timer_call(int64_t when, void (*fn)(void *), void *arg) {
+	return add((struct timer) {
+		.when = when,
+		.pipe = null_obj,
+		.val = null_obj,
+		.fn = fn,
+		.arg = arg,
+	});
+}
+
+int timer_stop(int64_t id) {
+	int found = 0;
+
+	mtx_lock(&mu);
+	for (size_t i = 0; i < len; i++) {
+		if (heap[i].id == id) {
+			remove_at(i);
+			found = 1;
+			break;
+		}
+	}
+	mtx_unlock(&mu);
+	return found;
+}
@@ -0,0 +1,216 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+
+#include "vm.h"
+#include "trace.h"
+#include "thrd.h"
+
+/*
+ * The execution tracer of `tau run -trace`: what the routines and the pipes
+ * did and when, as a stream of records that internal/trace reads back. A
+ * record is written where it happens, by the thread it happens on, into one
+ * buffer that trace.go takes away and writes out every so often.
+ *
+ * A record is its kind in a byte, the nanoseconds since the trace started and
+ * the routine it happened on, followed by what the kind has to say. Numbers
+ * are varints and strings a varint length followed by the bytes: the format
+ * is spelled out in internal/trace, which is the one reading it.
+ *
+ * ponytail: one buffer under one mutex, so the routines tracing at the same
+ * time queue for it. A buffer per thread would not, but a trace is meant to
+ * show where a program waits, and what it adds to that is small next to a
+ * pipe's own mutex.
+ */
+
+static int enabled = 0;
+static mtx_t mu;
+static int64_t start_ns = 0;
+static uint8_t *buf = NULL;
+static size_t len = 0;
+static size_t cap = 0;
+
+static int64_t trace_now(void) {
+	struct timespec ts;
+	timespec_get(&ts, TIME_UTC);
+	return (int64_t) ts.tv_sec * 1000000000 + ts.tv_nsec;
+}
+
+static void put_byte(uint8_t b) {
+	if (len == cap) {
+		cap = cap ? cap * 2 : 1 << 16;
+		buf = realloc(buf, cap);
+	}
+	buf[len++] = b;
+}
+
+static void put_uint(uint64_t v) {
+	while (v >= 0x80) {
+		put_byte((uint8_t) v | 0x80);
+		v >>= 7;
+	}
+	put_byte((uint8_t) v);
+}
+
+static void put_str(const char *s) {
+	if (s == NULL) s = "";
+	size_t n = strlen(s);
+
+	put_uint(n);
+	for (size_t i = 0; i < n; i++) {
+		put_byte((uint8_t) s[i]);
+	}
+}
+
+static uint32_t routine_id(void) {
+	struct vm *vm = gc_current_vm();
+	return vm != NULL ? vm->id : 0;
+}
+
+// Starts a record with the mutex held. The time is taken once the mutex is,
+// so that the records are in the order of their times.
+static int begin(enum trace_ev ev, uint32_t routine) {
+	if (!__atomic_load_n(&enabled, __ATOMIC_ACQUIRE)) return 0;
+
+	mtx_lock(&mu);
+	if (!enabled) {
+		mtx_unlock(&mu);
+		return 0;
+	}
+	put_byte(ev);
+	put_uint(trace_now() - start_ns);
+	put_uint(routine);
+	return 1;
+}
+
+static void end(void) {
+	mtx_unlock(&mu);
+}
+
+// ponytail: no lock around the first call, trace_start runs before the
+// program does.
+void trace_start(void) {
+	static int initialised = 0;
+	if (!initialised) {
+		initialised = 1;
+		mtx_init(&mu, mtx_plain);
+	}
+
+	mtx_lock(&mu);
+	start_ns = trace_now();
+	len = 0;
+	// The header: what this is, the version of the format, and when it starts.
+	for (const char *m = "tau trace\n"; *m != '\0'; m++) {
+		put_byte((uint8_t) *m);
+	}
+	put_uint(1);
+	put_uint(start_ns);
+	__atomic_store_n(&enabled, 1, __ATOMIC_RELEASE);
+	mtx_unlock(&mu);
+}
+
+void trace_stop(void) {
+	mtx_lock(&mu);
+	__atomic_store_n(&enabled, 0, __ATOMIC_RELEASE);
+	mtx_unlock(&mu);
+}
+
+// Takes what was written since the last call, which is the caller's to free.
+uint8_t *trace_take(size_t *n) {
+	mtx_lock(&mu);
+	uint8_t *out = buf;
+	*n = len;
+	buf = NULL;
+	len = cap = 0;
+	mtx_unlock(&mu);
+	return out;
+}
+
+// Written at every flush: a program that hangs writes nothing else, and the
+// trace it leaves has to say for how long it hung.
+void trace_tick(void) {
+	if (begin(trace_ev_tick, 0)) end();
+}
+
+int trace_enabled(void) {
+	return __atomic_load_n(&enabled, __ATOMIC_RELAXED);
+}
+
+// A routine is created by the one running `tau f()`, which is where it comes
+// from, and starts and ends on its own thread.
+void trace_routine(enum trace_ev ev, struct vm *vm, struct vm *parent) {
+	if (ev != trace_ev_routine_create) {
+		if (begin(ev, vm->id)) end();
+		return;
+	}
+	if (!trace_enabled()) return;
+
+	char *file;
+	int32_t line;
+	vm_where(parent, &file, &line);
+
+	// Named the way the profiles name it, after its line when it has no name.
+	struct function *fn = vm->frames[vm->frame_idx].cl.data.cl->fn;
+	char name[32];
+	if (fn->name == NULL) {
+		snprintf(name, sizeof(name), "fn@%d", fn->bklen > 0 ? fn->bookmarks[0].lineno : 0);
+	}
+
+	if (begin(ev, parent != NULL ? parent->id : 0)) {
+		put_uint(vm->id);
+		put_uint(line);
+		put_str(file);
+		put_str(fn->name != NULL ? fn->name : name);
+		end();
+	}
+}
+
+void trace_gc(enum trace_ev ev) {
+	if (begin(ev, routine_id())) end();
+}
+
+void trace_pipe_new(struct pipe *p) {
+	if (begin(trace_ev_pipe_new, routine_id())) {
+		put_uint((uintptr_t) p);
+		put_uint(p->cap);
+		put_uint(p->is_buffered);
+		put_uint(p->line);
+		put_str(p->file);
+		end();
+	}
+}
+
+static void pipe_event(enum trace_ev ev, struct pipe *p) {
+	if (begin(ev, routine_id())) {
+		put_uint((uintptr_t) p);
+		end();
+	}
+}
+
+void trace_pipe_send(struct pipe *p) {
+	pipe_event(trace_ev_pipe_send, p);
+}
+
+void trace_pipe_recv(struct pipe *p) {
+	pipe_event(trace_ev_pipe_recv, p);
+}
+
+void trace_pipe_close(struct pipe *p) {
+	pipe_event(trace_ev_pipe_close, p);
+}
+
+void trace_block(struct pipe_wait *w) {
+	if (begin(trace_ev_block, routine_id())) {
+		put_uint(w->why);
+		put_uint(w->n);
+		for (size_t i = 0; i < w->n; i++) {
+			put_uint((uintptr_t) w->pipes[i]);
+		}
+		end();
+	}
+}
+
+void trace_unblock(void) {
+	if (begin(trace_ev_unblock, routine_id())) end();
+}
@@ -0,0 +1,107 @@
+package vm
+
+/*
+#include <stdlib.h>
+#include "trace.h"
+
+void profile_on_exit(void);
+*/
+import "C"
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// How often what was traced is taken from the VMs and written out.
+const traceFlush = 100 * time.Millisecond
+
+var tracer struct {
+	sync.Mutex
+	w       io.Writer
+	err     error
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// StartTrace traces the routines and the pipes of the tau code run from now
+// on, until StopTrace, writing the trace to w as it goes: internal/trace reads
+// it. A program that calls exit writes what is left on the way out as well.
+//
+// What is traced is every routine started and ended, every pipe made, every
+// value sent and received, every wait on a pipe or a select and every
+// collection, along with the waits of the routines it stopped.
+func StartTrace(w io.Writer) error {
+	tracer.Lock()
+	defer tracer.Unlock()
+
+	if tracer.w != nil {
+		return errors.New("tracing already in use")
+	}
+	tracer.w = w
+	tracer.err = nil
+	tracer.done = make(chan struct{})
+	tracer.stopped = make(chan struct{})
+
+	C.profile_on_exit()
+	C.trace_start()
+	go traceLoop(tracer.done, tracer.stopped)
+	return nil
+}
+
+// StopTrace stops tracing and writes what is left of the trace.
+func StopTrace() error {
+	tracer.Lock()
+	if tracer.w == nil {
+		tracer.Unlock()
+		return nil
+	}
+	C.trace_tick()
+	C.trace_stop()
+	close(tracer.done)
+	stopped := tracer.stopped
+	tracer.Unlock()
+	<-stopped
+
+	tracer.Lock()
+	defer tracer.Unlock()
+	flushTrace()
+	tracer.w = nil
+	return tracer.err
+}
+
+func traceLoop(done, stopped chan struct{}) {
+	defer close(stopped)
+	t := time.NewTicker(traceFlush)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		C.trace_tick()
+		tracer.Lock()
+		flushTrace()
+		tracer.Unlock()
+	}
+}
+
+// flushTrace writes what was traced since the last time. It is called with
+// the tracer locked; once writing failed what comes next is dropped, a trace
+// with a hole in the middle reads as nonsense.
+func flushTrace() {
+	var n C.size_t
+	buf := C.trace_take(&n)
+	if buf == nil {
+		return
+	}
+	defer C.free(unsafe.Pointer(buf))
+
+	if tracer.err == nil {
+		_, tracer.err = tracer.w.Write(C.GoBytes(unsafe.Pointer(buf), C.int(n)))
+	}
+}
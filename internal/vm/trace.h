@@ -0,0 +1,34 @@
+#pragma once
+
+#include <stdint.h>
+#include <stddef.h>
+#include "vm.h"
+
+// The kinds of the records of a trace. The values are written to the file,
+// see internal/trace for the format: only ever add at the end.
+enum trace_ev {
+	trace_ev_routine_create = 1,
+	trace_ev_routine_start,
+	trace_ev_routine_end,
+	trace_ev_pipe_new,
+	trace_ev_pipe_send,
+	trace_ev_pipe_recv,
+	trace_ev_pipe_close,
+	trace_ev_block,
+	trace_ev_unblock,
+	trace_ev_gc_start,
+	trace_ev_gc_end,
+	trace_ev_park,
+	trace_ev_unpark,
+	trace_ev_tick
+};
+
+void trace_start(void);
+void trace_stop(void);
+uint8_t *trace_take(size_t *len);
+void trace_tick(void);
+
+// What the VM and the collector tell the tracer. The pipes tell it the rest
+// through the hooks in object.h.
+void trace_routine(enum trace_ev ev, struct vm *vm, struct vm *parent);
+void trace_gc(enum trace_ev ev);
@@ -8,6 +8,7 @@
 #include "vm.h"
 #include "opcode.h"
 #include "thrd.h"
+#include "trace.h"
 #ifdef TAU_RT
 	// A runtime built to run one bundled program has no Go in it: the loader
 	// of a module that came with the program is written in C, next to the
@@ -39,9 +40,9 @@
 #endif
 
 #ifndef DEBUG
-	#define DISPATCH() goto *jump_table[*frame->ip++]
+	#define DISPATCH() goto *dispatch[*frame->ip++]
 #else
-	#define DISPATCH() puts(opcode_str(*frame->ip)); goto *jump_table[*frame->ip++]
+	#define DISPATCH() puts(opcode_str(*frame->ip)); goto *dispatch[*frame->ip++]
 #endif
 
 #define ASSERT(obj, t) ((obj)->type == t)
@@ -84,9 +85,95 @@ inline void state_dispose(struct state s) {
 	modtab_dispose(s.mods);
 }
 
+// The most a routine may use of the stack and the frames together, in bytes.
+static uint64_t max_stack;
+
+// max_stack_init reads the limit from TAUMAXSTACK, a number of bytes with K, M
+// or G after it if wanted, the way GOMAXPROCS-like variables are given. One
+// that doesn't read as that is ignored: a program that can't start because of
+// a typo in the environment is worse off than one that gets the default.
+static void max_stack_init(void) {
+	if (max_stack != 0) return;
+	max_stack = MAX_STACK;
+
+	char *s = getenv("TAUMAXSTACK");
+	if (s == NULL || *s == '\0') return;
+
+	char *end;
+	uint64_t n = strtoull(s, &end, 10);
+	switch (*end) {
+	case 'K': case 'k': n <<= 10; end++; break;
+	case 'M': case 'm': n <<= 20; end++; break;
+	case 'G': case 'g': n <<= 30; end++; break;
+	}
+	// Past 64G the indices of the stack no longer fit in 32 bits.
+	if (*end == '\0' && n > 0 && n <= (64ULL << 30)) {
+		max_stack = n;
+	}
+}
+
+// alloc_vm allocates a VM with the stack and the frames it starts with.
+static struct vm *alloc_vm(void) {
+	struct vm *vm = calloc(1, sizeof(struct vm));
+	vm->stack = malloc(STACK_INIT * sizeof(struct object));
+	vm->stack_cap = STACK_INIT;
+	vm->frames = calloc(FRAMES_INIT, sizeof(struct frame));
+	vm->frames_cap = FRAMES_INIT;
+	return vm;
+}
+
+// vm_reserve makes room on the stack for nslots values from the bottom, and
+// for nframes frames, growing either that is short of it to twice as much or
+// more, and reports whether it couldn't: past max_stack is a stack overflow.
+// Growing moves them, so what points into the stack or the frames is no good
+// after a call to this, and has to be looked up again by its index.
+static int vm_reserve(struct vm * restrict vm, uint64_t nslots, uint64_t nframes) {
+	if (nslots <= vm->stack_cap && nframes <= vm->frames_cap) {
+		return 0;
+	}
+	if (nslots * sizeof(struct object) + nframes * sizeof(struct frame) > max_stack) {
+		return 1;
+	}
+
+	if (nslots > vm->stack_cap) {
+		uint64_t cap = vm->stack_cap;
+		while (cap < nslots) cap *= 2;
+
+		struct object *stack = realloc(vm->stack, cap * sizeof(struct object));
+		if (stack == NULL) return 1;
+		vm->stack = stack;
+		vm->stack_cap = cap;
+	}
+	if (nframes > vm->frames_cap) {
+		uint64_t cap = vm->frames_cap;
+		while (cap < nframes) cap *= 2;
+
+		struct frame *frames = realloc(vm->frames, cap * sizeof(struct frame));
+		if (frames == NULL) return 1;
+		vm->frames = frames;
+		vm->frames_cap = cap;
+	}
+	return 0;
+}
+
+// vm_reserve_args is vm_reserve for a call whose arguments may be on the stack
+// themselves, as they are for the try builtin: *args is moved along with it.
+static int vm_reserve_args(struct vm * restrict vm, uint64_t nslots, uint64_t nframes, struct object **args) {
+	uintptr_t p = (uintptr_t) *args, lo = (uintptr_t) vm->stack;
+	int inside = p >= lo && p < lo + vm->stack_cap * sizeof(struct object);
+	size_t off = (p - lo) / sizeof(struct object);
+
+	int ret = vm_reserve(vm, nslots, nframes);
+	if (inside) {
+		*args = &vm->stack[off];
+	}
+	return ret;
+}
+
 struct vm *new_vm(char *file, struct bytecode bc) {
 	gc_init();
-	struct vm *vm = calloc(1, sizeof(struct vm));
+	max_stack_init();
+	struct vm *vm = alloc_vm();
 	vm->file = file;
 	vm->state = new_state();
 	// The globals this program defines: an imported module gets its own
@@ -94,7 +181,7 @@ struct vm *new_vm(char *file, struct bytecode bc) {
 	vm->state.ndefs = bc.ndefs;
 	pool_extend(vm->state.consts, bc.consts, bc.nconsts);
 
-	struct function *fn = new_function(bc.insts, bc.len, 0, 0, bc.bookmarks, bc.bklen);
+	struct function *fn = new_function(bc.insts, bc.len, 0, 0, bc.bookmarks, bc.bklen, NULL, NULL);
 	struct object cl = new_closure_obj(fn, NULL, 0);
 	vm->frames[0] = new_frame(cl, 0);
 
@@ -103,7 +190,8 @@ struct vm *new_vm(char *file, struct bytecode bc) {
 
 struct vm *new_vm_with_state(char *file, struct bytecode bc, struct state state) {
 	gc_init();
-	struct vm *vm = calloc(1, sizeof(struct vm));
+	max_stack_init();
+	struct vm *vm = alloc_vm();
 	vm->file = file;
 	vm->state = state;
 	vm->state.ndefs = bc.ndefs;
@@ -112,7 +200,7 @@ struct vm *new_vm_with_state(char *file, struct bytecode bc, struct state state)
 	// constants will land, so the indices in their bytecode are absolute.
 	pool_extend(vm->state.consts, bc.consts, bc.nconsts);
 
-	struct function *fn = new_function(bc.insts, bc.len, 0, 0, bc.bookmarks, bc.bklen);
+	struct function *fn = new_function(bc.insts, bc.len, 0, 0, bc.bookmarks, bc.bklen, NULL, NULL);
 	struct object cl = new_closure_obj(fn, NULL, 0);
 	vm->frames[0] = new_frame(cl, 0);
 
@@ -120,12 +208,17 @@ struct vm *new_vm_with_state(char *file, struct bytecode bc, struct state state)
 }
 
 void vm_dispose(struct vm *vm) {
+	free(vm->stack);
+	free(vm->frames);
 	free(vm->file);
+	free(vm->origin_file);
 	free(vm);
 }
 
-static struct bookmark *vm_get_bookmark(struct vm * restrict vm) {
-	struct frame *frame = vm_current_frame(vm);
+// The bookmark of the instruction the frame is at: for the innermost frame
+// the one that failed, for the others the call that is still going on. The
+// bookmark of an instruction is the first one past it.
+struct bookmark *frame_bookmark(struct frame *frame) {
 	uint32_t offset = frame->ip - frame->start;
 	size_t blen = frame->cl.data.cl->fn->bklen;
 	struct bookmark *bookmarks = frame->cl.data.cl->fn->bookmarks;
@@ -141,49 +234,102 @@ static struct bookmark *vm_get_bookmark(struct vm * restrict vm) {
 	return NULL;
 }
 
-inline void vm_errorf(struct vm * restrict vm, const char *fmt, ...) {
-	struct bookmark *b = vm_get_bookmark(vm);
+// The file the code of the frame comes from. A function of an imported
+// module runs on the VM of whoever calls it, so the file of the VM is only
+// right for the functions that don't say otherwise.
+char *frame_file(struct vm * restrict vm, struct frame *frame, struct bookmark *b) {
+	struct function *fn = frame->cl.data.cl->fn;
 
-	if (b == NULL) {
-		va_list args;
-		va_start(args, fmt);
-		vfprintf(stderr, fmt, args);
-		va_end(args);
-		longjmp(vm->env, 1);
+	if (b != NULL && b->file != NULL) {
+		return b->file;
 	}
+	return fn->file != NULL ? fn->file : vm->file;
+}
 
-	char msg[512];
-	va_list args;
-	va_start(args, fmt);
-	vsnprintf(msg, 512, fmt, args);
-	va_end(args);
+static struct bookmark *vm_get_bookmark(struct vm * restrict vm) {
+	return frame_bookmark(vm_current_frame(vm));
+}
 
-	char arrow[b->pos+2];
-	memset(arrow, ' ', b->pos+2);
-	arrow[b->pos] = '^';
-	arrow[b->pos+1] = '\0';
+void vm_where(struct vm *vm, char **file, int32_t *line) {
+	*file = NULL;
+	*line = 0;
+	if (vm == NULL) return;
 
-	// What went wrong goes to standard error, so that the output of a program
-	// stays what the program wrote.
-	fflush(stdout);
-	fprintf(
-		stderr,
-		"error in file %s at line %d:\n    %s\n    %s\n%s\n",
-		b->file != NULL ? b->file : vm->file,
-		b->lineno,
-		b->line,
-		arrow,
-		msg
-	);
+	for (int64_t i = vm->frame_idx; i >= 0; i--) {
+		struct frame *f = &vm->frames[i];
+		if (f->ip == NULL || f->cl.type != obj_closure) continue;
 
-	longjmp(vm->env, 1);
+		struct bookmark *b = frame_bookmark(f);
+		*file = frame_file(vm, f, b);
+		if (b != NULL) *line = b->lineno;
+		return;
+	}
 }
 
-void go_vm_errorf(struct vm * restrict vm, const char *fmt) {
+// How many of the innermost calls and of the outermost ones a stack trace
+// shows, when there are more than the two together: a recursion that ran out
+// of stack is a million of the same line, and the ends are what tell.
+#define TRACE_ENDS 50
+
+// Prints the calls the VM is in, the innermost first, and where the routine
+// was started if the VM runs one.
+void vm_print_stack(FILE *out, struct vm *vm) {
+	for (int64_t i = vm->frame_idx; i >= 0; i--) {
+		struct frame *frame = &vm->frames[i];
+
+		if (vm->frame_idx > 2 * TRACE_ENDS && i == (int64_t) vm->frame_idx - TRACE_ENDS) {
+			fprintf(out, "    ... %ld more calls\n", i - TRACE_ENDS + 1);
+			i = TRACE_ENDS;
+			continue;
+		}
+
+		// The frame a call from C stops at, and the empty one at the
+		// bottom of a routine.
+		if (frame->ip == NULL || frame->cl.data.cl == NULL) {
+			continue;
+		}
+
+		struct bookmark *b = frame_bookmark(frame);
+		struct function *fn = frame->cl.data.cl->fn;
+		char *name = fn->name != NULL ? fn->name : (i == 0 ? "<top level>" : "fn");
+
+		if (b != NULL) {
+			fprintf(out, "    %s at %s:%d\n", name, frame_file(vm, frame, b), b->lineno);
+		} else {
+			fprintf(out, "    %s\n", name);
+		}
+		// The calls that handed the frame over took theirs with them.
+		if (frame->tail_calls > 0) {
+			fprintf(out, "    ... %lu %s elided by tail calls\n", frame->tail_calls, frame->tail_calls == 1 ? "frame" : "frames");
+		}
+	}
+
+	if (vm->origin != NULL) {
+		fprintf(out, "routine started at %s:%d\n", vm->origin_file, vm->origin->lineno);
+	}
+}
+
+// The calls that led to the error. An error at the top level gets none, the
+// message already says all there is.
+static void vm_print_trace(struct vm * restrict vm) {
+	if (vm->frame_idx == 0 && vm->origin == NULL) {
+		return;
+	}
+
+	fputs("stack trace:\n", stderr);
+	vm_print_stack(stderr, vm);
+}
+
+// The message, pointing at the line that failed, and the trace below it.
+static void vm_print_error(struct vm * restrict vm, const char *msg) {
 	struct bookmark *b = vm_get_bookmark(vm);
+
+	// What went wrong goes to standard error, so that the output of a program
+	// stays what the program wrote.
+	fflush(stdout);
 	if (b == NULL) {
-		fflush(stdout);
-		fprintf(stderr, "%s\n", fmt);
+		fprintf(stderr, "%s\n", msg);
+		vm_print_trace(vm);
 		return;
 	}
 
@@ -192,16 +338,70 @@ void go_vm_errorf(struct vm * restrict vm, const char *fmt) {
 	arrow[b->pos] = '^';
 	arrow[b->pos+1] = '\0';
 
-	fflush(stdout);
 	fprintf(
 		stderr,
 		"error in file %s at line %d:\n    %s\n    %s\n%s\n",
-		b->file != NULL ? b->file : vm->file,
+		frame_file(vm, vm_current_frame(vm), b),
 		b->lineno,
 		b->line,
 		arrow,
-		fmt
+		msg
 	);
+	vm_print_trace(vm);
+}
+
+// vm_fail reports the error that stops the VM: it is printed, or, under a
+// call of try, kept with the file and the line it happened at for try to give
+// back. Only the first is kept, the ones the deferred calls run into on the
+// way out came after it.
+static void vm_fail(struct vm * restrict vm, const char *msg) {
+	if (vm->trying == 0) {
+		vm_print_error(vm, msg);
+		return;
+	}
+	if (vm->fault != NULL) {
+		return;
+	}
+
+	char *file;
+	int32_t line;
+	vm_where(vm, &file, &line);
+	if (file == NULL) {
+		vm->fault = strdup(msg);
+		return;
+	}
+
+	size_t len = snprintf(NULL, 0, "%s:%d: %s", file, line, msg);
+	vm->fault = malloc(len + 1);
+	snprintf(vm->fault, len + 1, "%s:%d: %s", file, line, msg);
+}
+
+inline void vm_errorf(struct vm * restrict vm, const char *fmt, ...) {
+	char msg[512];
+	va_list args;
+	va_start(args, fmt);
+	vsnprintf(msg, 512, fmt, args);
+	va_end(args);
+
+	vm_fail(vm, msg);
+	longjmp(vm->env, 1);
+}
+
+void go_vm_errorf(struct vm * restrict vm, const char *fmt) {
+	vm_fail(vm, fmt);
+}
+
+// vm_room makes sure there is room on the stack for n more values, for an
+// instruction about to push them, and fails with a stack overflow when there
+// can't be. What a call leaves above the locals of a function is only a guess
+// at how high it piles its values, a list of a thousand elements goes well past
+// it, so whatever pushes asks first. The stack may move, and so it is asked
+// before anything points into it; the frames never do, there is one already
+// for every call.
+static inline void vm_room(struct vm * restrict vm, uint64_t n) {
+	if (vm->sp + n > vm->stack_cap && vm_reserve(vm, (uint64_t) vm->sp + n + STACK_SLACK, (uint64_t) vm->frame_idx + 1)) {
+		vm_errorf(vm, "stack overflow");
+	}
 }
 
 static inline void vm_exec_dot(struct vm * restrict vm) {
@@ -220,6 +420,14 @@ static inline void vm_exec_dot(struct vm * restrict vm) {
 		cstr_free(right.data.str, name);
 		return;
 
+	case obj_error: {
+		struct object o = error_get(left, name);
+		vm_heap_add(vm, o);
+		vm_stack_push(vm, o);
+		cstr_free(right.data.str, name);
+		return;
+	}
+
 	case obj_native: {
 		// Pointer to the native object.
 		void *ptr = dlsym(left.data.handle, name);
@@ -251,6 +459,12 @@ static inline void vm_exec_define(struct vm * restrict vm) {
 	switch (target.type) {
 	case obj_object: {
 		char *name = cstr(field.data.str);
+		if (object_is_const(target, name)) {
+			char msg[128];
+			snprintf(msg, sizeof(msg), "cannot assign to constant %s", name);
+			cstr_free(field.data.str, name);
+			vm_errorf(vm, "%s", msg);
+		}
 		vm_stack_push(vm, object_set(target, name, val));
 		cstr_free(field.data.str, name);
 		return;
@@ -276,11 +490,40 @@ static inline void vm_exec_define(struct vm * restrict vm) {
 		return;
 	}
 
+	case obj_error: {
+		if (field.type != obj_string) {
+			vm_errorf(vm, "error object has no attribute %s", object_str(field));
+		}
+		char *name = cstr(field.data.str);
+		if (error_set(target, name, val) < 0) {
+			char msg[128];
+			snprintf(msg, sizeof(msg), "cannot assign to %s of an error", name);
+			cstr_free(field.data.str, name);
+			vm_errorf(vm, "%s", msg);
+		}
+		cstr_free(field.data.str, name);
+		// The object for the fields is made by the first one set.
+		vm_heap_add(vm, target.data.err->fields);
+		vm_stack_push(vm, val);
+		return;
+	}
+
 	default:
 		vm_errorf(vm, "cannot assign to type \"%s\"", otype_str(target.type));
 	}
 }
 
+// vm_cell turns the variable in slot into a cell holding its value, unless it
+// already is one, and gives back the cell.
+static inline struct object vm_cell(struct vm * restrict vm, struct object *slot) {
+	if (slot->type != obj_cell) {
+		struct object cell = new_cell_obj(*slot);
+		vm_heap_add(vm, cell);
+		*slot = cell;
+	}
+	return *slot;
+}
+
 static inline void vm_push_closure(struct vm * restrict vm, uint32_t const_idx, uint32_t num_free) {
 	struct object fn = vm->state.consts->list[const_idx];
 
@@ -341,39 +584,67 @@ static inline void vm_push_map(struct vm * restrict vm, uint32_t start, uint32_t
 	gc();
 }
 
+// The string constant has a 0xff for each value and, for a value written with
+// a format like {x:08.3f}, the format between a 0xfe and its 0xff. Neither
+// byte is ever part of UTF-8 text.
 static inline void vm_push_interpolated(struct vm * restrict vm, uint32_t str_idx, uint32_t num_args) {
 	struct object o = vm->state.consts->list[str_idx];
-	char *str = o.data.str->str;
+	uint8_t *str = (uint8_t *) o.data.str->str;
 	size_t fmt_len = o.data.str->len;
+	struct object *args = &vm->stack[vm->sp - num_args];
 	char *subs[num_args];
-	uint32_t len_table[num_args];
-	uint32_t sub_len = 0;
+	size_t len_table[num_args];
+	size_t len = fmt_len;
+	uint32_t subidx = 0;
+	char err[128];
+
+	for (size_t i = 0; i < fmt_len; i++) {
+		char *spec = NULL;
+		size_t speclen = 0;
+
+		if (str[i] == 0xfe) {
+			spec = (char *) &str[++i];
+			for (; str[i] != 0xff; i++) {
+				speclen++;
+			}
+		} else if (str[i] != 0xff) {
+			continue;
+		}
 
-	for (int i = num_args-1; i >= 0; i--) {
-		char *s = object_str(vm_stack_pop(vm));
-		subs[i] = s;
-		uint32_t len = strlen(s);
-		len_table[i] = len;
-		sub_len += len;
+		if (spec == NULL) {
+			subs[subidx] = object_str(args[subidx]);
+			len_table[subidx] = strlen(subs[subidx]);
+		} else if ((subs[subidx] = fmt_value(args[subidx], spec, speclen, &len_table[subidx], err, sizeof(err))) == NULL) {
+			for (uint32_t j = 0; j < subidx; j++) {
+				free(subs[j]);
+			}
+			vm_errorf(vm, "interpolation: %s", err);
+		}
+		// The format and its markers go away, the value takes their place.
+		len += len_table[subidx] - speclen - (spec != NULL ? 2 : 1);
+		subidx++;
 	}
+	vm->sp -= num_args;
 
-	// One placeholder byte per substitution goes away, and one more byte
-	// holds the NUL, which is not part of the string.
-	uint32_t len = fmt_len + sub_len - num_args;
 	char *ret = malloc(sizeof(char) * (len + 1));
 	ret[len] = '\0';
-	uint32_t retidx = 0;
-	uint32_t subidx = 0;
+	size_t retidx = 0;
+	subidx = 0;
 
-	for (uint8_t *s = (uint8_t *) str; *s != '\0'; s++) {
-		if (*s == 0xff) {
-			strncpy(&ret[retidx], subs[subidx], len_table[subidx]);
+	for (size_t i = 0; i < fmt_len; i++) {
+		if (str[i] == 0xfe) {
+			while (str[i] != 0xff) {
+				i++;
+			}
+		}
+		if (str[i] == 0xff) {
+			memcpy(&ret[retidx], subs[subidx], len_table[subidx]);
 			retidx += len_table[subidx];
 			free(subs[subidx]);
 			subidx++;
 			continue;
 		}
-		ret[retidx++] = *s;
+		ret[retidx++] = str[i];
 	}
 
 	struct object res = new_string_obj(ret, len);
@@ -684,6 +955,36 @@ static inline void vm_exec_greater_than_eq(struct vm * restrict vm) {
 	}
 }
 
+// vm_local is where the local in the slot idx of the frame is: the slot
+// itself, or the cell in it when a closure shares it.
+static inline struct object *vm_local(struct vm * restrict vm, struct frame *frame, uint32_t idx) {
+	struct object *slot = &vm->stack[frame->base_ptr+idx];
+	return slot->type == obj_cell ? slot->data.cell : slot;
+}
+
+// vm_exec_binary is the binary operator op, one of the opcodes that take two
+// values off the stack and put one back, for the instructions the optimizer
+// makes out of one of them and what comes before or after it.
+static inline void vm_exec_binary(struct vm * restrict vm, uint32_t op) {
+	switch (op) {
+	case op_add: vm_exec_add(vm); break;
+	case op_sub: vm_exec_sub(vm); break;
+	case op_mul: vm_exec_mul(vm); break;
+	case op_div: vm_exec_div(vm); break;
+	case op_mod: vm_exec_mod(vm); break;
+	case op_bw_and: vm_exec_bw_and(vm); break;
+	case op_bw_or: vm_exec_bw_or(vm); break;
+	case op_bw_xor: vm_exec_bw_xor(vm); break;
+	case op_bw_lshift: vm_exec_bw_lshift(vm); break;
+	case op_bw_rshift: vm_exec_bw_rshift(vm); break;
+	case op_equal: vm_exec_eq(vm); break;
+	case op_not_equal: vm_exec_not_eq(vm); break;
+	case op_greater_than: vm_exec_greater_than(vm); break;
+	case op_greater_than_equal: vm_exec_greater_than_eq(vm); break;
+	default: vm_errorf(vm, "%s is not a binary operator", opcode_str(op));
+	}
+}
+
 static inline void vm_exec_minus(struct vm * restrict vm) {
 	struct object *right = &vm_stack_peek(vm);
 
@@ -768,25 +1069,355 @@ static inline void vm_exec_index(struct vm * restrict vm) {
 	}
 }
 
-static inline void vm_call_closure(struct vm * restrict vm, struct object *cl, size_t numargs) {
-	size_t num_params = cl->data.cl->fn->num_params;
+// The state of a for loop over a collection sits on the stack under whatever
+// the body pushes: the collection, and a cursor that says where the loop is.
+// That is the offset of what comes next in a list, a string or bytes, how many
+// values came so far out of a pipe, and the last key of a map, null before the
+// first. Every way out of the loop, break included, goes through the two pops
+// that drop it.
+static inline void vm_exec_iter(struct vm * restrict vm) {
+	struct object *o = &vm_stack_peek(vm);
 
-	if (num_params != numargs) {
-		vm_errorf(vm, "wrong number of arguments: expected %d, got %lu", num_params, numargs);
+	switch (o->type) {
+	case obj_list:
+	case obj_string:
+	case obj_bytes:
+	case obj_pipe:
+		vm_stack_push(vm, new_integer_obj(0));
+		break;
+	case obj_map:
+		vm_stack_push(vm, null_obj);
+		break;
+	default:
+		vm_errorf(vm, "cannot iterate over %s", otype_str(o->type));
 	}
+}
 
-	struct frame frame = new_frame(*cl, vm->sp-numargs);
-	vm_push_frame(vm, frame);
+// decode_rune reads the code point at the start of s, n bytes long, the way the
+// utf8 module does: a byte that doesn't start valid UTF-8, a short one written
+// long or a surrogate are U+FFFD, one byte long, so a loop always moves on.
+static inline int64_t decode_rune(const uint8_t *s, size_t n, size_t *width) {
+	uint8_t c = s[0];
+	size_t len;
+	int64_t r, min;
+
+	*width = 1;
+	if (c < 0x80) {
+		return c;
+	} else if ((c & 0xe0) == 0xc0) {
+		len = 2, r = c & 0x1f, min = 0x80;
+	} else if ((c & 0xf0) == 0xe0) {
+		len = 3, r = c & 0x0f, min = 0x800;
+	} else if ((c & 0xf8) == 0xf0) {
+		len = 4, r = c & 0x07, min = 0x10000;
+	} else {
+		return 0xfffd;
+	}
+
+	if (len > n) return 0xfffd;
+	for (size_t i = 1; i < len; i++) {
+		if ((s[i] & 0xc0) != 0x80) return 0xfffd;
+		r = (r << 6) | (s[i] & 0x3f);
+	}
+	if (r < min || r > 0x10ffff || (r >= 0xd800 && r <= 0xdfff)) return 0xfffd;
+	*width = len;
+	return r;
+}
+
+// vm_exec_iter_next moves the loop on by one and pushes what the names of the
+// loop take, or returns 0 when there is nothing left. With two names those are
+// the key and the value: the index and the element of a list or of bytes, the
+// byte offset and the code point of a string, the key and the value of a map,
+// and how many values came before and the value of a pipe. A name alone takes
+// the value, but for a map, where it takes the key.
+//
+// A list or bytes are read as they are at every step, so a change ahead of the
+// loop is seen, and it ends when it reaches the end they have then.
+static inline int vm_exec_iter_next(struct vm * restrict vm, uint32_t nvars) {
+	struct object coll = vm->stack[vm->sp-2];
+	struct object *cur = &vm->stack[vm->sp-1];
+	struct object key;
+	struct object val;
+
+	switch (coll.type) {
+	case obj_list: {
+		int64_t i = cur->data.i;
+		if (i >= coll.data.list->len) return 0;
+
+		key = new_integer_obj(i);
+		val = coll.data.list->list[i];
+		cur->data.i++;
+		break;
+	}
+
+	case obj_bytes: {
+		int64_t i = cur->data.i;
+		if (i >= coll.data.bytes->len) return 0;
+
+		key = new_integer_obj(i);
+		val = new_integer_obj(coll.data.bytes->bytes[i]);
+		cur->data.i++;
+		break;
+	}
+
+	case obj_string: {
+		int64_t i = cur->data.i;
+		size_t width;
+		if (i >= coll.data.str->len) return 0;
+
+		key = new_integer_obj(i);
+		val = new_integer_obj(decode_rune((uint8_t *) coll.data.str->str + i, coll.data.str->len - i, &width));
+		cur->data.i += width;
+		break;
+	}
+
+	case obj_pipe:
+		// Parks while it waits, like recv does.
+		if (!pipe_next(coll, &val)) return 0;
+		key = new_integer_obj(cur->data.i++);
+		break;
+
+	case obj_map: {
+		struct map_pair p = map_next(coll, cur->type == obj_null ? NULL : cur);
+		if (p.key.type == obj_null) return 0;
+
+		key = p.key;
+		val = p.val;
+		*cur = p.key;
+		break;
+	}
+
+	default:
+		vm_errorf(vm, "cannot iterate over %s", otype_str(coll.type));
+	}
+
+	if (nvars == 2) {
+		vm_stack_push(vm, key);
+		vm_stack_push(vm, val);
+	} else {
+		vm_stack_push(vm, coll.type == obj_map ? key : val);
+	}
+	return 1;
+}
+
+// vm_exec_unpack takes the list on top of the stack apart for an assignment to
+// n names: the elements go on top of it, the first one last, for the names to
+// take in order, and the list stays under them as the value of the whole
+// assignment.
+static inline void vm_exec_unpack(struct vm * restrict vm, uint32_t n) {
+	struct object l = vm_stack_peek(vm);
+
+	if (l.type != obj_list) {
+		vm_errorf(vm, "cannot assign %s to %u names", otype_str(l.type), n);
+	}
+	if (l.data.list->len != n) {
+		vm_errorf(vm, "cannot assign %lu values to %u names", l.data.list->len, n);
+	}
+	for (uint32_t i = n; i > 0; i--) {
+		vm_stack_push(vm, l.data.list->list[i-1]);
+	}
+}
+
+// vm_exec_unpack_fields is vm_exec_unpack for {a, b} = o: the n names of the
+// fields are on top of the object, and their values take their place. A field
+// that isn't there is null, as it is when read with a dot.
+static inline void vm_exec_unpack_fields(struct vm * restrict vm, uint32_t n) {
+	struct object *names = &vm->stack[vm->sp-n];
+	struct object o = vm->stack[vm->sp-n-1];
+	struct object vals[n > 0 ? n : 1];
+
+	if (o.type != obj_object) {
+		vm_errorf(vm, "cannot take the fields of %s", otype_str(o.type));
+	}
+	for (uint32_t i = 0; i < n; i++) {
+		char *name = cstr(names[i].data.str);
+		vals[i] = object_get(o, name);
+		cstr_free(names[i].data.str, name);
+	}
+	for (uint32_t i = 0; i < n; i++) {
+		names[i] = vals[n-1-i];
+	}
+}
+
+// The patterns of a switch. A list pattern asks whether the value on top of
+// the stack is a list of n elements, and if it is the elements take its place,
+// the first one on top, for the patterns inside it to take one by one. If it
+// isn't the value stays where it is. Either way the answer goes on top, for
+// the jump that follows.
+static inline void vm_exec_match_list(struct vm * restrict vm, uint32_t n) {
+	struct object v = vm_stack_peek(vm);
 
-	// The locals that are not arguments start as null. Their slots hold
-	// whatever the stack left there, so a read before the first assignment
-	// would hand the program a stale object, and the collector would mark it
-	// as live because it sits below sp.
-	uint32_t num_locals = cl->data.cl->fn->num_locals;
+	if (v.type != obj_list || v.data.list->len != n) {
+		vm_stack_push(vm, false_obj);
+		return;
+	}
+	vm_stack_pop_ignore(vm);
+	for (uint32_t i = n; i > 0; i--) {
+		vm_stack_push(vm, v.data.list->list[i-1]);
+	}
+	vm_stack_push(vm, true_obj);
+}
+
+// A map pattern has its n keys on top of the value, and matches a map that
+// has all of them, whatever else it has: the values of those keys take the
+// place of the map and of the keys, the first one on top. The keys go either
+// way, and the value stays when it doesn't match.
+static inline void vm_exec_match_map(struct vm * restrict vm, uint32_t n) {
+	struct object *keys = &vm->stack[vm->sp-n];
+	struct object v = vm->stack[vm->sp-n-1];
+	struct object vals[n > 0 ? n : 1];
+	int ok = v.type == obj_map;
+
+	for (uint32_t i = 0; ok && i < n; i++) {
+		struct map_pair p = map_get(v, keys[i]);
+		ok = p.key.type != obj_null;
+		vals[i] = p.val;
+	}
+
+	if (!ok) {
+		vm->sp -= n;
+		vm_stack_push(vm, false_obj);
+		return;
+	}
+	vm->sp -= n + 1;
+	for (uint32_t i = n; i > 0; i--) {
+		vm_stack_push(vm, vals[i-1]);
+	}
+	vm_stack_push(vm, true_obj);
+}
+
+// vm_exec_switch_table takes the subject of a switch on dense integer cases off
+// the stack and says which of the n+1 jumps after op_switch_table to take: the
+// one of its value counted from lo, or the last one for a value outside the
+// table or that isn't a whole number. A float is matched as == would.
+static inline uint32_t vm_exec_switch_table(struct vm * restrict vm, int64_t lo, uint32_t n) {
+	struct object v = vm_stack_pop(vm);
+	int64_t i;
+
+	if (v.type == obj_integer) {
+		i = v.data.i;
+	} else if (v.type == obj_float && v.data.f >= -0x1p62 && v.data.f < 0x1p62 && v.data.f == (double) (int64_t) v.data.f) {
+		i = (int64_t) v.data.f;
+	} else {
+		return n;
+	}
+
+	if (i < lo || i >= lo + (int64_t) n) {
+		return n;
+	}
+	return i - lo;
+}
+
+// vm_exec_defer takes the function on the stack and its nargs arguments off
+// it and adds them to the calls deferred in the current frame, which op_return
+// makes. The arguments are worked out here, as they are for a call made right
+// away; only the call is put off. What can't be called is an error now rather
+// than when the function returns, far from the defer that caused it.
+static inline void vm_exec_defer(struct vm * restrict vm, uint32_t nargs) {
+	struct object *fn = &vm->stack[vm->sp-1-nargs];
+
+	switch (fn->type) {
+	case obj_closure:
+	case obj_builtin:
+	case obj_native:
+	case obj_native_fn:
+		break;
+	default:
+		vm_errorf(vm, "defer of a non-function: got type %s", otype_str(fn->type));
+	}
+
+	struct frame *frame = vm_current_frame(vm);
+	if (frame->defers.type != obj_list) {
+		frame->defers = make_list(nargs + 2);
+		vm_heap_add(vm, frame->defers);
+	}
+
+	struct list *l = frame->defers.data.list;
+	if (l->len + nargs + 2 > l->cap) {
+		l->cap = (l->len + nargs + 2) * 2;
+		l->list = realloc(l->list, l->cap * sizeof(struct object));
+	}
+	memcpy(&l->list[l->len], fn, (nargs + 1) * sizeof(struct object));
+	l->len += nargs + 1;
+	l->list[l->len++] = new_integer_obj(nargs);
+
+	// A defer is an expression like a call, and its value is null.
+	vm->sp -= nargs + 1;
+	vm_stack_push(vm, null_obj);
+}
+
+// vm_bad_arity writes into msg what is wrong with calling fn with numargs
+// arguments, and reports whether anything is: there have to be at least the
+// parameters with no default, and no more than all of them unless the last
+// takes the rest.
+static int vm_bad_arity(struct function *fn, size_t numargs, char *msg, size_t len) {
+	if (numargs >= fn->num_required && (fn->variadic || numargs <= fn->num_params)) {
+		return 0;
+	}
+
+	if (fn->variadic) {
+		snprintf(msg, len, "wrong number of arguments: expected at least %u, got %lu", fn->num_required, numargs);
+	} else if (fn->num_required < fn->num_params) {
+		snprintf(msg, len, "wrong number of arguments: expected %u to %u, got %lu", fn->num_required, fn->num_params, numargs);
+	} else {
+		snprintf(msg, len, "wrong number of arguments: expected %u, got %lu", fn->num_params, numargs);
+	}
+	return 1;
+}
+
+// vm_init_locals lays out the locals of fn, whose frame starts at base_ptr
+// with the numargs arguments of the call.
+static inline void vm_init_locals(struct vm * restrict vm, struct function *fn, uint32_t base_ptr, size_t numargs) {
+	uint32_t num_locals = fn->num_locals;
+
+	// The arguments past the parameters go in a list, in the slot after
+	// them. The ones left out are nulls, which the function replaces with
+	// their defaults, and so are the locals that are not arguments: their
+	// slots hold whatever the stack left there, so a read before the first
+	// assignment would hand the program a stale object, and the collector
+	// would mark it as live because it sits below sp.
+	if (fn->variadic) {
+		size_t extra = numargs > fn->num_params ? numargs - fn->num_params : 0;
+		struct object rest = make_list(extra);
+
+		memcpy(rest.data.list->list, &vm->stack[base_ptr + fn->num_params], extra * sizeof(struct object));
+		rest.data.list->len = extra;
+		vm_heap_add(vm, rest);
+
+		for (uint32_t i = numargs - extra; i < fn->num_params; i++) {
+			vm->stack[base_ptr + i] = null_obj;
+		}
+		vm->stack[base_ptr + fn->num_params] = rest;
+		numargs = fn->num_params + 1;
+	}
 	for (uint32_t i = numargs; i < num_locals; i++) {
-		vm->stack[frame.base_ptr + i] = null_obj;
+		vm->stack[base_ptr + i] = null_obj;
+	}
+	vm->sp = base_ptr + num_locals;
+}
+
+// vm_call_closure calls the closure cl, which is copied before the stack it
+// may well be on grows under it.
+static inline void vm_call_closure(struct vm * restrict vm, struct object *cl, size_t numargs) {
+	struct object closure = *cl;
+	struct function *fn = closure.data.cl->fn;
+	char msg[128];
+
+	if (vm_bad_arity(fn, numargs, msg, sizeof(msg))) {
+		vm_errorf(vm, "%s", msg);
+	}
+
+	// The frame, and the locals with the slack left above them for the
+	// values the expressions of the function pile up. How high a function
+	// piles them is never worked out, the slack is a guess, and what pushes
+	// more than that makes room for itself, see vm_room.
+	if (vm_reserve(vm, (uint64_t) vm->sp - numargs + fn->num_locals + STACK_SLACK, (uint64_t) vm->frame_idx + 2)) {
+		vm_errorf(vm, "stack overflow");
 	}
-	vm->sp = frame.base_ptr + num_locals;
+
+	struct frame frame = new_frame(closure, vm->sp-numargs);
+	vm_push_frame(vm, frame);
+	vm_init_locals(vm, fn, frame.base_ptr, numargs);
 }
 
 static inline void vm_call_builtin(struct vm * restrict vm, builtin fn, size_t numargs) {
@@ -898,7 +1529,8 @@ static inline void vm_call_native(struct vm * restrict vm, struct object *n, siz
 	}
 
 	// A native call can block for an arbitrary amount of time (sockets, IO):
-	// park so that it doesn't hold back a collection. The arguments are still
+	// park so that it doesn't hold back a collection, nor the other routines,
+	// which get the proc of this thread if it takes long. The arguments are still
 	// on the stack, so a collection happening now marks them and the buffers
 	// the C function is reading stay where they are.
 	ffi_arg return_value = 0;
@@ -941,19 +1573,112 @@ static inline void vm_exec_call(struct vm * restrict vm, size_t numargs) {
 	}
 }
 
+// Stack layout: [fn, list0, ..., listN-1], the arguments of a call some of
+// which were spread, in lists. They are laid out one by one in the place of
+// the lists, and the call is made as any other.
+static inline void vm_exec_call_spread(struct vm * restrict vm, uint32_t nlists) {
+	struct object *lists = &vm->stack[vm->sp - nlists];
+	size_t numargs = 0;
+
+	for (uint32_t i = 0; i < nlists; i++) {
+		if (lists[i].type != obj_list) {
+			vm_errorf(vm, "cannot spread %s, only a list", otype_str(lists[i].type));
+		}
+		numargs += lists[i].data.list->len;
+	}
+	if (vm_reserve(vm, (uint64_t) vm->sp - nlists + numargs + STACK_SLACK, vm->frame_idx + 1)) {
+		vm_errorf(vm, "stack overflow");
+	}
+	lists = &vm->stack[vm->sp - nlists];
+
+	// The lists are copied out first: the arguments go where they are.
+	struct object copy[nlists > 0 ? nlists : 1];
+	memcpy(copy, lists, nlists * sizeof(struct object));
+
+	vm->sp -= nlists;
+	for (uint32_t i = 0; i < nlists; i++) {
+		struct list *l = copy[i].data.list;
+		memcpy(&vm->stack[vm->sp], l->list, l->len * sizeof(struct object));
+		vm->sp += l->len;
+	}
+	vm_exec_call(vm, numargs);
+}
+
+// The flags of op_select, the same as code.SelectDefault and SelectTimeout.
+#define SELECT_DEFAULT 1
+#define SELECT_TIMEOUT 2
+
+// Stack layout: [kind0, pipe0, val0, ..., kindN-1, pipeN-1, valN-1, timeout]
+// with the timeout there only if the select has one. The values stay on the
+// stack while the select waits, it is what keeps them reachable.
+//
+// Returns the index of the case that went, or ncases when none did because
+// of the default or the timeout. The compiler puts a jump for each of them
+// right after the instruction and the VM skips to the one it has to take.
+static inline uint32_t vm_exec_select(struct vm * restrict vm, uint32_t ncases, uint32_t flags) {
+	struct select_case cases[ncases > 0 ? ncases : 1];
+	struct object *base = &vm->stack[vm->sp - ncases*3 - ((flags & SELECT_TIMEOUT) != 0)];
+	int64_t timeout = -1;
+
+	if (flags & SELECT_DEFAULT) {
+		timeout = 0;
+	} else if (flags & SELECT_TIMEOUT) {
+		struct object t = vm_stack_peek(vm);
+
+		if (t.type != obj_integer) {
+			vm_errorf(vm, "select: timeout must be int, got %s", otype_str(t.type));
+		}
+		// Already expired, like in a timer set in the past.
+		timeout = t.data.i > 0 ? t.data.i : 0;
+	}
+
+	for (uint32_t i = 0; i < ncases; i++) {
+		struct object pipe = base[i*3+1];
+
+		if (pipe.type != obj_pipe) {
+			vm_errorf(vm, "select: case %u must be on a pipe, got %s instead", i+1, otype_str(pipe.type));
+		}
+		cases[i] = (struct select_case) {
+			.pipe = pipe,
+			.val = base[i*3+2],
+			.kind = base[i*3].data.i,
+		};
+	}
+
+	int idx = pipe_select(cases, ncases, timeout);
+	vm->sp = base - vm->stack;
+
+	if (idx < 0) {
+		vm_stack_push(vm, null_obj);
+		return ncases;
+	}
+	// What recv or send would have returned.
+	if (cases[idx].closed) {
+		struct object err = errorf("send: closed pipe");
+		vm_stack_push(vm, err);
+		vm_heap_add(vm, err);
+		gc();
+	} else {
+		vm_stack_push(vm, cases[idx].val);
+	}
+	return idx;
+}
+
 int vm_run(struct vm * restrict vm);
 
 static int run_and_cleanup(void *vmptr) {
 	struct vm *vm = vmptr;
 
+	trace_routine(trace_ev_routine_start, vm, NULL);
 	int ret = vm_run(vm);
+	trace_routine(trace_ev_routine_end, vm, NULL);
 	fflush(stdout);
 
 	// The heap is global: whatever this VM allocated and is still reachable
-	// from somewhere else (a pipe, the globals) survives.
+	// from somewhere else (a pipe, the globals) survives. The segment it
+	// allocated into is the one of the worker, which goes on to the next
+	// routine.
 	gc_unregister(vm);
-	gc_release_segment();
-	gc_flush_headers();
 	vm_dispose(vm);
 	return ret;
 }
@@ -972,45 +1697,45 @@ static int call_builtin_and_cleanup(void *data) {
 	gc_remove_roots(d->roots);
 	fflush(stdout);
 
-	// A builtin allocates too, and this thread is about to end.
-	gc_release_segment();
-	gc_flush_headers();
-
 	free(d->args);
 	free(d);
 	return 0;
 }
 
 static inline void vm_exec_concurrent_call(struct vm * restrict vm, uint32_t num_args) {
-	thrd_t thread;
 	struct object *o = &vm->stack[vm->sp-1-num_args];
 
 	switch (o->type) {
 	case obj_closure: {
-		struct vm *tvm = calloc(1, sizeof(struct vm));
+		struct vm *tvm = alloc_vm();
+		tvm->routine = 1;
 		tvm->file = strdup(vm->file);
 		tvm->state.consts = vm->state.consts;    // The same pool, shared.
 		tvm->state.mods = vm->state.mods;
 		tvm->state.globals = vm->state.globals;  // Shared, never reallocated.
 
+		// The bookmarks of a function live as long as the program does.
+		struct frame *frame = vm_current_frame(vm);
+		tvm->origin = frame_bookmark(frame);
+		if (tvm->origin != NULL) {
+			tvm->origin_file = strdup(frame_file(vm, frame, tvm->origin));
+		}
+
 		// Only copy the closure and its arguments to the new VM's stack
-		// Stack layout: [closure, arg0, arg1, ..., argN-1]
+		// Stack layout: [closure, arg0, arg1, ..., argN-1], at most the 256
+		// values a VM starts with room for.
 		memcpy(tvm->stack, &vm->stack[vm->sp-1-num_args], (num_args + 1) * sizeof(struct object));
 		tvm->sp = num_args + 1;
 
 		vm_call_closure(tvm, o, num_args);
-		// Registered here and not in the new thread: until the thread starts
+		// Registered here and not in the new routine: until it starts
 		// running, the objects on its stack are reachable only from here.
 		gc_register(tvm);
-		if (thrd_create(&thread, run_and_cleanup, tvm) != thrd_success) {
+		trace_routine(trace_ev_routine_create, tvm, vm);
+		if (sched_go(run_and_cleanup, tvm) != 0) {
 			gc_unregister(tvm);
-			vm_errorf(vm, "failed to create thread");
+			vm_errorf(vm, "failed to start routine");
 		}
-		// Nobody ever joins a tau routine, so the thread has to be told that
-		// its remains are of no interest: a thread that is neither joined nor
-		// detached keeps its stack and its descriptor until the process ends,
-		// and a program that starts a few thousand of them runs out of them.
-		thrd_detach(thread);
 		break;
 	}
 
@@ -1022,11 +1747,10 @@ static inline void vm_exec_concurrent_call(struct vm * restrict vm, uint32_t num
 		memcpy(d->args, &vm->stack[vm->sp-num_args], num_args * sizeof(struct object));
 		d->roots = gc_add_roots(d->args, num_args);
 
-		if (thrd_create(&thread, call_builtin_and_cleanup, d) != thrd_success) {
+		if (sched_go(call_builtin_and_cleanup, d) != 0) {
 			gc_remove_roots(d->roots);
-			vm_errorf(vm, "failed to create thread");
+			vm_errorf(vm, "failed to start routine");
 		}
-		thrd_detach(thread);
 		break;
 	}
 
@@ -1059,6 +1783,8 @@ static inline void vm_exec_return_value(struct vm * restrict vm) {
 	vm_stack_push(vm, *o);
 }
 
+void (*vm_debug_hook)(struct vm *vm) = NULL;
+
 struct object vm_last_popped_stack_elem(struct vm * restrict vm) {
 	return vm->stack[vm->sp];
 }
@@ -1105,31 +1831,154 @@ struct object vm_last_popped_stack_elem(struct vm * restrict vm) {
 
 static int vm_loop(struct vm * restrict vm);
 
-// vm_call_tau runs a tau function from C and gives back what it returned. It
-// is what a callback needs: libffi hands the arguments to a handler written in
-// C, and the answer has to come from the VM that is already running on this
-// thread.
+static int vm_reenter(struct vm * restrict vm, struct object cl, struct object *args, size_t nargs, struct object *res);
+
+// vm_exec_tail_call makes the call of op_tail_call, whose value the function
+// making it returns as it is. A closure takes over the frame of that function
+// instead of going on top of it: the closure and the arguments are moved down
+// to where the one making the call and its arguments were, and the frame is
+// made again from there, so that returning from it returns to the caller of
+// both. Anything else is an ordinary call, and so is the tail call of a frame
+// with calls deferred in it, which have to be made once the call is over; the
+// op_return_value after the call returns its value.
+static inline void vm_exec_tail_call(struct vm * restrict vm, size_t numargs) {
+	struct frame *frame = vm_current_frame(vm);
+	struct object *cl = &vm->stack[vm->sp-1-numargs];
+
+	if (cl->type != obj_closure || frame->cl.type != obj_closure || vm->frame_idx == 0 ||
+		(frame->defers.type == obj_list && frame->defers.data.list->len > 0)) {
+		return vm_exec_call(vm, numargs);
+	}
+
+	struct function *fn = cl->data.cl->fn;
+	char msg[128];
+
+	if (vm_bad_arity(fn, numargs, msg, sizeof(msg))) {
+		vm_errorf(vm, "%s", msg);
+	}
+
+	uint32_t base_ptr = frame->base_ptr;
+	if (vm_reserve(vm, (uint64_t) base_ptr + fn->num_locals + STACK_SLACK, vm->frame_idx + 1)) {
+		vm_errorf(vm, "stack overflow");
+	}
+	frame = vm_current_frame(vm);
+	cl = &vm->stack[vm->sp-1-numargs];
+
+	uint64_t tail_calls = frame->tail_calls + 1;
+	memmove(&vm->stack[base_ptr-1], cl, (numargs + 1) * sizeof(struct object));
+	vm->sp = base_ptr + numargs;
+
+	*frame = new_frame(vm->stack[base_ptr-1], base_ptr);
+	frame->tail_calls = tail_calls;
+	vm_init_locals(vm, fn, base_ptr, numargs);
+}
+
+// vm_call_deferred makes a deferred call, the function followed by its nargs
+// arguments, and reports whether it failed. What it returns is dropped. A
+// closure runs on a loop of its own, so that a failure in it is an answer and
+// not a jump: the calls deferred after an error are made from outside any
+// loop, where there is nowhere left to jump to.
+static int vm_call_deferred(struct vm * restrict vm, struct object *call, uint32_t nargs) {
+	if (call[0].type == obj_closure) {
+		struct object res;
+		return vm_reenter(vm, call[0], &call[1], nargs, &res);
+	}
+
+	if (vm_reserve(vm, (uint64_t) vm->sp + nargs + 1 + STACK_SLACK, vm->frame_idx + 1)) {
+		vm_fail(vm, "stack overflow");
+		return 1;
+	}
+
+	// Anything else that can be called returns right away, and its failures
+	// are values: op_defer let through nothing that makes vm_exec_call fail.
+	uint32_t sp = vm->sp;
+	memcpy(&vm->stack[vm->sp], call, (nargs + 1) * sizeof(struct object));
+	vm->sp += nargs + 1;
+	vm_exec_call(vm, nargs);
+	vm->sp = sp;
+	return 0;
+}
+
+// vm_run_defers makes the calls deferred in the current frame, the last one
+// first, and reports whether any of them failed. Each is taken off the list
+// before it is made, so that none is made twice: the list is laid out as
+// op_defer leaves it, the function, the arguments and how many there are. The
+// frame is looked up again for each, the calls may have grown the frames.
+static int vm_run_defers(struct vm * restrict vm) {
+	int failed = 0;
+
+	for (;;) {
+		struct frame *frame = vm_current_frame(vm);
+		if (frame->defers.type != obj_list || frame->defers.data.list->len == 0) {
+			break;
+		}
+
+		struct list *l = frame->defers.data.list;
+		uint32_t nargs = l->list[l->len-1].data.i;
+
+		l->len -= nargs + 2;
+		failed |= vm_call_deferred(vm, &l->list[l->len], nargs);
+	}
+	return failed;
+}
+
+// vm_unwind makes the deferred calls of the frames a runtime error left
+// behind, from the innermost one down to lowest: a function that failed
+// returns no more than one that didn't, so the files and the sockets it has
+// open are closed all the same. Each frame is made the current one while its
+// calls are made, so that theirs go on top of it, and the stack of the ones
+// above it is given back: after a stack overflow it is all the room there is.
+static void vm_unwind(struct vm * restrict vm, uint32_t lowest) {
+	int64_t top = vm->frame_idx;
+
+	for (int64_t i = top; i >= (int64_t) lowest; i--) {
+		if (i < top && vm->frames[i+1].base_ptr - 1 < vm->sp) {
+			vm->sp = vm->frames[i+1].base_ptr - 1;
+		}
+		vm->frame_idx = i;
+		vm_run_defers(vm);
+	}
+}
+
+// vm_reenter calls the closure cl on a loop of its own and leaves what it
+// returned in res. It returns 0 when the call went well, and 1 when it failed
+// or could not be made at all, the failure reported already.
 //
 // The loop is entered again rather than resumed. A frame whose ip is NULL sits
 // under the call, and returning into it halts the new loop the way the end of
 // a program does, so the outer loop is left exactly where it was. vm_loop arms
 // its own landing pad for errors, so a failure in here comes back as a value
 // instead of jumping through the C function that called us - which would leave
-// it holding locks and allocations nobody will free.
-struct object vm_call_tau(struct vm * restrict vm, struct object cl, struct object *args, size_t nargs) {
-	if (cl.type != obj_closure) {
-		return errorf("callback: %s is not a function", otype_str(cl.type));
-	}
-
+// it holding locks and allocations nobody will free. The frames a failure
+// leaves above the one that halts have their deferred calls made first.
+//
+// Every loop entered is on top of the one that made the call on the C stack,
+// and there is only so much of that: calls from C nest as deep as the C stack
+// of the routine has room for, and one more is a stack overflow.
+static int vm_reenter(struct vm * restrict vm, struct object cl, struct object *args, size_t nargs, struct object *res) {
 	// The landing pad of whoever is waiting further down the C stack.
 	jmp_buf saved;
 	memcpy(saved, vm->env, sizeof(jmp_buf));
 
 	uint32_t sp = vm->sp;
 	uint32_t frame_idx = vm->frame_idx;
-
-	if (frame_idx + 2 >= MAX_FRAMES || sp + nargs + 1 >= STACK_SIZE) {
-		return errorf("callback: no room left to call into tau");
+	struct function *fn = cl.data.cl->fn;
+
+	// What vm_call_closure would fail on, with no loop of this call yet to
+	// land in: the error would go to the one under it. It is reported the way
+	// vm_errorf does, at the line of the caller and with its trace, without
+	// the jump.
+	char msg[128];
+	if (vm_bad_arity(fn, nargs, msg, sizeof(msg))) {
+		vm_fail(vm, msg);
+		*res = errorf("callback: the function failed");
+		return 1;
+	}
+	if (vm->reentered >= sched_stack_size() / REENTER_STACK ||
+		vm_reserve_args(vm, (uint64_t) sp + 1 + nargs + fn->num_locals + STACK_SLACK, (uint64_t) frame_idx + 3, &args)) {
+		vm_fail(vm, "stack overflow");
+		*res = errorf("callback: the function failed");
+		return 1;
 	}
 
 	// The frame that stops the loop: everything of it is unused but the ip.
@@ -1142,29 +1991,124 @@ struct object vm_call_tau(struct vm * restrict vm, struct object cl, struct obje
 	}
 
 	vm_call_closure(vm, &cl, nargs);
+	vm->reentered++;
 	int failed = vm_loop(vm);
-	struct object res = failed ? errorf("callback: the function failed") : vm_stack_peek(vm);
+	vm->reentered--;
+	if (failed) {
+		vm_unwind(vm, frame_idx + 2);
+		*res = errorf("callback: the function failed");
+	} else {
+		*res = vm_stack_peek(vm);
+	}
 
 	vm->sp = sp;
 	vm->frame_idx = frame_idx;
 	memcpy(vm->env, saved, sizeof(jmp_buf));
 
+	return failed;
+}
+
+// vm_call_tau runs a tau function from C and gives back what it returned. It
+// is what a callback needs: libffi hands the arguments to a handler written in
+// C, and the answer has to come from the VM that is already running on this
+// thread.
+struct object vm_call_tau(struct vm * restrict vm, struct object cl, struct object *args, size_t nargs) {
+	if (cl.type != obj_closure) {
+		return errorf("callback: %s is not a function", otype_str(cl.type));
+	}
+
+	// A callback is not what try called, and its errors are printed as they
+	// always are: all C gets to see is that it failed.
+	int trying = vm->trying;
+	vm->trying = 0;
+
+	struct object res;
+	vm_reenter(vm, cl, args, nargs, &res);
+	vm->trying = trying;
 	return res;
 }
 
-// Registers the VM as a GC root set and runs it.
+// vm_try calls fn with the arguments and gives back what it returned, or the
+// error that stopped the VM while it ran, as an error value telling where it
+// happened: the try builtin. What failed is left behind the way a failed
+// routine is, its deferred calls made, and the caller goes on.
+struct object vm_try(struct vm * restrict vm, struct object fn, struct object *args, size_t nargs) {
+	switch (fn.type) {
+	case obj_closure:
+		break;
+
+	// Nothing else runs tau code, so nothing else can fail but by returning
+	// an error; it is called right here.
+	case obj_builtin:
+	case obj_native:
+	case obj_native_fn: {
+		if (vm_reserve_args(vm, (uint64_t) vm->sp + nargs + 1 + STACK_SLACK, vm->frame_idx + 1, &args)) {
+			return errorf("try: stack overflow");
+		}
+		uint32_t sp = vm->sp;
+		vm_stack_push(vm, fn);
+		for (size_t i = 0; i < nargs; i++) {
+			vm_stack_push(vm, args[i]);
+		}
+		vm_exec_call(vm, nargs);
+		struct object res = vm_stack_peek(vm);
+		vm->sp = sp;
+		return res;
+	}
+
+	default:
+		return errorf("try: %s is not a function", otype_str(fn.type));
+	}
+
+	// A try in a deferred call made on the way out of another one has its
+	// own error to give back, and the outer one is still to be returned.
+	char *outer = vm->fault;
+	vm->fault = NULL;
+	vm->trying++;
+
+	struct object res;
+	int failed = vm_reenter(vm, fn, args, nargs, &res);
+
+	vm->trying--;
+	if (vm->fault != NULL) {
+		if (failed) {
+			res = new_error_obj(vm->fault, strlen(vm->fault));
+		} else {
+			free(vm->fault);
+		}
+	}
+	vm->fault = outer;
+	return res;
+}
+
+static int run_main(void *vm) {
+	return vm_run(vm);
+}
+
+// Registers the VM as a GC root set and runs it. A program runs as a routine
+// like the ones it starts, see sched.c, and whoever runs it from outside waits
+// for it to end.
 int vm_run(struct vm * restrict vm) {
+	if (!sched_inside()) {
+		return sched_main(run_main, vm);
+	}
+
 	// The VM of a tau routine is registered by whoever spawned it.
 	int owned = vm->gc_node == NULL;
 	if (owned) gc_register(vm);
 
 	void *prev = gc_activate(vm);
 	int ret = vm_loop(vm);
+	if (ret != 0) {
+		vm_unwind(vm, 0);
+	}
 
 	if (owned) {
 		gc_unregister(vm);
 	} else {
-		gc_park();
+		// Ending, not blocking: parked for the collector, with the thread
+		// kept for the next routine.
+		gc_park_wait(NULL);
 	}
 	gc_restore(prev);
 
@@ -1174,6 +2118,20 @@ int vm_run(struct vm * restrict vm) {
 // TODO: maybe return a char *.
 static int vm_loop(struct vm * restrict vm) {
 #include "jump_table.h"
+#define NOPCODES (sizeof(jump_table) / sizeof(*jump_table))
+
+	// Under a debugger every opcode lands on TARGET_DEBUG first, which lets
+	// the debugger look before going to the real one. Swapping the table and
+	// not testing a flag in DISPATCH keeps the loop of a program that isn't
+	// being debugged exactly what it was.
+	const void *debug_table[NOPCODES];
+	const void * const *dispatch = jump_table;
+	if (vm_debug_hook != NULL) {
+		for (size_t i = 0; i < NOPCODES; i++) {
+			debug_table[i] = &&TARGET_DEBUG;
+		}
+		dispatch = debug_table;
+	}
 
 	// Used by vm_errorf to stop the execution of the VM without exiting.
 	if (setjmp(vm->env) == 1) {
@@ -1190,21 +2148,25 @@ static int vm_loop(struct vm * restrict vm) {
 	TARGET_CONST: {
 		uint16_t idx = read_uint16(frame->ip);
 		frame->ip += 2;
+		vm_room(vm, 1);
 		vm_stack_push(vm, vm->state.consts->list[idx]);
 		DISPATCH();
 	}
 
 	TARGET_TRUE: {
+		vm_room(vm, 1);
 		vm_stack_push(vm, true_obj);
 		DISPATCH();
 	}
 
 	TARGET_FALSE: {
+		vm_room(vm, 1);
 		vm_stack_push(vm, false_obj);
 		DISPATCH();
 	}
 
 	TARGET_NULL: {
+		vm_room(vm, 1);
 		vm_stack_push(vm, null_obj);
 		DISPATCH();
 	}
@@ -1227,11 +2189,13 @@ static int vm_loop(struct vm * restrict vm) {
 		uint16_t const_idx = read_uint16(frame->ip);
 		uint8_t num_free = read_uint8(frame->ip+2);
 		frame->ip += 3;
+		vm_room(vm, 1);
 		vm_push_closure(vm, const_idx, num_free);
 		DISPATCH();
 	}
 
 	TARGET_CURRENT_CLOSURE: {
+		vm_room(vm, 1);
 		vm_stack_push(vm, frame->cl);
 		DISPATCH();
 	}
@@ -1344,6 +2308,14 @@ static int vm_loop(struct vm * restrict vm) {
 		DISPATCH();
 	}
 
+	TARGET_TAIL_CALL: {
+		uint8_t num_args = read_uint8(frame->ip++);
+		if (gc_pending()) gc_safepoint();
+		vm_exec_tail_call(vm, num_args);
+		frame = vm_current_frame(vm);
+		DISPATCH();
+	}
+
 	TARGET_CONCURRENT_CALL: {
 		uint8_t num_args = read_uint8(frame->ip++);
 		vm_exec_concurrent_call(vm, num_args);
@@ -1351,6 +2323,14 @@ static int vm_loop(struct vm * restrict vm) {
 	}
 
 	TARGET_RETURN: {
+		// Safepoint: the profiler samples at the safepoints, and without
+		// one here a function with no call and no loop would never be seen
+		// running.
+		if (gc_pending()) gc_safepoint();
+		// A deferred call that fails fails the function that deferred it,
+		// once every other one has been made: vm_run and vm_reenter make
+		// the rest of them on the way out.
+		if (vm_run_defers(vm)) longjmp(vm->env, 1);
 		vm_exec_return(vm);
 		frame = vm_current_frame(vm);
 		if (frame->ip == NULL) goto TARGET_HALT;
@@ -1358,6 +2338,10 @@ static int vm_loop(struct vm * restrict vm) {
 	}
 
 	TARGET_RETURN_VALUE: {
+		if (gc_pending()) gc_safepoint();
+		// The value stays on top of the stack while the deferred calls are
+		// made above it.
+		if (vm_run_defers(vm)) longjmp(vm->env, 1);
 		vm_exec_return_value(vm);
 		frame = vm_current_frame(vm);
 		if (frame->ip == NULL) goto TARGET_HALT;
@@ -1398,6 +2382,7 @@ static int vm_loop(struct vm * restrict vm) {
 	TARGET_GET_GLOBAL: {
 		uint32_t global_idx = read_uint16(frame->ip);
 		frame->ip += 2;
+		vm_room(vm, 1);
 		vm_stack_push(vm, vm->state.globals->list[global_idx]);
 		DISPATCH();
 	}
@@ -1409,28 +2394,38 @@ static int vm_loop(struct vm * restrict vm) {
 		DISPATCH();
 	}
 
+	// A local shared with a closure is a cell, which is what it holds both
+	// for reading it and for assigning it.
 	TARGET_GET_LOCAL: {
 		uint32_t local_idx = read_uint8(frame->ip++);
-		vm_stack_push(vm, vm->stack[frame->base_ptr+local_idx]);
+		vm_room(vm, 1);
+		struct object o = vm->stack[frame->base_ptr+local_idx];
+		vm_stack_push(vm, o.type == obj_cell ? *o.data.cell : o);
 		DISPATCH();
 	}
 
 	TARGET_SET_LOCAL: {
 		uint32_t local_idx = read_uint8(frame->ip++);
-		vm->stack[frame->base_ptr+local_idx] = vm_stack_peek(vm);
+		struct object *slot = &vm->stack[frame->base_ptr+local_idx];
+		if (slot->type == obj_cell) {
+			slot = slot->data.cell;
+		}
+		*slot = vm_stack_peek(vm);
 		DISPATCH();
 	}
 
 	TARGET_GET_BUILTIN: {
 		uint32_t idx = read_uint8(frame->ip++);
+		vm_room(vm, 1);
 		vm_stack_push(vm, new_builtin_obj(builtins[idx]));
 		DISPATCH();
 	}
 
 	TARGET_GET_FREE: {
 		uint32_t free_idx = read_uint8(frame->ip++);
-		struct object cl = frame->cl;
-		vm_stack_push(vm, cl.data.cl->free[free_idx]);
+		vm_room(vm, 1);
+		struct object o = frame->cl.data.cl->free[free_idx];
+		vm_stack_push(vm, o.type == obj_cell ? *o.data.cell : o);
 		DISPATCH();
 	}
 
@@ -1440,7 +2435,10 @@ static int vm_loop(struct vm * restrict vm) {
 			vm_errorf(vm, "import: expected string, got %s", otype_str(path.type));
 		}
 		char *modpath = cstr(path.data.str);
+		// The loader is Go, and a routine in Go code stays on its thread.
+		sched_pin();
 		int failed = vm_exec_load_module(vm, modpath);
+		sched_unpin();
 		cstr_free(path.data.str, modpath);
 		if (failed) {
 			return 1;
@@ -1452,12 +2450,199 @@ static int vm_loop(struct vm * restrict vm) {
 		uint32_t str_idx = read_uint16(frame->ip);
 		uint32_t num_args = read_uint16(frame->ip+2);
 		frame->ip += 4;
+		vm_room(vm, 1);
 		vm_push_interpolated(vm, str_idx, num_args);
 		DISPATCH();
 	}
 
+	TARGET_SELECT: {
+		uint32_t ncases = read_uint8(frame->ip);
+		uint32_t flags = read_uint8(frame->ip+1);
+		frame->ip += 2;
+		vm_room(vm, 1);
+		// Every entry of the table is an op_jump, one opcode and two bytes.
+		frame->ip += vm_exec_select(vm, ncases, flags) * 3;
+		DISPATCH();
+	}
+
+	TARGET_ITER: {
+		vm_room(vm, 1);
+		vm_exec_iter(vm);
+		DISPATCH();
+	}
+
+	TARGET_ITER_NEXT: {
+		uint16_t pos = read_uint16(frame->ip);
+		uint32_t nvars = read_uint8(frame->ip+2);
+		frame->ip += 3;
+		vm_room(vm, nvars);
+		if (!vm_exec_iter_next(vm, nvars)) {
+			frame->ip = &frame->start[pos];
+		}
+		DISPATCH();
+	}
+
+	TARGET_UNPACK: {
+		uint32_t n = read_uint8(frame->ip++);
+		vm_room(vm, n);
+		vm_exec_unpack(vm, n);
+		DISPATCH();
+	}
+
+	TARGET_UNPACK_FIELDS: {
+		uint32_t n = read_uint8(frame->ip++);
+		vm_exec_unpack_fields(vm, n);
+		DISPATCH();
+	}
+
+	TARGET_DUP: {
+		vm_room(vm, 1);
+		struct object top = vm_stack_peek(vm);
+		vm_stack_push(vm, top);
+		DISPATCH();
+	}
+
+	TARGET_MATCH_LIST: {
+		uint32_t n = read_uint8(frame->ip++);
+		vm_room(vm, n + 1);
+		vm_exec_match_list(vm, n);
+		DISPATCH();
+	}
+
+	TARGET_MATCH_MAP: {
+		uint32_t n = read_uint8(frame->ip++);
+		vm_exec_match_map(vm, n);
+		DISPATCH();
+	}
+
+	TARGET_SWITCH_TABLE: {
+		uint16_t lo = read_uint16(frame->ip);
+		uint32_t n = read_uint16(frame->ip+2);
+		frame->ip += 4;
+		// Every entry of the table is an op_jump, like the one of a select.
+		frame->ip += vm_exec_switch_table(vm, vm->state.consts->list[lo].data.i, n) * 3;
+		DISPATCH();
+	}
+
+	TARGET_DEFER: {
+		uint8_t num_args = read_uint8(frame->ip++);
+		vm_exec_defer(vm, num_args);
+		DISPATCH();
+	}
+
+	TARGET_CALL_SPREAD: {
+		uint8_t num_lists = read_uint8(frame->ip++);
+		if (gc_pending()) gc_safepoint();
+		vm_exec_call_spread(vm, num_lists);
+		frame = vm_current_frame(vm);
+		DISPATCH();
+	}
+
+	// The compiler only writes a free variable that was taken as a cell.
+	TARGET_SET_FREE: {
+		uint32_t free_idx = read_uint8(frame->ip++);
+		*frame->cl.data.cl->free[free_idx].data.cell = vm_stack_peek(vm);
+		DISPATCH();
+	}
+
+	// What a closure about to be made takes of a variable: the cell, if the
+	// variable is one, so that it sees what is assigned to it later, its
+	// value otherwise. The second operand is set when the closure assigns the
+	// variable, which then becomes a cell if it isn't yet, and stays one for
+	// the rest of the call.
+	TARGET_CAPTURE_LOCAL: {
+		uint32_t local_idx = read_uint8(frame->ip++);
+		uint32_t cell = read_uint8(frame->ip++);
+		vm_room(vm, 1);
+		struct object *slot = &vm->stack[frame->base_ptr+local_idx];
+		vm_stack_push(vm, cell ? vm_cell(vm, slot) : *slot);
+		DISPATCH();
+	}
+
+	TARGET_CAPTURE_FREE: {
+		uint32_t free_idx = read_uint8(frame->ip++);
+		uint32_t cell = read_uint8(frame->ip++);
+		vm_room(vm, 1);
+		struct object *slot = &frame->cl.data.cl->free[free_idx];
+		vm_stack_push(vm, cell ? vm_cell(vm, slot) : *slot);
+		DISPATCH();
+	}
+
+	// The value of a local with a constant, x + 1, with no instruction for
+	// each of the two to push it.
+	TARGET_LOCAL_CONST: {
+		uint32_t local_idx = read_uint8(frame->ip);
+		uint16_t const_idx = read_uint16(frame->ip+1);
+		uint32_t op = read_uint8(frame->ip+3);
+		frame->ip += 4;
+		vm_room(vm, 2);
+		vm_stack_push(vm, *vm_local(vm, frame, local_idx));
+		vm_stack_push(vm, vm->state.consts->list[const_idx]);
+		vm_exec_binary(vm, op);
+		DISPATCH();
+	}
+
+	// x += 1 and ++x as a statement: the local changes where it is, and
+	// nothing is left on the stack since nothing would use it.
+	TARGET_UPDATE_LOCAL: {
+		uint32_t local_idx = read_uint8(frame->ip);
+		uint16_t const_idx = read_uint16(frame->ip+1);
+		uint32_t op = read_uint8(frame->ip+3);
+		frame->ip += 4;
+		vm_room(vm, 2);
+		struct object *slot = vm_local(vm, frame, local_idx);
+		struct object c = vm->state.consts->list[const_idx];
+
+		if (op == op_add && slot->type == obj_integer && c.type == obj_integer) {
+			slot->data.i += c.data.i;
+		} else {
+			vm_stack_push(vm, *slot);
+			vm_stack_push(vm, c);
+			vm_exec_binary(vm, op);
+			*vm_local(vm, frame, local_idx) = vm_stack_pop(vm);
+		}
+		DISPATCH();
+	}
+
+	// A comparison and the jump of the if or of the loop that asks it. Two
+	// integers, what a loop counter is, are compared here and never pushed.
+	TARGET_COMPARE_JUMP: {
+		uint32_t op = read_uint8(frame->ip);
+		uint16_t pos = read_uint16(frame->ip+1);
+		frame->ip += 3;
+		if (gc_pending()) gc_safepoint();
+
+		struct object *right = &vm->stack[vm->sp-1];
+		struct object *left = &vm->stack[vm->sp-2];
+		int cond;
+
+		if (M_ASSERT(left, right, obj_integer)) {
+			switch (op) {
+			case op_equal: cond = left->data.i == right->data.i; break;
+			case op_not_equal: cond = left->data.i != right->data.i; break;
+			case op_greater_than: cond = left->data.i > right->data.i; break;
+			default: cond = left->data.i >= right->data.i; break;
+			}
+			vm->sp -= 2;
+		} else {
+			vm_exec_binary(vm, op);
+			cond = is_truthy(&vm_stack_pop(vm));
+		}
+		if (!cond) {
+			frame->ip = &frame->start[pos];
+		}
+		DISPATCH();
+	}
+
+	TARGET_DEBUG: {
+		frame->ip--;
+		vm_debug_hook(vm);
+		goto *jump_table[*frame->ip++];
+	}
+
 	TARGET_HALT:
 		return 0;
+#undef NOPCODES
 }
 
 #if !defined(_WIN32) && !defined(WIN32)
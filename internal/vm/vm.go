@@ -63,6 +63,7 @@ func NewWithState(file string, bc compiler.Bytecode, state State) VM {
 // Run executes the program and reports whether it ended in an error, so that
 // a failing script fails the command that started it.
 func (vm VM) Run() bool {
+	dumpOnQuit()
 	ok := C.vm_run(vm.vm) == 0
 	C.fflush(C.stdout)
 	return ok
@@ -198,6 +199,7 @@ func LookupModule(vmfile, taupath string) (string, error) { return lookup(vmfile
 type BundledModule struct {
 	Bytecode []byte
 	Exports  map[string]int
+	Consts   map[string]bool
 }
 
 // SetBundledModules hands the runtime the modules carried inside a bundle, in
@@ -246,7 +248,10 @@ func (vm VM) LoadBundled() error {
 			cexp := C.CString(exp)
 
 			if o._type == C.obj_object {
-				C.object_set(mod, cexp, C.object_to_module(o))
+				o = C.object_to_module(o)
+			}
+			if m.Consts[exp] {
+				C.object_set_const(mod, cexp, o)
 			} else {
 				C.object_set(mod, cexp, o)
 			}
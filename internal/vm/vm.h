@@ -1,21 +1,47 @@
 #pragma once
 
 #include <stdint.h>
+#include <stdio.h>
 #include <stdlib.h>
 #include <setjmp.h>
 #include "../obj/object.h"
 #include "../compiler/bytecode.h"
 
-#define STACK_SIZE    2048
+// What the stack and the frames of a VM start with. Both grow on demand, up
+// to the most a routine may use, see vm_reserve.
+#define STACK_INIT    256
+#define FRAMES_INIT   16
+// The most a routine may use of the stack and the frames together, in bytes,
+// when TAUMAXSTACK doesn't say.
+#define MAX_STACK     (256 << 20)
 #define GLOBAL_SIZE   65536
-#define MAX_FRAMES    16384
+// The part of the stack a call leaves alone, for the values the expressions
+// of the function it makes pile up.
+#define STACK_SLACK   128
+// How much of the C stack a call made on a loop of its own is given, see
+// vm_reenter. One takes less than half of it.
+#define REENTER_STACK (8 << 10)
 #define HEAP_TRESHOLD 1024
+// How many of the last collections runtime.MemStats has the pause of.
+#define GC_NPAUSES 256
 
 struct frame {
 	struct object cl;
 	uint8_t *ip;
 	uint8_t *start;
 	uint32_t base_ptr;
+	// The line the debugger last saw this frame on, 0 until it looks. Kept per
+	// frame so that coming back from a call to the line that made it is not
+	// arriving at a new line.
+	uint32_t dbg_line;
+	// The calls deferred in this frame, the last one first: a list holding the
+	// one deferred before it, the function and its arguments, null when there
+	// are none. A tau list, so that the collector looks after it the way it
+	// does everything else the frame holds.
+	struct object defers;
+	// How many calls in tail position the frame has been handed over by,
+	// each of them a frame the stack traces no longer have.
+	uint64_t tail_calls;
 };
 
 // One segment of the heap, owned by the thread that allocated into it. `next`
@@ -27,6 +53,13 @@ struct heap {
 	int64_t treshold;
 	struct heap *next;
 	struct heap *free_next;
+	// Whether a thread writes into it, and what it holds: the bytes as of
+	// the last collection and those allocated since, the allocations of
+	// every type ever.
+	int owned;
+	size_t bytes;
+	uint64_t allocs[OBJ_NTYPES];
+	uint64_t alloc_bytes[OBJ_NTYPES];
 };
 
 struct pool {
@@ -70,12 +103,36 @@ struct state {
 
 struct vm {
 	struct state state;
-	struct object stack[STACK_SIZE];
-	struct frame frames[MAX_FRAMES];
+	// Allocated apart from the VM and moved when they grow, so that what
+	// points into them is only good until the next call.
+	struct object *stack;
+	struct frame *frames;
+	uint32_t stack_cap;
+	uint32_t frames_cap;
 	uint32_t sp;
 	uint32_t frame_idx;
 	char *file;
 	void *gc_node;
+	// Where the routine this VM runs was started, NULL for the main one and
+	// for the modules, which run to the end before anyone goes on.
+	struct bookmark *origin;
+	char *origin_file;
+	// Whether it runs a tau routine, rather than a program or a module.
+	int routine;
+	// A number for the debugger to tell the VMs apart by, given in the order
+	// they are registered with the collector.
+	uint32_t id;
+	// Set while the VM is in the debugger's hook, where its ip is at the start
+	// of the instruction and not past it like everywhere else.
+	int dbg_held;
+	// How many calls of try this VM is in, and what the first error in them
+	// said. While there is one, an error is not printed: it is what try
+	// gives back.
+	int trying;
+	char *fault;
+	// How many loops of calls from C are running on top of each other, each
+	// on the C stack: what try, a callback and a deferred call make.
+	uint32_t reentered;
 	jmp_buf env;
 };
 
@@ -95,11 +152,24 @@ int vm_run(struct vm * restrict vm);
 void vm_errorf(struct vm * restrict vm, const char *fmt, ...);
 void go_vm_errorf(struct vm * restrict vm, const char *fmt);
 struct object vm_call_tau(struct vm * restrict vm, struct object cl, struct object *args, size_t nargs);
+struct object vm_try(struct vm * restrict vm, struct object fn, struct object *args, size_t nargs);
 struct object vm_last_popped_stack_elem(struct vm * restrict vm);
 void vm_dispose(struct vm *vm);
 void state_dispose(struct state s);
 void set_exit();
 
+// Where a frame is: the bookmark of the instruction it is at, and the file
+// that bookmark is in.
+struct bookmark *frame_bookmark(struct frame *frame);
+char *frame_file(struct vm * restrict vm, struct frame *frame, struct bookmark *b);
+void vm_print_stack(FILE *out, struct vm *vm);
+
+// Called before every instruction when set, by every VM of the program. It is
+// how the debugger in debug.c gets to look; a program that isn't being
+// debugged never calls anything and only pays for the check on entering the
+// loop.
+extern void (*vm_debug_hook)(struct vm *vm);
+
 // Garbage collector.
 // The heap is global and shared by every VM (the main one and the tau routines).
 // Collection is stop-the-world: the collector waits for all the other VMs to
@@ -110,9 +180,17 @@ void set_exit();
 // to the compiler about other threads. Relaxed is enough, what a reader needs
 // to see is only whether it has to park, and the parking itself goes through
 // the heap mutex, which is what orders everything else.
+//
+// It is also how the scheduler asks a routine that has run for long enough to
+// make room for the others, see sched.c: the safepoints are where a routine
+// can be stopped, for whatever reason.
+#define GC_COLLECT 1
+#define GC_YIELD   2
 extern int gc_wanted;
 #define gc_pending() __atomic_load_n(&gc_wanted, __ATOMIC_RELAXED)
-#define gc_set_wanted(v) __atomic_store_n(&gc_wanted, (v), __ATOMIC_RELAXED)
+#define gc_collecting() (gc_pending() & GC_COLLECT)
+#define gc_want(bit) __atomic_fetch_or(&gc_wanted, (bit), __ATOMIC_RELAXED)
+#define gc_unwant(bit) __atomic_fetch_and(&gc_wanted, ~(bit), __ATOMIC_RELAXED)
 
 // Small things the Go side reaches for. They live here and not in the preamble
 // of one file because more than one file needs them, and a cgo preamble is
@@ -142,6 +220,7 @@ static inline void set_exec_dir(char *dir) {
 
 void gc_init(void);
 void gc_register(struct vm *vm);   // Makes the VM a root, initially parked.
+void *gc_register_thread(void);    // The same for a thread that runs no VM, which takes it with gc_restore.
 void gc_unregister(struct vm *vm);
 void *gc_activate(struct vm *vm);  // Called by the thread that runs the VM, returns the previous one.
 void gc_restore(void *prev);       // Restores the VM active before gc_activate.
@@ -151,7 +230,52 @@ void gc_remove_roots(void *handle);
 void gc_park(void);                // Before blocking (pipes, native calls, IO).
 void gc_unpark(void);              // After blocking.
 void gc_safepoint(void);           // Cheap check, parks only if a GC is pending.
+void *gc_swap_self(void *node);    // For the scheduler: the VM node goes with the routine, returns the one there was.
 void gc_flush_headers(void);       // Frees the object headers this thread kept for reuse.
 void gc_release_segment(void);     // Gives this thread's heap segment to the next one that needs it.
 void heap_add(struct object obj);
 void gc(void);
+void gc_collect(void);             // A collection now, whatever the budget says.
+struct object gc_memstats(void);   // What runtime.MemStats returns.
+
+// For the heap profiler: how often to sample, who to tell, and the samples
+// freed since it last asked.
+extern int64_t gc_sample_rate;
+extern void (*gc_sample_hook)(struct gc_header *h, size_t bytes);
+size_t gc_freed_samples(struct gc_header **out, size_t max);
+
+// For the debugger and the profiler, which look at the stacks of every VM
+// while none of them moves. The world is stopped by a thread and started
+// again by the same one; in between the VMs stay parked wherever they were.
+void gc_stop_world(void);
+void gc_start_world(void);
+size_t gc_vms(struct vm **out, size_t max); // The VMs there are, at most max of them.
+int gc_waiting(struct vm *vm);              // Whether the VM is parked waiting, not running.
+
+// A program whose routines all sleep on pipes is ended by the collector, which
+// is the one that can tell, with what every routine waits for and its stack.
+// gc_dump prints the same for a program that is still going, and ends it too:
+// it is what SIGQUIT does.
+void gc_dump(void);
+
+// Timers, implemented in timer.c: one thread sending on pipes when the time
+// comes. gc_init sets them up and the collector marks the pipes and values
+// of those still to go off.
+void timers_init(void);
+void timers_mark(void);
+
+// The network poller, implemented in netpoll.c. What obj needs of it, the
+// builtins of the net module, is declared in object.h.
+void netpoll_init(void);
+
+// The scheduler, implemented in sched.c: the tau routines are coroutines run
+// by a few threads, TAUMAXPROCS at a time. What obj needs of it, parking and
+// waking routines up, is declared in object.h.
+void sched_init(void);
+int sched_go(int (*fn)(void *), void *arg);   // Starts a routine, non zero if it can't.
+int sched_main(int (*fn)(void *), void *arg); // Runs fn as a routine and waits for it.
+int sched_inside(void);                       // Whether this thread runs a routine.
+size_t sched_stack_size(void);                // How much C stack the routine here has.
+int sched_preempted(void);                    // Whether the routine here was asked to make room.
+void sched_requeue(void);                     // Makes room: to the back of the queue.
+int sched_runnable(void);                     // Whether any routine waits to run.
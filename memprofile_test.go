@@ -0,0 +1,55 @@
+package tau
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHeapProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prog.tau")
+	err := os.WriteFile(path, []byte(`grow = fn(n) {
+	out = []
+	for i = 0; i < n; i++ {
+		out = append(out, "item {i}")
+	}
+	return out
+}
+kept = grow(20000)
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var prof bytes.Buffer
+	if err := StartHeapProfile(&prof, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartHeapProfile(io.Discard, 0); err == nil {
+		t.Error("a second profile started while the first one runs")
+	}
+	if err := ExecFileVM(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := StopHeapProfile(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := gzip.NewReader(&prof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As with the CPU profile, the encoding is tested in internal/pprof.
+	for _, want := range []string{"grow", path, "alloc_space", "inuse_objects"} {
+		if !bytes.Contains(raw, []byte(want)) {
+			t.Errorf("no %q in the profile", want)
+		}
+	}
+}
@@ -40,3 +40,32 @@ func redirectStdout(w io.Writer) {
 		pr.Close()
 	}()
 }
+
+// splitStdout moves what the program writes off the standard output, which
+// is left for the caller alone: proto writes where stdout used to, output
+// reads what the program writes until end is called, which is once the
+// program is over.
+func splitStdout() (proto io.Writer, output io.Reader, end func(), err error) {
+	fd, err := syscall.Dup(syscall.Stdout)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := dupTo(int(pw.Fd()), syscall.Stdout); err != nil {
+		return nil, nil, nil, err
+	}
+	pw.Close()
+
+	// The pipe ends, and output with it, when the last copy of its writing
+	// end is gone: stdout, pointed at nowhere in particular.
+	end = func() {
+		if null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			dupTo(int(null.Fd()), syscall.Stdout)
+			null.Close()
+		}
+	}
+	return os.NewFile(uintptr(fd), "stdout"), pr, end, nil
+}
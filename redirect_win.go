@@ -51,3 +51,32 @@ func redirectStdout(w io.Writer) {
 		pr.Close()
 	}()
 }
+
+// splitStdout moves what the program writes off the standard output, which
+// is left for the caller alone: proto writes where stdout used to, output
+// reads what the program writes until end is called, which is once the
+// program is over.
+func splitStdout() (proto io.Writer, output io.Reader, end func(), err error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var stdHandle windows.Handle
+	err = windows.DuplicateHandle(windows.CurrentProcess(), windows.Handle(pw.Fd()), windows.CurrentProcess(), &stdHandle, 0, true, windows.DUPLICATE_SAME_ACCESS)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// os.Stdout keeps the handle it was opened with, the old one.
+	if err := windows.SetStdHandle(windows.STD_OUTPUT_HANDLE, stdHandle); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// The pipe ends, and output with it, when the last handle to its
+	// writing end is closed.
+	end = func() {
+		windows.SetStdHandle(windows.STD_OUTPUT_HANDLE, windows.Handle(os.Stdout.Fd()))
+		windows.CloseHandle(stdHandle)
+		pw.Close()
+	}
+	return os.Stdout, pr, end, nil
+}
@@ -0,0 +1,74 @@
+package tau
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestManyRoutines starts far more routines than a program could have threads,
+// each sleeping on the pipe until it is its turn to send. They are also more
+// than the kernel would map stacks with a guard page for, one mapping each.
+func TestManyRoutines(t *testing.T) {
+	cmd := runTau(t, `p = pipe()
+n = 100000
+for i = 0; i < n; i++ {
+	tau fn(x) { send(p, x) }(i)
+}
+sum = 0
+for i = 0; i < n; i++ {
+	sum = sum + recv(p)
+}
+println(sum)
+`)
+	out, err := cmd.CombinedOutput()
+	if err != nil || strings.TrimSpace(string(out)) != "4999950000" {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+}
+
+// TestPreempt runs a routine that never sleeps with a single proc: the one
+// that is meant to stop it only gets to run if the spinning one is made to
+// leave room for it.
+func TestPreempt(t *testing.T) {
+	cmd := runTau(t, `flag = [false]
+done = pipe()
+tau fn() {
+	for !flag[0] {}
+	send(done, true)
+}()
+tau fn() { flag[0] = true }()
+recv(done)
+println("done")
+`)
+	cmd.Env = append(cmd.Env, "TAUMAXPROCS=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil || string(out) != "done\n" {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+}
+
+// TestBlockingHandoff blocks four routines in C at once with a single proc: a
+// routine in a native call gives its proc up, so the four sleep side by side
+// rather than one after the other.
+func TestBlockingHandoff(t *testing.T) {
+	cmd := runTau(t, `libc = dlopen(null)
+done = pipe()
+for i = 0; i < 4; i++ {
+	tau fn() { libc.usleep(300000); send(done, true) }()
+}
+for i = 0; i < 4; i++ {
+	recv(done)
+}
+println("done")
+`)
+	cmd.Env = append(cmd.Env, "TAUMAXPROCS=1")
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	if err != nil || string(out) != "done\n" {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+	if d := time.Since(start); d >= 1200*time.Millisecond {
+		t.Errorf("four sleeps of 300ms took %v, one after the other", d)
+	}
+}
@@ -0,0 +1,33 @@
+package tau
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestStackLimit runs a recursion past the limit TAUMAXSTACK sets, which has
+// to end in a stack overflow and a trace of the ends of the calls.
+func TestStackLimit(t *testing.T) {
+	src := `depth = fn(n) { if n == 0 { 0 } else { 1 + depth(n - 1) } }
+println(depth(100000))
+`
+	out, err := runTau(t, src).CombinedOutput()
+	if err != nil || strings.TrimSpace(string(out)) != "100000" {
+		t.Fatalf("100000 calls deep: %v\n%s", err, out)
+	}
+
+	cmd := runTau(t, src)
+	cmd.Env = append(cmd.Env, "TAUMAXSTACK=1M")
+	out, err = cmd.CombinedOutput()
+	if code := exitCode(t, err); code != 1 {
+		t.Fatalf("exit %d:\n%s", code, out)
+	}
+	for _, want := range []string{"stack overflow\n", "more calls\n", "<top level> at "} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("no %q in the output:\n%s", want, out)
+		}
+	}
+	if n := strings.Count(string(out), "depth at "); n != 99 {
+		t.Errorf("%d calls in the trace, expected 99:\n%s", n, out)
+	}
+}
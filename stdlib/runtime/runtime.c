@@ -2,7 +2,8 @@
 //
 // Only what a shared object can answer on its own: the interpreter's own
 // numbers, how many tau routines are alive or how full the heap is, are static
-// to the interpreter and no plugin can reach them.
+// to the interpreter and no plugin can reach them. Those are builtins, see
+// runtime.tau.
 //
 // The system and the architecture come from the macros the compiler sets and
 // not from asking the machine, so they say what this was built for. That is
@@ -244,6 +244,106 @@ int64_t sys_shutdown(int64_t sockfd, int64_t how) {
 #endif
 }
 
+// ========== Wakers ==========
+
+#if !defined(_WIN32) && !defined(WIN32)
+#include <poll.h>
+#include <signal.h>
+
+// A waker is how one routine gets another out of a call that waits in here:
+// a pipe, whose read end the waiting call polls along with what it waits
+// for, and whose write end sys_waker_wake writes a byte into. Nobody reads
+// the byte, so a waker once woken stays woken. Both ends travel as one
+// number, the write end in the high half.
+int64_t sys_waker_new(void) {
+    int fds[2];
+    if (pipe(fds) < 0) return -1;
+
+    for (int i = 0; i < 2; i++) {
+        fcntl(fds[i], F_SETFD, FD_CLOEXEC);
+        fcntl(fds[i], F_SETFL, fcntl(fds[i], F_GETFL) | O_NONBLOCK);
+    }
+    return ((int64_t)fds[1] << 32) | (int64_t)fds[0];
+}
+
+int64_t sys_waker_wake(int64_t w) {
+    char c = 1;
+    // A full pipe is a waker woken many times over already.
+    if (write((int)(w >> 32), &c, 1) < 0 && errno != EAGAIN) return -1;
+    return 0;
+}
+
+int64_t sys_waker_close(int64_t w) {
+    close((int)(w & 0xffffffff));
+    return close((int)(w >> 32));
+}
+
+// The end to poll, -1 for no waker at all, which poll skips.
+static int waker_fd(int64_t w) {
+    return w < 0 ? -1 : (int)(w & 0xffffffff);
+}
+
+// connect, unless the waker is woken first: the socket is put in non
+// blocking mode for the connection to go on while both are polled, and back
+// once it is done. Returns 0 when connected, -2 when woken and -1 with errno
+// set when the connection failed.
+int64_t sys_connect_wake(int64_t sockfd, const void *addr, int64_t addrlen, int64_t waker) {
+    int fd = (int)sockfd;
+    int flags = fcntl(fd, F_GETFL);
+
+    if (flags < 0 || fcntl(fd, F_SETFL, flags | O_NONBLOCK) < 0) return -1;
+    int64_t ret = 0;
+    if (connect(fd, (const struct sockaddr *)addr, (socklen_t)addrlen) < 0) {
+        if (errno != EINPROGRESS) {
+            ret = -1;
+            goto done;
+        }
+
+        struct pollfd p[2] = {
+            {.fd = fd, .events = POLLOUT},
+            {.fd = waker_fd(waker), .events = POLLIN},
+        };
+        int n;
+        while ((n = poll(p, 2, -1)) < 0 && errno == EINTR);
+        if (n < 0) {
+            ret = -1;
+        } else if (p[1].revents != 0) {
+            ret = -2;
+        } else {
+            int err = 0;
+            socklen_t len = sizeof(err);
+            getsockopt(fd, SOL_SOCKET, SO_ERROR, &err, &len);
+            if (err != 0) {
+                errno = err;
+                ret = -1;
+            }
+        }
+    }
+
+done:
+    {
+        int saved = errno;
+        fcntl(fd, F_SETFL, flags);
+        errno = saved;
+    }
+    return ret;
+}
+
+#else
+
+// ponytail: no wakers on Windows, where a pipe can't be polled along with a
+// socket. A call given one waits the way it would without.
+int64_t sys_waker_new(void) { return -1; }
+int64_t sys_waker_wake(int64_t w) { (void)w; return -1; }
+int64_t sys_waker_close(int64_t w) { (void)w; return -1; }
+
+int64_t sys_connect_wake(int64_t sockfd, const void *addr, int64_t addrlen, int64_t waker) {
+    (void)waker;
+    return sys_connect(sockfd, addr, addrlen);
+}
+
+#endif
+
 // ========== Network Helpers ==========
 
 uint16_t sys_htons(uint16_t hostshort) {
@@ -588,12 +688,16 @@ int64_t sys_spawn_status(void) { return spawn_status; }
 // flags: 1 sends the standard error of the child into the same place as its
 // output, 2 leaves output and error alone, inherited from this process.
 //
+// A waker, -1 for none, kills the child when it is woken. What the child wrote
+// up to then is kept, and the status says it was killed. Only the child is
+// killed: a program it started lives on, but is no longer waited for.
+//
 // Returns -1 when the child could not be started, and the exit status is left
 // in spawn_status: the value passed to exit, or 128 plus the signal that
 // killed it, or 127 when the program wasn't found.
 int64_t sys_spawn(const void *blob, int64_t bloblen, int64_t nargs,
                   const void *in, int64_t inlen,
-                  void *out, int64_t outcap, int64_t flags) {
+                  void *out, int64_t outcap, int64_t flags, int64_t waker) {
     spawn_status = -1;
     if (nargs <= 0 || bloblen <= 0) return -1;
 
@@ -664,11 +768,29 @@ int64_t sys_spawn(const void *blob, int64_t bloblen, int64_t nargs,
     }
 
     int64_t total = 0;
+    struct pollfd wake = {.fd = waker_fd(waker), .events = POLLIN};
     if (capture) {
         close(fds[1]);
 
         char scratch[8192];
         for (;;) {
+            // Output or the waker, whichever comes first. Once the child is
+            // killed only what is in the pipe already is read: waiting for
+            // the end of it would wait on whatever the child started, which
+            // holds the pipe open as long as it lives.
+            struct pollfd p[2] = {{.fd = fds[0], .events = POLLIN}, wake};
+            int ready = poll(p, 2, wake.fd < 0 && waker >= 0 ? 0 : -1);
+            if (ready < 0) {
+                if (errno == EINTR) continue;
+                break;
+            }
+            if (ready == 0) break;
+            if (p[1].revents != 0) {
+                kill(pid, SIGKILL);
+                wake.fd = -1;
+                continue;
+            }
+
             ssize_t n = read(fds[0], scratch, sizeof(scratch));
             if (n < 0) {
                 if (errno == EINTR) continue;
@@ -688,7 +810,19 @@ int64_t sys_spawn(const void *blob, int64_t bloblen, int64_t nargs,
         close(fds[0]);
     }
 
+    // A child that closed its output, or never had one to read, is waited for
+    // with an eye on the waker. There is no polling a process, so it is looked
+    // at every 50 milliseconds.
     int status = 0;
+    while (wake.fd >= 0) {
+        pid_t r = waitpid(pid, &status, WNOHANG);
+        if (r == pid) goto reaped;
+        if (r < 0 && errno != EINTR) break;
+        if (poll(&wake, 1, 50) > 0) {
+            kill(pid, SIGKILL);
+            break;
+        }
+    }
     while (waitpid(pid, &status, 0) < 0) {
         if (errno != EINTR) {
             if (tmp != NULL) fclose(tmp);
@@ -697,6 +831,7 @@ int64_t sys_spawn(const void *blob, int64_t bloblen, int64_t nargs,
         }
     }
 
+reaped:
     if (WIFEXITED(status)) {
         spawn_status = WEXITSTATUS(status);
     } else if (WIFSIGNALED(status)) {
@@ -717,9 +852,9 @@ int64_t sys_spawn_status(void) { return -1; }
 
 int64_t sys_spawn(const void *blob, int64_t bloblen, int64_t nargs,
                   const void *in, int64_t inlen,
-                  void *out, int64_t outcap, int64_t flags) {
+                  void *out, int64_t outcap, int64_t flags, int64_t waker) {
     (void)blob; (void)bloblen; (void)nargs;
-    (void)in; (void)inlen; (void)out; (void)outcap; (void)flags;
+    (void)in; (void)inlen; (void)out; (void)outcap; (void)flags; (void)waker;
     return -1;
 }
 
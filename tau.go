@@ -11,6 +11,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/NicoNex/tau/internal/ast"
@@ -19,6 +20,7 @@ import (
 	"github.com/NicoNex/tau/internal/doc"
 	"github.com/NicoNex/tau/internal/format"
 	"github.com/NicoNex/tau/internal/parser"
+	"github.com/NicoNex/tau/internal/trace"
 	"github.com/NicoNex/tau/internal/vm"
 )
 
@@ -122,7 +124,8 @@ func ExecFileVM(f string) (err error) {
 		if bundlepkg.Is(raw) {
 			var clean func()
 
-			if bytecode, clean, err = bundlepkg.Open(raw); err != nil {
+			// Its errors point at the source it was compiled from.
+			if bytecode, f, clean, err = bundlepkg.Open(raw); err != nil {
 				return err
 			}
 			defer clean()
@@ -150,9 +153,93 @@ func runBytecode(name string, bytecode compiler.Bytecode) error {
 	return bundlepkg.Run(name, bytecode)
 }
 
+// DisableOptimizer compiles everything from now on as it is written, which
+// is what -O0 asks for.
+func DisableOptimizer() { compiler.DisableOptimizer() }
+
 // SetArgs hands the command line to the program about to run.
 func SetArgs(args []string) { vm.SetArgs(args) }
 
+// StartCPUProfile profiles the tau code run from now on, by function and by
+// line, until StopCPUProfile writes the profile to w in the format of pprof.
+func StartCPUProfile(w io.Writer) error { return vm.StartCPUProfile(w) }
+
+// StopCPUProfile writes the profile started by StartCPUProfile.
+func StopCPUProfile() error { return vm.StopCPUProfile() }
+
+// StartHeapProfile profiles where the tau code run from now on allocates,
+// sampling one object in rate, until StopHeapProfile writes the profile to w
+// in the format of pprof. A rate of 0 is the default one.
+func StartHeapProfile(w io.Writer, rate int64) error { return vm.StartHeapProfile(w, rate) }
+
+// StopHeapProfile writes the profile started by StartHeapProfile.
+func StopHeapProfile() error { return vm.StopHeapProfile() }
+
+// StartTrace traces the routines and the pipes of the tau code run from now
+// on, writing the trace to w, until StopTrace. `tau trace` reads it.
+func StartTrace(w io.Writer) error { return vm.StartTrace(w) }
+
+// StopTrace writes what is left of the trace started by StartTrace.
+func StopTrace() error { return vm.StopTrace() }
+
+// TraceFile tells what is in a trace written by `tau run -trace`: how long
+// every routine and every pipe waited, and what was still waiting when it
+// ended. With chrome it writes the whole trace to that file instead, "-"
+// being the standard output, in the JSON a browser shows as a timeline.
+func TraceFile(path, chrome string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	t, err := trace.Parse(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if chrome == "" {
+		return trace.Summarize(t).Write(os.Stdout)
+	}
+	if chrome == "-" {
+		return trace.WriteChrome(os.Stdout, t)
+	}
+
+	out, err := os.Create(chrome)
+	if err != nil {
+		return err
+	}
+	if err := trace.WriteChrome(out, t); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// TestFlags are the options of `tau test` that are handed down to the
+// processes running the test files.
+type TestFlags struct {
+	CPUProfile     string
+	MemProfile     string
+	MemProfileRate int64
+	NoOptimize     bool
+}
+
+func (f TestFlags) args() (args []string) {
+	if f.NoOptimize {
+		args = append(args, "-O0")
+	}
+	if f.CPUProfile != "" {
+		args = append(args, "-cpuprofile", f.CPUProfile)
+	}
+	if f.MemProfile != "" {
+		args = append(args, "-memprofile", f.MemProfile)
+		if f.MemProfileRate > 0 {
+			args = append(args, "-memprofilerate", strconv.FormatInt(f.MemProfileRate, 10))
+		}
+	}
+	return
+}
+
 // CompileFiles compiles each file into a self contained '.tauc' bundle. With
 // out empty each bundle is written next to its source.
 func CompileFiles(files []string, out string) error {
@@ -202,7 +289,7 @@ func Parse(src string) (ast.Node, error) {
 // for the test files it holds, and reports how many of them failed. Each file
 // runs in its own process the way `go test` does with its packages, so a test
 // that exits or crashes takes down only itself.
-func TestFiles(paths []string) error {
+func TestFiles(paths []string, flags TestFlags) error {
 	if len(paths) == 0 {
 		paths = []string{"."}
 	}
@@ -240,6 +327,14 @@ func TestFiles(paths []string) error {
 	}
 	sort.Strings(files)
 
+	// One profile is one process, as with `go test` and its packages.
+	if flags.CPUProfile != "" && len(files) > 1 {
+		return fmt.Errorf("cannot use -cpuprofile with %d test files, it takes one", len(files))
+	}
+	if flags.MemProfile != "" && len(files) > 1 {
+		return fmt.Errorf("cannot use -memprofile with %d test files, it takes one", len(files))
+	}
+
 	self, err := os.Executable()
 	if err != nil {
 		self = os.Args[0]
@@ -250,6 +345,9 @@ func TestFiles(paths []string) error {
 		fmt.Printf("=== %s\n", f)
 
 		cmd := exec.Command(self, f)
+		if args := flags.args(); len(args) > 0 {
+			cmd = exec.Command(self, append(append([]string{"run"}, args...), f)...)
+		}
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
 		if err := cmd.Run(); err != nil {
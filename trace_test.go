@@ -0,0 +1,76 @@
+package tau
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/NicoNex/tau/internal/trace"
+)
+
+func TestTrace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prog.tau")
+	err := os.WriteFile(path, []byte(`square = fn(in, out) {
+	for v = recv(in); v != null; v = recv(in) {
+		send(out, v * v)
+	}
+	close(out)
+}
+in = pipe()
+out = pipe()
+tau square(in, out)
+tau fn() {
+	for i = 0; i < 100; i++ {
+		send(in, i)
+	}
+	close(in)
+}()
+for v = recv(out); v != null; v = recv(out) {}
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := StartTrace(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ExecFileVM(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := StopTrace(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := trace.Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := trace.Summarize(tr)
+
+	var square *trace.Routine
+	for _, r := range s.Routines {
+		if r.Func == "square" {
+			square = r
+		}
+	}
+	// Whether it ended before the trace did is a race: main is done when out
+	// is closed, which square does just before it returns.
+	if square == nil || square.File != path || square.Line != 9 {
+		t.Fatalf("no routine for square started at line 9: %+v", s.Routines)
+	}
+
+	// The pipes are told apart by where they were made, the two of them
+	// carrying a hundred values each.
+	lines := make(map[int]*trace.Pipe)
+	for _, p := range s.Pipes {
+		lines[p.Line] = p
+	}
+	for _, line := range []int{7, 8} {
+		p := lines[line]
+		if p == nil || p.Sent != 100 || p.Received != 100 || !p.Closed {
+			t.Errorf("pipe made at line %d: %+v", line, p)
+		}
+	}
+}